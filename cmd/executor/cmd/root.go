@@ -17,9 +17,11 @@ limitations under the License.
 package cmd
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/buildcontext"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
@@ -33,14 +35,26 @@ import (
 )
 
 var (
-	opts     = &options.KanikoOptions{}
-	logLevel string
-	force    bool
+	opts      = &options.KanikoOptions{}
+	logLevel  string
+	logFormat string
+	force     bool
+
+	cacheRunLayers  bool
+	cacheCopyLayers bool
+
+	daemon         bool
+	daemonSocket   string
+	daemonCacheDir string
 )
 
 func init() {
-	RootCmd.PersistentFlags().StringVarP(&logLevel, "verbosity", "v", constants.DefaultLogLevel, "Log level (debug, info, warn, error, fatal, panic")
-	RootCmd.PersistentFlags().BoolVarP(&force, "force", "", false, "Force building outside of a container")
+	RootCmd.PersistentFlags().StringVarP(&logLevel, "verbosity", "v", constants.DefaultLogLevel, "Log level (debug, info, warn, error, fatal, panic), or the levels of modules, like snapshot=debug,push=warn,*=info")
+	RootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", util.LogFormatText, "Log format (text, json). With json, each log entry is a line of JSON, and build milestones are logged as entries with an event field.")
+	RootCmd.PersistentFlags().BoolVarP(&force, "force", "", false, "Force building outside of a container. With warm, pull images again even if they're already cached.")
+	RootCmd.Flags().BoolVarP(&daemon, "daemon", "", false, "Experimental: serve the builds POSTed to /build on --daemon-socket one at a time, instead of building once. Base images are only pulled by the first build which uses them.")
+	RootCmd.Flags().StringVarP(&daemonSocket, "daemon-socket", "", constants.DefaultDaemonSocket, "Unix socket --daemon serves builds on")
+	RootCmd.Flags().StringVarP(&daemonCacheDir, "daemon-cache-dir", "", constants.DefaultDaemonCacheDir, "Directory --daemon stores the base images of builds in, like a tmpfs")
 	addKanikoOptionsFlags(RootCmd)
 	addHiddenFlags(RootCmd)
 }
@@ -51,15 +65,51 @@ var RootCmd = &cobra.Command{
 		if err := util.SetLogLevel(logLevel); err != nil {
 			return err
 		}
-		if !opts.NoPush && len(opts.Destinations) == 0 {
+		if err := util.SetLogFormat(logFormat); err != nil {
+			return err
+		}
+		// Caching is on by default, so the options are negated, keeping it on for options which aren't set by flags
+		opts.NoCacheRunLayers, opts.NoCacheCopyLayers = !cacheRunLayers, !cacheCopyLayers
+		if opts.ReproducibleTimestamp == "" {
+			opts.ReproducibleTimestamp = os.Getenv("SOURCE_DATE_EPOCH")
+		}
+		if daemon {
+			if opts.DryRun {
+				return errors.New("--dry-run can't be used with --daemon")
+			}
+			// The context and destinations are given with each build
+			return executor.ValidateOptions(opts)
+		}
+		if !opts.NoPush && !opts.DryRun && len(opts.Destinations) == 0 {
 			return errors.New("You must provide --destination, or use --no-push")
 		}
+		if err := executor.ValidateOptions(opts); err != nil {
+			return err
+		}
 		if err := resolveSourceContext(); err != nil {
 			return errors.Wrap(err, "error resolving source context")
 		}
+		context, err := buildcontext.SubPath(opts.SrcContext, opts.ContextSubPath)
+		if err != nil {
+			return err
+		}
+		opts.SrcContext, opts.ContextSubPath = context, ""
+		contexts, err := buildcontext.UnpackNamedContexts(opts.BuildContexts, constants.NamedContextsDir)
+		if err != nil {
+			return errors.Wrap(err, "error resolving build contexts")
+		}
+		opts.BuildContexts = contexts
 		return resolveDockerfilePath()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// A dry run doesn't change the filesystem, so it's safe outside of a container
+		if opts.DryRun {
+			steps, err := executor.Plan(opts)
+			if err != nil {
+				return errors.Wrap(err, "error planning build")
+			}
+			return executor.PrintPlan(os.Stdout, steps)
+		}
 		if !checkContained() {
 			if !force {
 				return errors.New("kaniko should only be run inside of a container, run with the --force flag if you are sure you want to continue")
@@ -69,28 +119,125 @@ var RootCmd = &cobra.Command{
 		if err := os.Chdir("/"); err != nil {
 			return errors.Wrap(err, "error changing to root dir")
 		}
-		image, err := executor.DoBuild(opts)
+		if daemon {
+			return serveDaemon()
+		}
+		if opts.TarPath == constants.TarPathStdout {
+			// The tarball is streamed to stdout, so anything else, like the output of RUN commands, goes to stderr
+			os.Stdout = os.Stderr
+		}
+		if len(opts.Platforms) > 0 {
+			index, err := executor.BuildIndex(opts)
+			if err != nil {
+				return errors.Wrap(err, "error building image")
+			}
+			if err := executor.DoPushIndex(index, opts); err != nil {
+				return err
+			}
+			return cleanup()
+		}
+		image, err := executor.Build(opts)
 		if err != nil {
 			return errors.Wrap(err, "error building image")
 		}
-		return executor.DoPush(image, opts)
+		if err := executor.DoPush(image, opts); err != nil {
+			return err
+		}
+		return cleanup()
 	},
 }
 
+// serveDaemon serves builds on --daemon-socket until kaniko is stopped
+func serveDaemon() error {
+	// A socket left behind by a daemon which was stopped would stop this one listening
+	if err := os.Remove(daemonSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", daemonSocket)
+	if err != nil {
+		return errors.Wrap(err, "error listening for builds")
+	}
+	defer l.Close()
+	return executor.NewDaemon(opts, daemonCacheDir).Serve(l)
+}
+
+// cleanup deletes the filesystem the image was built in, and the stages saved while building it, with --cleanup
+func cleanup() error {
+	if !opts.Cleanup {
+		return nil
+	}
+	if err := util.DeleteFilesystem(); err != nil {
+		return errors.Wrap(err, "error deleting filesystem")
+	}
+	return os.RemoveAll(constants.KanikoIntermediateStagesDir)
+}
+
 // addKanikoOptionsFlags configures opts
 func addKanikoOptionsFlags(cmd *cobra.Command) {
-	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "f", "Dockerfile", "Path to the dockerfile to be built.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "f", "Dockerfile", "Path to the dockerfile to be built, or - to read it from stdin.")
 	RootCmd.PersistentFlags().StringVarP(&opts.SrcContext, "context", "c", "/workspace/", "Path to the dockerfile build context.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ContextSubPath, "context-sub-path", "", "", "Directory in the build context to use as the context, like services/api in a monorepo. The Dockerfile is looked for in it too.")
+	RootCmd.PersistentFlags().VarP(&opts.BuildContexts, "build-context", "", "Additional build context which FROM and COPY --from can use by its name, as name=<directory|docker-image://image|URL of a tar>. Set it repeatedly for multiple contexts.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Bucket, "bucket", "b", "", "Name of the GCS bucket from which to access build context as tarball.")
+	RootCmd.PersistentFlags().StringVarP(&opts.S3Region, "s3-region", "", "", "Region of the S3 bucket with the build context. Defaults to the region in the AWS environment or config.")
 	RootCmd.PersistentFlags().VarP(&opts.Destinations, "destination", "d", "Registry the final image should be pushed to. Set it repeatedly for multiple destinations.")
-	RootCmd.PersistentFlags().StringVarP(&opts.SnapshotMode, "snapshotMode", "", "full", "Change the file attributes inspected during snapshotting")
+	RootCmd.PersistentFlags().StringVarP(&opts.SnapshotMode, "snapshotMode", "", "full", "Change the file attributes inspected during snapshotting: full, time or time+size")
+	RootCmd.PersistentFlags().IntVarP(&opts.SnapshotConcurrency, "snapshot-concurrency", "", 0, "Number of files to hash at once when snapshotting. Defaults to GOMAXPROCS.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SnapshotWatch, "snapshot-watch", "", false, "Experimental: watch the filesystem with inotify while RUN commands run, and snapshot just the paths they change instead of the whole filesystem.")
 	RootCmd.PersistentFlags().VarP(&opts.BuildArgs, "build-arg", "", "This flag allows you to pass in ARG values at build time. Set it repeatedly for multiple values.")
+	RootCmd.PersistentFlags().StringVarP(&opts.BuildArgFile, "build-arg-file", "", "", "File to read build args from, with a KEY=VALUE on each line. --build-arg overrides them.")
+	RootCmd.PersistentFlags().VarP(&opts.Labels, "label", "", "Label to set in the image, as key=value. It overrides a LABEL in the Dockerfile with the same key. Set it repeatedly for multiple labels.")
+	RootCmd.PersistentFlags().VarP(&opts.Annotations, "annotation", "", "Annotation to set in the image manifest, and the manifest list with --platform, as key=value. Set it repeatedly for multiple annotations.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.DockerInsecureSkipTLSVerify, "insecure-skip-tls-verify", "", false, "Push to insecure registry ignoring TLS verify")
-	RootCmd.PersistentFlags().StringVarP(&opts.TarPath, "tarPath", "", "", "Path to save the image in as a tarball instead of pushing")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Insecure, "insecure", "", false, "Pull from and push to every registry over plain HTTP, like --insecure-pull and --insecure-push.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.InsecurePull, "insecure-pull", "", false, "Pull images from every registry over plain HTTP.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.InsecurePush, "insecure-push", "", false, "Push to every registry over plain HTTP.")
+	RootCmd.PersistentFlags().VarP(&opts.InsecureRegistries, "insecure-registry", "", "Registry to push to and pull from over plain HTTP, like registry.example.com:5000. Set it repeatedly for multiple registries.")
+	RootCmd.PersistentFlags().VarP(&opts.SkipTLSVerifyRegistries, "skip-tls-verify-registry", "", "Registry to push to and pull from without verifying its TLS certificate, like registry.example.com:5000. Set it repeatedly for multiple registries.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DockerConfig, "docker-config", "", "", "Path to a docker config.json, or a directory with one, to read registry credentials from. They take precedence over the ones in $DOCKER_CONFIG/config.json.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.DryRun, "dry-run", "", false, "Print what the build would do for each instruction, and which layers it would take from the cache, without building or pushing the image.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Cleanup, "cleanup", "", false, "Remove saved stages as soon as no later stage needs them, and delete the filesystem once the image is pushed.")
+	RootCmd.PersistentFlags().StringVarP(&opts.TarPath, "tarPath", "", "", "Path to save the image in as a tarball instead of pushing, or - to stream the tarball to stdout")
+	RootCmd.PersistentFlags().StringVarP(&opts.OCILayoutPath, "oci-layout-path", "", "", "Directory to write the image to as an OCI image layout, as well as pushing it unless --no-push is set")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SingleSnapshot, "single-snapshot", "", false, "Take a single snapshot at the end of the build.")
+	RootCmd.PersistentFlags().StringVarP(&opts.SquashFrom, "squash-from", "", "", "Squash the layers of the image from a stage, or a layer index, to the end into one layer, keeping the layers before it.")
+	RootCmd.PersistentFlags().StringVarP(&opts.MaxLayerSize, "max-layer-size", "", "", "Split each layer the build adds which is bigger than this compressed, like 2GB, into layers which aren't.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SkipUnpack, "skip-unpack", "", false, "Build the first stage on the base image filesystem already extracted to the root, instead of unpacking it again. It must have been extracted from the same base image digest.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SkipUnpackForce, "skip-unpack-force", "", false, "With --skip-unpack, build on the existing filesystem even if its base image digest is missing or doesn't match.")
+	RootCmd.PersistentFlags().VarP(&opts.IgnorePaths, "ignore-path", "", "Absolute path whose contents are never added to a layer, like a mounted cache. Set it repeatedly for multiple paths.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Reproducible, "reproducible", "", false, "Strip timestamps out of the image to make it reproducible")
+	RootCmd.PersistentFlags().StringVarP(&opts.ReproducibleTimestamp, "reproducible-timestamp", "", "", "Seconds since the unix epoch to use as the image creation time, and as the latest file modification time in layers. Defaults to $SOURCE_DATE_EPOCH.")
+	RootCmd.PersistentFlags().IntVarP(&opts.PushRetry, "push-retry", "", 3, "Number of times to retry pushing to a destination after network errors, or 429 and 5xx responses.")
+	RootCmd.PersistentFlags().IntVarP(&opts.PushConcurrency, "push-concurrency", "", 0, "Number of layers to upload to a destination at once. Halved each time the registry responds with 429. Defaults to 5.")
+	RootCmd.PersistentFlags().IntVarP(&opts.ImageFSExtractRetries, "image-fs-extract-retries", "", 0, "Number of times to retry unpacking a layer of a base image after it fails to download, like a truncated or corrupt download, network errors, or 429 and 5xx responses.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.ImageFSExtractRetryBackoff, "image-fs-extract-retry-backoff", "", time.Second, "How long to wait before the first retry of unpacking a layer. The wait doubles after each attempt.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ImageNameDigestFile, "image-name-with-digest-file", "", "", "File to write each destination with the digest of the image pushed to it to, one per line, like gcr.io/project/image:tag@sha256:..., once every push succeeds")
+	RootCmd.PersistentFlags().StringVarP(&opts.FileManifestPath, "file-manifest-path", "", "", "File to write the paths, sizes, modes and digests of the files in each layer the build adds, and the paths each one deletes, to as JSON.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Target, "target", "", "", "Set the target build stage to build")
 	RootCmd.PersistentFlags().BoolVarP(&opts.NoPush, "no-push", "", false, "Do not push the image to the registry")
+	RootCmd.PersistentFlags().BoolVarP(&opts.ContainerdImport, "containerd-import", "", false, "Import the image into containerd as each destination, instead of pushing it to the registry")
+	RootCmd.PersistentFlags().StringVarP(&opts.ContainerdAddress, "containerd-address", "", constants.DefaultContainerdAddress, "Socket of the containerd which --containerd-import imports the image into")
+	RootCmd.PersistentFlags().StringVarP(&opts.ContainerdNamespace, "containerd-namespace", "", constants.DefaultContainerdNamespace, "containerd namespace which --containerd-import imports the image into, like k8s.io for the images kubelet runs")
+	RootCmd.PersistentFlags().StringVarP(&opts.RunNetwork, "run-network", "", constants.RunNetworkHost, "Network of RUN commands: host, or none to run them without network access.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RunMemoryLimit, "run-memory-limit", "", "", "Most memory each RUN command can use, like 512m. A command which uses more is killed.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RunCPULimit, "run-cpu-limit", "", "", "How many CPUs each RUN command can use, like 1.5.")
+	RootCmd.PersistentFlags().StringVarP(&opts.MountCacheDir, "mount-cache-dir", "", constants.KanikoMountCacheDir, "Directory to store RUN --mount=type=cache caches in. Mount a volume here to keep caches between builds.")
+	RootCmd.PersistentFlags().StringVarP(&opts.PostInstructionHook, "post-instruction-hook", "", "", "Path to a binary to run after each instruction, with the instruction and the digest of the layer it added in its environment.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.HookFailOnError, "hook-fail-on-error", "", false, "Fail the build if the --post-instruction-hook exits with an error, instead of logging a warning.")
+	RootCmd.PersistentFlags().VarP(&opts.Platforms, "platform", "", "Platforms to build the image for, like linux/amd64,linux/arm64. The images are pushed as a manifest list.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Cache, "cache", "", false, "Reuse the layers created by RUN, COPY and ADD commands in earlier builds, and cache the layers of this build.")
+	RootCmd.PersistentFlags().BoolVarP(&cacheRunLayers, "cache-run-layers", "", true, "Cache the layers of RUN commands when --cache is set.")
+	RootCmd.PersistentFlags().BoolVarP(&cacheCopyLayers, "cache-copy-layers", "", true, "Cache the layers of COPY and ADD commands when --cache is set.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheReadOnly, "cache-read-only", "", false, "Reuse the layers in the cache when --cache is set, without caching the layers of this build.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheWriteOnly, "cache-write-only", "", false, "Cache the layers of this build when --cache is set, without reusing the layers already in the cache.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheDir, "cache-dir", "", constants.DefaultCacheDir, "Directory to cache layers in when --cache is set. Mount a volume shared between builds here, or use azblob://<container>/<path> for Azure Blob Storage.")
+	RootCmd.PersistentFlags().IntVarP(&opts.CacheCompressionLevel, "cache-compression-level", "", 0, "Gzip compression level, from 1 to 9, for the layers cached when --cache is set. Defaults to the level of the layers built.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.CacheTTL, "cache-ttl", "", 0, "How long cached layers are used for, like 168h. Older layers are rebuilt. By default they're used forever.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.VerifyCache, "verify-cache", "", false, "Check the digest of each cached layer before using it, and run the command again if the layer is corrupt.")
+	RootCmd.PersistentFlags().StringVarP(&opts.Compression, "compression", "", constants.CompressionGzip, "Compression algorithm for the layers built: gzip or zstd. Registries which reject zstd layers are pushed gzip layers instead.")
+	RootCmd.PersistentFlags().IntVarP(&opts.CompressionLevel, "compression-level", "", 0, "Compression level for the layers built, from 1 to 9 for gzip and 1 to 22 for zstd. Defaults to the algorithm's default level.")
+	RootCmd.PersistentFlags().VarP(&opts.RegistryMirrors, "registry-mirror", "", "Registry to pull images on Docker Hub from instead, like mirror.local or mirror.local/dockerhub, followed by ,insecure for plain HTTP or ,skip-tls-verify. Set it repeatedly for mirrors to try in turn.")
+	RootCmd.PersistentFlags().VarP(&opts.Secrets, "secret", "", "Secret that RUN --mount=type=secret can use, as id=<id>,src=<path> or id=<id>,env=<variable>. Set it repeatedly for multiple secrets.")
 }
 
 // addHiddenFlags marks certain flags as hidden from the executor help text
@@ -106,8 +253,11 @@ func checkContained() bool {
 	return err == nil
 }
 
-// resolveDockerfilePath resolves the Dockerfile path to an absolute path
+// resolveDockerfilePath resolves the Dockerfile path to an absolute path, unless the Dockerfile is read from stdin
 func resolveDockerfilePath() error {
+	if opts.DockerfilePath == constants.DockerfileStdin {
+		return nil
+	}
 	if util.FilepathExists(opts.DockerfilePath) {
 		abs, err := filepath.Abs(opts.DockerfilePath)
 		if err != nil {
@@ -145,7 +295,7 @@ func resolveSourceContext() error {
 		}
 	}
 	// if no prefix use Google Cloud Storage as default for backwards compability
-	contextExecutor, err := buildcontext.GetBuildContext(opts.SrcContext)
+	contextExecutor, err := buildcontext.GetBuildContext(opts.SrcContext, opts)
 	if err != nil {
 		return err
 	}
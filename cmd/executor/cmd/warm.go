@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/executor"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+var warmOpts = &options.WarmerOptions{}
+
+func init() {
+	WarmCmd.Flags().VarP(&warmOpts.Images, "image", "i", "Image to cache, like ubuntu:18.04. Set it repeatedly for multiple images.")
+	RootCmd.AddCommand(WarmCmd)
+}
+
+// WarmCmd caches base images under --cache-dir, so builds with the same --cache-dir don't pull them
+var WarmCmd = &cobra.Command{
+	Use:   "warm",
+	Short: "Cache base images under --cache-dir for later builds",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := util.SetLogLevel(logLevel); err != nil {
+			return err
+		}
+		return util.SetLogFormat(logFormat)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// --force is a flag of every command
+		warmOpts.Force = force
+		return executor.Warm(opts, warmOpts)
+	},
+}
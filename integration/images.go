@@ -55,6 +55,12 @@ var additionalDockerFlagsMap = map[string][]string{
 	"Dockerfile_test_target": {"--target=second"},
 }
 
+// Environment variables to set when building Dockerfiles with docker
+var additionalDockerEnvMap = map[string][]string{
+	// The legacy builder doesn't support COPY --chmod
+	"Dockerfile_test_copy_chmod": {"DOCKER_BUILDKIT=1"},
+}
+
 // Arguments to build Dockerfiles with when building with kaniko
 var additionalKanikoFlagsMap = map[string][]string{
 	"Dockerfile_test_add":     {"--single-snapshot"},
@@ -141,6 +147,7 @@ func (d *DockerFileBuilder) BuildImage(imageRepo, gcsBucket, dockerfilesPath, do
 			"."},
 			additionalFlags...)...,
 	)
+	dockerCmd.Env = append(os.Environ(), additionalDockerEnvMap[dockerfile]...)
 	_, err := RunCommandWithoutTest(dockerCmd)
 	if err != nil {
 		return fmt.Errorf("Failed to build image %s with docker command \"%s\": %s", dockerImage, dockerCmd.Args, err)
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// AzureBlob unifies calls to download and unpack a tar of the build context from Azure Blob Storage
+type AzureBlob struct {
+	context   string
+	directory string
+}
+
+// UnpackTarFromBuildContext downloads the tar from the container and unpacks it. The tar can be
+// uncompressed, or compressed. The storage account and credentials come from the environment.
+func (a *AzureBlob) UnpackTarFromBuildContext() (string, error) {
+	container, blob := util.GetBucketAndItem(a.context)
+	client, err := util.NewAzureBlobClient()
+	if err != nil {
+		return a.directory, err
+	}
+	r, err := client.Get(container, blob)
+	if err != nil {
+		return a.directory, errors.Wrapf(err, "downloading blob %s from container %s", blob, container)
+	}
+	defer r.Close()
+	if err := os.MkdirAll(a.directory, 0750); err != nil {
+		return a.directory, err
+	}
+	tarPath := filepath.Join(a.directory, constants.ContextTar)
+	if err := util.CreateFile(tarPath, r, 0600, 0, 0); err != nil {
+		return a.directory, err
+	}
+	logger.Debug("Unpacking source context tar...")
+	if err := util.UnpackLocalTarArchive(tarPath, a.directory); err != nil {
+		return a.directory, err
+	}
+	// Remove the tar so it doesn't interfere with subsequent commands
+	logger.Debugf("Deleting %s", tarPath)
+	return a.directory, os.Remove(tarPath)
+}
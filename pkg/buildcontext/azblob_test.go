@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestAzureBlob_UnpackTarFromBuildContext(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile": "FROM scratch\nCOPY foo /foo\n",
+		"foo":        "bar",
+	}
+	storage, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+	storage.SetBlob("contexts", "app/context.tar.gz", contextTar(t, files, true))
+	storage.SetBlob("contexts", "context.tar.gz", contextTar(t, files, false))
+
+	tests := []struct {
+		name      string
+		context   string
+		shouldErr bool
+	}{
+		{
+			name:    "compressed tar",
+			context: "azblob://contexts/app/context.tar.gz",
+		},
+		{
+			name:    "default name",
+			context: "azblob://contexts",
+		},
+		{
+			name:      "missing blob",
+			context:   "azblob://contexts/missing.tar.gz",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			buildContext, err := GetBuildContext(test.context, &options.KanikoOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			buildContext.(*AzureBlob).directory = directory
+			actual, err := buildContext.UnpackTarFromBuildContext()
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, directory, actual)
+			if !test.shouldErr {
+				checkUnpacked(t, directory, files)
+			}
+		})
+	}
+}
@@ -18,10 +18,15 @@ package buildcontext
 
 import (
 	"errors"
-	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 )
 
+var logger = util.ModuleLogger("buildcontext")
+
 // BuildContext unifies calls to download and unpack the build context.
 type BuildContext interface {
 	// Unpacks a build context and returns the directory where it resides
@@ -29,8 +34,8 @@ type BuildContext interface {
 }
 
 // GetBuildContext parses srcContext for the prefix and returns related buildcontext
-// parser
-func GetBuildContext(srcContext string) (BuildContext, error) {
+// parser, configured with opts
+func GetBuildContext(srcContext string, opts *options.KanikoOptions) (BuildContext, error) {
 	split := strings.SplitAfter(srcContext, "://")
 	prefix := split[0]
 	context := split[1]
@@ -38,9 +43,13 @@ func GetBuildContext(srcContext string) (BuildContext, error) {
 	case constants.GCSBuildContextPrefix:
 		return &GCS{context: context}, nil
 	case constants.S3BuildContextPrefix:
-		return &S3{context: context}, nil
+		return &S3{context: context, region: opts.S3Region, directory: constants.BuildContextDir}, nil
 	case constants.LocalDirBuildContextPrefix:
 		return &Dir{context: context}, nil
+	case constants.AzureBlobPrefix:
+		return &AzureBlob{context: context, directory: constants.BuildContextDir}, nil
+	case constants.HTTPBuildContextPrefix, constants.HTTPSBuildContextPrefix:
+		return &HTTP{context: srcContext, directory: constants.BuildContextDir}, nil
 	}
-	return nil, errors.New("unknown build context prefix provided, please use one of the following: gs://, dir://, s3://")
+	return nil, errors.New("unknown build context prefix provided, please use one of the following: gs://, dir://, s3://, azblob://, http://, https://")
 }
@@ -23,7 +23,6 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
@@ -44,12 +43,12 @@ func unpackTarFromGCSBucket(bucketName, item, directory string) error {
 	if err != nil {
 		return err
 	}
-	logrus.Debug("Unpacking source context tar...")
+	logger.Debug("Unpacking source context tar...")
 	if err := util.UnpackCompressedTar(tarPath, directory); err != nil {
 		return err
 	}
 	// Remove the tar so it doesn't interfere with subsequent commands
-	logrus.Debugf("Deleting %s", tarPath)
+	logger.Debugf("Deleting %s", tarPath)
 	return os.Remove(tarPath)
 }
 
@@ -72,6 +71,6 @@ func getTarFromBucket(bucketName, item, directory string) (string, error) {
 	if err := util.CreateFile(tarPath, reader, 0600, 0, 0); err != nil {
 		return "", err
 	}
-	logrus.Debugf("Copied tarball %s from GCS bucket %s to %s", constants.ContextTar, bucketName, tarPath)
+	logger.Debugf("Copied tarball %s from GCS bucket %s to %s", constants.ContextTar, bucketName, tarPath)
 	return tarPath, nil
 }
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// checksumPrefix starts the fragment of an HTTP context URL with the sha256 checksum of the tar
+const checksumPrefix = "sha256:"
+
+// HTTP unifies calls to download and unpack a tar of the build context from an HTTP(S) URL.
+// The URL can end with #sha256:<checksum> to check the tar is the one expected.
+type HTTP struct {
+	context   string
+	directory string
+}
+
+// UnpackTarFromBuildContext downloads the tar and unpacks it. It can be uncompressed, or compressed
+// with gzip, bzip2, xz or zstd.
+func (h *HTTP) UnpackTarFromBuildContext() (string, error) {
+	url, checksum := h.context, ""
+	if i := strings.Index(url, "#"); i >= 0 {
+		url, checksum = url[:i], url[i+1:]
+		if !strings.HasPrefix(checksum, checksumPrefix) {
+			return h.directory, errors.Errorf("the fragment of context %s must be %s<checksum of the tar>", url, checksumPrefix)
+		}
+		checksum = strings.TrimPrefix(checksum, checksumPrefix)
+	}
+	if err := os.MkdirAll(h.directory, 0750); err != nil {
+		return h.directory, err
+	}
+	tarPath := filepath.Join(h.directory, constants.ContextTar)
+	if err := download(url, tarPath, checksum); err != nil {
+		return h.directory, errors.Wrapf(err, "downloading context %s", url)
+	}
+	logger.Debug("Unpacking source context tar...")
+	if err := util.UnpackLocalTarArchive(tarPath, h.directory); err != nil {
+		return h.directory, err
+	}
+	// Remove the tar so it doesn't interfere with subsequent commands
+	logger.Debugf("Deleting %s", tarPath)
+	return h.directory, os.Remove(tarPath)
+}
+
+// download saves the file at url to path, and checks its sha256 checksum is checksum, if it's set
+func download(url, path, checksum string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return err
+	}
+	if checksum != "" {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(checksum) {
+			return errors.Errorf("checksum of the tar is %s%s, not %s%s", checksumPrefix, actual, checksumPrefix, checksum)
+		}
+	}
+	return f.Close()
+}
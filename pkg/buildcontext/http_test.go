@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// contextTar returns a tar of files, compressed with gzip if gzipped is set
+func contextTar(t *testing.T, files map[string]string, gzipped bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gw *gzip.Writer
+	if gzipped {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for name, contents := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// checkUnpacked checks directory has exactly files in it, so the downloaded tar wasn't left in the context
+func checkUnpacked(t *testing.T, directory string, files map[string]string) {
+	unpacked := map[string]string{}
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		contents, err := ioutil.ReadFile(filepath.Join(directory, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked[fi.Name()] = string(contents)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, files, unpacked)
+}
+
+func TestHTTP_UnpackTarFromBuildContext(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile": "FROM scratch\nCOPY foo /foo\n",
+		"foo":        "bar",
+	}
+	contextTar := contextTar(t, files, true)
+	sum := sha256.Sum256(contextTar)
+	checksum := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/context.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(contextTar)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		context   string
+		shouldErr bool
+	}{
+		{
+			name:    "no checksum",
+			context: server.URL + "/context.tar.gz",
+		},
+		{
+			name:    "checksum",
+			context: server.URL + "/context.tar.gz#sha256:" + checksum,
+		},
+		{
+			name:      "wrong checksum",
+			context:   server.URL + "/context.tar.gz#sha256:" + checksum[1:] + "0",
+			shouldErr: true,
+		},
+		{
+			name:      "invalid fragment",
+			context:   server.URL + "/context.tar.gz#" + checksum,
+			shouldErr: true,
+		},
+		{
+			name:      "not found",
+			context:   server.URL + "/missing.tar.gz",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			buildContext, err := GetBuildContext(test.context, &options.KanikoOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			buildContext.(*HTTP).directory = directory
+			actual, err := buildContext.UnpackTarFromBuildContext()
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, directory, actual)
+			if test.shouldErr {
+				return
+			}
+			checkUnpacked(t, directory, files)
+		})
+	}
+}
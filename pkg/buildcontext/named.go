@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+)
+
+// UnpackNamedContexts downloads and unpacks the --build-context values which are the URL of a tar, each
+// to a directory of its own under dir, and returns the values with the directories instead of the URLs.
+// Relative directories are made absolute, and images are left as they are.
+func UnpackNamedContexts(values []string, dir string) ([]string, error) {
+	var resolved []string
+	for i, value := range values {
+		name, source, err := dockerfile.ParseBuildContext(value)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(source, constants.DockerImageBuildContextPrefix):
+		case strings.HasPrefix(source, constants.HTTPBuildContextPrefix), strings.HasPrefix(source, constants.HTTPSBuildContextPrefix):
+			h := &HTTP{context: source, directory: filepath.Join(dir, strconv.Itoa(i))}
+			if source, err = h.UnpackTarFromBuildContext(); err != nil {
+				return nil, err
+			}
+		default:
+			if source, err = filepath.Abs(strings.TrimPrefix(source, constants.LocalDirBuildContextPrefix)); err != nil {
+				return nil, err
+			}
+		}
+		resolved = append(resolved, name+"="+source)
+	}
+	return resolved, nil
+}
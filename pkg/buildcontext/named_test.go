@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestUnpackNamedContexts(t *testing.T) {
+	files := map[string]string{"foo": "bar"}
+	contextTar := contextTar(t, files, true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(contextTar)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{
+		"base=docker-image://alpine:3.9",
+		"assets=" + server.URL + "/assets.tar.gz",
+		"src=dir://relative",
+		"config=" + dir,
+	}
+	actual, err := UnpackNamedContexts(values, dir)
+	expected := []string{
+		"base=docker-image://alpine:3.9",
+		"assets=" + filepath.Join(dir, "1"),
+		"src=" + filepath.Join(wd, "relative"),
+		"config=" + dir,
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, actual)
+	checkUnpacked(t, filepath.Join(dir, "1"), files)
+
+	_, err = UnpackNamedContexts([]string{"assets"}, dir)
+	testutil.CheckError(t, true, err)
+}
@@ -17,26 +17,44 @@ limitations under the License.
 package buildcontext
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"os"
-	"path/filepath"
 )
 
 // S3 unifies calls to download and unpack the build context.
 type S3 struct {
 	context string
+	// region is the region of the bucket, or "" for the one in the AWS environment or config
+	region    string
+	directory string
+	// endpoint is the S3 API to use instead of AWS, like a fake one in tests
+	endpoint string
 }
 
-// UnpackTarFromBuildContext download and untar a file from s3
+// UnpackTarFromBuildContext download and untar a file from s3. The credentials come from the
+// environment, like the instance role or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
 func (s *S3) UnpackTarFromBuildContext() (string, error) {
 	bucket, item := util.GetBucketAndItem(s.context)
-	downloader := s3manager.NewDownloader(session.New())
-	directory := constants.BuildContextDir
+	config := aws.NewConfig()
+	if s.region != "" {
+		config = config.WithRegion(s.region)
+	}
+	if s.endpoint != "" {
+		config = config.WithEndpoint(s.endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return s.directory, err
+	}
+	downloader := s3manager.NewDownloader(sess)
+	directory := s.directory
 	tarPath := filepath.Join(directory, constants.ContextTar)
 	if err := os.MkdirAll(directory, 0750); err != nil {
 		return directory, err
@@ -45,6 +63,7 @@ func (s *S3) UnpackTarFromBuildContext() (string, error) {
 	if err != nil {
 		return directory, err
 	}
+	defer file.Close()
 	_, err = downloader.Download(file,
 		&s3.GetObjectInput{
 			Bucket: aws.String(bucket),
@@ -53,6 +72,14 @@ func (s *S3) UnpackTarFromBuildContext() (string, error) {
 	if err != nil {
 		return directory, err
 	}
-
-	return directory, util.UnpackCompressedTar(tarPath, directory)
+	if err := file.Close(); err != nil {
+		return directory, err
+	}
+	// The object can be a tar, or a compressed one
+	if err := util.UnpackLocalTarArchive(tarPath, directory); err != nil {
+		return directory, err
+	}
+	// Remove the tar so it doesn't interfere with subsequent commands
+	logger.Debugf("Deleting %s", tarPath)
+	return directory, os.Remove(tarPath)
 }
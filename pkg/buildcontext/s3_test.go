@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestS3_UnpackTarFromBuildContext(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile": "FROM scratch\nCOPY foo /foo\n",
+		"foo":        "bar",
+	}
+	objects := map[string][]byte{
+		"/kaniko-bucket/context.tar":         contextTar(t, files, false),
+		"/kaniko-bucket/path/context.tar.gz": contextTar(t, files, true),
+	}
+	var authorizations []string
+	// A fake S3 API, which serves the objects from path style URLs
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		object, ok := objects[r.URL.Path]
+		if r.Method != http.MethodGet || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(object))
+	}))
+	defer server.Close()
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "us-east-1"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	tests := []struct {
+		name      string
+		context   string
+		region    string
+		shouldErr bool
+	}{
+		{
+			name:    "tar",
+			context: "s3://kaniko-bucket/context.tar",
+		},
+		{
+			name:    "compressed tar in region",
+			context: "s3://kaniko-bucket/path/context.tar.gz",
+			region:  "eu-west-1",
+		},
+		{
+			name:      "missing object",
+			context:   "s3://kaniko-bucket/missing.tar.gz",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			buildContext, err := GetBuildContext(test.context, &options.KanikoOptions{S3Region: test.region})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s3Context := buildContext.(*S3)
+			s3Context.directory = directory
+			s3Context.endpoint = server.URL
+			authorizations = nil
+			actual, err := buildContext.UnpackTarFromBuildContext()
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, directory, actual)
+			if test.shouldErr {
+				return
+			}
+			checkUnpacked(t, directory, files)
+			// Requests are signed for the region of the bucket
+			region := test.region
+			if region == "" {
+				region = "us-east-1"
+			}
+			if len(authorizations) == 0 {
+				t.Error("the object wasn't downloaded")
+			}
+			for _, auth := range authorizations {
+				if !strings.Contains(auth, "/"+region+"/s3/") {
+					t.Errorf("request wasn't signed for region %s: %s", region, auth)
+				}
+			}
+		})
+	}
+}
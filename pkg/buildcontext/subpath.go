@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+)
+
+// SubPath returns the directory at subPath in the build context, the --context-sub-path, which is used as
+// the context instead. Symlinks in subPath are followed as if the context were the root of the filesystem,
+// so it can't lead out of the context. An empty subPath is the context itself.
+func SubPath(context, subPath string) (string, error) {
+	if subPath == "" {
+		return context, nil
+	}
+	clean := filepath.Clean(subPath)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.Errorf("--context-sub-path %s must be a relative path within the build context", subPath)
+	}
+	dir, err := symlink.FollowSymlinkInScope(filepath.Join(context, clean), context)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving --context-sub-path %s", subPath)
+	}
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", errors.Errorf("--context-sub-path %s doesn't exist in the build context %s", subPath, context)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", errors.Errorf("--context-sub-path %s isn't a directory", subPath)
+	}
+	logger.Debugf("Using %s in the build context as the context", subPath)
+	return dir, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func setUpMonorepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(dir, map[string]string{
+		"app.txt":              "root",
+		"services/api/app.txt": "api",
+		"services/web/app.txt": "web",
+		"README.md":            "readme",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"api": "services/api", "escape": "../../../../services/web", "outside": "/"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSubPath(t *testing.T) {
+	dir := setUpMonorepo(t)
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name        string
+		subPath     string
+		expected    string
+		shouldError bool
+	}{
+		{name: "no sub path", expected: dir},
+		{name: "sub path", subPath: "services/api", expected: filepath.Join(dir, "services/api")},
+		{name: "trailing slash", subPath: "services/api/", expected: filepath.Join(dir, "services/api")},
+		{name: "symlink", subPath: "api", expected: filepath.Join(dir, "services/api")},
+		{name: "symlink stays in the context", subPath: "escape", expected: filepath.Join(dir, "services/web")},
+		{name: "absolute symlink stays in the context", subPath: "outside", expected: dir},
+		{name: "missing", subPath: "services/missing", shouldError: true},
+		{name: "file", subPath: "README.md", shouldError: true},
+		{name: "absolute", subPath: "/services/api", shouldError: true},
+		{name: "outside of the context", subPath: "../services", shouldError: true},
+		{name: "back out of the context", subPath: "services/../../other", shouldError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := SubPath(dir, test.subPath)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldError, err, test.expected, actual)
+		})
+	}
+}
+
+func TestSubPath_Copy(t *testing.T) {
+	dir := setUpMonorepo(t)
+	defer os.RemoveAll(dir)
+	context, err := SubPath(dir, "services/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nCOPY app.txt /app/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := commands.GetCommand(stages[0].Commands[0], context, '\\', &options.KanikoOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyCmd := cmd.(*commands.CopyCommand)
+	copyCmd.SetRoot(root)
+	if err := copyCmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// The file is the sub path's, not the one at the root of the context
+	contents, err := ioutil.ReadFile(filepath.Join(root, "app/app.txt"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "api", string(contents))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// AzureBlobCache is a LayerCache which stores layers in a container in Azure Blob Storage, laid out like
+// a LocalCache under a path in the container
+type AzureBlobCache struct {
+	client    *util.AzureBlobClient
+	container string
+	prefix    string
+	// ttl is how long a layer is used for after it's cached, or forever if it's 0
+	ttl time.Duration
+	now func() time.Time
+	// verify checks the digest of layers before they're used, and corrupt are the layers which failed
+	verify  bool
+	corrupt map[v1.Hash]bool
+}
+
+var _ LayerCache = (*AzureBlobCache)(nil)
+
+// NewAzureBlobCache returns a cache which stores layers in the container and path in location, which is
+// <container>[/<path>]. The storage account and credentials come from the environment, like for NewAzureBlobClient.
+// Layers cached longer than ttl ago aren't used, unless ttl is 0.
+func NewAzureBlobCache(location string, ttl time.Duration) (*AzureBlobCache, error) {
+	client, err := util.NewAzureBlobClient()
+	if err != nil {
+		return nil, err
+	}
+	container, prefix := location, ""
+	if i := strings.Index(location, "/"); i >= 0 {
+		container, prefix = location[:i], location[i+1:]
+	}
+	return &AzureBlobCache{client: client, container: container, prefix: prefix, ttl: ttl, now: time.Now, corrupt: map[v1.Hash]bool{}}, nil
+}
+
+// SetVerify makes Get check that the digest of a cached layer is still the one it was cached with, like
+// LocalCache.SetVerify
+func (c *AzureBlobCache) SetVerify(verify bool) {
+	c.verify = verify
+}
+
+func (c *AzureBlobCache) keyBlob(key string) string {
+	return path.Join(c.prefix, "keys", key)
+}
+
+func (c *AzureBlobCache) layerBlob(h v1.Hash) string {
+	return path.Join(c.prefix, "blobs", h.Algorithm, h.Hex)
+}
+
+// Get implements LayerCache
+func (c *AzureBlobCache) Get(key string) (v1.Layer, error) {
+	contents, err := c.read(c.keyBlob(key))
+	if err == util.ErrAzureBlobNotFound {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry localCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return nil, errors.Wrapf(err, "parsing cache entry for key %s", key)
+	}
+	if c.ttl > 0 && c.now().Sub(entry.Created) > c.ttl {
+		logger.Infof("Layer cached for key %s at %s has expired", key, entry.Created)
+		return nil, ErrCacheMiss
+	}
+	// Layers made by commands are kept in memory during builds anyway, so the layer is downloaded once
+	layer, err := c.read(c.layerBlob(entry.Digest))
+	if err == util.ErrAzureBlobNotFound {
+		logger.Warnf("Layer %s cached for key %s is missing from container %s", entry.Digest, key, c.container)
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.verify {
+		if err := verifyBlob(bytes.NewReader(layer), entry.Digest); err != nil {
+			logger.Warnf("Not using the layer cached for key %s in container %s: %v", key, c.container, err)
+			c.corrupt[entry.Digest] = true
+			return nil, ErrCacheMiss
+		}
+	}
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(layer)), nil
+	})
+}
+
+// Set implements LayerCache
+func (c *AzureBlobCache) Set(key string, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	blob := c.layerBlob(digest)
+	exists, err := c.client.Exists(c.container, blob)
+	if err != nil {
+		return err
+	}
+	if !exists || c.corrupt[digest] {
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+		r, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		err = c.client.Put(c.container, blob, r, size)
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "caching layer %s", digest)
+		}
+		delete(c.corrupt, digest)
+	}
+	entry, err := json.Marshal(&localCacheEntry{Digest: digest, Created: c.now().UTC()})
+	if err != nil {
+		return err
+	}
+	// The entry is written once the layer is, so builds sharing the cache never see one without its layer
+	return c.client.Put(c.container, c.keyBlob(key), bytes.NewReader(entry), int64(len(entry)))
+}
+
+func (c *AzureBlobCache) read(blob string) ([]byte, error) {
+	r, err := c.client.Get(c.container, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
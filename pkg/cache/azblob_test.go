@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func newTestAzureBlobCache(t *testing.T, location string, ttl time.Duration) *AzureBlobCache {
+	c, err := NewAzureBlobCache(location, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAzureBlobCache(t *testing.T) {
+	storage, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+
+	_, err := newTestAzureBlobCache(t, "cache/kaniko", 0).Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+
+	layer := randomLayer(t)
+	if err := newTestAzureBlobCache(t, "cache/kaniko", 0).Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	// Another layer with the same contents is only stored once
+	if err := newTestAzureBlobCache(t, "cache/kaniko", 0).Set("other", layer); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later build only needs the container and path to find the layer
+	for _, key := range []string{"key", "other"} {
+		cached, err := newTestAzureBlobCache(t, "cache/kaniko", 0).Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedDigest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := cached.Digest()
+		testutil.CheckErrorAndDeepEqual(t, false, err, expectedDigest, digest)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, readCompressed(t, layer), readCompressed(t, cached))
+	}
+	layerBlobs := 0
+	for name := range storage.Blobs {
+		if !strings.HasPrefix(name, "cache/kaniko/") {
+			t.Errorf("blob %s isn't under the cache's path", name)
+		}
+		if strings.HasPrefix(name, "cache/kaniko/blobs/") {
+			layerBlobs++
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, layerBlobs)
+
+	// A cache in another path of the container doesn't have the layers
+	_, err = newTestAzureBlobCache(t, "cache", 0).Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+}
+
+func TestAzureBlobCache_MissingBlob(t *testing.T) {
+	storage, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+	c := newTestAzureBlobCache(t, "cache", 0)
+	layer := randomLayer(t)
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(storage.Blobs, "cache/"+c.layerBlob(digest))
+	_, err = c.Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+}
+
+func TestAzureBlobCache_Verify(t *testing.T) {
+	storage, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+	c := newTestAzureBlobCache(t, "cache", 0)
+	c.SetVerify(true)
+	layer := randomLayer(t)
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Get("key")
+	testutil.CheckError(t, false, err)
+
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Blobs["cache/"+c.layerBlob(digest)] = []byte("corrupt")
+	_, err = c.Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+
+	// Caching the layer again replaces the corrupt one
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, readCompressed(t, layer), readCompressed(t, cached))
+}
+
+func TestAzureBlobCache_TTL(t *testing.T) {
+	_, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+	cachedAt := time.Date(2018, time.July, 1, 0, 0, 0, 0, time.UTC)
+	c := newTestAzureBlobCache(t, "cache", 0)
+	c.now = func() time.Time { return cachedAt }
+	if err := c.Set("key", randomLayer(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestAzureBlobCache(t, "cache", 168*time.Hour)
+	c.now = func() time.Time { return cachedAt.Add(24 * time.Hour) }
+	_, err := c.Get("key")
+	testutil.CheckError(t, false, err)
+
+	c.now = func() time.Time { return cachedAt.Add(200 * time.Hour) }
+	_, err = c.Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+var logger = util.ModuleLogger("cache")
+
+// LayerCache stores the layers created by commands, so that later builds can reuse them
+// instead of running the commands again
+type LayerCache interface {
+	// Get returns the layer cached for key, or ErrCacheMiss if there isn't one
+	Get(key string) (v1.Layer, error)
+	// Set caches layer for key
+	Set(key string, layer v1.Layer) error
+}
+
+// ErrCacheMiss is returned by LayerCache.Get when no layer is cached for a key
+var ErrCacheMiss = errors.New("no layer is cached for key")
+
+// ReadOnly returns c without storing the layers set in it, so a build can reuse the layers in a shared cache
+// without adding its own
+func ReadOnly(c LayerCache) LayerCache {
+	return readOnlyCache{c}
+}
+
+type readOnlyCache struct {
+	LayerCache
+}
+
+func (c readOnlyCache) Set(key string, layer v1.Layer) error {
+	logger.Debugf("Not caching the layer for key %s, since the cache is read-only", key)
+	return nil
+}
+
+// WriteOnly returns c without reading any layers from it, so a build can populate a cache without reusing the
+// layers already in it
+func WriteOnly(c LayerCache) LayerCache {
+	return writeOnlyCache{c}
+}
+
+type writeOnlyCache struct {
+	LayerCache
+}
+
+func (c writeOnlyCache) Get(key string) (v1.Layer, error) {
+	return nil, ErrCacheMiss
+}
+
+// CompressionLevel returns c storing the layers set in it compressed again with gzip at level, so layers can
+// be cached smaller, or faster, than they're pushed
+func CompressionLevel(c LayerCache, level int) LayerCache {
+	return compressingCache{LayerCache: c, level: level}
+}
+
+type compressingCache struct {
+	LayerCache
+	level int
+}
+
+func (c compressingCache) Set(key string, layer v1.Layer) error {
+	compressed, err := util.CompressLayer(layer, constants.CompressionGzip, c.level)
+	if err != nil {
+		return errors.Wrapf(err, "compressing the layer for key %s", key)
+	}
+	return c.LayerCache.Set(key, compressed)
+}
+
+// verifyBlob returns an error if the digest of the contents of r, a cached layer, isn't expected
+func verifyBlob(r io.Reader, expected v1.Hash) error {
+	actual, _, err := v1.SHA256(r)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return errors.Errorf("layer %s has digest %s", expected, actual)
+	}
+	return nil
+}
+
+// CompositeCache builds a cache key out of everything which can change the result of a command:
+// the base image, and the commands and files which came before it
+type CompositeCache struct {
+	keys []string
+}
+
+// NewCompositeCache returns a composite cache starting with keys, such as the digest of the base image
+func NewCompositeCache(keys ...string) *CompositeCache {
+	return &CompositeCache{keys: keys}
+}
+
+// AddKey adds keys to the composite cache
+func (c *CompositeCache) AddKey(keys ...string) {
+	c.keys = append(c.keys, keys...)
+}
+
+// AddPath adds the path and the contents, permissions and ownership of the file at p to the composite cache.
+// Its timestamps aren't included, since they change every time a file is copied.
+func (c *CompositeCache) AddPath(p string) error {
+	h, err := util.CacheHasher()(p)
+	if err != nil {
+		return errors.Wrapf(err, "hashing %s for the cache key", p)
+	}
+	c.AddKey(p, h)
+	return nil
+}
+
+// Key returns the cache key for everything added to the composite cache
+func (c *CompositeCache) Key() string {
+	h := sha256.New()
+	for _, key := range c.keys {
+		// The length keeps keys from running into each other
+		fmt.Fprintf(h, "%d:%s", len(key), key)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
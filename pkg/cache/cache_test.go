@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// recordingCache is a LayerCache in memory, which records the keys layers are read and stored with
+type recordingCache struct {
+	layers map[string]v1.Layer
+	gets   []string
+	sets   []string
+}
+
+func (c *recordingCache) Get(key string) (v1.Layer, error) {
+	c.gets = append(c.gets, key)
+	if l, ok := c.layers[key]; ok {
+		return l, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+func (c *recordingCache) Set(key string, layer v1.Layer) error {
+	c.sets = append(c.sets, key)
+	c.layers[key] = layer
+	return nil
+}
+
+func TestReadOnlyAndWriteOnly(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := layers[0]
+	tests := []struct {
+		name         string
+		wrap         func(LayerCache) LayerCache
+		expectedGets []string
+		expectedSets []string
+		expectedHit  bool
+	}{
+		{
+			name:         "read-only",
+			wrap:         ReadOnly,
+			expectedGets: []string{"cached", "new"},
+			expectedHit:  true,
+		},
+		{
+			name:         "write-only",
+			wrap:         WriteOnly,
+			expectedSets: []string{"new"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &recordingCache{layers: map[string]v1.Layer{"cached": layer}}
+			c := test.wrap(mock)
+			cached, err := c.Get("cached")
+			if test.expectedHit {
+				testutil.CheckErrorAndDeepEqual(t, false, err, layer, cached)
+			} else {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+			}
+			// A layer which was set is only found again if the cache is read and written
+			testutil.CheckError(t, false, c.Set("new", layer))
+			_, err = c.Get("new")
+			testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedGets, mock.gets)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedSets, mock.sets)
+		})
+	}
+}
+
+func TestCompositeCache_Key(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    []string
+		second   []string
+		expected bool
+	}{
+		{
+			name:     "same keys",
+			first:    []string{"sha256:abc", "RUN make"},
+			second:   []string{"sha256:abc", "RUN make"},
+			expected: true,
+		},
+		{
+			name:   "different base",
+			first:  []string{"sha256:abc", "RUN make"},
+			second: []string{"sha256:def", "RUN make"},
+		},
+		{
+			name:   "different order",
+			first:  []string{"sha256:abc", "ENV A=1", "RUN make"},
+			second: []string{"sha256:abc", "RUN make", "ENV A=1"},
+		},
+		{
+			name:   "keys running together",
+			first:  []string{"sha256:abc", "RUN ma", "ke"},
+			second: []string{"sha256:abc", "RUN m", "ake"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := NewCompositeCache(test.first...).Key()
+			second := NewCompositeCache(test.second...).Key()
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, first == second)
+		})
+	}
+}
+
+func TestCompositeCache_AddPath(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "file")
+	key := func() string {
+		c := NewCompositeCache("sha256:abc")
+		if err := c.AddPath(path); err != nil {
+			t.Fatal(err)
+		}
+		return c.Key()
+	}
+
+	if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	original := key()
+
+	// Copying a file changes its timestamps, which shouldn't change the key
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, original, key())
+
+	if err := ioutil.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key() == original {
+		t.Error("expected changing the contents of a file to change the key")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCompositeCache()
+	testutil.CheckError(t, true, c.AddPath(path))
+}
+
+func TestCompressionLevel(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := layers[0]
+	expected, err := util.CompressLayer(layer, constants.CompressionGzip, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &recordingCache{layers: map[string]v1.Layer{}}
+	c := CompressionLevel(mock, gzip.BestCompression)
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layer is stored compressed at the level, with the same contents
+	cached, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []func(v1.Layer) (v1.Hash, error){v1.Layer.Digest, v1.Layer.DiffID} {
+		want, err := f(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f(cached)
+		testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	}
+}
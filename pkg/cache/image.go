@@ -0,0 +1,241 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// ImageCache stores base images in a directory, such as a volume shared between builds, so builds can use
+// them without pulling them. Each image is pinned to the digest it had when it was cached: builds use that
+// digest until the image is cached again. Manifests are stored under images/, and their config files and
+// layers under blobs/, which they share with the layers of a LocalCache in the same directory.
+type ImageCache struct {
+	dir string
+}
+
+var _ util.ImageCache = (*ImageCache)(nil)
+
+// NewImageCache returns a cache which stores images in dir
+func NewImageCache(dir string) *ImageCache {
+	return &ImageCache{dir: dir}
+}
+
+// imagePin is the contents of the file for an image on a platform, naming the manifest it's pinned to
+type imagePin struct {
+	Image    string  `json:"image"`
+	Platform string  `json:"platform,omitempty"`
+	Digest   v1.Hash `json:"digest"`
+}
+
+// Exists returns true if there's an image cache in dir
+func (c *ImageCache) Exists() bool {
+	fi, err := os.Stat(filepath.Join(c.dir, "images"))
+	return err == nil && fi.IsDir()
+}
+
+func (c *ImageCache) pinPath(image string, platform *v1.Platform) string {
+	key := sha256.Sum256([]byte(image + " " + platformString(platform)))
+	return filepath.Join(c.dir, "images", "pins", hex.EncodeToString(key[:]))
+}
+
+func (c *ImageCache) manifestPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "images", "manifests", h.Algorithm, h.Hex)
+}
+
+func (c *ImageCache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+func platformString(platform *v1.Platform) string {
+	if platform == nil {
+		return ""
+	}
+	return util.PlatformString(*platform)
+}
+
+// Image implements util.ImageCache. An image given by digest is the one with that digest, and otherwise
+// it's the one the image was pinned to when it was cached for platform.
+func (c *ImageCache) Image(image string, platform *v1.Platform) (v1.Image, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+	var digest v1.Hash
+	if d, ok := ref.(name.Digest); ok {
+		if digest, err = v1.NewHash(d.DigestStr()); err != nil {
+			return nil, err
+		}
+	} else {
+		contents, err := ioutil.ReadFile(c.pinPath(ref.Name(), platform))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var pin imagePin
+		if err := json.Unmarshal(contents, &pin); err != nil {
+			return nil, errors.Wrapf(err, "parsing the pin of %s", image)
+		}
+		digest = pin.Digest
+	}
+	rawManifest, err := ioutil.ReadFile(c.manifestPath(digest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing the cached manifest of %s", image)
+	}
+	// An image whose blobs aren't all there, like after they've been cleaned up, has to be pulled
+	for _, desc := range append(m.Layers, m.Config) {
+		if _, err := os.Stat(c.blobPath(desc.Digest)); err != nil {
+			return nil, nil
+		}
+	}
+	rawConfig, err := ioutil.ReadFile(c.blobPath(m.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&cachedImage{cache: c, manifest: m, rawManifest: rawManifest, rawConfig: rawConfig})
+}
+
+// Set caches img as the image for platform, and pins image to it
+func (c *ImageCache) Set(image string, platform *v1.Platform, img v1.Image) error {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(c.blobPath(digest)); err == nil {
+			continue
+		}
+		r, err := l.Compressed()
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(c.blobPath(digest), r)
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "caching layer %s of %s", digest, image)
+		}
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.blobPath(configName), bytes.NewReader(rawConfig)); err != nil {
+		return err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.manifestPath(digest), bytes.NewReader(rawManifest)); err != nil {
+		return err
+	}
+	pin, err := json.Marshal(&imagePin{Image: ref.Name(), Platform: platformString(platform), Digest: digest})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.pinPath(ref.Name(), platform), bytes.NewReader(pin))
+}
+
+// cachedImage is an image in an ImageCache
+type cachedImage struct {
+	cache       *ImageCache
+	manifest    *v1.Manifest
+	rawManifest []byte
+	rawConfig   []byte
+}
+
+func (i *cachedImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+func (i *cachedImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *cachedImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if h == i.manifest.Config.Digest {
+		return partial.ConfigLayer(i)
+	}
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &cachedLayer{path: i.cache.blobPath(h), desc: desc}, nil
+		}
+	}
+	return nil, errors.Errorf("no layer with digest %s in the cached image", h)
+}
+
+// cachedLayer is a layer of an image in an ImageCache
+type cachedLayer struct {
+	path string
+	desc v1.Descriptor
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+func (l *cachedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func randomImage(t *testing.T) v1.Image {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func checkSameImage(t *testing.T, expected, actual v1.Image) {
+	expectedDigest, err := expected.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualDigest, err := actual.Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expectedDigest, actualDigest)
+	expectedConfig, err := expected.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualConfig, err := actual.RawConfigFile()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expectedConfig, actualConfig)
+	expectedLayers, err := expected.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualLayers, err := actual.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(expectedLayers), len(actualLayers))
+	for i := range expectedLayers {
+		testutil.CheckErrorAndDeepEqual(t, false, nil, readCompressed(t, expectedLayers[i]), readCompressed(t, actualLayers[i]))
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewImageCache(dir)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, false, c.Exists())
+
+	img := randomImage(t)
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	if err := c.Set("ubuntu", amd64, img); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, c.Exists())
+
+	// The name of the image is normalized, like it is when it's pulled
+	for _, image := range []string{"ubuntu", "ubuntu:latest", "index.docker.io/library/ubuntu:latest"} {
+		cached, err := c.Image(image, amd64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameImage(t, img, cached)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An image given by digest doesn't need to be pinned
+	cached, err := c.Image("gcr.io/other/image@"+digest.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameImage(t, img, cached)
+
+	for _, miss := range []struct {
+		image    string
+		platform *v1.Platform
+	}{
+		{"ubuntu", nil},
+		{"ubuntu", &v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{"ubuntu:18.04", amd64},
+		{"debian", amd64},
+	} {
+		cached, err := c.Image(miss.image, miss.platform)
+		testutil.CheckErrorAndDeepEqual(t, false, err, nil, cached)
+	}
+}
+
+func TestImageCache_Pin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewImageCache(dir)
+	first, second := randomImage(t), randomImage(t)
+	if err := c.Set("ubuntu", nil, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("debian", nil, second); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := c.Image("ubuntu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameImage(t, first, cached)
+
+	// Caching the image again pins it to the new digest
+	if err := c.Set("ubuntu", nil, second); err != nil {
+		t.Fatal(err)
+	}
+	cached, err = c.Image("ubuntu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameImage(t, second, cached)
+}
+
+func TestImageCache_MissingBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewImageCache(dir)
+	img := randomImage(t)
+	if err := c.Set("ubuntu", nil, img); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "blobs", digest.Algorithm, digest.Hex)); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := c.Image("ubuntu", nil)
+	testutil.CheckErrorAndDeepEqual(t, false, err, nil, cached)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// LocalCache is a LayerCache which stores layers in a directory, such as a volume shared between builds.
+// Each layer is stored once under blobs/, by digest, and each key is a file under keys/ naming the layer.
+type LocalCache struct {
+	dir string
+	// ttl is how long a layer is used for after it's cached, or forever if it's 0
+	ttl time.Duration
+	now func() time.Time
+	// verify checks the digest of layers before they're used, and corrupt are the layers which failed
+	verify  bool
+	corrupt map[v1.Hash]bool
+}
+
+var _ LayerCache = (*LocalCache)(nil)
+
+// NewLocalCache returns a cache which stores layers in dir. Layers cached longer than ttl ago
+// aren't used, unless ttl is 0.
+func NewLocalCache(dir string, ttl time.Duration) *LocalCache {
+	return &LocalCache{dir: dir, ttl: ttl, now: time.Now, corrupt: map[v1.Hash]bool{}}
+}
+
+// SetVerify makes Get check that the digest of a cached layer is still the one it was cached with. A layer which
+// isn't is a cache miss, and it's replaced when the layer is cached again.
+func (c *LocalCache) SetVerify(verify bool) {
+	c.verify = verify
+}
+
+// localCacheEntry is the contents of the file for a key
+type localCacheEntry struct {
+	Digest  v1.Hash   `json:"digest"`
+	Created time.Time `json:"created"`
+}
+
+func (c *LocalCache) keyPath(key string) string {
+	return filepath.Join(c.dir, "keys", key)
+}
+
+func (c *LocalCache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// Get implements LayerCache
+func (c *LocalCache) Get(key string) (v1.Layer, error) {
+	contents, err := ioutil.ReadFile(c.keyPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry localCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return nil, errors.Wrapf(err, "parsing cache entry for key %s", key)
+	}
+	if c.ttl > 0 && c.now().Sub(entry.Created) > c.ttl {
+		logger.Infof("Layer cached for key %s at %s has expired", key, entry.Created)
+		return nil, ErrCacheMiss
+	}
+	blob := c.blobPath(entry.Digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		logger.Warnf("Layer %s cached for key %s is missing from %s", entry.Digest, key, c.dir)
+		return nil, ErrCacheMiss
+	}
+	if c.verify {
+		f, err := os.Open(blob)
+		if err != nil {
+			return nil, err
+		}
+		err = verifyBlob(f, entry.Digest)
+		f.Close()
+		if err != nil {
+			logger.Warnf("Not using the layer cached for key %s in %s: %v", key, c.dir, err)
+			c.corrupt[entry.Digest] = true
+			return nil, ErrCacheMiss
+		}
+	}
+	return tarball.LayerFromFile(blob)
+}
+
+// Set implements LayerCache
+func (c *LocalCache) Set(key string, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	blob := c.blobPath(digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) || c.corrupt[digest] {
+		r, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(blob, r)
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "caching layer %s", digest)
+		}
+		delete(c.corrupt, digest)
+	}
+	entry, err := json.Marshal(&localCacheEntry{Digest: digest, Created: c.now().UTC()})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.keyPath(key), bytes.NewReader(entry))
+}
+
+// writeFileAtomic writes the contents of r to path. The file is written under a temporary name
+// and then renamed, so builds sharing the cache never see a partly written file.
+func writeFileAtomic(path string, r io.Reader) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func randomLayer(t *testing.T) v1.Layer {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layers[0]
+}
+
+func readCompressed(t *testing.T, layer v1.Layer) []byte {
+	r, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewLocalCache(dir, 0).Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+
+	layer := randomLayer(t)
+	if err := NewLocalCache(dir, 0).Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	// Another layer with the same contents is only stored once
+	if err := NewLocalCache(dir, 0).Set("other", layer); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later build only needs the directory to find the layer
+	for _, key := range []string{"key", "other"} {
+		cached, err := NewLocalCache(dir, 0).Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedDigest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := cached.Digest()
+		testutil.CheckErrorAndDeepEqual(t, false, err, expectedDigest, digest)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, readCompressed(t, layer), readCompressed(t, cached))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(files))
+}
+
+func TestLocalCache_MissingBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewLocalCache(dir, 0)
+	layer := randomLayer(t)
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(c.blobPath(digest)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+}
+
+func TestLocalCache_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layer := randomLayer(t)
+	if err := NewLocalCache(dir, 0).Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := NewLocalCache(dir, 0).blobPath(digest)
+	if err := ioutil.WriteFile(blob, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without verifying, the corrupt layer is used
+	_, err = NewLocalCache(dir, 0).Get("key")
+	testutil.CheckError(t, false, err)
+
+	c := NewLocalCache(dir, 0)
+	c.SetVerify(true)
+	_, err = c.Get("key")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+
+	// Caching the layer again replaces the corrupt one
+	if err := c.Set("key", layer); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, readCompressed(t, layer), readCompressed(t, cached))
+}
+
+func TestLocalCache_TTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachedAt := time.Date(2018, time.July, 1, 0, 0, 0, 0, time.UTC)
+	c := NewLocalCache(dir, 0)
+	c.now = func() time.Time { return cachedAt }
+	if err := c.Set("key", randomLayer(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		age       time.Duration
+		expectHit bool
+	}{
+		{
+			name:      "fresh",
+			ttl:       168 * time.Hour,
+			age:       24 * time.Hour,
+			expectHit: true,
+		},
+		{
+			name: "expired",
+			ttl:  168 * time.Hour,
+			age:  200 * time.Hour,
+		},
+		{
+			name:      "no ttl",
+			age:       10000 * time.Hour,
+			expectHit: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewLocalCache(dir, test.ttl)
+			c.now = func() time.Time { return cachedAt.Add(test.age) }
+			_, err := c.Get("key")
+			if test.expectHit {
+				testutil.CheckError(t, false, err)
+			} else {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, ErrCacheMiss, err)
+			}
+		})
+	}
+}
@@ -17,20 +17,24 @@ limitations under the License.
 package commands
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 
 	"github.com/google/go-containerregistry/pkg/v1"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 type AddCommand struct {
-	cmd           *instructions.AddCommand
+	cmd           *dockerfile.AddCommand
+	escape        rune
 	buildcontext  string
 	snapshotFiles []string
 }
@@ -41,18 +45,23 @@ type AddCommand struct {
 // 		- destination will have permissions of 0600
 // 		- If remote file has HTTP Last-Modified header, we set the mtime of the file to that timestamp
 // 		- If dest doesn't end with a slash, the filepath is inferred to be <dest>/<filename>
-// 	2. If <src> is a local tar archive:
+// 		- If --checksum is set, the downloaded file must have that digest
+// 	2. If <src> is a git repository:
+// 		- The ref in its fragment, or the default branch, is cloned into dest without the .git directory
+// 	3. If <src> is a local tar archive:
 // 		-If <src> is a local tar archive, it is unpacked at the dest, as 'tar -x' would
+// 		- The archives in it given with --extract-nested are unpacked too, into the directories they're in
+// --chmod and --chown apply to all of them, and override the modes and ownership stored in archives
 func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	srcs := a.cmd.SourcesAndDest[:len(a.cmd.SourcesAndDest)-1]
 	dest := a.cmd.SourcesAndDest[len(a.cmd.SourcesAndDest)-1]
 
-	logrus.Infof("cmd: Add %s", srcs)
-	logrus.Infof("dest: %s", dest)
+	logger.Infof("cmd: Add %s", srcs)
+	logger.Infof("dest: %s", dest)
 
 	// First, resolve any environment replacement
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	resolvedEnvs, err := util.ResolveEnvironmentReplacementList(a.cmd.SourcesAndDest, replacementEnvs, true)
+	resolvedEnvs, err := util.ResolveEnvironmentReplacementList(a.cmd.SourcesAndDest, replacementEnvs, a.escape, true)
 	if err != nil {
 		return err
 	}
@@ -62,36 +71,80 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	if err != nil {
 		return err
 	}
+	copyOpts, err := copyOptions(a.cmd.Chmod, a.cmd.Chown, replacementEnvs, a.escape)
+	if err != nil {
+		return err
+	}
+	var checksum *util.Checksum
+	if a.cmd.Checksum != "" {
+		if checksum, err = util.ParseChecksum(a.cmd.Checksum); err != nil {
+			return err
+		}
+	}
 	var unresolvedSrcs []string
+	var unpackedArchives []string
 	// If any of the sources are local tar archives:
 	// 	1. Unpack them to the specified destination
 	// If any of the sources is a remote file URL:
 	//	1. Download and copy it to the specified dest
 	// Else, add to the list of unresolved sources
 	for _, src := range srcs {
-		fullPath := filepath.Join(a.buildcontext, src)
-		if util.IsSrcRemoteFileURL(src) {
-			urlDest := util.URLDestinationFilepath(src, dest, config.WorkingDir)
-			logrus.Infof("Adding remote URL %s to %s", src, urlDest)
-			if err := util.DownloadFileToDest(src, urlDest); err != nil {
-				return err
+		if util.IsSrcRemoteGitURL(src) {
+			if checksum != nil {
+				return errors.Errorf("ADD --checksum can only be used with remote URLs, not %s", src)
 			}
-			a.snapshotFiles = append(a.snapshotFiles, urlDest)
-		} else if util.IsFileLocalTarArchive(fullPath) {
-			logrus.Infof("Unpacking local tar archive %s to %s", src, dest)
-			if err := util.UnpackLocalTarArchive(fullPath, dest); err != nil {
+			gitDest := dest
+			if !filepath.IsAbs(gitDest) {
+				gitDest = filepath.Join(config.WorkingDir, gitDest)
+			}
+			if err := addGitRepo(src, gitDest, copyOpts); err != nil {
 				return err
 			}
-			// Add the unpacked files to the snapshotter
-			filesAdded, err := util.Files(dest)
+			filesAdded, err := util.Files(gitDest)
 			if err != nil {
 				return err
 			}
-			logrus.Debugf("Added %v from local tar archive %s", filesAdded, src)
 			a.snapshotFiles = append(a.snapshotFiles, filesAdded...)
+		} else if util.IsSrcRemoteFileURL(src) {
+			urlDest := util.URLDestinationFilepath(src, dest, config.WorkingDir)
+			logger.Infof("Adding remote URL %s to %s", src, urlDest)
+			if err := util.DownloadFileToDest(src, urlDest, checksum, copyOpts); err != nil {
+				return err
+			}
+			a.snapshotFiles = append(a.snapshotFiles, urlDest)
+		} else if checksum != nil {
+			return errors.Errorf("ADD --checksum can only be used with remote URLs, not %s", src)
 		} else {
-			unresolvedSrcs = append(unresolvedSrcs, src)
+			fullPath, err := util.ContextPath(a.buildcontext, src)
+			if err != nil {
+				return err
+			}
+			if !util.IsFileLocalTarArchive(fullPath) {
+				unresolvedSrcs = append(unresolvedSrcs, src)
+				continue
+			}
+			logger.Infof("Unpacking local tar archive %s to %s", src, dest)
+			if err := util.UnpackLocalTarArchiveWithOptions(fullPath, dest, copyOpts); err != nil {
+				return err
+			}
+			unpackedArchives = append(unpackedArchives, src)
+		}
+	}
+	if len(a.cmd.ExtractNested) > 0 && len(unpackedArchives) == 0 {
+		return errors.New("ADD --extract-nested can only be used with local tar archives")
+	}
+	if len(unpackedArchives) > 0 {
+		// The nested archives can be in any of the archives, so they're unpacked once all of them are
+		if err := util.UnpackNestedTarArchives(dest, a.cmd.ExtractNested, copyOpts); err != nil {
+			return err
+		}
+		// Add the unpacked files to the snapshotter
+		filesAdded, err := util.Files(dest)
+		if err != nil {
+			return err
 		}
+		logger.Debugf("Added %v from local tar archives %v", filesAdded, unpackedArchives)
+		a.snapshotFiles = append(a.snapshotFiles, filesAdded...)
 	}
 	// With the remaining "normal" sources, create and execute a standard copy command
 	if len(unresolvedSrcs) == 0 {
@@ -99,9 +152,14 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	}
 
 	copyCmd := CopyCommand{
-		cmd: &instructions.CopyCommand{
-			SourcesAndDest: append(unresolvedSrcs, dest),
+		cmd: &dockerfile.CopyCommand{
+			CopyCommand: &instructions.CopyCommand{
+				SourcesAndDest: append(unresolvedSrcs, dest),
+				Chown:          a.cmd.Chown,
+			},
+			Chmod: a.cmd.Chmod,
 		},
+		escape:       a.escape,
 		buildcontext: a.buildcontext,
 	}
 	if err := copyCmd.ExecuteCommand(config, buildArgs); err != nil {
@@ -111,6 +169,63 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	return nil
 }
 
+// addGitRepo clones the git repository src, and copies its files to dest with opts
+func addGitRepo(src, dest string, opts util.CopyOptions) error {
+	// Clone into the kaniko directory, so the clone isn't part of the filesystem being snapshotted
+	dir, err := ioutil.TempDir(constants.KanikoDir, "git")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	contents, err := util.CloneGitRepo(src, dir)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Adding git repository %s to %s", src, dest)
+	return util.CopyDir(contents, dest, opts)
+}
+
+// CacheKey returns the keys for the files the command adds: the contents of the local files, and the URLs of
+// remote files along with the checksums they must have, along with the flags and the destination they're
+// added with. Remote files without a checksum and git repositories are only known once they're fetched,
+// so nil is returned for them.
+func (a *AddCommand) CacheKey(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
+	resolvedEnvs, err := util.ResolveEnvironmentReplacementList(a.cmd.SourcesAndDest, replacementEnvs, a.escape, true)
+	if err != nil {
+		return nil, err
+	}
+	srcs, err := util.ResolveSources(resolvedEnvs, a.buildcontext)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := copyFlagsCacheKey("ADD", a.cmd.Chmod, a.cmd.Chown, resolvedEnvs[len(resolvedEnvs)-1], config, replacementEnvs, a.escape)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.cmd.ExtractNested) > 0 {
+		keys = append(keys, "--extract-nested="+strings.Join(a.cmd.ExtractNested, ","))
+	}
+	for _, src := range srcs {
+		switch {
+		case util.IsSrcRemoteGitURL(src):
+			return nil, nil
+		case util.IsSrcRemoteFileURL(src):
+			if a.cmd.Checksum == "" {
+				return nil, nil
+			}
+			keys = append(keys, src, a.cmd.Checksum)
+		default:
+			srcKeys, err := sourcesCacheKey(a.buildcontext, []string{src})
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, srcKeys...)
+		}
+	}
+	return keys, nil
+}
+
 // FilesToSnapshot should return an empty array if still nil; no files were changed
 func (a *AddCommand) FilesToSnapshot() []string {
 	return a.snapshotFiles
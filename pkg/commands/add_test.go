@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func writeTestArchive(t *testing.T, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Name: "app/", Mode: 0700, Typeflag: tar.TypeDir, Uid: 0, Gid: 0},
+		{Name: "app/bin", Mode: 0755, Typeflag: tar.TypeReg, Size: 3, Uid: 0, Gid: 0},
+		{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "bin", Uid: 0, Gid: 0},
+	} {
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := w.Write([]byte("bin")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestFile returns the mode and owner of the file at path, without following symlinks
+func addTestFile(t *testing.T, path string) (os.FileMode, []uint32) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return fi.Mode(), []uint32{stat.Uid, stat.Gid}
+}
+
+func TestAddCommand_ChmodChown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("downloaded"))
+	}))
+	defer server.Close()
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	writeTestArchive(t, filepath.Join(buildcontext, "archive.tar"))
+	if err := ioutil.WriteFile(filepath.Join(buildcontext, "plain"), []byte("plain"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	stages, err := dockerfile.Parse([]byte(fmt.Sprintf("FROM scratch\nADD --chmod=0644 --chown=1000:1000 archive.tar plain %s/file %s/\n", server.URL, dest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &AddCommand{cmd: stages[0].Commands[0].(*dockerfile.AddCommand), buildcontext: buildcontext}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The modes and ownership stored in the archive are overridden, like those of any other files
+	for _, path := range []string{"app", "app/bin", "plain", "file"} {
+		mode, owner := addTestFile(t, filepath.Join(dest, path))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, os.FileMode(0644), mode.Perm())
+		testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{1000, 1000}, owner)
+	}
+	// Symlinks have no mode of their own, but are owned by the user too
+	mode, owner := addTestFile(t, filepath.Join(dest, "app/link"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, os.ModeSymlink, mode&os.ModeSymlink)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{1000, 1000}, owner)
+}
+
+func TestAddCommand_ArchiveModes(t *testing.T) {
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	writeTestArchive(t, filepath.Join(buildcontext, "archive.tar"))
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	stages, err := dockerfile.Parse([]byte(fmt.Sprintf("FROM scratch\nADD archive.tar %s/\n", dest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &AddCommand{cmd: stages[0].Commands[0].(*dockerfile.AddCommand), buildcontext: buildcontext}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Without --chmod, the modes stored in the archive are kept
+	for path, expected := range map[string]os.FileMode{"app": 0700, "app/bin": 0755} {
+		mode, _ := addTestFile(t, filepath.Join(dest, path))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, expected, mode.Perm())
+	}
+}
+
+func TestAddCommand_ExtractNested(t *testing.T) {
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	// The bundle is a tar with the test archive in it
+	writeTestArchive(t, filepath.Join(buildcontext, "app.tar"))
+	inner, err := ioutil.ReadFile(filepath.Join(buildcontext, "app.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(buildcontext, "bundle.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tar.NewWriter(f)
+	if err := w.WriteHeader(&tar.Header{Name: "lib/app.tar", Mode: 0644, Size: int64(len(inner)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(inner); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	stages, err := dockerfile.Parse([]byte(fmt.Sprintf("FROM scratch\nADD --extract-nested=lib/app.tar bundle.tar %s/\nADD --extract-nested=lib/app.tar app.tar %s/\n", dest, dest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &AddCommand{cmd: stages[0].Commands[0].(*dockerfile.AddCommand), buildcontext: buildcontext}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// The nested archive is unpacked where it was, instead of being added itself
+	contents, err := ioutil.ReadFile(filepath.Join(dest, "lib/app/bin"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "bin", string(contents))
+	if _, err := os.Lstat(filepath.Join(dest, "lib/app.tar")); !os.IsNotExist(err) {
+		t.Errorf("expected lib/app.tar to be removed once it was unpacked, got %v", err)
+	}
+	snapshotted := map[string]bool{}
+	for _, f := range cmd.FilesToSnapshot() {
+		snapshotted[f] = true
+	}
+	if !snapshotted[filepath.Join(dest, "lib/app/bin")] || snapshotted[filepath.Join(dest, "lib/app.tar")] {
+		t.Errorf("expected the nested files to be snapshotted instead of the nested archive, got %v", cmd.FilesToSnapshot())
+	}
+
+	// The nested archive has to be in the archive being added
+	cmd = &AddCommand{cmd: stages[0].Commands[1].(*dockerfile.AddCommand), buildcontext: buildcontext}
+	testutil.CheckError(t, true, cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)))
+}
+
+func TestAddCommand_Symlinks(t *testing.T) {
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	outside, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	writeTestArchive(t, filepath.Join(outside, "archive.tar"))
+	if err := testutil.SetupFiles(buildcontext, map[string]string{"tree/file": "file"}); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"tree/internal": "file",
+		"tree/dangling": "missing",
+		"tree/outside":  filepath.Join(outside, "archive.tar"),
+		// A symlink to an archive outside of the context isn't unpacked
+		"archive.tar": filepath.Join(outside, "archive.tar"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(buildcontext, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	stages, err := dockerfile.Parse([]byte(fmt.Sprintf("FROM scratch\nADD tree archive.tar %s/\n", dest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &AddCommand{cmd: stages[0].Commands[0].(*dockerfile.AddCommand), buildcontext: buildcontext}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The symlinks are added to the layer as symlinks, with the same targets
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, f := range cmd.FilesToSnapshot() {
+		fi, err := os.Lstat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.AddToTar(f, fi, map[util.FileID]string{}, w, util.TarOptions{Root: dest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	symlinks := map[string]string{}
+	var files []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			symlinks[hdr.Name] = hdr.Linkname
+		case tar.TypeReg:
+			files = append(files, hdr.Name)
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{
+		"/internal":    "file",
+		"/dangling":    "missing",
+		"/outside":     filepath.Join(outside, "archive.tar"),
+		"/archive.tar": filepath.Join(outside, "archive.tar"),
+	}, symlinks)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/file"}, files)
+}
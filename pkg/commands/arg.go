@@ -23,24 +23,24 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type ArgCommand struct {
-	cmd *instructions.ArgCommand
+	cmd    *instructions.ArgCommand
+	escape rune
 }
 
 // ExecuteCommand only needs to add this ARG key/value as seen
 func (r *ArgCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("ARG")
+	logger.Info("ARG")
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	resolvedKey, err := util.ResolveEnvironmentReplacement(r.cmd.Key, replacementEnvs, false)
+	resolvedKey, err := util.ResolveEnvironmentReplacement(r.cmd.Key, replacementEnvs, r.escape, false)
 	if err != nil {
 		return err
 	}
 	var resolvedValue *string
 	if r.cmd.Value != nil {
-		value, err := util.ResolveEnvironmentReplacement(*r.cmd.Value, replacementEnvs, false)
+		value, err := util.ResolveEnvironmentReplacement(*r.cmd.Value, replacementEnvs, r.escape, false)
 		if err != nil {
 			return err
 		}
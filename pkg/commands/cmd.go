@@ -23,33 +23,28 @@ import (
 
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type CmdCommand struct {
 	cmd *instructions.CmdCommand
 }
 
+// SetsCmd returns true if the command sets a CMD, which ENTRYPOINT commands after it in the stage keep.
+// Like docker, CMD [] doesn't.
+func (c *CmdCommand) SetsCmd() bool {
+	return len(c.cmd.CmdLine) > 0
+}
+
 // ExecuteCommand executes the CMD command
 // Argument handling is the same as RUN.
 func (c *CmdCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: CMD")
-	var newCommand []string
+	logger.Info("cmd: CMD")
+	newCommand := c.cmd.CmdLine
 	if c.cmd.PrependShell {
-		// This is the default shell on Linux
-		var shell []string
-		if len(config.Shell) > 0 {
-			shell = config.Shell
-		} else {
-			shell = append(shell, "/bin/sh", "-c")
-		}
-
-		newCommand = append(shell, strings.Join(c.cmd.CmdLine, " "))
-	} else {
-		newCommand = c.cmd.CmdLine
+		newCommand = withShell(config, c.cmd.CmdLine)
 	}
 
-	logrus.Infof("Replacing CMD in config with %v", newCommand)
+	logger.Infof("Replacing CMD in config with %v", newCommand)
 	config.Cmd = newCommand
 	config.ArgsEscaped = true
 	return nil
@@ -17,13 +17,17 @@ limitations under the License.
 package commands
 
 import (
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
+var logger = util.ModuleLogger("commands")
+
 type DockerCommand interface {
 	// ExecuteCommand is responsible for:
 	// 	1. Making required changes to the filesystem (ex. copying files for ADD/COPY or setting ENV variables)
@@ -36,42 +40,68 @@ type DockerCommand interface {
 	FilesToSnapshot() []string
 }
 
-func GetCommand(cmd instructions.Command, buildcontext string) (DockerCommand, error) {
+// CacheKeyCommand is a command which adds files from outside of the filesystem, like COPY and ADD, and whose
+// layer can be cached by the files it adds, without running it
+type CacheKeyCommand interface {
+	DockerCommand
+	// CacheKey returns the keys which identify the files the command adds and how, or nil if they're only
+	// known once it's run
+	CacheKey(*v1.Config, *dockerfile.BuildArgs) ([]string, error)
+}
+
+// GetCommand returns the command which runs cmd. escape is the escape character the words in cmd are resolved with,
+// the one of the Dockerfile it's from.
+func GetCommand(cmd instructions.Command, buildcontext string, escape rune, opts *options.KanikoOptions) (DockerCommand, error) {
 	switch c := cmd.(type) {
-	case *instructions.RunCommand:
-		return &RunCommand{cmd: c}, nil
-	case *instructions.CopyCommand:
-		return &CopyCommand{cmd: c, buildcontext: buildcontext}, nil
+	case *dockerfile.RunCommand:
+		secrets, err := util.ParseSecrets(opts.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		limits, err := util.ParseRunLimits(opts.RunMemoryLimit, opts.RunCPULimit)
+		if err != nil {
+			return nil, err
+		}
+		return &RunCommand{
+			cmd:           c,
+			mountCacheDir: opts.MountCacheDir,
+			secrets:       secrets,
+			secretsDir:    constants.KanikoSecretsDir,
+			network:       opts.RunNetwork,
+			limits:        limits,
+		}, nil
+	case *dockerfile.CopyCommand:
+		return &CopyCommand{cmd: c, escape: escape, buildcontext: buildcontext}, nil
 	case *instructions.ExposeCommand:
-		return &ExposeCommand{cmd: c}, nil
+		return &ExposeCommand{cmd: c, escape: escape}, nil
 	case *instructions.EnvCommand:
-		return &EnvCommand{cmd: c}, nil
+		return &EnvCommand{cmd: c, escape: escape}, nil
 	case *instructions.WorkdirCommand:
-		return &WorkdirCommand{cmd: c}, nil
-	case *instructions.AddCommand:
-		return &AddCommand{cmd: c, buildcontext: buildcontext}, nil
+		return &WorkdirCommand{cmd: c, escape: escape}, nil
+	case *dockerfile.AddCommand:
+		return &AddCommand{cmd: c, escape: escape, buildcontext: buildcontext}, nil
 	case *instructions.CmdCommand:
 		return &CmdCommand{cmd: c}, nil
 	case *instructions.EntrypointCommand:
 		return &EntrypointCommand{cmd: c}, nil
 	case *instructions.LabelCommand:
-		return &LabelCommand{cmd: c}, nil
+		return &LabelCommand{cmd: c, escape: escape}, nil
 	case *instructions.UserCommand:
-		return &UserCommand{cmd: c}, nil
+		return &UserCommand{cmd: c, escape: escape}, nil
 	case *instructions.OnbuildCommand:
 		return &OnBuildCommand{cmd: c}, nil
 	case *instructions.VolumeCommand:
-		return &VolumeCommand{cmd: c}, nil
+		return &VolumeCommand{cmd: c, escape: escape}, nil
 	case *instructions.StopSignalCommand:
-		return &StopSignalCommand{cmd: c}, nil
+		return &StopSignalCommand{cmd: c, escape: escape}, nil
 	case *instructions.ArgCommand:
-		return &ArgCommand{cmd: c}, nil
+		return &ArgCommand{cmd: c, escape: escape}, nil
 	case *instructions.ShellCommand:
 		return &ShellCommand{cmd: c}, nil
 	case *instructions.HealthCheckCommand:
 		return &HealthCheckCommand{cmd: c}, nil
 	case *instructions.MaintainerCommand:
-		logrus.Warnf("%s is deprecated, skipping", cmd.Name())
+		logger.Warnf("%s is deprecated, skipping", cmd.Name())
 		return nil, nil
 	}
 	return nil, errors.Errorf("%s is not a supported command", cmd.Name())
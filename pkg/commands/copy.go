@@ -26,76 +26,170 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 type CopyCommand struct {
-	cmd           *instructions.CopyCommand
+	cmd           *dockerfile.CopyCommand
+	escape        rune
 	buildcontext  string
 	snapshotFiles []string
+	// root is the directory files are copied under, or "" for the root of the filesystem
+	root string
 }
 
-func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	srcs := c.cmd.SourcesAndDest[:len(c.cmd.SourcesAndDest)-1]
-	dest := c.cmd.SourcesAndDest[len(c.cmd.SourcesAndDest)-1]
+// copySources are the sources and destination of a COPY, with environment replacements resolved
+type copySources struct {
+	// patterns are the sources in the build context, which can have wildcards
+	patterns []string
+	// srcs are the paths in the build context to copy, with wildcards resolved
+	srcs     []string
+	heredocs []dockerfile.Heredoc
+	dest     string
+	// replacementEnvs are the environment variables the sources and destination were resolved with
+	replacementEnvs []string
+}
 
-	logrus.Infof("cmd: copy %s", srcs)
-	logrus.Infof("dest: %s", dest)
+// resolveSources resolves the environment variables and wildcards in the sources and destination of the command
+func (c *CopyCommand) resolveSources(config *v1.Config, buildArgs *dockerfile.BuildArgs) (*copySources, error) {
+	sources, err := c.resolveEnvs(config, buildArgs)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources.patterns) > 0 {
+		// Resolve wildcards and get a list of resolved sources
+		sources.srcs, err = util.ResolveSources(append(sources.patterns, sources.dest), c.buildcontext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sources.patterns)+len(sources.heredocs) > 1 && !util.IsDestDir(sources.dest) {
+		return nil, errors.New("when specifying multiple sources in a COPY command, destination must be a directory and end in '/'")
+	}
+	return sources, nil
+}
 
+// resolveEnvs resolves the environment variables in the sources and destination of the command, and
+// separates the heredocs from the sources in the build context
+func (c *CopyCommand) resolveEnvs(config *v1.Config, buildArgs *dockerfile.BuildArgs) (*copySources, error) {
 	// Resolve from
 	if c.cmd.From != "" {
 		c.buildcontext = filepath.Join(constants.KanikoDir, c.cmd.From)
 	}
+	if c.cmd.Context != "" {
+		c.buildcontext = c.cmd.Context
+	}
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 	// First, resolve any environment replacement
-	resolvedEnvs, err := util.ResolveEnvironmentReplacementList(c.cmd.SourcesAndDest, replacementEnvs, true)
+	resolvedEnvs, err := util.ResolveEnvironmentReplacementList(c.cmd.SourcesAndDest, replacementEnvs, c.escape, true)
+	if err != nil {
+		return nil, err
+	}
+	sources := &copySources{
+		dest:            resolvedEnvs[len(resolvedEnvs)-1],
+		replacementEnvs: replacementEnvs,
+	}
+	// Heredocs are written to the destination, instead of being copied from the build context
+	for _, src := range resolvedEnvs[:len(resolvedEnvs)-1] {
+		if dockerfile.IsHeredoc(src) {
+			// Heredocs aren't extracted from ONBUILD triggers
+			if len(sources.heredocs) == len(c.cmd.Heredocs) {
+				return nil, errors.Errorf("no body for heredoc %s", src)
+			}
+			sources.heredocs = append(sources.heredocs, c.cmd.Heredocs[len(sources.heredocs)])
+			continue
+		}
+		sources.patterns = append(sources.patterns, src)
+	}
+	return sources, nil
+}
+
+func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	logger.Infof("cmd: copy %s", c.cmd.SourcesAndDest[:len(c.cmd.SourcesAndDest)-1])
+	logger.Infof("dest: %s", c.cmd.SourcesAndDest[len(c.cmd.SourcesAndDest)-1])
+
+	sources, err := c.resolveSources(config, buildArgs)
 	if err != nil {
 		return err
 	}
-	dest = resolvedEnvs[len(resolvedEnvs)-1]
-	// Resolve wildcards and get a list of resolved sources
-	srcs, err = util.ResolveSources(resolvedEnvs, c.buildcontext)
+	srcs, heredocs, dest, replacementEnvs := sources.srcs, sources.heredocs, sources.dest, sources.replacementEnvs
+	copyOpts, err := copyOptions(c.cmd.Chmod, c.cmd.Chown, replacementEnvs, c.escape)
 	if err != nil {
 		return err
 	}
+	// Hardlinked sources stay hardlinked, so the snapshot adds their contents to the layer only once
+	copyOpts.Hardlinks = map[util.FileID]string{}
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = constants.RootDir
+	}
+	for _, heredoc := range heredocs {
+		// Like a file in the build context, the heredoc is named after its delimiter in a destination directory
+		destPath, err := util.DestinationFilepath(heredoc.Name, dest, cwd)
+		if err != nil {
+			return err
+		}
+		if c.root != "" {
+			destPath = filepath.Join(c.root, destPath)
+		}
+		content, err := heredoc.Resolve(replacementEnvs)
+		if err != nil {
+			return err
+		}
+		mode, uid, gid := os.FileMode(0644), uint32(0), uint32(0)
+		if copyOpts.Chmod != nil {
+			mode = *copyOpts.Chmod
+		}
+		if copyOpts.Chown != nil {
+			uid, gid = uint32(copyOpts.Chown.UID), uint32(copyOpts.Chown.GID)
+		}
+		logger.Infof("Writing heredoc %s to %s", heredoc.Name, destPath)
+		if err := util.CreateFile(destPath, strings.NewReader(content), mode, uid, gid); err != nil {
+			return err
+		}
+		c.snapshotFiles = append(c.snapshotFiles, destPath)
+	}
 	// For each source, iterate through and copy it over
 	for _, src := range srcs {
-		fullPath := filepath.Join(c.buildcontext, src)
-		fi, err := os.Lstat(fullPath)
+		fullPath, err := util.ContextPath(c.buildcontext, src)
 		if err != nil {
 			return err
 		}
-		cwd := config.WorkingDir
-		if cwd == "" {
-			cwd = constants.RootDir
+		fi, err := os.Lstat(fullPath)
+		if err != nil {
+			return err
 		}
 		destPath, err := util.DestinationFilepath(src, dest, cwd)
 		if err != nil {
 			return err
 		}
+		if fi.IsDir() && !filepath.IsAbs(dest) {
+			// we need to add '/' to the end to indicate the destination is a directory
+			dest = filepath.Join(cwd, dest) + "/"
+		}
+		destDir := dest
+		if c.root != "" {
+			destPath = filepath.Join(c.root, destPath)
+			destDir = filepath.Join(c.root, dest) + "/"
+		}
 		if fi.IsDir() {
-			if !filepath.IsAbs(dest) {
-				// we need to add '/' to the end to indicate the destination is a directory
-				dest = filepath.Join(cwd, dest) + "/"
-			}
-			if err := util.CopyDir(fullPath, dest); err != nil {
+			if err := util.CopyDir(fullPath, destDir, copyOpts); err != nil {
 				return err
 			}
-			copiedFiles, err := util.Files(dest)
+			copiedFiles, err := util.Files(destDir)
 			if err != nil {
 				return err
 			}
 			c.snapshotFiles = append(c.snapshotFiles, copiedFiles...)
 		} else if fi.Mode()&os.ModeSymlink != 0 {
 			// If file is a symlink, we want to create the same relative symlink
-			if err := util.CopySymlink(fullPath, destPath); err != nil {
+			if err := util.CopySymlink(fullPath, destPath, copyOpts); err != nil {
 				return err
 			}
 			c.snapshotFiles = append(c.snapshotFiles, destPath)
 		} else {
 			// ... Else, we want to copy over a file
-			if err := util.CopyFile(fullPath, destPath); err != nil {
+			if err := util.CopyFile(fullPath, destPath, copyOpts); err != nil {
 				return err
 			}
 			c.snapshotFiles = append(c.snapshotFiles, destPath)
@@ -104,12 +198,141 @@ func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bu
 	return nil
 }
 
+// CacheKey returns the keys for the files the command copies: the digest of the image and the paths copied
+// from it for COPY --from an image, and otherwise the contents of the files, along with the flags and the
+// destination they're copied with
+func (c *CopyCommand) CacheKey(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	resolve := c.resolveSources
+	if c.cmd.From != "" && c.cmd.FromDigest != "" {
+		// The files of an image are known from its digest, without reading them
+		resolve = c.resolveEnvs
+	}
+	sources, err := resolve(config, buildArgs)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := copyFlagsCacheKey("COPY", c.cmd.Chmod, c.cmd.Chown, sources.dest, config, sources.replacementEnvs, c.escape)
+	if err != nil {
+		return nil, err
+	}
+	for _, heredoc := range sources.heredocs {
+		content, err := heredoc.Resolve(sources.replacementEnvs)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, heredoc.Name, content)
+	}
+	if c.cmd.From != "" && c.cmd.FromDigest != "" {
+		keys = append(keys, "--from="+c.cmd.FromDigest)
+		return append(keys, sources.patterns...), nil
+	}
+	if c.cmd.From != "" {
+		keys = append(keys, "--from="+c.cmd.From)
+	}
+	srcKeys, err := sourcesCacheKey(c.buildcontext, sources.srcs)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, srcKeys...), nil
+}
+
 // FilesToSnapshot should return an empty array if still nil; no files were changed
 func (c *CopyCommand) FilesToSnapshot() []string {
 	return c.snapshotFiles
 }
 
+// Link returns true if the files are copied into a layer of their own, with COPY --link
+func (c *CopyCommand) Link() bool {
+	return c.cmd.Link
+}
+
+// SetRoot makes the command copy files under root, instead of the root of the filesystem.
+// It's used to copy the files for COPY --link into a directory of their own.
+func (c *CopyCommand) SetRoot(root string) {
+	c.root = root
+}
+
 // CreatedBy returns some information about the command for the image config
 func (c *CopyCommand) CreatedBy() string {
-	return strings.Join(c.cmd.SourcesAndDest, " ")
+	createdBy := strings.Join(c.cmd.SourcesAndDest, " ")
+	// Heredocs are included like in the Dockerfile, so changing them changes the cache key
+	for _, heredoc := range c.cmd.Heredocs {
+		createdBy += "\n" + heredoc.Content + heredoc.Name
+	}
+	return createdBy
+}
+
+// copyOptions returns the options for the files copied by COPY or added by ADD with the values of --chmod
+// and --chown, either of which can be empty. --chown can use the envs in replacementEnvs, and escape characters
+// with escape.
+func copyOptions(chmod, chown string, replacementEnvs []string, escape rune) (util.CopyOptions, error) {
+	var opts util.CopyOptions
+	if chmod != "" {
+		mode, err := util.ParseChmod(chmod)
+		if err != nil {
+			return opts, err
+		}
+		opts.Chmod = &mode
+	}
+	if chown != "" {
+		resolved, err := util.ResolveEnvironmentReplacement(chown, replacementEnvs, escape, false)
+		if err != nil {
+			return opts, err
+		}
+		ids, err := util.ParseChown(resolved, constants.RootDir)
+		if err != nil {
+			return opts, err
+		}
+		opts.Chown = &ids
+	}
+	return opts, nil
+}
+
+// copyFlagsCacheKey returns the keys for the instruction, COPY or ADD, its --chmod and --chown, and the destination
+// files are copied to, which is in the working directory of config unless it's absolute
+func copyFlagsCacheKey(instruction, chmod, chown, dest string, config *v1.Config, replacementEnvs []string, escape rune) ([]string, error) {
+	if chown != "" {
+		resolved, err := util.ResolveEnvironmentReplacement(chown, replacementEnvs, escape, false)
+		if err != nil {
+			return nil, err
+		}
+		chown = resolved
+	}
+	return []string{instruction, "--chmod=" + chmod, "--chown=" + chown, config.WorkingDir, dest}, nil
+}
+
+// sourcesCacheKey returns the keys for the files at srcs in buildcontext, and everything in the ones which
+// are directories: the path of each file in buildcontext, and a hash of its contents, permissions and ownership.
+// Files which .dockerignore excludes aren't copied, so they're left out.
+func sourcesCacheKey(buildcontext string, srcs []string) ([]string, error) {
+	hasher := util.CacheHasher()
+	var keys []string
+	for _, src := range srcs {
+		fullPath, err := util.ContextPath(buildcontext, src)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && util.ExcludeFile(path) {
+				return nil
+			}
+			rel, err := filepath.Rel(buildcontext, path)
+			if err != nil {
+				return err
+			}
+			h, err := hasher(path)
+			if err != nil {
+				return errors.Wrapf(err, "hashing %s for the cache key", rel)
+			}
+			keys = append(keys, rel, h)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
 }
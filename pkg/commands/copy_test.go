@@ -0,0 +1,218 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestCopyCommand_Heredoc(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		expected   map[string]string
+		shouldErr  bool
+	}{
+		{
+			name:       "inline file",
+			dockerfile: "FROM scratch\nCOPY <<EOF /app/greeting\nhello $NAME\n\tbye\nEOF",
+			expected:   map[string]string{"app/greeting": "hello world\n\tbye\n"},
+		},
+		{
+			name:       "inline files in a directory",
+			dockerfile: "FROM scratch\nCOPY <<-EOF <<'RAW' /app/\n\thello $NAME\n\tEOF\nhello $NAME\nRAW",
+			expected: map[string]string{
+				"app/EOF": "hello world\n",
+				"app/RAW": "hello $NAME\n",
+			},
+		},
+		{
+			name:       "relative to the working directory",
+			dockerfile: "FROM scratch\nCOPY <<EOF greeting\nhi\nEOF",
+			expected:   map[string]string{"work/greeting": "hi\n"},
+		},
+		{
+			name:       "multiple heredocs need a destination directory",
+			dockerfile: "FROM scratch\nCOPY <<A <<B /app\na\nA\nb\nB",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			stages, err := dockerfile.Parse([]byte(test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := &CopyCommand{cmd: stages[0].Commands[0].(*dockerfile.CopyCommand)}
+			cmd.SetRoot(root)
+			config := &v1.Config{Env: []string{"NAME=world"}, WorkingDir: "/work"}
+			err = cmd.ExecuteCommand(config, dockerfile.NewBuildArgs(nil))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			for path, expected := range test.expected {
+				contents, err := ioutil.ReadFile(filepath.Join(root, path))
+				testutil.CheckErrorAndDeepEqual(t, false, err, expected, string(contents))
+				fi, err := os.Stat(filepath.Join(root, path))
+				testutil.CheckErrorAndDeepEqual(t, false, err, os.FileMode(0644), fi.Mode())
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, len(test.expected), len(cmd.FilesToSnapshot()))
+		})
+	}
+}
+
+func TestCopyCommand_Hardlinks(t *testing.T) {
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	if err := testutil.SetupFiles(buildcontext, map[string]string{
+		"tree/original": "linked",
+		"tree/other":    "not linked",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"tree/link", "tree/sub/link"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(buildcontext, link)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(buildcontext, "tree/original"), filepath.Join(buildcontext, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nCOPY tree /app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &CopyCommand{cmd: stages[0].Commands[0].(*dockerfile.CopyCommand), buildcontext: buildcontext}
+	cmd.SetRoot(root)
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are added to the layer like the snapshotter adds them
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	hardlinks := map[util.FileID]string{}
+	for _, f := range cmd.FilesToSnapshot() {
+		fi, err := os.Lstat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.AddToTar(f, fi, hardlinks, w, util.TarOptions{Root: root}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var first string
+	links := map[string]string{}
+	contents := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			links[hdr.Name] = hdr.Linkname
+		case tar.TypeReg:
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(b)
+			if string(b) == "linked" {
+				first = hdr.Name
+			}
+		}
+	}
+	// Only the first of the linked files has its contents in the layer, and the others link to it
+	linked := map[string]bool{"/app/original": true, "/app/link": true, "/app/sub/link": true}
+	if !linked[first] {
+		t.Fatalf("expected one of %v to be the file the others link to, got %q", linked, first)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{first: "linked", "/app/other": "not linked"}, contents)
+	expectedLinks := map[string]string{}
+	for name := range linked {
+		if name != first {
+			expectedLinks[name] = first
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedLinks, links)
+}
+
+func TestCopyCommand_BuildContext(t *testing.T) {
+	context, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(context)
+	if err := testutil.SetupFiles(context, map[string]string{"assets/logo": "logo"}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nCOPY --from=assets assets/logo /logo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dockerfile.ResolveBuildContexts(stages, map[string]dockerfile.BuildContext{"assets": {Dir: context}}); err != nil {
+		t.Fatal(err)
+	}
+	// The files are copied from the directory of the context, not the build context
+	cmd := &CopyCommand{cmd: stages[0].Commands[0].(*dockerfile.CopyCommand), buildcontext: "/missing"}
+	cmd.SetRoot(root)
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(root, "logo"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "logo", string(contents))
+}
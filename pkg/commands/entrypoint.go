@@ -23,33 +23,34 @@ import (
 
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type EntrypointCommand struct {
 	cmd *instructions.EntrypointCommand
+	// cmdSet is true if CMD was set earlier in the stage
+	cmdSet bool
+}
+
+// SetCmdSet sets whether CMD was set earlier in the stage. Like docker, ENTRYPOINT clears the CMD
+// inherited from the base image, or set by an earlier stage, unless it was.
+func (e *EntrypointCommand) SetCmdSet(cmdSet bool) {
+	e.cmdSet = cmdSet
 }
 
 // ExecuteCommand handles command processing similar to CMD and RUN,
 func (e *EntrypointCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: ENTRYPOINT")
-	var newCommand []string
+	logger.Info("cmd: ENTRYPOINT")
+	newCommand := e.cmd.CmdLine
 	if e.cmd.PrependShell {
-		// This is the default shell on Linux
-		var shell []string
-		if len(config.Shell) > 0 {
-			shell = config.Shell
-		} else {
-			shell = append(shell, "/bin/sh", "-c")
-		}
-
-		newCommand = append(shell, strings.Join(e.cmd.CmdLine, " "))
-	} else {
-		newCommand = e.cmd.CmdLine
+		newCommand = withShell(config, e.cmd.CmdLine)
 	}
 
-	logrus.Infof("Replacing Entrypoint in config with %v", newCommand)
+	logger.Infof("Replacing Entrypoint in config with %v", newCommand)
 	config.Entrypoint = newCommand
+	if !e.cmdSet && config.Cmd != nil {
+		logger.Infof("Clearing CMD %v, since it isn't set in the stage before ENTRYPOINT", config.Cmd)
+		config.Cmd = nil
+	}
 	return nil
 }
 
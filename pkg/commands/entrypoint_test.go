@@ -48,7 +48,7 @@ func TestEntrypointExecuteCmd(t *testing.T) {
 
 	for _, test := range entrypointTests {
 		cmd := EntrypointCommand{
-			&instructions.EntrypointCommand{
+			cmd: &instructions.EntrypointCommand{
 				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
 					PrependShell: test.prependShell,
 					CmdLine:      test.cmdLine,
@@ -59,3 +59,103 @@ func TestEntrypointExecuteCmd(t *testing.T) {
 		testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedCmd, cfg.Entrypoint)
 	}
 }
+
+func newCmdCommand(prependShell bool, cmdLine ...string) DockerCommand {
+	return &CmdCommand{
+		cmd: &instructions.CmdCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{PrependShell: prependShell, CmdLine: cmdLine},
+		},
+	}
+}
+
+func newEntrypointCommand(prependShell bool, cmdLine ...string) DockerCommand {
+	return &EntrypointCommand{
+		cmd: &instructions.EntrypointCommand{
+			ShellDependantCmdLine: instructions.ShellDependantCmdLine{PrependShell: prependShell, CmdLine: cmdLine},
+		},
+	}
+}
+
+// Each test runs the commands of a stage, which start from the config of its base image
+func TestEntrypointResetsCmd(t *testing.T) {
+	tests := []struct {
+		name               string
+		config             v1.Config
+		commands           []DockerCommand
+		expectedCmd        []string
+		expectedEntrypoint []string
+	}{
+		{
+			name:        "cmd is inherited",
+			config:      v1.Config{Cmd: []string{"inherited"}},
+			expectedCmd: []string{"inherited"},
+		},
+		{
+			name:               "entrypoint clears the inherited cmd",
+			config:             v1.Config{Cmd: []string{"inherited"}, Entrypoint: []string{"old"}},
+			commands:           []DockerCommand{newEntrypointCommand(false, "new")},
+			expectedEntrypoint: []string{"new"},
+		},
+		{
+			name:               "entrypoint keeps a cmd set before it",
+			config:             v1.Config{Cmd: []string{"inherited"}},
+			commands:           []DockerCommand{newCmdCommand(false, "cmd"), newEntrypointCommand(false, "entrypoint")},
+			expectedCmd:        []string{"cmd"},
+			expectedEntrypoint: []string{"entrypoint"},
+		},
+		{
+			name:               "cmd after entrypoint",
+			config:             v1.Config{Cmd: []string{"inherited"}},
+			commands:           []DockerCommand{newEntrypointCommand(false, "entrypoint"), newCmdCommand(false, "cmd")},
+			expectedCmd:        []string{"cmd"},
+			expectedEntrypoint: []string{"entrypoint"},
+		},
+		{
+			name:               "empty cmd before entrypoint isn't kept",
+			config:             v1.Config{Cmd: []string{"inherited"}},
+			commands:           []DockerCommand{newCmdCommand(false), newEntrypointCommand(false, "entrypoint")},
+			expectedEntrypoint: []string{"entrypoint"},
+		},
+		{
+			name:     "empty entrypoint clears the inherited cmd",
+			config:   v1.Config{Cmd: []string{"inherited"}, Entrypoint: []string{"old"}},
+			commands: []DockerCommand{newEntrypointCommand(false)},
+		},
+		{
+			name:               "shell form uses the shell",
+			config:             v1.Config{Shell: []string{"/bin/bash", "-eu", "-c"}},
+			commands:           []DockerCommand{newCmdCommand(true, "echo", "cmd"), newEntrypointCommand(true, "echo", "entrypoint")},
+			expectedCmd:        []string{"/bin/bash", "-eu", "-c", "echo cmd"},
+			expectedEntrypoint: []string{"/bin/bash", "-eu", "-c", "echo entrypoint"},
+		},
+		{
+			name:               "exec form entrypoint with shell form cmd",
+			commands:           []DockerCommand{newEntrypointCommand(false, "/entrypoint.sh"), newCmdCommand(true, "echo", "cmd")},
+			expectedCmd:        []string{"/bin/sh", "-c", "echo cmd"},
+			expectedEntrypoint: []string{"/entrypoint.sh"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The shell's backing array has room for more, which the commands mustn't share
+			if test.config.Shell != nil {
+				test.config.Shell = append(make([]string, 0, 10), test.config.Shell...)
+			}
+			cfg := test.config
+			cmdSet := false
+			for _, c := range test.commands {
+				switch c := c.(type) {
+				case *CmdCommand:
+					cmdSet = cmdSet || c.SetsCmd()
+				case *EntrypointCommand:
+					c.SetCmdSet(cmdSet)
+				}
+				if err := c.ExecuteCommand(&cfg, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedCmd, cfg.Cmd)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedEntrypoint, cfg.Entrypoint)
+		})
+	}
+}
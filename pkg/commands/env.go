@@ -24,18 +24,18 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type EnvCommand struct {
-	cmd *instructions.EnvCommand
+	cmd    *instructions.EnvCommand
+	escape rune
 }
 
 func (e *EnvCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: ENV")
+	logger.Info("cmd: ENV")
 	newEnvs := e.cmd.Env
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	return util.UpdateConfigEnv(newEnvs, config, replacementEnvs)
+	return util.UpdateConfigEnv(newEnvs, config, replacementEnvs, e.escape)
 }
 
 // We know that no files have changed, so return an empty array
@@ -33,7 +33,7 @@ func Test_EnvExecute(t *testing.T) {
 	}
 
 	envCmd := &EnvCommand{
-		&instructions.EnvCommand{
+		cmd: &instructions.EnvCommand{
 			Env: []instructions.KeyValuePair{
 				{
 					Key:   "path",
@@ -77,3 +77,97 @@ func setUpBuildArgs() *dockerfile.BuildArgs {
 	buildArgs.AddArg("buildArg2", &d)
 	return buildArgs
 }
+
+func Test_EnvExecute_Dockerfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		dockerfile  string
+		expectedEnv []string
+	}{
+		{
+			name:        "multiple pairs",
+			dockerfile:  `ENV A=1 B="two words" C=3`,
+			expectedEnv: []string{"A=1", "B=two words", "C=3"},
+		},
+		{
+			name:        "escaped characters",
+			dockerfile:  `ENV A="a \"quoted\" word" B=back\ slash C=\$HOME`,
+			expectedEnv: []string{`A=a "quoted" word`, "B=back slash", "C=$HOME"},
+		},
+		{
+			name:        "single quotes aren't expanded",
+			dockerfile:  "ENV HOME=/root\nENV A='$HOME is home' B=\"$HOME is home\"",
+			expectedEnv: []string{"HOME=/root", "A=$HOME is home", "B=/root is home"},
+		},
+		{
+			name:        "legacy form",
+			dockerfile:  "ENV A value with spaces",
+			expectedEnv: []string{"A=value with spaces"},
+		},
+		{
+			name:        "legacy form with quotes",
+			dockerfile:  `ENV A "quoted value"`,
+			expectedEnv: []string{"A=quoted value"},
+		},
+		{
+			name:        "line continuations",
+			dockerfile:  "ENV A=1 \\\n    B=\"two words\" \\\n    C=3",
+			expectedEnv: []string{"A=1", "B=two words", "C=3"},
+		},
+		{
+			name:        "same line references see the value from before the instruction",
+			dockerfile:  "ENV X=old\nENV X=new Y=$X Z=${X}-z",
+			expectedEnv: []string{"X=new", "Y=old", "Z=old-z"},
+		},
+		{
+			name:        "same line references to new variables are empty",
+			dockerfile:  "ENV A=1 B=$A",
+			expectedEnv: []string{"A=1", "B="},
+		},
+		{
+			name:        "later pairs replace earlier ones",
+			dockerfile:  "ENV A=1 A=2",
+			expectedEnv: []string{"A=2"},
+		},
+		{
+			name:        "empty values",
+			dockerfile:  `ENV A= B="" C=3`,
+			expectedEnv: []string{"A=", "B=", "C=3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := dockerfile.Parse([]byte("FROM scratch\n" + test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &v1.Config{}
+			buildArgs := dockerfile.NewBuildArgs(nil)
+			for _, c := range stages[0].Commands {
+				if err := (&EnvCommand{cmd: c.(*instructions.EnvCommand)}).ExecuteCommand(cfg, buildArgs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedEnv, cfg.Env)
+		})
+	}
+}
+
+func Test_EnvExecute_KeepsInstruction(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nENV A='$B' B=\"two words\""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envCmd := &EnvCommand{cmd: stages[0].Commands[0].(*instructions.EnvCommand)}
+	createdBy := envCmd.CreatedBy()
+
+	// Executing the instruction again shouldn't expand what was expanded the first time
+	cfg := &v1.Config{Env: []string{"B=other"}}
+	for i := 0; i < 2; i++ {
+		if err := envCmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil)); err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"B=two words", "A=$B"}, cfg.Env)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, createdBy, envCmd.CreatedBy())
+}
@@ -25,15 +25,15 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type ExposeCommand struct {
-	cmd *instructions.ExposeCommand
+	cmd    *instructions.ExposeCommand
+	escape rune
 }
 
 func (r *ExposeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: EXPOSE")
+	logger.Info("cmd: EXPOSE")
 	// Grab the currently exposed ports
 	existingPorts := config.ExposedPorts
 	if existingPorts == nil {
@@ -43,7 +43,7 @@ func (r *ExposeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.
 	// Add any new ones in
 	for _, p := range r.cmd.Ports {
 		// Resolve any environment variables
-		p, err := util.ResolveEnvironmentReplacement(p, replacementEnvs, false)
+		p, err := util.ResolveEnvironmentReplacement(p, replacementEnvs, r.escape, false)
 		if err != nil {
 			return err
 		}
@@ -55,7 +55,7 @@ func (r *ExposeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.
 		if !validProtocol(protocol) {
 			return fmt.Errorf("Invalid protocol: %s", protocol)
 		}
-		logrus.Infof("Adding exposed port: %s", p)
+		logger.Infof("Adding exposed port: %s", p)
 		existingPorts[p] = struct{}{}
 	}
 	config.ExposedPorts = existingPorts
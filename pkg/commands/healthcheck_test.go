@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func TestExecuteHealthCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		instruction  string
+		expectedJSON string
+	}{
+		{
+			name:         "shell form with options",
+			instruction:  "HEALTHCHECK --interval=5m --timeout=3s --start-period=10s --retries=3 CMD curl -f http://localhost/ || exit 1",
+			expectedJSON: `{"Test":["CMD-SHELL","curl -f http://localhost/ || exit 1"],"Interval":300000000000,"Timeout":3000000000,"StartPeriod":10000000000,"Retries":3}`,
+		},
+		{
+			name:         "exec form",
+			instruction:  `HEALTHCHECK CMD ["/bin/check", "--quiet"]`,
+			expectedJSON: `{"Test":["CMD","/bin/check","--quiet"]}`,
+		},
+		{
+			name:         "none",
+			instruction:  "HEALTHCHECK NONE",
+			expectedJSON: `{"Test":["NONE"]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := dockerfile.Parse([]byte("FROM scratch\n" + test.instruction))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := &HealthCheckCommand{cmd: stages[0].Commands[0].(*instructions.HealthCheckCommand)}
+			cfg := &v1.Config{}
+			if err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil)); err != nil {
+				t.Fatal(err)
+			}
+			actual, err := json.Marshal(cfg.Healthcheck)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedJSON, string(actual))
+		})
+	}
+}
@@ -24,19 +24,19 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type LabelCommand struct {
-	cmd *instructions.LabelCommand
+	cmd    *instructions.LabelCommand
+	escape rune
 }
 
 func (r *LabelCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: LABEL")
-	return updateLabels(r.cmd.Labels, config, buildArgs)
+	logger.Info("cmd: LABEL")
+	return updateLabels(r.cmd.Labels, config, buildArgs, r.escape)
 }
 
-func updateLabels(labels []instructions.KeyValuePair, config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+func updateLabels(labels []instructions.KeyValuePair, config *v1.Config, buildArgs *dockerfile.BuildArgs, escape rune) error {
 	existingLabels := config.Labels
 	if existingLabels == nil {
 		existingLabels = make(map[string]string)
@@ -44,11 +44,11 @@ func updateLabels(labels []instructions.KeyValuePair, config *v1.Config, buildAr
 	// Let's unescape values before setting the label
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 	for index, kvp := range labels {
-		key, err := util.ResolveEnvironmentReplacement(kvp.Key, replacementEnvs, false)
+		key, err := util.ResolveEnvironmentReplacement(kvp.Key, replacementEnvs, escape, false)
 		if err != nil {
 			return err
 		}
-		unescaped, err := util.ResolveEnvironmentReplacement(kvp.Value, replacementEnvs, false)
+		unescaped, err := util.ResolveEnvironmentReplacement(kvp.Value, replacementEnvs, escape, false)
 		if err != nil {
 			return err
 		}
@@ -58,7 +58,7 @@ func updateLabels(labels []instructions.KeyValuePair, config *v1.Config, buildAr
 		}
 	}
 	for _, kvp := range labels {
-		logrus.Infof("Applying label %s=%s", kvp.Key, kvp.Value)
+		logger.Infof("Applying label %s=%s", kvp.Key, kvp.Value)
 		existingLabels[kvp.Key] = kvp.Value
 	}
 
@@ -68,6 +68,6 @@ func TestUpdateLabels(t *testing.T) {
 		"backslashes":     "lots\\ of\\ words",
 		"build_arg_label": "foo",
 	}
-	updateLabels(labels, cfg, buildArgs)
+	updateLabels(labels, cfg, buildArgs, 0)
 	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedLabels, cfg.Labels)
 }
@@ -20,7 +20,6 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type OnBuildCommand struct {
@@ -29,8 +28,8 @@ type OnBuildCommand struct {
 
 //ExecuteCommand adds the specified expression in Onbuild to the config
 func (o *OnBuildCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: ONBUILD")
-	logrus.Infof("args: %s", o.cmd.Expression)
+	logger.Info("cmd: ONBUILD")
+	logger.Infof("args: %s", o.cmd.Expression)
 	if config.OnBuild == nil {
 		config.OnBuild = []string{o.cmd.Expression}
 	} else {
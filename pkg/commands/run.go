@@ -17,9 +17,12 @@ limitations under the License.
 package commands
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -28,41 +31,47 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
-	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 type RunCommand struct {
-	cmd *instructions.RunCommand
+	cmd           *dockerfile.RunCommand
+	mountCacheDir string
+	secrets       map[string]util.Secret
+	secretsDir    string
+	network       string
+	limits        util.RunLimits
 }
 
-func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	var newCommand []string
+func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) (err error) {
+	newCommand := r.cmd.CmdLine
 	if r.cmd.PrependShell {
-		// This is the default shell on Linux
-		var shell []string
-		if len(config.Shell) > 0 {
-			shell = config.Shell
-		} else {
-			shell = append(shell, "/bin/sh", "-c")
-		}
-
-		newCommand = append(shell, strings.Join(r.cmd.CmdLine, " "))
-	} else {
-		newCommand = r.cmd.CmdLine
+		newCommand = withShell(config, r.cmd.CmdLine)
 	}
 
-	logrus.Infof("cmd: %s", newCommand[0])
-	logrus.Infof("args: %s", newCommand[1:])
+	logger.Infof("cmd: %s", newCommand[0])
+	logger.Infof("args: %s", newCommand[1:])
+
+	for _, m := range r.cmd.Mounts {
+		unmount, mountErr := r.mount(m, config.WorkingDir)
+		if mountErr != nil {
+			return mountErr
+		}
+		// The mounts have to be removed before the filesystem is snapshotted
+		defer func() {
+			if unmountErr := unmount(); unmountErr != nil && err == nil {
+				err = unmountErr
+			}
+		}()
+	}
 
-	cmd := exec.Command(newCommand[0], newCommand[1:]...)
-	cmd.Dir = config.WorkingDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	cmd.Env = addDefaultHOME(config.User, replacementEnvs)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	env := addDefaultHOME(config.User, replacementEnvs)
+	sysProcAttr := &syscall.SysProcAttr{Setpgid: true}
+	if r.network == constants.RunNetworkNone {
+		// A new network namespace only has a loopback interface, which is down, so nothing can be reached
+		sysProcAttr.Cloneflags = syscall.CLONE_NEWNET
+	}
 
 	// If specified, run the command as a specific user
 	if config.User != "" {
@@ -92,11 +101,50 @@ func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 			}
 			gid = uint32(gid64)
 		}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+		sysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	// A command can only be started once, so a new one is made if it has to be started again
+	newCmd := func() *exec.Cmd {
+		cmd := exec.Command(newCommand[0], newCommand[1:]...)
+		cmd.Dir = config.WorkingDir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = env
+		attr := *sysProcAttr
+		cmd.SysProcAttr = &attr
+		return cmd
 	}
 
-	if err := cmd.Start(); err != nil {
-		return errors.Wrap(err, "starting command")
+	// The limits are left out with a warning if they can't be applied, instead of failing the build
+	var cgroup *util.Cgroup
+	if r.limits.Set() {
+		var cgroupErr error
+		if cgroup, cgroupErr = util.NewCgroup(r.limits); cgroupErr != nil {
+			logger.Warnf("Running the command without --run-memory-limit and --run-cpu-limit, which can't be applied: %v", cgroupErr)
+			cgroup = nil
+		} else {
+			defer func() {
+				if removeErr := cgroup.Remove(); removeErr != nil {
+					logger.Warnf("Error removing the cgroup the command ran in: %v", removeErr)
+				}
+			}()
+		}
+	}
+
+	var cmd *exec.Cmd
+	var startErr error
+	if cgroup != nil {
+		// The command is started in the cgroup, so nothing it forks can escape the limits
+		cmd, startErr = cgroup.Start(newCmd)
+	} else {
+		cmd = newCmd()
+		startErr = cmd.Start()
+	}
+	if startErr != nil {
+		if r.network == constants.RunNetworkNone && os.IsPermission(startErr) {
+			return errors.Wrapf(startErr, "starting command without network access: --run-network=%s needs the privileges to create a network namespace, like CAP_SYS_ADMIN", constants.RunNetworkNone)
+		}
+		return errors.Wrap(startErr, "starting command")
 	}
 
 	pgid, err := syscall.Getpgid(cmd.Process.Pid)
@@ -104,6 +152,9 @@ func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 		return errors.Wrap(err, "getting group id for process")
 	}
 	if err := cmd.Wait(); err != nil {
+		if cgroup != nil && cgroup.OOMKilled() {
+			return errors.Wrapf(err, "the command was killed for using more than the --run-memory-limit of %d bytes", r.limits.Memory)
+		}
 		return errors.Wrap(err, "waiting for process to exit")
 	}
 
@@ -115,6 +166,78 @@ func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	return nil
 }
 
+// mount makes m available for the command to use
+func (r *RunCommand) mount(m dockerfile.Mount, workdir string) (func() error, error) {
+	target := m.Target
+	if !filepath.IsAbs(target) {
+		if workdir == "" {
+			workdir = constants.RootDir
+		}
+		target = filepath.Join(workdir, target)
+	}
+	switch m.Type {
+	case dockerfile.MountTypeCache:
+		if r.mountCacheDir == "" {
+			return nil, errors.New("a --mount-cache-dir is required for RUN --mount=type=cache")
+		}
+		cacheDir := filepath.Join(r.mountCacheDir, mountDirName(m.ID))
+		if !util.FilepathExists(cacheDir) {
+			if err := os.MkdirAll(cacheDir, m.Mode); err != nil {
+				return nil, errors.Wrapf(err, "creating cache %s", m.ID)
+			}
+			if err := os.Chown(cacheDir, m.UID, m.GID); err != nil {
+				return nil, errors.Wrapf(err, "creating cache %s", m.ID)
+			}
+		}
+		logger.Infof("Mounting cache %s at %s", m.ID, target)
+		return util.MountPath(cacheDir, target)
+	case dockerfile.MountTypeSecret:
+		return r.mountSecret(m, target)
+	}
+	return nil, errors.Errorf("unsupported mount type %s", m.Type)
+}
+
+// mountSecret writes the secret for m to the secrets directory, and mounts it at target. The file
+// is removed when the secret is unmounted.
+func (r *RunCommand) mountSecret(m dockerfile.Mount, target string) (func() error, error) {
+	secret, ok := r.secrets[m.ID]
+	if !ok {
+		if m.Required {
+			return nil, errors.Errorf("secret %s is required, but wasn't given with --secret", m.ID)
+		}
+		logger.Warnf("Secret %s wasn't given with --secret, not mounting it at %s", m.ID, target)
+		return func() error { return nil }, nil
+	}
+	contents, err := secret.Contents()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(r.secretsDir, 0700); err != nil {
+		return nil, err
+	}
+	secretPath := filepath.Join(r.secretsDir, mountDirName(m.Target))
+	if err := util.CreateFile(secretPath, bytes.NewReader(contents), m.Mode, uint32(m.UID), uint32(m.GID)); err != nil {
+		return nil, errors.Wrapf(err, "writing secret %s", m.ID)
+	}
+	logger.Infof("Mounting secret %s at %s", m.ID, target)
+	unmount, err := util.MountPath(secretPath, target)
+	if err != nil {
+		os.Remove(secretPath)
+		return nil, err
+	}
+	return func() error {
+		if err := unmount(); err != nil {
+			return err
+		}
+		return os.Remove(secretPath)
+	}, nil
+}
+
+// mountDirName returns a name for the files backing a mount, since ids and targets can be any string
+func mountDirName(id string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(id)))
+}
+
 // addDefaultHOME adds the default value for HOME if it isn't already set
 func addDefaultHOME(user string, envs []string) []string {
 	for _, env := range envs {
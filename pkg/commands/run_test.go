@@ -16,9 +16,28 @@ limitations under the License.
 package commands
 
 import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/snapshot"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"golang.org/x/sys/unix"
 )
 
 func Test_addDefaultHOME(t *testing.T) {
@@ -70,3 +89,376 @@ func Test_addDefaultHOME(t *testing.T) {
 		})
 	}
 }
+
+func TestRunCommand_CacheMount(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	root := filepath.Join(testDir, "root")
+	cacheDir := filepath.Join(testDir, "cache")
+	if err := testutil.SetupFiles(root, map[string]string{"var/cache/existing": "existing"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshotter := snapshot.NewSnapshotter(snapshot.NewLayeredMap(util.Hasher()), root, util.TarOptions{})
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(root, "var/cache")
+	script := fmt.Sprintf("echo cached > %s/cached && echo kept > %s/kept", target, root)
+	cmd := &RunCommand{
+		cmd: &dockerfile.RunCommand{
+			RunCommand: &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{script},
+					PrependShell: true,
+				},
+			},
+			Mounts: []dockerfile.Mount{
+				{Type: dockerfile.MountTypeCache, ID: "cache", Target: target},
+			},
+		},
+		mountCacheDir: cacheDir,
+	}
+	// Run twice, to make sure the cache is reused
+	for i := 0; i < 2; i++ {
+		if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	// Only the file written outside of the cache should be in the layer
+	sort.Strings(names)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{root, filepath.Join(root, "kept")}, names)
+
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*", "cached"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(cached))
+	existing, err := ioutil.ReadFile(filepath.Join(target, "existing"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "existing", string(existing))
+}
+
+func TestRunCommand_SecretMount(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	root := filepath.Join(testDir, "root")
+	secretsDir := filepath.Join(testDir, "secrets")
+	if err := testutil.SetupFiles(testDir, map[string]string{"root/existing": "existing", "token": "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshotter := snapshot.NewSnapshotter(snapshot.NewLayeredMap(util.Hasher()), root, util.TarOptions{})
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(root, "run/secrets/token")
+	cmd := &RunCommand{
+		cmd: &dockerfile.RunCommand{
+			RunCommand: &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{fmt.Sprintf("cat %s > %s/kept", target, root)},
+					PrependShell: true,
+				},
+			},
+			Mounts: []dockerfile.Mount{
+				{Type: dockerfile.MountTypeSecret, ID: "token", Target: target, Mode: 0400},
+			},
+		},
+		secrets:    map[string]util.Secret{"token": {ID: "token", Src: filepath.Join(testDir, "token")}},
+		secretsDir: secretsDir,
+	}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	// The secret and its parent directories shouldn't be in the layer. Layers are only in order with --reproducible.
+	sort.Strings(names)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{root, filepath.Join(root, "kept")}, names)
+
+	kept, err := ioutil.ReadFile(filepath.Join(root, "kept"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "hunter2", string(kept))
+	written, err := ioutil.ReadDir(secretsDir)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 0, len(written))
+}
+
+func TestRunCommand_MissingSecret(t *testing.T) {
+	tests := []struct {
+		name        string
+		required    bool
+		shouldError bool
+	}{
+		{
+			name:     "optional secret is skipped",
+			required: false,
+		},
+		{
+			name:        "required secret errors",
+			required:    true,
+			shouldError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := &RunCommand{
+				cmd: &dockerfile.RunCommand{
+					RunCommand: &instructions.RunCommand{
+						ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+							CmdLine:      []string{"true"},
+							PrependShell: true,
+						},
+					},
+					Mounts: []dockerfile.Mount{
+						{Type: dockerfile.MountTypeSecret, ID: "token", Target: "/run/secrets/token", Required: test.required},
+					},
+				},
+			}
+			err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil))
+			testutil.CheckError(t, test.shouldError, err)
+		})
+	}
+}
+
+func TestRunCommand_Shell(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash isn't installed")
+	}
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	output := filepath.Join(testDir, "output")
+
+	cmd := &RunCommand{
+		cmd: &dockerfile.RunCommand{
+			RunCommand: &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					// BASH_VERSION is only set when the command is run by bash
+					CmdLine:      []string{fmt.Sprintf("test -n \"$BASH_VERSION\" && echo bash > %s", output)},
+					PrependShell: true,
+				},
+			},
+		},
+	}
+	cfg := &v1.Config{Shell: []string{bash, "-c"}}
+	if err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(output)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "bash\n", string(contents))
+}
+
+func TestRunCommand_Heredoc(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	script := filepath.Join(testDir, "script")
+	input := filepath.Join(testDir, "input")
+	stages, err := dockerfile.Parse([]byte(fmt.Sprintf(`FROM scratch
+RUN <<EOF
+echo one > %[1]s
+echo two >> %[1]s
+EOF
+RUN cat <<'EOF' > %[2]s
+$HOME
+EOF
+`, script, input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range stages[0].Commands {
+		cmd := &RunCommand{cmd: c.(*dockerfile.RunCommand)}
+		if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every line of the script is run, not just the first
+	contents, err := ioutil.ReadFile(script)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "one\ntwo\n", string(contents))
+	// The shell doesn't expand a quoted heredoc
+	contents, err = ioutil.ReadFile(input)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "$HOME\n", string(contents))
+}
+
+func TestRunCommand_NetworkNone(t *testing.T) {
+	curl, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl isn't installed")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	run := func(network string) error {
+		cmd := &RunCommand{
+			cmd: &dockerfile.RunCommand{
+				RunCommand: &instructions.RunCommand{
+					ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+						CmdLine:      []string{fmt.Sprintf("%s -sf --max-time 5 %s", curl, server.URL)},
+						PrependShell: true,
+					},
+				},
+			},
+			network: network,
+		}
+		return cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil))
+	}
+
+	if err := run(constants.RunNetworkHost); err != nil {
+		t.Fatalf("the address can't be reached with the host network: %v", err)
+	}
+	err = run(constants.RunNetworkNone)
+	if os.Geteuid() != 0 {
+		// Only the error about the missing privileges is expected then
+		testutil.CheckError(t, true, err)
+		if err != nil && !strings.Contains(err.Error(), "--run-network=none needs the privileges") {
+			t.Errorf("the error doesn't say why the command couldn't start: %v", err)
+		}
+		return
+	}
+	if err != nil && strings.Contains(err.Error(), "needs the privileges") {
+		t.Skipf("network namespaces can't be created here: %v", err)
+	}
+	testutil.CheckError(t, true, err)
+}
+
+func TestRunCommand_MemoryLimit(t *testing.T) {
+	limits := util.RunLimits{Memory: 16 * 1024 * 1024}
+	run := func(limits util.RunLimits) error {
+		cmd := &RunCommand{
+			cmd: &dockerfile.RunCommand{
+				RunCommand: &instructions.RunCommand{
+					ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+						// Hold 64MB in memory
+						CmdLine:      []string{`x=$(head -c 67108864 /dev/zero | tr '\0' a); echo ${#x}`},
+						PrependShell: true,
+					},
+				},
+			},
+			limits: limits,
+		}
+		return cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil))
+	}
+
+	if err := run(util.RunLimits{}); err != nil {
+		t.Fatalf("the command failed without a limit: %v", err)
+	}
+	if reason := cgroupV2Unwritable(); reason != "" {
+		// The command still runs, just without the limit
+		if err := run(limits); err != nil {
+			t.Errorf("the command failed when the limit couldn't be applied: %v", err)
+		}
+		t.Skip(reason)
+	}
+	cgroup, err := util.NewCgroup(limits)
+	if err != nil {
+		t.Skipf("cgroups with limits can't be created here: %v", err)
+	}
+	cgroup.Remove()
+	err = run(limits)
+	testutil.CheckError(t, true, err)
+	if err != nil && !strings.Contains(err.Error(), "--run-memory-limit") {
+		t.Errorf("the error doesn't say the command ran out of memory: %v", err)
+	}
+}
+
+func TestRunCommand_CgroupChildren(t *testing.T) {
+	if reason := cgroupV2Unwritable(); reason != "" {
+		t.Skip(reason)
+	}
+	limits := util.RunLimits{CPUs: 1}
+	cgroup, err := util.NewCgroup(limits)
+	if err != nil {
+		t.Skipf("cgroups with limits can't be created here: %v", err)
+	}
+	cgroup.Remove()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A process forked as soon as the command starts is in the cgroup too
+	out := filepath.Join(dir, "cgroup")
+	cmd := &RunCommand{
+		cmd: &dockerfile.RunCommand{
+			RunCommand: &instructions.RunCommand{
+				ShellDependantCmdLine: instructions.ShellDependantCmdLine{
+					CmdLine:      []string{fmt.Sprintf("cat /proc/self/cgroup > %s & wait", out)},
+					PrependShell: true,
+				},
+			},
+		},
+		limits: limits,
+	}
+	if err := cmd.ExecuteCommand(&v1.Config{}, dockerfile.NewBuildArgs(nil)); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "/kaniko-run") {
+		t.Errorf("the forked process wasn't in the cgroup of the command: %s", contents)
+	}
+}
+
+// cgroupV2Unwritable returns why cgroups v2 can't be created under the cgroup the test runs in, or an
+// empty string if they can
+func cgroupV2Unwritable() string {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return "cgroups v2 aren't mounted at /sys/fs/cgroup"
+	}
+	contents, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return err.Error()
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			dir := filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(line, "0::"))
+			if err := unix.Access(dir, unix.W_OK); err != nil {
+				return fmt.Sprintf("cgroup %s isn't writable: %v", dir, err)
+			}
+			return ""
+		}
+	}
+	return "the test isn't in a cgroup v2"
+}
@@ -22,7 +22,6 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type ShellCommand struct {
@@ -31,16 +30,27 @@ type ShellCommand struct {
 
 // ExecuteCommand handles command processing similar to CMD and RUN,
 func (s *ShellCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: SHELL")
+	logger.Info("cmd: SHELL")
 	var newShell []string
 
 	newShell = s.cmd.Shell
 
-	logrus.Infof("Replacing Shell in config with %v", newShell)
+	logger.Infof("Replacing Shell in config with %v", newShell)
 	config.Shell = newShell
 	return nil
 }
 
+// withShell returns the shell form of cmdLine, run with the shell set by SHELL, or /bin/sh -c by default.
+// The shell is copied, so the commands using it don't share the shell in config.
+func withShell(config *v1.Config, cmdLine []string) []string {
+	// This is the default shell on Linux
+	shell := []string{"/bin/sh", "-c"}
+	if len(config.Shell) > 0 {
+		shell = append([]string{}, config.Shell...)
+	}
+	return append(shell, strings.Join(cmdLine, " "))
+}
+
 // FilesToSnapshot returns an empty array since this is a metadata command
 func (s *ShellCommand) FilesToSnapshot() []string {
 	return []string{}
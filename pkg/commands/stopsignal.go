@@ -24,20 +24,21 @@ import (
 	"github.com/docker/docker/pkg/signal"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 type StopSignalCommand struct {
-	cmd *instructions.StopSignalCommand
+	cmd    *instructions.StopSignalCommand
+	escape rune
 }
 
 // ExecuteCommand handles command processing similar to CMD and RUN,
 func (s *StopSignalCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: STOPSIGNAL")
+	logger.Info("cmd: STOPSIGNAL")
 
 	// resolve possible environment variables
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	resolvedEnvs, err := util.ResolveEnvironmentReplacementList([]string{s.cmd.Signal}, replacementEnvs, false)
+	resolvedEnvs, err := util.ResolveEnvironmentReplacementList([]string{s.cmd.Signal}, replacementEnvs, s.escape, false)
 	if err != nil {
 		return err
 	}
@@ -46,10 +47,10 @@ func (s *StopSignalCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerf
 	// validate stopsignal
 	_, err = signal.ParseSignal(stopsignal)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "invalid STOPSIGNAL %s", s.cmd.Signal)
 	}
 
-	logrus.Infof("Replacing StopSignal in config with %v", stopsignal)
+	logger.Infof("Replacing StopSignal in config with %v", stopsignal)
 	config.StopSignal = stopsignal
 	return nil
 }
@@ -51,7 +51,7 @@ func TestStopsignalExecuteCmd(t *testing.T) {
 
 	for _, test := range stopsignalTests {
 		cmd := StopSignalCommand{
-			&instructions.StopSignalCommand{
+			cmd: &instructions.StopSignalCommand{
 				Signal: test.signal,
 			},
 		}
@@ -60,3 +60,16 @@ func TestStopsignalExecuteCmd(t *testing.T) {
 		testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedSignal, cfg.StopSignal)
 	}
 }
+
+func TestStopsignalExecuteCmd_Invalid(t *testing.T) {
+	cfg := &v1.Config{
+		Env: []string{"STOPSIG=SIGNOPE"},
+	}
+	cmd := StopSignalCommand{
+		cmd: &instructions.StopSignalCommand{
+			Signal: "${STOPSIG}",
+		},
+	}
+	err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+	testutil.CheckError(t, true, err)
+}
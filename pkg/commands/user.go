@@ -23,25 +23,25 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type UserCommand struct {
-	cmd *instructions.UserCommand
+	cmd    *instructions.UserCommand
+	escape rune
 }
 
 func (r *UserCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: USER")
+	logger.Info("cmd: USER")
 	u := r.cmd.User
 	userAndGroup := strings.Split(u, ":")
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	userStr, err := util.ResolveEnvironmentReplacement(userAndGroup[0], replacementEnvs, false)
+	userStr, err := util.ResolveEnvironmentReplacement(userAndGroup[0], replacementEnvs, r.escape, false)
 	if err != nil {
 		return err
 	}
 	var groupStr string
 	if len(userAndGroup) > 1 {
-		groupStr, err = util.ResolveEnvironmentReplacement(userAndGroup[1], replacementEnvs, false)
+		groupStr, err = util.ResolveEnvironmentReplacement(userAndGroup[1], replacementEnvs, r.escape, false)
 		if err != nil {
 			return err
 		}
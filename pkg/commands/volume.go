@@ -18,6 +18,8 @@ package commands
 
 import (
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -25,44 +27,50 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 )
 
 type VolumeCommand struct {
 	cmd           *instructions.VolumeCommand
+	escape        rune
 	snapshotFiles []string
+	// root is the directory the volumes are created under, or "" for the root of the filesystem
+	root string
 }
 
+// ExecuteCommand adds the volumes to the config, and creates their directories. Like docker, relative
+// volumes are relative to the working directory, and the directories are owned by root.
 func (v *VolumeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: VOLUME")
+	logger.Info("cmd: VOLUME")
 	volumes := v.cmd.Volumes
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	resolvedVolumes, err := util.ResolveEnvironmentReplacementList(volumes, replacementEnvs, true)
+	resolvedVolumes, err := util.ResolveEnvironmentReplacementList(volumes, replacementEnvs, v.escape, true)
 	if err != nil {
 		return err
 	}
-	existingVolumes := config.Volumes
-	if existingVolumes == nil {
-		existingVolumes = map[string]struct{}{}
+	if config.Volumes == nil {
+		config.Volumes = map[string]struct{}{}
 	}
+	root := v.root
+	if root == "" {
+		root = "/"
+	}
+	v.snapshotFiles = []string{}
 	for _, volume := range resolvedVolumes {
-		var x struct{}
-		existingVolumes[volume] = x
-		err := util.AddPathToVolumeWhitelist(volume)
-		if err != nil {
+		config.Volumes[volume] = struct{}{}
+		dir := volume
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", config.WorkingDir, dir)
+		}
+		dir = path.Clean(dir)
+		if err := util.AddPathToVolumeWhitelist(dir); err != nil {
 			return err
 		}
-
-		logrus.Infof("Creating directory %s", volume)
-		if err := os.MkdirAll(volume, 0755); err != nil {
+		logger.Infof("Creating directory %s", dir)
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
 			return err
 		}
-
-		//Check if directory already exists?
-		v.snapshotFiles = append(v.snapshotFiles, volume)
+		v.snapshotFiles = append(v.snapshotFiles, dir)
 	}
-	config.Volumes = existingVolumes
-
 	return nil
 }
 
@@ -16,6 +16,9 @@ limitations under the License.
 package commands
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -26,6 +29,11 @@ import (
 )
 
 func TestUpdateVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
 	cfg := &v1.Config{
 		Env: []string{
 			"VOLUME=/etc",
@@ -44,6 +52,7 @@ func TestUpdateVolume(t *testing.T) {
 			Volumes: volumes,
 		},
 		snapshotFiles: []string{},
+		root:          root,
 	}
 
 	expectedVolumes := map[string]struct{}{
@@ -52,6 +61,74 @@ func TestUpdateVolume(t *testing.T) {
 		"/etc":     {},
 	}
 	buildArgs := dockerfile.NewBuildArgs([]string{})
-	err := volumeCmd.ExecuteCommand(cfg, buildArgs)
+	err = volumeCmd.ExecuteCommand(cfg, buildArgs)
 	testutil.CheckErrorAndDeepEqual(t, false, err, expectedVolumes, cfg.Volumes)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/tmp", "/var/lib", "/etc"}, volumeCmd.FilesToSnapshot())
+	for volume := range expectedVolumes {
+		fi, err := os.Stat(filepath.Join(root, volume))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir() {
+			t.Errorf("expected %s to be a directory", volume)
+		}
+	}
+}
+
+func TestVolumeCommand_Forms(t *testing.T) {
+	tests := []struct {
+		name            string
+		dockerfile      string
+		workingDir      string
+		expectedVolumes map[string]struct{}
+		expectedDirs    []string
+	}{
+		{
+			name:            "json array",
+			dockerfile:      `VOLUME ["/a", "/b/c"]`,
+			expectedVolumes: map[string]struct{}{"/a": {}, "/b/c": {}},
+			expectedDirs:    []string{"/a", "/b/c"},
+		},
+		{
+			name:            "several paths",
+			dockerfile:      "VOLUME /a /b",
+			expectedVolumes: map[string]struct{}{"/a": {}, "/b": {}},
+			expectedDirs:    []string{"/a", "/b"},
+		},
+		{
+			name:            "relative to the working directory",
+			dockerfile:      "VOLUME data",
+			workingDir:      "/app",
+			expectedVolumes: map[string]struct{}{"data": {}},
+			expectedDirs:    []string{"/app/data"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			stages, err := dockerfile.Parse([]byte("FROM scratch\n" + test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			volumeCmd := &VolumeCommand{
+				cmd:  stages[0].Commands[0].(*instructions.VolumeCommand),
+				root: root,
+			}
+			cfg := &v1.Config{WorkingDir: test.workingDir}
+			err = volumeCmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil))
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedVolumes, cfg.Volumes)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedDirs, volumeCmd.FilesToSnapshot())
+			for _, dir := range test.expectedDirs {
+				fi, err := os.Stat(filepath.Join(root, dir))
+				if err != nil {
+					t.Fatal(err)
+				}
+				testutil.CheckErrorAndDeepEqual(t, false, nil, os.ModeDir|0755, fi.Mode())
+			}
+		})
+	}
 }
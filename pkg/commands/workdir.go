@@ -18,6 +18,7 @@ package commands
 
 import (
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -25,30 +26,75 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 type WorkdirCommand struct {
 	cmd           *instructions.WorkdirCommand
+	escape        rune
 	snapshotFiles []string
+	// root is the directory the working directory is created under, or "" for the root of the filesystem
+	root string
 }
 
 func (w *WorkdirCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	logrus.Info("cmd: workdir")
+	logger.Info("cmd: workdir")
 	workdirPath := w.cmd.Path
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	resolvedWorkingDir, err := util.ResolveEnvironmentReplacement(workdirPath, replacementEnvs, true)
+	resolvedWorkingDir, err := util.ResolveEnvironmentReplacement(workdirPath, replacementEnvs, w.escape, true)
 	if err != nil {
 		return err
 	}
-	if filepath.IsAbs(resolvedWorkingDir) {
-		config.WorkingDir = resolvedWorkingDir
-	} else {
-		config.WorkingDir = filepath.Join(config.WorkingDir, resolvedWorkingDir)
+	// The working directory is a path in the image, so it's always a posix path, relative to the previous one
+	if !path.IsAbs(resolvedWorkingDir) {
+		previous := config.WorkingDir
+		if previous == "" {
+			previous = "/"
+		}
+		resolvedWorkingDir = path.Join(previous, resolvedWorkingDir)
 	}
-	logrus.Infof("Changed working directory to %s", config.WorkingDir)
-	w.snapshotFiles = []string{config.WorkingDir}
-	return os.MkdirAll(config.WorkingDir, 0755)
+	config.WorkingDir = path.Clean(resolvedWorkingDir)
+	logger.Infof("Changed working directory to %s", config.WorkingDir)
+	return w.createWorkingDir(config)
+}
+
+// createWorkingDir creates the working directory and any missing parents. Like docker, the directories
+// which are created are owned by the user set with USER, if there is one.
+func (w *WorkdirCommand) createWorkingDir(config *v1.Config) error {
+	root := w.root
+	if root == "" {
+		root = "/"
+	}
+	dir := filepath.Join(root, filepath.FromSlash(config.WorkingDir))
+	w.snapshotFiles = []string{dir}
+	var created []string
+	for d := dir; d != root && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil {
+			break
+		}
+		created = append(created, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if config.User == "" || len(created) == 0 {
+		return nil
+	}
+	ids, err := util.ParseChown(config.User, root)
+	if err != nil {
+		return errors.Wrapf(err, "resolving the owner of working directory %s", config.WorkingDir)
+	}
+	for _, d := range created {
+		if err := os.Chown(d, ids.UID, ids.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRoot makes the command create the working directory under root, instead of the root of the filesystem
+func (w *WorkdirCommand) SetRoot(root string) {
+	w.root = root
 }
 
 // FilesToSnapshot returns the workingdir, which should have been created if it didn't already exist
@@ -16,6 +16,10 @@ limitations under the License.
 package commands
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -61,9 +65,30 @@ var workdirTests = []struct {
 		path:         "$path/$home",
 		expectedPath: "/root/usr/root",
 	},
+	{
+		path:         "../x/",
+		expectedPath: "/root/usr/x",
+	},
+	{
+		path:         "./y/../z",
+		expectedPath: "/root/usr/x/z",
+	},
+	{
+		path:         "${dir}/w",
+		expectedPath: "/opt/app/w",
+	},
+	{
+		path:         "$dir/$path",
+		expectedPath: "/opt/app/usr",
+	},
 }
 
 func TestWorkdirCommand(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
 
 	cfg := &v1.Config{
 		WorkingDir: "/",
@@ -79,9 +104,101 @@ func TestWorkdirCommand(t *testing.T) {
 				Path: test.path,
 			},
 			snapshotFiles: []string{},
+			root:          root,
 		}
-		buildArgs := dockerfile.NewBuildArgs([]string{})
-		cmd.ExecuteCommand(cfg, buildArgs)
-		testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedPath, cfg.WorkingDir)
+		buildArgs := dockerfile.NewBuildArgs([]string{"dir=/opt/app"})
+		buildArgs.AddArg("dir", nil)
+		err := cmd.ExecuteCommand(cfg, buildArgs)
+		testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedPath, cfg.WorkingDir)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, []string{filepath.Join(root, test.expectedPath)}, cmd.FilesToSnapshot())
+		if fi, err := os.Stat(filepath.Join(root, test.expectedPath)); err != nil || !fi.IsDir() {
+			t.Errorf("%s wasn't created: %v", test.expectedPath, err)
+		}
+	}
+}
+
+func TestWorkdirCommand_RelativeToEmptyWorkingDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cfg := &v1.Config{}
+	cmd := WorkdirCommand{
+		cmd:  &instructions.WorkdirCommand{Path: "app"},
+		root: root,
+	}
+	err = cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "/app", cfg.WorkingDir)
+}
+
+func TestWorkdirCommand_Ownership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of directories requires root")
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &v1.Config{
+		WorkingDir: "/existing",
+		User:       "1000:2000",
+	}
+	cmd := WorkdirCommand{
+		cmd:  &instructions.WorkdirCommand{Path: "a/b"},
+		root: root,
+	}
+	if err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{})); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := func(p string) []uint32 {
+		fi, err := os.Stat(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		return []uint32{stat.Uid, stat.Gid}
+	}
+	// Only the directories created by WORKDIR are owned by the user
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{0, 0}, owner("existing"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{1000, 2000}, owner("existing/a"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{1000, 2000}, owner("existing/a/b"))
+}
+
+func TestWorkdirCommand_OwnershipPrimaryGroup(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of directories requires root")
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// The user has no group of the same name, so the directories are owned by its primary group
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\napp:x:1002:100::/home/app:/bin/sh\n",
+		"etc/group":  "root:x:0:\nusers:x:100:\n",
+	}
+	if err := testutil.SetupFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &v1.Config{User: "app"}
+	cmd := WorkdirCommand{
+		cmd:  &instructions.WorkdirCommand{Path: "/app"},
+		root: root,
+	}
+	if err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{})); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(root, "app"))
+	if err != nil {
+		t.Fatal(err)
 	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []uint32{1002, 100}, []uint32{stat.Uid, stat.Gid})
 }
@@ -31,6 +31,10 @@ const (
 
 	WhitelistPath = "/proc/self/mountinfo"
 
+	// BaseImageDigestFile records the digest of the base image whose filesystem is extracted to the root,
+	// so that --skip-unpack can check the filesystem is still the right one
+	BaseImageDigestFile = "/kaniko/base-image-digest"
+
 	Author = "kaniko"
 
 	// ContextTar is the default name of the tar uploaded to GCS buckets
@@ -44,9 +48,52 @@ const (
 	// as tarballs in case they are needed later on
 	KanikoIntermediateStagesDir = "/kaniko/stages"
 
+	// KanikoMountCacheDir is where the contents of RUN --mount=type=cache mounts are stored by default
+	KanikoMountCacheDir = "/kaniko/mount-cache"
+
+	// KanikoSecretsDir is where secrets are written while they're mounted by RUN --mount=type=secret
+	KanikoSecretsDir = "/kaniko/secrets"
+
+	// NamedContextsDir is where the tars of --build-context contexts are unpacked
+	NamedContextsDir = "/kaniko/contexts"
+
+	// LayersDir is where the tarballs of the layers a build creates are written until they're pushed
+	LayersDir = "/kaniko/layers"
+
+	// DefaultCacheDir is where --cache stores layers by default
+	DefaultCacheDir = "/cache"
+
+	// DefaultDaemonSocket is the unix socket --daemon serves builds on by default
+	DefaultDaemonSocket = "/kaniko/daemon.sock"
+
+	// DefaultDaemonCacheDir is where --daemon stores the base images its builds pull by default
+	DefaultDaemonCacheDir = "/kaniko/daemon-cache"
+
+	// DefaultContainerdAddress is the socket containerd listens on by default
+	DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	// DefaultContainerdNamespace is the namespace containerd uses by default. The images kubelet runs are in k8s.io.
+	DefaultContainerdNamespace = "default"
+
+	// TarPathStdout is the --tarPath which streams the tarball to stdout
+	TarPathStdout = "-"
+
+	// DockerfileStdin is the --dockerfile which reads the Dockerfile from stdin
+	DockerfileStdin = "-"
+
 	// Various snapshot modes:
 	SnapshotModeTime = "time"
 	SnapshotModeFull = "full"
+	// SnapshotModeTimeSize also hashes the contents of files whose size is unchanged
+	SnapshotModeTimeSize = "time+size"
+
+	// Compression algorithms for the layers kaniko creates
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// The networks RUN commands can have
+	RunNetworkHost = "host"
+	RunNetworkNone = "none"
 
 	// NoBaseImage is the scratch image
 	NoBaseImage = "scratch"
@@ -54,6 +101,12 @@ const (
 	GCSBuildContextPrefix      = "gs://"
 	S3BuildContextPrefix       = "s3://"
 	LocalDirBuildContextPrefix = "dir://"
+	HTTPBuildContextPrefix     = "http://"
+	HTTPSBuildContextPrefix    = "https://"
+	// AzureBlobPrefix is the prefix of a container and path in Azure Blob Storage, for build contexts and caches
+	AzureBlobPrefix = "azblob://"
+	// DockerImageBuildContextPrefix is the prefix of a --build-context which is an image
+	DockerImageBuildContextPrefix = "docker-image://"
 
 	// DefaultHOMEValue is the default value Docker sets for $HOME
 	HOME             = "HOME"
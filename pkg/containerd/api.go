@@ -0,0 +1,170 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of the parts of containerd's API which are used to import images, with the same field
+// numbers as github.com/containerd/containerd/api. Fields which aren't used are left out, and are
+// skipped when a response is decoded.
+
+// The actions of a WriteContentRequest
+const (
+	writeActionStat   int32 = 0
+	writeActionWrite  int32 = 1
+	writeActionCommit int32 = 2
+)
+
+const (
+	contentInfoMethod  = "/containerd.services.content.v1.Content/Info"
+	contentWriteMethod = "/containerd.services.content.v1.Content/Write"
+	imagesCreateMethod = "/containerd.services.images.v1.Images/Create"
+	imagesUpdateMethod = "/containerd.services.images.v1.Images/Update"
+	leasesCreateMethod = "/containerd.services.leases.v1.Leases/Create"
+	leasesDeleteMethod = "/containerd.services.leases.v1.Leases/Delete"
+)
+
+type infoRequest struct {
+	Digest string `protobuf:"bytes,1,opt,name=digest,proto3"`
+}
+
+func (m *infoRequest) Reset()         { *m = infoRequest{} }
+func (m *infoRequest) String() string { return proto.CompactTextString(m) }
+func (*infoRequest) ProtoMessage()    {}
+
+type contentInfo struct {
+	Digest string `protobuf:"bytes,1,opt,name=digest,proto3"`
+	Size   int64  `protobuf:"varint,2,opt,name=size,proto3"`
+}
+
+func (m *contentInfo) Reset()         { *m = contentInfo{} }
+func (m *contentInfo) String() string { return proto.CompactTextString(m) }
+func (*contentInfo) ProtoMessage()    {}
+
+type infoResponse struct {
+	Info *contentInfo `protobuf:"bytes,1,opt,name=info"`
+}
+
+func (m *infoResponse) Reset()         { *m = infoResponse{} }
+func (m *infoResponse) String() string { return proto.CompactTextString(m) }
+func (*infoResponse) ProtoMessage()    {}
+
+type writeContentRequest struct {
+	Action   int32             `protobuf:"varint,1,opt,name=action,proto3"`
+	Ref      string            `protobuf:"bytes,2,opt,name=ref,proto3"`
+	Total    int64             `protobuf:"varint,3,opt,name=total,proto3"`
+	Expected string            `protobuf:"bytes,4,opt,name=expected,proto3"`
+	Offset   int64             `protobuf:"varint,5,opt,name=offset,proto3"`
+	Data     []byte            `protobuf:"bytes,6,opt,name=data,proto3"`
+	Labels   map[string]string `protobuf:"bytes,7,rep,name=labels" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *writeContentRequest) Reset()         { *m = writeContentRequest{} }
+func (m *writeContentRequest) String() string { return proto.CompactTextString(m) }
+func (*writeContentRequest) ProtoMessage()    {}
+
+type writeContentResponse struct {
+	Action int32  `protobuf:"varint,1,opt,name=action,proto3"`
+	Offset int64  `protobuf:"varint,4,opt,name=offset,proto3"`
+	Total  int64  `protobuf:"varint,5,opt,name=total,proto3"`
+	Digest string `protobuf:"bytes,6,opt,name=digest,proto3"`
+}
+
+func (m *writeContentResponse) Reset()         { *m = writeContentResponse{} }
+func (m *writeContentResponse) String() string { return proto.CompactTextString(m) }
+func (*writeContentResponse) ProtoMessage()    {}
+
+type descriptor struct {
+	MediaType string `protobuf:"bytes,1,opt,name=media_type,json=mediaType,proto3"`
+	Digest    string `protobuf:"bytes,2,opt,name=digest,proto3"`
+	Size      int64  `protobuf:"varint,3,opt,name=size,proto3"`
+}
+
+func (m *descriptor) Reset()         { *m = descriptor{} }
+func (m *descriptor) String() string { return proto.CompactTextString(m) }
+func (*descriptor) ProtoMessage()    {}
+
+type image struct {
+	Name   string            `protobuf:"bytes,1,opt,name=name,proto3"`
+	Labels map[string]string `protobuf:"bytes,2,rep,name=labels" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Target *descriptor       `protobuf:"bytes,3,opt,name=target"`
+}
+
+func (m *image) Reset()         { *m = image{} }
+func (m *image) String() string { return proto.CompactTextString(m) }
+func (*image) ProtoMessage()    {}
+
+// imageRequest is a CreateImageRequest or an UpdateImageRequest, whose update mask is left empty so
+// every field is updated
+type imageRequest struct {
+	Image *image `protobuf:"bytes,1,opt,name=image"`
+}
+
+func (m *imageRequest) Reset()         { *m = imageRequest{} }
+func (m *imageRequest) String() string { return proto.CompactTextString(m) }
+func (*imageRequest) ProtoMessage()    {}
+
+// imageResponse is a CreateImageResponse or an UpdateImageResponse
+type imageResponse struct {
+	Image *image `protobuf:"bytes,1,opt,name=image"`
+}
+
+func (m *imageResponse) Reset()         { *m = imageResponse{} }
+func (m *imageResponse) String() string { return proto.CompactTextString(m) }
+func (*imageResponse) ProtoMessage()    {}
+
+type createLeaseRequest struct {
+	ID     string            `protobuf:"bytes,1,opt,name=id,proto3"`
+	Labels map[string]string `protobuf:"bytes,3,rep,name=labels" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *createLeaseRequest) Reset()         { *m = createLeaseRequest{} }
+func (m *createLeaseRequest) String() string { return proto.CompactTextString(m) }
+func (*createLeaseRequest) ProtoMessage()    {}
+
+type lease struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3"`
+}
+
+func (m *lease) Reset()         { *m = lease{} }
+func (m *lease) String() string { return proto.CompactTextString(m) }
+func (*lease) ProtoMessage()    {}
+
+type createLeaseResponse struct {
+	Lease *lease `protobuf:"bytes,1,opt,name=lease"`
+}
+
+func (m *createLeaseResponse) Reset()         { *m = createLeaseResponse{} }
+func (m *createLeaseResponse) String() string { return proto.CompactTextString(m) }
+func (*createLeaseResponse) ProtoMessage()    {}
+
+type deleteLeaseRequest struct {
+	ID string `protobuf:"bytes,1,opt,name=id,proto3"`
+}
+
+func (m *deleteLeaseRequest) Reset()         { *m = deleteLeaseRequest{} }
+func (m *deleteLeaseRequest) String() string { return proto.CompactTextString(m) }
+func (*deleteLeaseRequest) ProtoMessage()    {}
+
+// empty is google.protobuf.Empty, which some methods respond with
+type empty struct{}
+
+func (m *empty) Reset()         { *m = empty{} }
+func (m *empty) String() string { return proto.CompactTextString(m) }
+func (*empty) ProtoMessage()    {}
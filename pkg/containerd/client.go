@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	namespaceHeader = "containerd-namespace"
+	leaseHeader     = "containerd-lease"
+	// leaseExpireLabel makes containerd delete the lease if it isn't deleted when the import finishes
+	leaseExpireLabel = "containerd.io/gc.expire"
+	leaseExpiry      = 24 * time.Hour
+
+	dialTimeout = 10 * time.Second
+	// writeChunkSize is how much of a blob is sent in each write request
+	writeChunkSize = 1 << 20
+	maxRetryDelay  = 5 * time.Second
+)
+
+var (
+	// For testing
+	retryDelay   = 100 * time.Millisecond
+	retryTimeout = 5 * time.Minute
+)
+
+// Client is a Store for a namespace of the containerd listening on a socket. Content written with it is
+// kept by a lease until it's closed, so that containerd doesn't garbage collect the blobs of an image
+// before its image record is created.
+type Client struct {
+	conn    *grpc.ClientConn
+	ctx     context.Context
+	leaseID string
+}
+
+var _ Store = (*Client)(nil)
+
+// NewClient connects to the containerd listening on the socket at address, for namespace
+func NewClient(address, namespace string) (*Client, error) {
+	conn, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithTimeout(dialTimeout),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to containerd at %s", address)
+	}
+	c := &Client{
+		conn: conn,
+		ctx:  metadata.AppendToOutgoingContext(context.Background(), namespaceHeader, namespace),
+	}
+	leaseID := fmt.Sprintf("kaniko-%d", time.Now().UnixNano())
+	req := &createLeaseRequest{
+		ID:     leaseID,
+		Labels: map[string]string{leaseExpireLabel: time.Now().Add(leaseExpiry).UTC().Format(time.RFC3339)},
+	}
+	if err := retry(func() error {
+		return conn.Invoke(c.ctx, leasesCreateMethod, req, &createLeaseResponse{})
+	}); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "creating containerd lease")
+	}
+	c.leaseID = leaseID
+	c.ctx = metadata.AppendToOutgoingContext(c.ctx, leaseHeader, leaseID)
+	return c, nil
+}
+
+// Close deletes the lease of the Client, and disconnects from containerd
+func (c *Client) Close() error {
+	if err := c.conn.Invoke(c.ctx, leasesDeleteMethod, &deleteLeaseRequest{ID: c.leaseID}, &empty{}); err != nil {
+		logger.Warnf("Couldn't delete containerd lease %s, which expires in %s: %v", c.leaseID, leaseExpiry, err)
+	}
+	return c.conn.Close()
+}
+
+// Has implements Store
+func (c *Client) Has(h v1.Hash) (bool, error) {
+	err := retry(func() error {
+		return c.conn.Invoke(c.ctx, contentInfoMethod, &infoRequest{Digest: h.String()}, &infoResponse{})
+	})
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Write implements Store
+func (c *Client) Write(desc v1.Descriptor, r io.Reader, labels map[string]string) error {
+	err := c.write(desc, r, labels)
+	// Another import can write the blob between checking for it and writing it
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) write(desc v1.Descriptor, r io.Reader, labels map[string]string) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	ref := "kaniko-" + desc.Digest.String()
+	var stream grpc.ClientStream
+	send := func(req *writeContentRequest) error {
+		if err := stream.SendMsg(req); err != nil {
+			return err
+		}
+		return stream.RecvMsg(&writeContentResponse{})
+	}
+	// containerd locks ref until the write which opened it finishes, and responds with Unavailable to
+	// another import writing the same blob. Opening the write with a stat request doesn't read from r,
+	// so it can be retried until the lock is released.
+	if err := retry(func() error {
+		var err error
+		if stream, err = c.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, contentWriteMethod); err != nil {
+			return err
+		}
+		return send(&writeContentRequest{Action: writeActionStat, Ref: ref, Total: desc.Size, Expected: desc.Digest.String()})
+	}); err != nil {
+		return err
+	}
+	buf := make([]byte, writeChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			// Writing from offset 0 truncates anything left from an import which was interrupted
+			req := &writeContentRequest{Action: writeActionWrite, Ref: ref, Total: desc.Size, Expected: desc.Digest.String(), Offset: offset, Data: buf[:n]}
+			if err := send(req); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := send(&writeContentRequest{Action: writeActionCommit, Ref: ref, Total: desc.Size, Expected: desc.Digest.String(), Offset: offset, Labels: labels}); err != nil {
+		return err
+	}
+	return stream.CloseSend()
+}
+
+// SetImage implements Store
+func (c *Client) SetImage(name string, target v1.Descriptor) error {
+	req := &imageRequest{Image: &image{
+		Name: name,
+		Target: &descriptor{
+			MediaType: string(target.MediaType),
+			Digest:    target.Digest.String(),
+			Size:      target.Size,
+		},
+	}}
+	err := retry(func() error {
+		return c.conn.Invoke(c.ctx, imagesCreateMethod, req, &imageResponse{})
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return retry(func() error {
+			return c.conn.Invoke(c.ctx, imagesUpdateMethod, req, &imageResponse{})
+		})
+	}
+	return err
+}
+
+// retry calls f until it returns an error other than Unavailable, which containerd responds with while
+// it's restarting or a ref is locked, or until retryTimeout has passed
+func retry(f func() error) error {
+	deadline := time.Now().Add(retryTimeout)
+	delay := retryDelay
+	for {
+		err := f()
+		if status.Code(err) != codes.Unavailable || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		logger.Debugf("containerd is unavailable, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+const testNamespace = "kaniko-test"
+
+// fakeContainerd serves the parts of containerd's API which Client uses, keeping blobs, image records
+// and leases in memory
+type fakeContainerd struct {
+	mu     sync.Mutex
+	leases map[string]map[string]string
+	blobs  map[string]fakeBlob
+	images map[string]*image
+	// locked is how many more times writing a ref is refused as if another import was writing it
+	locked map[string]int
+	// unavailable is how many more requests are refused as if containerd was restarting
+	unavailable int
+}
+
+func serveFakeContainerd(t *testing.T) (*fakeContainerd, string, func()) {
+	dir, err := ioutil.TempDir("", "containerd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := filepath.Join(dir, "containerd.sock")
+	lis, err := net.Listen("unix", address)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s := &fakeContainerd{
+		leases: map[string]map[string]string{},
+		blobs:  map[string]fakeBlob{},
+		images: map[string]*image{},
+		locked: map[string]int{},
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(s.handle))
+	go server.Serve(lis)
+	stop := func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+	return s, address, stop
+}
+
+func (s *fakeContainerd) handle(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if ns := md[namespaceHeader]; len(ns) != 1 || ns[0] != testNamespace {
+		return status.Errorf(codes.InvalidArgument, "namespace %v", ns)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unavailable > 0 {
+		s.unavailable--
+		return status.Error(codes.Unavailable, "containerd is restarting")
+	}
+	switch method {
+	case leasesCreateMethod:
+		req := &createLeaseRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		s.leases[req.ID] = req.Labels
+		return stream.SendMsg(&createLeaseResponse{Lease: &lease{ID: req.ID}})
+	case leasesDeleteMethod:
+		req := &deleteLeaseRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		delete(s.leases, req.ID)
+		return stream.SendMsg(&empty{})
+	case contentInfoMethod:
+		req := &infoRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		blob, ok := s.blobs[req.Digest]
+		if !ok {
+			return status.Errorf(codes.NotFound, "content digest %s: not found", req.Digest)
+		}
+		return stream.SendMsg(&infoResponse{Info: &contentInfo{Digest: req.Digest, Size: blob.desc.Size}})
+	case contentWriteMethod:
+		if leases := md[leaseHeader]; len(leases) != 1 || s.leases[leases[0]] == nil {
+			return status.Errorf(codes.FailedPrecondition, "lease %v doesn't exist", leases)
+		}
+		return s.write(stream)
+	case imagesCreateMethod, imagesUpdateMethod:
+		req := &imageRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		_, exists := s.images[req.Image.Name]
+		if method == imagesCreateMethod && exists {
+			return status.Errorf(codes.AlreadyExists, "image %q: already exists", req.Image.Name)
+		}
+		if method == imagesUpdateMethod && !exists {
+			return status.Errorf(codes.NotFound, "image %q: not found", req.Image.Name)
+		}
+		s.images[req.Image.Name] = req.Image
+		return stream.SendMsg(&imageResponse{Image: req.Image})
+	}
+	return status.Errorf(codes.Unimplemented, "method %s", method)
+}
+
+func (s *fakeContainerd) write(stream grpc.ServerStream) error {
+	var ref string
+	var data []byte
+	for {
+		req := &writeContentRequest{}
+		if err := stream.RecvMsg(req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ref == "" {
+			ref = req.Ref
+			if s.locked[ref] > 0 {
+				s.locked[ref]--
+				return status.Errorf(codes.Unavailable, "ref %s locked", ref)
+			}
+			if _, ok := s.blobs[req.Expected]; ok {
+				return status.Errorf(codes.AlreadyExists, "content %s: already exists", req.Expected)
+			}
+		}
+		switch req.Action {
+		case writeActionWrite:
+			if req.Offset > int64(len(data)) {
+				return status.Errorf(codes.InvalidArgument, "writing at offset %d of %d bytes", req.Offset, len(data))
+			}
+			data = append(data[:req.Offset], req.Data...)
+		case writeActionCommit:
+			digest, size, err := v1.SHA256(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			if digest.String() != req.Expected || size != req.Total {
+				return status.Errorf(codes.FailedPrecondition, "committed %s with size %d, expected %s with size %d", digest, size, req.Expected, req.Total)
+			}
+			s.blobs[req.Expected] = fakeBlob{desc: v1.Descriptor{Digest: digest, Size: size}, contents: data, labels: req.Labels}
+		}
+		if err := stream.SendMsg(&writeContentResponse{Action: req.Action, Offset: int64(len(data)), Total: req.Total}); err != nil {
+			return err
+		}
+	}
+}
+
+func shortRetries() func() {
+	originalDelay, originalTimeout := retryDelay, retryTimeout
+	retryDelay, retryTimeout = time.Millisecond, time.Second
+	return func() {
+		retryDelay, retryTimeout = originalDelay, originalTimeout
+	}
+}
+
+func TestClient_ImportImage(t *testing.T) {
+	s, address, stop := serveFakeContainerd(t)
+	defer stop()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewTag("gcr.io/kaniko-test/app:v1", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(address, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire, err := time.Parse(time.RFC3339, s.leases[c.leaseID][leaseExpireLabel])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expire.Before(time.Now()) {
+		t.Errorf("lease %s expires at %s, which has passed", c.leaseID, expire)
+	}
+	target, err := ImportImage(c, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Tag(c, []name.Tag{ref}, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]map[string]string{}, s.leases)
+
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, &descriptor{MediaType: string(types.DockerManifestSchema2), Digest: digest.String(), Size: target.Size}, s.images["gcr.io/kaniko-test/app:v1"].Target)
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, rawManifest, s.blobs[digest.String()].contents)
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, m.Config.Digest.String(), s.blobs[digest.String()].labels["containerd.io/gc.ref.content.config"])
+	for _, desc := range m.Layers {
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := layer.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, contents, s.blobs[desc.Digest.String()].contents)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, len(s.blobs))
+}
+
+func randomBlob(t *testing.T, size int) ([]byte, v1.Descriptor) {
+	contents := make([]byte, size)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents, v1.Descriptor{Digest: digest, Size: int64(size)}
+}
+
+func TestClient_Write(t *testing.T) {
+	defer shortRetries()()
+	tests := []struct {
+		name        string
+		size        int
+		locked      int
+		unavailable int
+		exists      bool
+		shouldErr   bool
+	}{
+		{
+			name: "in chunks",
+			size: 2*writeChunkSize + 10,
+		},
+		{
+			name:   "ref locked by another import",
+			size:   10,
+			locked: 3,
+		},
+		{
+			name:        "containerd restarting",
+			size:        10,
+			unavailable: 3,
+		},
+		{
+			name:   "written by another import",
+			size:   10,
+			exists: true,
+		},
+		{
+			name:      "ref locked until the retries time out",
+			size:      10,
+			locked:    1 << 30,
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, address, stop := serveFakeContainerd(t)
+			defer stop()
+			c, err := NewClient(address, testNamespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			contents, desc := randomBlob(t, test.size)
+			if test.exists {
+				s.blobs[desc.Digest.String()] = fakeBlob{desc: desc, contents: contents}
+			}
+			s.mu.Lock()
+			s.locked["kaniko-"+desc.Digest.String()] = test.locked
+			s.unavailable = test.unavailable
+			s.mu.Unlock()
+			err = c.Write(desc, bytes.NewReader(contents), map[string]string{"label": "value"})
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, codes.Unavailable, status.Code(err))
+				return
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, contents, s.blobs[desc.Digest.String()].contents)
+			has, err := c.Has(desc.Digest)
+			testutil.CheckErrorAndDeepEqual(t, false, err, true, has)
+		})
+	}
+}
+
+func TestClient_Has(t *testing.T) {
+	_, address, stop := serveFakeContainerd(t)
+	defer stop()
+	c, err := NewClient(address, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	has, err := c.Has(v1.Hash{Algorithm: "sha256", Hex: "abc"})
+	testutil.CheckErrorAndDeepEqual(t, false, err, false, has)
+}
+
+func TestClient_SetImage(t *testing.T) {
+	defer shortRetries()()
+	s, address, stop := serveFakeContainerd(t)
+	defer stop()
+	c, err := NewClient(address, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, hex := range []string{"abc", "def"} {
+		// The image record is created, and then updated as it exists
+		target := v1.Descriptor{MediaType: types.DockerManifestSchema2, Size: 1, Digest: v1.Hash{Algorithm: "sha256", Hex: hex}}
+		s.mu.Lock()
+		s.unavailable = 1
+		s.mu.Unlock()
+		err := c.SetImage("docker.io/library/busybox:latest", target)
+		testutil.CheckErrorAndDeepEqual(t, false, err, &descriptor{MediaType: string(target.MediaType), Digest: target.Digest.String(), Size: 1}, s.images["docker.io/library/busybox:latest"].Target)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+var logger = util.ModuleLogger("containerd")
+
+const (
+	// gcRefLabel is the prefix of the labels which tell containerd's garbage collector the content a blob
+	// refers to, so that the layers and config of an image are kept as long as its manifest is
+	gcRefLabel = "containerd.io/gc.ref.content."
+
+	// dockerHubRegistry is what containerd calls the registry go-containerregistry calls index.docker.io
+	dockerHubRegistry = "docker.io"
+)
+
+// Store is the content store and image records of a containerd namespace
+type Store interface {
+	// Has returns whether the content store has the blob with digest h
+	Has(h v1.Hash) (bool, error)
+	// Write writes the blob desc from r to the content store, with labels
+	Write(desc v1.Descriptor, r io.Reader, labels map[string]string) error
+	// SetImage creates the image record called name with target as its manifest, or changes the target of
+	// the one which already exists
+	SetImage(name string, target v1.Descriptor) error
+}
+
+// ImportImage writes the layers, config and manifest of img to the content store, and returns the
+// descriptor of its manifest. Blobs the store already has aren't written again.
+func ImportImage(store Store, img v1.Image) (v1.Descriptor, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	labels := map[string]string{gcRefLabel + "config": m.Config.Digest.String()}
+	for i, desc := range m.Layers {
+		labels[fmt.Sprintf("%sl.%d", gcRefLabel, i)] = desc.Digest.String()
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if err := writeBlob(store, desc, layer.Compressed, nil); err != nil {
+			return v1.Descriptor{}, errors.Wrapf(err, "importing layer %s", desc.Digest)
+		}
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := writeBlob(store, m.Config, rawBlob(rawConfig), nil); err != nil {
+		return v1.Descriptor{}, errors.Wrapf(err, "importing config %s", m.Config.Digest)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return writeManifest(store, mediaType, rawManifest, labels)
+}
+
+// ImportIndex writes the images in index, which image returns by the digests of their manifests, and
+// then index itself, to the content store, and returns the descriptor of index
+func ImportIndex(store Store, index v1.ImageIndex, image func(v1.Hash) (v1.Image, error)) (v1.Descriptor, error) {
+	m, err := index.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	labels := map[string]string{}
+	for i, desc := range m.Manifests {
+		labels[fmt.Sprintf("%sm.%d", gcRefLabel, i)] = desc.Digest.String()
+		img, err := image(desc.Digest)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if _, err := ImportImage(store, img); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+	mediaType, err := index.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	rawIndex, err := index.RawIndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return writeManifest(store, mediaType, rawIndex, labels)
+}
+
+// Tag creates an image record called name, in the format containerd names images in, for each of refs,
+// with target as its manifest
+func Tag(store Store, refs []name.Tag, target v1.Descriptor) error {
+	for _, ref := range refs {
+		imageName := ImageName(ref)
+		if err := store.SetImage(imageName, target); err != nil {
+			return errors.Wrapf(err, "creating image %s", imageName)
+		}
+		logger.Infof("Imported %s with digest %s to containerd", imageName, target.Digest)
+	}
+	return nil
+}
+
+// ImageName returns the name of ref in containerd, such as docker.io/library/busybox:latest for busybox
+func ImageName(ref name.Tag) string {
+	registry := ref.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+	return fmt.Sprintf("%s/%s:%s", registry, ref.Context().RepositoryStr(), ref.Identifier())
+}
+
+func writeManifest(store Store, mediaType types.MediaType, raw []byte, labels map[string]string) (v1.Descriptor, error) {
+	digest, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}
+	if err := writeBlob(store, desc, rawBlob(raw), labels); err != nil {
+		return v1.Descriptor{}, errors.Wrapf(err, "importing manifest %s", digest)
+	}
+	return desc, nil
+}
+
+func writeBlob(store Store, desc v1.Descriptor, open func() (io.ReadCloser, error), labels map[string]string) error {
+	has, err := store.Has(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if has {
+		logger.Debugf("containerd already has %s", desc.Digest)
+		return nil
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return store.Write(desc, r, labels)
+}
+
+func rawBlob(raw []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(raw)), nil
+	}
+}
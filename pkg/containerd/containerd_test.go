@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+type fakeBlob struct {
+	desc     v1.Descriptor
+	contents []byte
+	labels   map[string]string
+}
+
+// fakeStore is a Store which keeps blobs and image records in memory
+type fakeStore struct {
+	blobs  map[v1.Hash]fakeBlob
+	images map[string]v1.Descriptor
+	writes int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{blobs: map[v1.Hash]fakeBlob{}, images: map[string]v1.Descriptor{}}
+}
+
+func (s *fakeStore) Has(h v1.Hash) (bool, error) {
+	_, ok := s.blobs[h]
+	return ok, nil
+}
+
+func (s *fakeStore) Write(desc v1.Descriptor, r io.Reader, labels map[string]string) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	if digest != desc.Digest || size != desc.Size {
+		return fmt.Errorf("wrote %s with size %d, expected %s with size %d", digest, size, desc.Digest, desc.Size)
+	}
+	s.writes++
+	s.blobs[desc.Digest] = fakeBlob{desc: desc, contents: contents, labels: labels}
+	return nil
+}
+
+func (s *fakeStore) SetImage(name string, target v1.Descriptor) error {
+	s.images[name] = target
+	return nil
+}
+
+func TestImportImage(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeStore()
+	target, err := ImportImage(store, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, v1.Descriptor{MediaType: types.DockerManifestSchema2, Size: int64(len(rawManifest)), Digest: digest}, target)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, rawManifest, store.blobs[digest].contents)
+
+	// The manifest refers to the config and layers, so they aren't garbage collected
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, rawConfig, store.blobs[m.Config.Digest].contents)
+	expectedLabels := map[string]string{"containerd.io/gc.ref.content.config": m.Config.Digest.String()}
+	for i, desc := range m.Layers {
+		expectedLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = desc.Digest.String()
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := layer.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, contents, store.blobs[desc.Digest].contents)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedLabels, store.blobs[digest].labels)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, store.writes)
+
+	// Blobs which are already in the store aren't written again
+	if _, err := ImportImage(store, img); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, store.writes)
+}
+
+type testIndex struct {
+	manifest *v1.IndexManifest
+	raw      []byte
+}
+
+func (i *testIndex) MediaType() (types.MediaType, error) {
+	return types.DockerManifestList, nil
+}
+
+func (i *testIndex) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+func (i *testIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest, nil
+}
+
+func (i *testIndex) RawIndexManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func TestImportIndex(t *testing.T) {
+	images := map[v1.Hash]v1.Image{}
+	manifest := &v1.IndexManifest{SchemaVersion: 2, MediaType: types.DockerManifestList}
+	for i := 0; i < 2; i++ {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		images[digest] = img
+		manifest.Manifests = append(manifest.Manifests, v1.Descriptor{MediaType: types.DockerManifestSchema2, Digest: digest})
+	}
+	raw := []byte(fmt.Sprintf(`{"manifests":[{"digest":"%s"},{"digest":"%s"}]}`, manifest.Manifests[0].Digest, manifest.Manifests[1].Digest))
+	index := &testIndex{manifest: manifest, raw: raw}
+
+	store := newFakeStore()
+	target, err := ImportIndex(store, index, func(h v1.Hash) (v1.Image, error) {
+		return images[h], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, v1.Descriptor{MediaType: types.DockerManifestList, Size: int64(len(raw)), Digest: digest}, target)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{
+		"containerd.io/gc.ref.content.m.0": manifest.Manifests[0].Digest.String(),
+		"containerd.io/gc.ref.content.m.1": manifest.Manifests[1].Digest.String(),
+	}, store.blobs[digest].labels)
+	for h := range images {
+		if _, ok := store.blobs[h]; !ok {
+			t.Errorf("manifest %s wasn't imported", h)
+		}
+	}
+}
+
+func TestTag(t *testing.T) {
+	var refs []name.Tag
+	for _, r := range []string{"busybox", "gcr.io/kaniko-test/app:v1"} {
+		ref, err := name.NewTag(r, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	target := v1.Descriptor{MediaType: types.DockerManifestSchema2, Size: 1, Digest: v1.Hash{Algorithm: "sha256", Hex: "abc"}}
+	store := newFakeStore()
+	err := Tag(store, refs, target)
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]v1.Descriptor{
+		"docker.io/library/busybox:latest": target,
+		"gcr.io/kaniko-test/app:v1":        target,
+	}, store.images)
+}
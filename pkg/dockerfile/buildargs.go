@@ -17,8 +17,15 @@ limitations under the License.
 package dockerfile
 
 import (
-	d "github.com/docker/docker/builder/dockerfile"
+	"bufio"
+	"os"
+	"sort"
 	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	d "github.com/docker/docker/builder/dockerfile"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
 )
 
 type BuildArgs struct {
@@ -28,7 +35,7 @@ type BuildArgs struct {
 func NewBuildArgs(args []string) *BuildArgs {
 	argsFromOptions := make(map[string]*string)
 	for _, a := range args {
-		s := strings.Split(a, "=")
+		s := strings.SplitN(a, "=", 2)
 		if len(s) == 1 {
 			argsFromOptions[s[0]] = nil
 		} else {
@@ -40,6 +47,65 @@ func NewBuildArgs(args []string) *BuildArgs {
 	}
 }
 
+// ReadBuildArgFile reads build args from a --build-arg-file, which has a KEY=VALUE on each line.
+// Blank lines and lines starting with # are ignored. A line with just a KEY takes its value from the
+// environment, if it's set there.
+func ReadBuildArgFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening build arg file")
+	}
+	defer f.Close()
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "=") {
+			return nil, errors.Errorf("%s:%d: build arg %q has no name", path, lineNumber, line)
+		}
+		if !strings.Contains(line, "=") {
+			if value, ok := os.LookupEnv(line); ok {
+				line = line + "=" + value
+			}
+		}
+		args = append(args, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading build arg file %s", path)
+	}
+	return args, nil
+}
+
+// AddMetaArgs adds the meta args declared before the first FROM. Their values are the ones from --build-arg,
+// or else their defaults, which can use the meta args before them. escape is the escape character of the Dockerfile.
+func (b *BuildArgs) AddMetaArgs(metaArgs []instructions.ArgCommand, escape rune) error {
+	for _, arg := range metaArgs {
+		var value *string
+		if arg.Value != nil {
+			resolved, err := util.ResolveEnvironmentReplacement(*arg.Value, b.MetaEnvs(), escape, false)
+			if err != nil {
+				return err
+			}
+			value = &resolved
+		}
+		b.AddMetaArg(arg.Key, value)
+	}
+	return nil
+}
+
+// MetaEnvs returns the meta args with values as key=value pairs, for replacing them in FROM lines
+func (b *BuildArgs) MetaEnvs() []string {
+	var envs []string
+	for k, v := range b.GetAllMeta() {
+		envs = append(envs, k+"="+v)
+	}
+	sort.Strings(envs)
+	return envs
+}
+
 func (b *BuildArgs) Clone() *BuildArgs {
 	clone := b.BuildArgs.Clone()
 	return &BuildArgs{
@@ -52,3 +118,18 @@ func (b *BuildArgs) ReplacementEnvs(envs []string) []string {
 	filtered := b.FilterAllowed(envs)
 	return append(envs, filtered...)
 }
+
+// VisibleArgs returns the args which commands can see, as sorted key=value pairs. Args which are
+// overridden by envs are left out, as are builtin args like HTTP_PROXY unless the Dockerfile declares them,
+// since docker doesn't let those invalidate the cache either.
+func (b *BuildArgs) VisibleArgs(envs []string) []string {
+	var args []string
+	for _, arg := range b.FilterAllowed(envs) {
+		key := strings.SplitN(arg, "=", 2)[0]
+		if b.IsReferencedOrNotBuiltin(key) {
+			args = append(args, arg)
+		}
+	}
+	sort.Strings(args)
+	return args
+}
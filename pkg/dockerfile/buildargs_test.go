@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func TestVisibleArgs(t *testing.T) {
+	value := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		options  []string
+		declared map[string]*string
+		envs     []string
+		expected []string
+	}{
+		{
+			name:     "declared args with values from options and defaults",
+			options:  []string{"VERSION=2"},
+			declared: map[string]*string{"VERSION": value("1"), "NAME": value("kaniko")},
+			expected: []string{"NAME=kaniko", "VERSION=2"},
+		},
+		{
+			name:     "undeclared args aren't visible",
+			options:  []string{"VERSION=2", "UNUSED=1"},
+			declared: map[string]*string{"VERSION": nil},
+			expected: []string{"VERSION=2"},
+		},
+		{
+			name:     "env overrides args",
+			options:  []string{"VERSION=2"},
+			declared: map[string]*string{"VERSION": nil},
+			envs:     []string{"VERSION=3"},
+		},
+		{
+			name:     "builtin args are left out unless declared",
+			options:  []string{"HTTP_PROXY=http://proxy", "HTTPS_PROXY=http://proxy"},
+			declared: map[string]*string{"HTTPS_PROXY": nil},
+			expected: []string{"HTTPS_PROXY=http://proxy"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBuildArgs(test.options)
+			for k, v := range test.declared {
+				b.AddArg(k, v)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, b.VisibleArgs(test.envs))
+		})
+	}
+}
+
+func TestReadBuildArgFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("KANIKO_TEST_TOKEN")
+	if err := os.Setenv("KANIKO_TEST_TOKEN", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		contents  string
+		expected  []string
+		shouldErr bool
+	}{
+		{
+			name:     "comments and blank lines",
+			contents: "# versions\nVERSION=1\n\n  NAME = kaniko\nURL=https://example.com/?a=b\n",
+			expected: []string{"VERSION=1", "NAME = kaniko", "URL=https://example.com/?a=b"},
+		},
+		{
+			name:     "inherits from the environment",
+			contents: "KANIKO_TEST_TOKEN\nKANIKO_TEST_UNSET\n",
+			expected: []string{"KANIKO_TEST_TOKEN=secret", "KANIKO_TEST_UNSET"},
+		},
+		{
+			name:      "missing name",
+			contents:  "=1\n",
+			shouldErr: true,
+		},
+	}
+	path := filepath.Join(dir, "build-args")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			actual, err := ReadBuildArgFile(path)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+
+	_, err = ReadBuildArgFile(filepath.Join(dir, "missing"))
+	testutil.CheckError(t, true, err)
+}
+
+func TestNewBuildArgs_Precedence(t *testing.T) {
+	fileArgs := []string{"VERSION=1", "NAME=file", "URL=https://example.com/?a=b"}
+	flagArgs := []string{"VERSION=2"}
+	b := NewBuildArgs(append(fileArgs, flagArgs...))
+	for _, key := range []string{"VERSION", "NAME", "URL"} {
+		b.AddArg(key, nil)
+	}
+	expected := map[string]string{
+		"VERSION": "2",
+		"NAME":    "file",
+		"URL":     "https://example.com/?a=b",
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, b.GetAllAllowed())
+}
+
+func TestMetaArgs(t *testing.T) {
+	dockerfile := `ARG REGISTRY=gcr.io
+ARG IMAGE=${REGISTRY}/distroless/base
+ARG TAG=latest
+ARG UNUSED
+FROM ${IMAGE}:${TAG} AS base
+ARG TAG
+ARG STAGE=base
+ARG VERSION
+FROM busybox:${TAG}
+ARG VERSION
+ARG HTTP_PROXY
+`
+	tests := []struct {
+		name              string
+		buildArgs         []string
+		expectedBaseNames []string
+		// expectedEnvs are the args each stage's commands see after its ARGs
+		expectedEnvs [][]string
+	}{
+		{
+			name:              "defaults",
+			expectedBaseNames: []string{"gcr.io/distroless/base:latest", "busybox:latest"},
+			expectedEnvs: [][]string{
+				{"STAGE=base", "TAG=latest"},
+				nil,
+			},
+		},
+		{
+			name:              "build args override defaults",
+			buildArgs:         []string{"REGISTRY=docker.io", "TAG=1.0", "VERSION=2", "HTTP_PROXY=http://proxy"},
+			expectedBaseNames: []string{"docker.io/distroless/base:1.0", "busybox:1.0"},
+			expectedEnvs: [][]string{
+				{"HTTP_PROXY=http://proxy", "STAGE=base", "TAG=1.0", "VERSION=2"},
+				{"HTTP_PROXY=http://proxy", "VERSION=2"},
+			},
+		},
+		{
+			name:              "build args which aren't meta args aren't used in FROM",
+			buildArgs:         []string{"STAGE=other"},
+			expectedBaseNames: []string{"gcr.io/distroless/base:latest", "busybox:latest"},
+			expectedEnvs: [][]string{
+				{"STAGE=other", "TAG=latest"},
+				nil,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, metaArgs, directives, err := parse([]byte(dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buildArgs := NewBuildArgs(test.buildArgs)
+			if err := buildArgs.AddMetaArgs(metaArgs, directives.Escape); err != nil {
+				t.Fatal(err)
+			}
+			err = ResolveBaseNames(stages, buildArgs, directives.Escape)
+			var baseNames []string
+			for _, stage := range stages {
+				baseNames = append(baseNames, stage.BaseName)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedBaseNames, baseNames)
+
+			for i, stage := range stages {
+				// Like the build, each stage starts with its own copy of the args
+				stageArgs := buildArgs.Clone()
+				for _, cmd := range stage.Commands {
+					if arg, ok := cmd.(*instructions.ArgCommand); ok {
+						stageArgs.AddArg(arg.Key, arg.Value)
+					}
+				}
+				envs := stageArgs.ReplacementEnvs(nil)
+				sort.Strings(envs)
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedEnvs[i], envs)
+			}
+		})
+	}
+}
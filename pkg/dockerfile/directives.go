@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+var logger = util.ModuleLogger("dockerfile")
+
+// directiveRegexp matches a parser directive, like # escape=`
+var directiveRegexp = regexp.MustCompile(`^#[ \t]*([A-Za-z][A-Za-z0-9]*)[ \t]*=[ \t]*(.*?)[ \t]*$`)
+
+// defaultFrontend is the image of the frontend which builds Dockerfiles with docker, which kaniko's
+// parser stands in for
+const defaultFrontend = "docker/dockerfile"
+
+// Directives are the parser directives at the top of a Dockerfile
+type Directives struct {
+	// Escape is the character which escapes characters in words and continues lines, \ or `
+	Escape rune
+	// Syntax is the image of the frontend the Dockerfile asks to be built with, which kaniko doesn't run
+	Syntax string
+}
+
+// parseDirectives parses the parser directives at the top of the Dockerfile b, which end at the first
+// line that isn't one. Like docker, a directive kaniko doesn't know is a comment, which ends them too.
+// Since the buildkit parser only looks for the escape directive on the first line, b is returned with
+// it moved there, which keeps the same number of lines.
+func parseDirectives(b []byte) (Directives, []byte, error) {
+	directives := Directives{Escape: parser.DefaultEscapeToken}
+	lines := bytes.Split(b, []byte("\n"))
+	seen := map[string]bool{}
+	escapeLine := -1
+	for i, line := range lines {
+		m := directiveRegexp.FindSubmatch(bytes.TrimRight(line, "\r"))
+		if m == nil {
+			break
+		}
+		key, value := strings.ToLower(string(m[1])), string(m[2])
+		if key != "escape" && key != "syntax" {
+			break
+		}
+		if seen[key] {
+			return Directives{}, nil, errors.Errorf("Dockerfile parse error line %d: only one %s parser directive can be used", i+1, key)
+		}
+		seen[key] = true
+		switch key {
+		case "escape":
+			if value != "`" && value != `\` {
+				return Directives{}, nil, errors.Errorf("Dockerfile parse error line %d: invalid escape parser directive %q: must be ` or \\", i+1, value)
+			}
+			directives.Escape = rune(value[0])
+			escapeLine = i
+		case "syntax":
+			if _, err := name.ParseReference(value, name.WeakValidation); err != nil {
+				return Directives{}, nil, errors.Wrapf(err, "Dockerfile parse error line %d: invalid syntax parser directive", i+1)
+			}
+			directives.Syntax = value
+		}
+	}
+	if directives.Syntax != "" {
+		if isDefaultFrontend(directives.Syntax) {
+			logger.Infof("Building the Dockerfile with kaniko's own parser instead of the %s frontend", directives.Syntax)
+		} else {
+			logger.Warnf("Custom frontends aren't supported, so the Dockerfile is built with kaniko's own parser instead of %s", directives.Syntax)
+		}
+	}
+	if escapeLine > 0 {
+		moved := append([][]byte{lines[escapeLine]}, lines[:escapeLine]...)
+		lines = append(moved, lines[escapeLine+1:]...)
+		b = bytes.Join(lines, []byte("\n"))
+	}
+	return directives, b, nil
+}
+
+// isDefaultFrontend returns true if syntax is a version of docker's own Dockerfile frontend,
+// like docker/dockerfile:1
+func isDefaultFrontend(syntax string) bool {
+	ref, err := name.ParseReference(syntax, name.WeakValidation)
+	if err != nil {
+		return false
+	}
+	return ref.Context().RegistryStr() == name.DefaultRegistry && ref.Context().RepositoryStr() == defaultFrontend
+}
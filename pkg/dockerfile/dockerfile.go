@@ -19,43 +19,144 @@ package dockerfile
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
 )
 
-// Stages reads the Dockerfile, validates it's contents, and returns stages
-func Stages(dockerfilePath, target string) ([]instructions.Stage, error) {
-	d, err := ioutil.ReadFile(dockerfilePath)
+// Stages reads the Dockerfile, validates it's contents, and returns stages, along with the meta args
+// declared before the first FROM and its parser directives, whose escape character the words in its
+// instructions are resolved with. With a target, the stages after it aren't returned, since they aren't built.
+func Stages(dockerfilePath, target string) ([]instructions.Stage, []instructions.ArgCommand, Directives, error) {
+	d, err := ReadDockerfile(dockerfilePath)
 	if err != nil {
-		return nil, err
+		return nil, nil, Directives{}, err
 	}
 
-	stages, err := Parse(d)
+	stages, metaArgs, directives, err := parse(d)
 	if err != nil {
-		return nil, err
+		return nil, nil, Directives{}, err
 	}
 	if err := ValidateTarget(stages, target); err != nil {
-		return nil, err
+		return nil, nil, Directives{}, err
+	}
+	stages = targetStages(stages, target)
+	if err := ResolveStages(stages); err != nil {
+		return nil, nil, Directives{}, err
+	}
+	return stages, metaArgs, directives, nil
+}
+
+var (
+	// stdin is where the Dockerfile is read from instead of os.Stdin, if it's set
+	stdin           io.Reader
+	stdinOnce       sync.Once
+	stdinDockerfile []byte
+	stdinErr        error
+)
+
+// SetStdin has the Dockerfile read from r again instead of os.Stdin, and returns a function which has it
+// read from os.Stdin again
+func SetStdin(r io.Reader) func() {
+	stdin, stdinOnce = r, sync.Once{}
+	return func() {
+		stdin, stdinOnce = nil, sync.Once{}
+	}
+}
+
+// ReadDockerfile reads the Dockerfile at dockerfilePath, or from stdin if it's -. Stdin is only read once, and
+// the same Dockerfile is returned after that, since it's parsed again for each platform that's built.
+func ReadDockerfile(dockerfilePath string) ([]byte, error) {
+	if dockerfilePath != constants.DockerfileStdin {
+		return ioutil.ReadFile(dockerfilePath)
 	}
-	ResolveStages(stages)
-	return stages, nil
+	stdinOnce.Do(func() {
+		var r io.Reader = os.Stdin
+		if stdin != nil {
+			r = stdin
+		}
+		stdinDockerfile, stdinErr = ioutil.ReadAll(r)
+		if stdinErr != nil {
+			stdinErr = errors.Wrap(stdinErr, "reading the Dockerfile from stdin")
+		}
+	})
+	return stdinDockerfile, stdinErr
 }
 
 // Parse parses the contents of a Dockerfile and returns a list of commands
 func Parse(b []byte) ([]instructions.Stage, error) {
-	p, err := parser.Parse(bytes.NewReader(b))
+	stages, _, _, err := parse(b)
+	return stages, err
+}
+
+// parse parses the contents of a Dockerfile into stages, the meta args before the first FROM, and its
+// parser directives
+func parse(b []byte) ([]instructions.Stage, []instructions.ArgCommand, Directives, error) {
+	directives, b, err := parseDirectives(b)
 	if err != nil {
-		return nil, err
+		return nil, nil, Directives{}, err
 	}
-	stages, _, err := instructions.Parse(p.AST)
+	b, heredocs, err := extractHeredocs(b, directives.Escape)
 	if err != nil {
-		return nil, err
+		return nil, nil, Directives{}, err
 	}
-	return stages, err
+	p, err := parser.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, Directives{}, err
+	}
+	var stages []instructions.Stage
+	var metaArgs []instructions.ArgCommand
+	for _, n := range p.AST.Children {
+		ins, err := parseInstruction(n, heredocs[n.StartLine])
+		if err != nil {
+			return nil, nil, Directives{}, errors.Wrapf(err, "Dockerfile parse error line %d", n.StartLine)
+		}
+		switch c := ins.(type) {
+		case *instructions.Stage:
+			stages = append(stages, *c)
+		case *instructions.ArgCommand:
+			// ARGs before the first FROM are meta args, which can only be used in FROM lines,
+			// and by ARGs in a stage with the same name
+			if len(stages) == 0 {
+				metaArgs = append(metaArgs, *c)
+				continue
+			}
+			stages[len(stages)-1].AddCommand(c)
+		case instructions.Command:
+			if len(stages) == 0 {
+				return nil, nil, Directives{}, errors.Errorf("Dockerfile parse error line %d: no build stage in current context", n.StartLine)
+			}
+			stages[len(stages)-1].AddCommand(c)
+		default:
+			return nil, nil, Directives{}, errors.Errorf("%T is not a command type", ins)
+		}
+	}
+	return stages, metaArgs, directives, nil
+}
+
+// ResolveBaseNames replaces the meta args in the base images of stages, like FROM alpine:${VERSION}, with
+// escape as the escape character
+func ResolveBaseNames(stages []instructions.Stage, buildArgs *BuildArgs, escape rune) error {
+	metaEnvs := buildArgs.MetaEnvs()
+	for i, stage := range stages {
+		baseName, err := util.ResolveEnvironmentReplacement(stage.BaseName, metaEnvs, escape, false)
+		if err != nil {
+			return errors.Wrapf(err, "resolving base image %s", stage.BaseName)
+		}
+		stages[i].BaseName = baseName
+	}
+	return nil
 }
 
 func ValidateTarget(stages []instructions.Stage, target string) error {
@@ -70,29 +171,168 @@ func ValidateTarget(stages []instructions.Stage, target string) error {
 	return fmt.Errorf("%s is not a valid target build stage", target)
 }
 
+// targetStages returns the stages up to and including the target stage, or all of them if there's no target
+func targetStages(stages []instructions.Stage, target string) []instructions.Stage {
+	if target == "" {
+		return stages
+	}
+	for i, stage := range stages {
+		if stage.Name == target {
+			return stages[:i+1]
+		}
+	}
+	return stages
+}
+
 // ResolveStages resolves any calls to previous stages with names to indices
-// Ex. --from=second_stage should be --from=1 for easier processing later on
-func ResolveStages(stages []instructions.Stage) {
-	nameToIndex := make(map[string]string)
+// Ex. --from=second_stage should be --from=1 for easier processing later on.
+// Like docker, --from can also be the index of a previous stage, counting from 0. It returns an error
+// if --from is the name or index of a stage which isn't built yet, since only previous stages can be copied from.
+func ResolveStages(stages []instructions.Stage) error {
+	nameToIndex := make(map[string]int)
 	for i, stage := range stages {
-		index := strconv.Itoa(i)
-		if stage.Name != index {
-			nameToIndex[stage.Name] = index
+		if stage.Name != "" {
+			nameToIndex[stage.Name] = i
 		}
+	}
+	for i, stage := range stages {
 		for _, cmd := range stage.Commands {
-			switch c := cmd.(type) {
-			case *instructions.CopyCommand:
-				if c.From != "" {
-					if val, ok := nameToIndex[c.From]; ok {
-						c.From = val
-					}
-				}
+			c, ok := cmd.(*CopyCommand)
+			if !ok || c.From == "" {
+				continue
 			}
+			from, err := stageIndex(c.From, nameToIndex, len(stages))
+			if err != nil {
+				return errors.Wrapf(err, "stage %d: COPY --from=%s", i, c.From)
+			}
+			// Anything else is an image
+			if from < 0 {
+				continue
+			}
+			if from >= i {
+				return errors.Errorf("stage %d: COPY --from=%s refers to stage %d, which isn't built before it", i, c.From, from)
+			}
+			c.From = strconv.Itoa(from)
+		}
+	}
+	return nil
+}
+
+// stageIndex returns the index of the stage with the name or index from, or -1 if from isn't a stage
+func stageIndex(from string, nameToIndex map[string]int, numStages int) (int, error) {
+	if index, ok := nameToIndex[from]; ok {
+		return index, nil
+	}
+	index, err := strconv.Atoi(from)
+	if err != nil {
+		return -1, nil
+	}
+	if index < 0 || index >= numStages {
+		return 0, errors.Errorf("there is no stage %d, the Dockerfile has %d stages", index, numStages)
+	}
+	return index, nil
+}
+
+// BuildContext is a context given with --build-context, which FROM and COPY --from can use by its name.
+// It's either an image, or a directory.
+type BuildContext struct {
+	Image string
+	Dir   string
+}
+
+// buildContextName is what the name of a --build-context can be, which includes image names like alpine:3.9
+var buildContextName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:/@-]*$`)
+
+// ParseBuildContext parses the value of --build-context, name=<source>, into the name and the source
+func ParseBuildContext(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.Errorf("--build-context %s must be name=<source>", value)
+	}
+	name := parts[0]
+	if !buildContextName.MatchString(name) || strings.Contains(name, "..") {
+		return "", "", errors.Errorf("--build-context %s: %q isn't a valid name", value, name)
+	}
+	// --from with a number is the index of a stage
+	if _, err := strconv.Atoi(name); err == nil {
+		return "", "", errors.Errorf("--build-context %s: the name can't be a number, since COPY --from=%s is stage %s", value, name, name)
+	}
+	return name, parts[1], nil
+}
+
+// ParseBuildContexts parses the values of --build-context, whose sources are either an image as
+// docker-image://<image>, or a directory
+func ParseBuildContexts(values []string) (map[string]BuildContext, error) {
+	contexts := map[string]BuildContext{}
+	for _, value := range values {
+		name, source, err := ParseBuildContext(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := contexts[name]; ok {
+			return nil, errors.Errorf("--build-context %s was given more than once", name)
+		}
+		if strings.HasPrefix(source, constants.DockerImageBuildContextPrefix) {
+			image := strings.TrimPrefix(source, constants.DockerImageBuildContextPrefix)
+			if image == "" {
+				return nil, errors.Errorf("--build-context %s has no image", value)
+			}
+			contexts[name] = BuildContext{Image: image}
+			continue
+		}
+		dir, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return nil, errors.Errorf("--build-context %s: %s isn't a directory", value, dir)
+		}
+		contexts[name] = BuildContext{Dir: dir}
+	}
+	return contexts, nil
+}
+
+// ResolveBuildContexts replaces the names of contexts in FROM and COPY --from with what they are. A FROM of
+// a context builds on its image, and a COPY --from it copies from its image, or its directory instead of the
+// build context. Contexts can't have the names of stages, since --from with the name of a stage copies from it.
+func ResolveBuildContexts(stages []instructions.Stage, contexts map[string]BuildContext) error {
+	if len(contexts) == 0 {
+		return nil
+	}
+	for _, stage := range stages {
+		if _, ok := contexts[stage.Name]; ok {
+			return errors.Errorf("--build-context %s has the same name as a stage", stage.Name)
+		}
+	}
+	for i, stage := range stages {
+		if context, ok := contexts[stage.BaseName]; ok {
+			if context.Image == "" {
+				return errors.Errorf("stage %d: FROM %s: --build-context %s is a directory, so it can't be built on", i, stage.BaseName, stage.BaseName)
+			}
+			stages[i].BaseName = context.Image
+		}
+		for _, cmd := range stage.Commands {
+			c, ok := cmd.(*CopyCommand)
+			if !ok || c.From == "" {
+				continue
+			}
+			context, ok := contexts[c.From]
+			if !ok {
+				continue
+			}
+			if context.Image != "" {
+				c.From = context.Image
+				continue
+			}
+			c.From = ""
+			c.Context = context.Dir
 		}
 	}
+	return nil
 }
 
-// ParseCommands parses an array of commands into an array of instructions.Command; used for onbuild
+// ParseCommands parses an array of commands into an array of instructions.Command; used for onbuild.
+// Like docker, they're parsed with the default escape character, not the one of the Dockerfile they're from.
 func ParseCommands(cmdArray []string) ([]instructions.Command, error) {
 	var cmds []instructions.Command
 	cmdString := strings.Join(cmdArray, "\n")
@@ -101,10 +341,14 @@ func ParseCommands(cmdArray []string) ([]instructions.Command, error) {
 		return nil, err
 	}
 	for _, child := range ast.AST.Children {
-		cmd, err := instructions.ParseCommand(child)
+		ins, err := parseInstruction(child, nil)
 		if err != nil {
 			return nil, err
 		}
+		cmd, ok := ins.(instructions.Command)
+		if !ok {
+			return nil, errors.Errorf("%T is not a command type", ins)
+		}
 		cmds = append(cmds, cmd)
 	}
 	return cmds, nil
@@ -123,7 +367,7 @@ func SaveStage(index int, stages []instructions.Stage) bool {
 		}
 		for _, cmd := range stage.Commands {
 			switch c := cmd.(type) {
-			case *instructions.CopyCommand:
+			case *CopyCommand:
 				if c.From == strconv.Itoa(index) {
 					return true
 				}
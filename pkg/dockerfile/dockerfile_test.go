@@ -17,13 +17,19 @@ limitations under the License.
 package dockerfile
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 )
 
@@ -42,12 +48,14 @@ func Test_ResolveStages(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ResolveStages(stages)
+	if err := ResolveStages(stages); err != nil {
+		t.Fatal(err)
+	}
 	for index, stage := range stages {
 		if index == 0 {
 			continue
 		}
-		copyCmd := stage.Commands[0].(*instructions.CopyCommand)
+		copyCmd := stage.Commands[0].(*CopyCommand)
 		expectedStage := strconv.Itoa(index - 1)
 		if copyCmd.From != expectedStage {
 			t.Fatalf("unexpected copy command: %s resolved to stage %s, expected %s", copyCmd.String(), copyCmd.From, expectedStage)
@@ -55,6 +63,258 @@ func Test_ResolveStages(t *testing.T) {
 	}
 }
 
+func Test_ResolveStages_From(t *testing.T) {
+	tests := []struct {
+		name         string
+		from         string
+		expectedFrom string
+		shouldErr    bool
+	}{
+		{
+			name:         "index of a previous stage",
+			from:         "1",
+			expectedFrom: "1",
+		},
+		{
+			name:         "name of a previous stage",
+			from:         "second",
+			expectedFrom: "1",
+		},
+		{
+			name:         "index with a leading zero",
+			from:         "01",
+			expectedFrom: "1",
+		},
+		{
+			name:         "image",
+			from:         "gcr.io/distroless/base",
+			expectedFrom: "gcr.io/distroless/base",
+		},
+		{
+			name:      "index of the stage itself",
+			from:      "2",
+			shouldErr: true,
+		},
+		{
+			name:      "index of a later stage",
+			from:      "3",
+			shouldErr: true,
+		},
+		{
+			name:      "name of a later stage",
+			from:      "last",
+			shouldErr: true,
+		},
+		{
+			name:      "index out of range",
+			from:      "4",
+			shouldErr: true,
+		},
+		{
+			name:      "negative index",
+			from:      "-1",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerfile := fmt.Sprintf(`
+			FROM scratch
+			FROM scratch AS second
+			FROM scratch
+			COPY --from=%s /hi /hi
+			FROM scratch AS last
+			`, test.from)
+			stages, err := Parse([]byte(dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ResolveStages(stages)
+			testutil.CheckError(t, test.shouldErr, err)
+			if !test.shouldErr {
+				copyCmd := stages[2].Commands[0].(*CopyCommand)
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedFrom, copyCmd.From)
+			}
+		})
+	}
+}
+
+func Test_ParseBuildContexts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		values    []string
+		expected  map[string]BuildContext
+		shouldErr bool
+	}{
+		{
+			name:   "image and directory",
+			values: []string{"base=docker-image://alpine:3.9", "alpine:3.9=docker-image://gcr.io/distroless/base", "assets=" + dir},
+			expected: map[string]BuildContext{
+				"base":       {Image: "alpine:3.9"},
+				"alpine:3.9": {Image: "gcr.io/distroless/base"},
+				"assets":     {Dir: dir},
+			},
+		},
+		{
+			name:      "no source",
+			values:    []string{"assets"},
+			shouldErr: true,
+		},
+		{
+			name:      "no image",
+			values:    []string{"base=docker-image://"},
+			shouldErr: true,
+		},
+		{
+			name:      "number",
+			values:    []string{"0=" + dir},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid name",
+			values:    []string{"../assets=" + dir},
+			shouldErr: true,
+		},
+		{
+			name:      "file",
+			values:    []string{"assets=" + file},
+			shouldErr: true,
+		},
+		{
+			name:      "given twice",
+			values:    []string{"assets=" + dir, "assets=docker-image://alpine"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ParseBuildContexts(test.values)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func Test_ResolveBuildContexts(t *testing.T) {
+	dockerfile := `
+	FROM base AS build
+	COPY --from=assets /a /a
+	COPY --from=tools /bin/tool /bin/
+	FROM build
+	COPY --from=build /a /b
+	`
+	stages, err := Parse([]byte(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contexts := map[string]BuildContext{
+		"base":   {Image: "alpine:3.9"},
+		"assets": {Dir: "/assets"},
+		"tools":  {Image: "gcr.io/tools"},
+	}
+	if err := ResolveBuildContexts(stages, contexts); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "alpine:3.9", stages[0].BaseName)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "build", stages[1].BaseName)
+	assets := stages[0].Commands[0].(*CopyCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"", "/assets"}, []string{assets.From, assets.Context})
+	tools := stages[0].Commands[1].(*CopyCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"gcr.io/tools", ""}, []string{tools.From, tools.Context})
+	build := stages[1].Commands[0].(*CopyCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"build", ""}, []string{build.From, build.Context})
+
+	// A context can't have the name of a stage
+	stages, err = Parse([]byte(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ResolveBuildContexts(stages, map[string]BuildContext{"build": {Image: "alpine"}})
+	testutil.CheckError(t, true, err)
+
+	// A directory can't be built on
+	err = ResolveBuildContexts(stages, map[string]BuildContext{"base": {Dir: "/base"}})
+	testutil.CheckError(t, true, err)
+}
+
+func Test_Stages_Target(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	// The last stage couldn't even be resolved, since it copies from a stage which doesn't exist
+	files := map[string]string{
+		"Dockerfile": `
+		FROM scratch AS first
+		FROM scratch AS middle
+		COPY --from=first /hi /hi
+		FROM scratch AS last
+		COPY --from=9 /hi /hi
+		`,
+	}
+	if err := testutil.SetupFiles(tempDir, files); err != nil {
+		t.Fatal(err)
+	}
+	stages, _, _, err := Stages(filepath.Join(tempDir, "Dockerfile"), "middle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"first", "middle"}, names)
+
+	_, _, _, err = Stages(filepath.Join(tempDir, "Dockerfile"), "")
+	testutil.CheckError(t, true, err)
+	_, _, _, err = Stages(filepath.Join(tempDir, "Dockerfile"), "missing")
+	testutil.CheckError(t, true, err)
+}
+
+func Test_Stages_Stdin(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := testutil.SetupFiles(tempDir, map[string]string{"Dockerfile": "FROM scratch AS first\nFROM scratch AS second\n"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(tempDir, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(stdin *os.File) {
+		os.Stdin = stdin
+		stdinOnce = sync.Once{}
+	}(os.Stdin)
+	os.Stdin = f
+	stdinOnce = sync.Once{}
+
+	// The Dockerfile is only read from stdin once, but it can be parsed again
+	for i := 0; i < 2; i++ {
+		stages, _, _, err := Stages(constants.DockerfileStdin, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, stage := range stages {
+			names = append(names, stage.Name)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"first", "second"}, names)
+	}
+}
+
 func Test_ValidateTarget(t *testing.T) {
 	dockerfile := `
 	FROM scratch
@@ -131,7 +391,7 @@ func Test_SaveStage(t *testing.T) {
 	if err := testutil.SetupFiles(tempDir, files); err != nil {
 		t.Fatalf("couldn't create dockerfile: %v", err)
 	}
-	stages, err := Stages(filepath.Join(tempDir, "Dockerfile"), "")
+	stages, _, _, err := Stages(filepath.Join(tempDir, "Dockerfile"), "")
 	if err != nil {
 		t.Fatalf("couldn't retrieve stages from Dockerfile: %v", err)
 	}
@@ -178,3 +438,556 @@ func Test_SaveStage(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseKanikoFlags(t *testing.T) {
+	tests := []struct {
+		name             string
+		dockerfile       string
+		expectedChmod    string
+		expectedFrom     string
+		expectedLink     bool
+		expectedPlatform *v1.Platform
+		shouldErr        bool
+	}{
+		{
+			name:       "copy without flags",
+			dockerfile: "FROM scratch\nCOPY foo /foo",
+		},
+		{
+			name:          "copy with chmod",
+			dockerfile:    "FROM scratch\nCOPY --chmod=0755 foo /foo",
+			expectedChmod: "0755",
+		},
+		{
+			name:          "copy with chmod and from",
+			dockerfile:    "FROM scratch\nCOPY --from=0 --chmod=644 foo /foo",
+			expectedChmod: "644",
+			expectedFrom:  "0",
+		},
+		{
+			name:          "copy with link",
+			dockerfile:    "FROM scratch\nCOPY --link --chmod=644 foo /foo",
+			expectedChmod: "644",
+			expectedLink:  true,
+		},
+		{
+			name:         "copy with link=true",
+			dockerfile:   "FROM scratch\nCOPY --link=true foo /foo",
+			expectedLink: true,
+		},
+		{
+			name:       "copy with link=false",
+			dockerfile: "FROM scratch\nCOPY --link=false foo /foo",
+		},
+		{
+			name:       "invalid link",
+			dockerfile: "FROM scratch\nCOPY --link=maybe foo /foo",
+			shouldErr:  true,
+		},
+		{
+			name:             "copy from image with platform",
+			dockerfile:       "FROM scratch\nCOPY --from=golang:1.11 --platform=linux/arm/v7 /go/bin/app /app",
+			expectedFrom:     "golang:1.11",
+			expectedPlatform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		{
+			name:       "invalid platform",
+			dockerfile: "FROM scratch\nCOPY --from=golang:1.11 --platform=linux /go/bin/app /app",
+			shouldErr:  true,
+		},
+		{
+			name:       "more than one platform",
+			dockerfile: "FROM scratch\nCOPY --from=golang:1.11 --platform=linux/amd64,linux/arm64 /go/bin/app /app",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid chmod",
+			dockerfile: "FROM scratch\nCOPY --chmod=rwx foo /foo",
+			shouldErr:  true,
+		},
+		{
+			name:       "chmod out of range",
+			dockerfile: "FROM scratch\nCOPY --chmod=17777 foo /foo",
+			shouldErr:  true,
+		},
+		{
+			name:       "unknown flag",
+			dockerfile: "FROM scratch\nCOPY --foo=bar foo /foo",
+			shouldErr:  true,
+		},
+		{
+			name:       "chmod on another instruction",
+			dockerfile: "FROM scratch\nWORKDIR --chmod=0755 /foo",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			copyCmd := stages[0].Commands[0].(*CopyCommand)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedChmod, copyCmd.Chmod)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedFrom, copyCmd.From)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedLink, copyCmd.Link)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedPlatform, copyCmd.Platform)
+		})
+	}
+}
+
+func Test_ParseAddFlags(t *testing.T) {
+	checksum := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	tests := []struct {
+		name             string
+		dockerfile       string
+		expectedChecksum string
+		expectedChmod    string
+		expectedChown    string
+		expectedNested   []string
+		shouldErr        bool
+	}{
+		{
+			name:       "add without flags",
+			dockerfile: "FROM scratch\nADD https://example.com/foo /foo",
+		},
+		{
+			name:             "add with checksum",
+			dockerfile:       "FROM scratch\nADD --checksum=" + checksum + " https://example.com/foo /foo",
+			expectedChecksum: checksum,
+		},
+		{
+			name:       "invalid checksum",
+			dockerfile: "FROM scratch\nADD --checksum=sha256:abc https://example.com/foo /foo",
+			shouldErr:  true,
+		},
+		{
+			name:          "add with chmod and chown",
+			dockerfile:    "FROM scratch\nADD --chmod=0644 --chown=1000:1000 foo.tar /foo",
+			expectedChmod: "0644",
+			expectedChown: "1000:1000",
+		},
+		{
+			name:       "invalid chmod on add",
+			dockerfile: "FROM scratch\nADD --chmod=rw foo.tar /foo",
+			shouldErr:  true,
+		},
+		{
+			name:           "add with nested archives",
+			dockerfile:     "FROM scratch\nADD --extract-nested=lib/a.tar.gz,/b.tar --extract-nested=lib/a/c.tar bundle.tar /",
+			expectedNested: []string{"lib/a.tar.gz", "b.tar", "lib/a/c.tar"},
+		},
+		{
+			name:       "nested archive outside the destination",
+			dockerfile: "FROM scratch\nADD --extract-nested=../a.tar bundle.tar /app",
+			shouldErr:  true,
+		},
+		{
+			name:       "empty nested archive",
+			dockerfile: "FROM scratch\nADD --extract-nested= bundle.tar /app",
+			shouldErr:  true,
+		},
+		{
+			name:       "extract-nested on copy",
+			dockerfile: "FROM scratch\nCOPY --extract-nested=a.tar bundle.tar /app",
+			shouldErr:  true,
+		},
+		{
+			name:       "checksum on copy",
+			dockerfile: "FROM scratch\nCOPY --checksum=" + checksum + " foo /foo",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			addCmd := stages[0].Commands[0].(*AddCommand)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedChecksum, addCmd.Checksum)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedChmod, addCmd.Chmod)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedChown, addCmd.Chown)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedNested, addCmd.ExtractNested)
+		})
+	}
+}
+
+func Test_ParseStopSignal(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		shouldErr  bool
+	}{
+		{
+			name:       "signal name",
+			dockerfile: "FROM scratch\nSTOPSIGNAL SIGTERM",
+		},
+		{
+			name:       "signal number",
+			dockerfile: "FROM scratch\nSTOPSIGNAL 9",
+		},
+		{
+			name:       "variable",
+			dockerfile: "FROM scratch\nARG SIG\nSTOPSIGNAL $SIG",
+		},
+		{
+			name:       "invalid signal name",
+			dockerfile: "FROM scratch\nSTOPSIGNAL SIGNOPE",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid signal number",
+			dockerfile: "FROM scratch\nSTOPSIGNAL 0",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+		})
+	}
+}
+
+func Test_ParseRunMounts(t *testing.T) {
+	tests := []struct {
+		name           string
+		dockerfile     string
+		expectedMounts []Mount
+		shouldErr      bool
+	}{
+		{
+			name:       "run without mounts",
+			dockerfile: "FROM scratch\nRUN echo hi",
+		},
+		{
+			name:       "cache mount",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,target=/var/cache/apt apt-get update",
+			expectedMounts: []Mount{
+				{Type: MountTypeCache, ID: "/var/cache/apt", Target: "/var/cache/apt", Mode: 0755},
+			},
+		},
+		{
+			name:       "multiple cache mounts with ids",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,id=npm,dst=/root/.npm/ --mount=type=cache,id=apt,target=/var/cache/apt,sharing=locked echo hi",
+			expectedMounts: []Mount{
+				{Type: MountTypeCache, ID: "npm", Target: "/root/.npm", Mode: 0755},
+				{Type: MountTypeCache, ID: "apt", Target: "/var/cache/apt", Mode: 0755},
+			},
+		},
+		{
+			name:       "cache mount with ownership",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,target=/home/user/.cache,uid=1000,gid=1000,mode=0700 echo hi",
+			expectedMounts: []Mount{
+				{Type: MountTypeCache, ID: "/home/user/.cache", Target: "/home/user/.cache", Mode: 0700, UID: 1000, GID: 1000},
+			},
+		},
+		{
+			name:       "secret mount with default target",
+			dockerfile: "FROM scratch\nRUN --mount=type=secret,id=token cat /run/secrets/token",
+			expectedMounts: []Mount{
+				{Type: MountTypeSecret, ID: "token", Target: "/run/secrets/token", Mode: 0400},
+			},
+		},
+		{
+			name:       "required secret mount with target",
+			dockerfile: "FROM scratch\nRUN --mount=type=secret,id=token,target=/root/.npmrc,required npm install",
+			expectedMounts: []Mount{
+				{Type: MountTypeSecret, ID: "token", Target: "/root/.npmrc", Required: true, Mode: 0400},
+			},
+		},
+		{
+			name:       "secret mount id defaults to target name",
+			dockerfile: "FROM scratch\nRUN --mount=type=secret,target=/root/.netrc,required=false cat /root/.netrc",
+			expectedMounts: []Mount{
+				{Type: MountTypeSecret, ID: ".netrc", Target: "/root/.netrc", Mode: 0400},
+			},
+		},
+		{
+			name:       "secret mount without id or target",
+			dockerfile: "FROM scratch\nRUN --mount=type=secret echo hi",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid mode",
+			dockerfile: "FROM scratch\nRUN --mount=type=secret,id=token,mode=999 echo hi",
+			shouldErr:  true,
+		},
+		{
+			name:       "bind mounts aren't supported",
+			dockerfile: "FROM scratch\nRUN --mount=target=/foo echo hi",
+			shouldErr:  true,
+		},
+		{
+			name:       "missing target",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,id=foo echo hi",
+			shouldErr:  true,
+		},
+		{
+			name:       "unknown option",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,target=/foo,foo=bar echo hi",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid sharing",
+			dockerfile: "FROM scratch\nRUN --mount=type=cache,target=/foo,sharing=none echo hi",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			runCmd := stages[0].Commands[0].(*RunCommand)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedMounts, runCmd.Mounts)
+		})
+	}
+}
+
+func Test_ParseHeredocs(t *testing.T) {
+	tests := []struct {
+		name             string
+		dockerfile       string
+		expectedCmdLine  []string
+		expectedHeredocs []Heredoc
+		shouldErr        bool
+	}{
+		{
+			name:            "run script",
+			dockerfile:      "FROM scratch\nRUN <<EOF\napt-get update\napt-get install -y curl\nEOF\n",
+			expectedCmdLine: []string{"apt-get update\napt-get install -y curl\n"},
+		},
+		{
+			name:            "run with heredoc input",
+			dockerfile:      "FROM scratch\nRUN python3 <<'EOF' > /out\nprint(\"$HOME\")\nEOF\n",
+			expectedCmdLine: []string{"python3 <<'EOF' > /out\nprint(\"$HOME\")\nEOF\n"},
+		},
+		{
+			name:            "run script with tabs stripped",
+			dockerfile:      "FROM scratch\nRUN <<-EOF\n\tif true; then\n\t\techo hi\n\tfi\n\tEOF\n",
+			expectedCmdLine: []string{"if true; then\necho hi\nfi\n"},
+		},
+		{
+			name:            "exec form isn't a heredoc",
+			dockerfile:      "FROM scratch\nRUN [\"echo\", \"<<EOF\"]",
+			expectedCmdLine: []string{"echo", "<<EOF"},
+		},
+		{
+			name:            "shifts aren't heredocs",
+			dockerfile:      "FROM scratch\nRUN echo $((1<<2))",
+			expectedCmdLine: []string{"echo $((1<<2))"},
+		},
+		{
+			name:       "copy inline files",
+			dockerfile: "FROM scratch\nCOPY <<EOF <<\"RAW\" /app/\nhello $NAME\nEOF\nhello $NAME\nRAW\nRUN echo hi",
+			expectedHeredocs: []Heredoc{
+				{Name: "EOF", Content: "hello $NAME\n", Expand: true, Escape: '\\'},
+				{Name: "RAW", Content: "hello $NAME\n", Escape: '\\'},
+			},
+		},
+		{
+			name:       "copy empty heredoc",
+			dockerfile: "FROM scratch\nCOPY <<EOF /empty\nEOF",
+			expectedHeredocs: []Heredoc{
+				{Name: "EOF", Expand: true, Escape: '\\'},
+			},
+		},
+		{
+			name:       "unterminated heredoc",
+			dockerfile: "FROM scratch\nRUN <<EOF\necho hi\n",
+			shouldErr:  true,
+		},
+		{
+			name:       "unterminated quote",
+			dockerfile: "FROM scratch\nRUN <<'EOF\necho hi\nEOF",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages, err := Parse([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			switch cmd := stages[0].Commands[0].(type) {
+			case *RunCommand:
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedCmdLine, []string(cmd.CmdLine))
+			case *CopyCommand:
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedHeredocs, cmd.Heredocs)
+			default:
+				t.Fatalf("unexpected command %T", cmd)
+			}
+		})
+	}
+}
+
+func TestHeredoc_Resolve(t *testing.T) {
+	envs := []string{"NAME=world"}
+	tests := []struct {
+		name     string
+		heredoc  Heredoc
+		expected string
+	}{
+		{
+			name:     "variables are replaced",
+			heredoc:  Heredoc{Content: "hello $NAME\nhello ${NAME}\n", Expand: true},
+			expected: "hello world\nhello world\n",
+		},
+		{
+			name:     "quotes are kept",
+			heredoc:  Heredoc{Content: "'$NAME' \"$NAME\" \\\"\n", Expand: true},
+			expected: "'world' \"world\" \\\"\n",
+		},
+		{
+			name:     "escaped variables aren't replaced",
+			heredoc:  Heredoc{Content: "\\$NAME\n", Expand: true},
+			expected: "$NAME\n",
+		},
+		{
+			name:     "escape directive",
+			heredoc:  Heredoc{Content: "C:\\$NAME \"`$NAME\"\n", Expand: true, Escape: '`'},
+			expected: "C:\\world \"$NAME\"\n",
+		},
+		{
+			name:     "quoted delimiter",
+			heredoc:  Heredoc{Content: "hello $NAME\n"},
+			expected: "hello $NAME\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := test.heredoc.Resolve(envs)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, actual)
+		})
+	}
+}
+
+func Test_parseDirectives(t *testing.T) {
+	tests := []struct {
+		name               string
+		dockerfile         string
+		expectedDirectives Directives
+		expectedDockerfile string
+		shouldErr          bool
+	}{
+		{
+			name:               "no directives",
+			dockerfile:         "FROM scratch",
+			expectedDirectives: Directives{Escape: '\\'},
+			expectedDockerfile: "FROM scratch",
+		},
+		{
+			name:               "escape",
+			dockerfile:         "# escape=`\nFROM scratch",
+			expectedDirectives: Directives{Escape: '`'},
+			expectedDockerfile: "# escape=`\nFROM scratch",
+		},
+		{
+			name:               "escape is moved before syntax",
+			dockerfile:         "# syntax=docker/dockerfile:1\n#ESCAPE = `\nFROM scratch",
+			expectedDirectives: Directives{Escape: '`', Syntax: "docker/dockerfile:1"},
+			expectedDockerfile: "#ESCAPE = `\n# syntax=docker/dockerfile:1\nFROM scratch",
+		},
+		{
+			name:               "directives after a comment are comments",
+			dockerfile:         "# a comment\n# escape=`\nFROM scratch",
+			expectedDirectives: Directives{Escape: '\\'},
+			expectedDockerfile: "# a comment\n# escape=`\nFROM scratch",
+		},
+		{
+			name:               "directives after a blank line are comments",
+			dockerfile:         "\n# escape=`\nFROM scratch",
+			expectedDirectives: Directives{Escape: '\\'},
+			expectedDockerfile: "\n# escape=`\nFROM scratch",
+		},
+		{
+			name:               "unknown directives are comments",
+			dockerfile:         "# foo=bar\n# escape=`\nFROM scratch",
+			expectedDirectives: Directives{Escape: '\\'},
+			expectedDockerfile: "# foo=bar\n# escape=`\nFROM scratch",
+		},
+		{
+			name:       "escape set twice",
+			dockerfile: "# escape=`\n# escape=\\\nFROM scratch",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid escape",
+			dockerfile: "# escape=$\nFROM scratch",
+			shouldErr:  true,
+		},
+		{
+			name:       "invalid syntax",
+			dockerfile: "# syntax=Not An Image\nFROM scratch",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directives, b, err := parseDirectives([]byte(test.dockerfile))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedDirectives, directives)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedDockerfile, string(b))
+		})
+	}
+}
+
+func Test_isDefaultFrontend(t *testing.T) {
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, isDefaultFrontend("docker/dockerfile:1"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, isDefaultFrontend("docker.io/docker/dockerfile:1.4-labs"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, false, isDefaultFrontend("example.com/frontend:1"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, false, isDefaultFrontend("tonistiigi/dockerfile"))
+}
+
+func Test_Parse_EscapeDirective(t *testing.T) {
+	dockerfile := "# syntax=docker/dockerfile:1\n" +
+		"# escape=`\n" +
+		"FROM scratch\n" +
+		"ENV DIR=C:\\app `\n" +
+		"    NAME=\"a `\"quoted`\" name\"\n" +
+		"COPY src\\*.txt `\n" +
+		"     C:\\app\\\n" +
+		"RUN echo one `\n" +
+		"    two\n" +
+		"RUN cat <<EOF `\n" +
+		"    > C:\\app\\greeting\n" +
+		"hello `$NAME\n" +
+		"EOF\n"
+	stages, _, directives, err := parse([]byte(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, '`', directives.Escape)
+	commands := stages[0].Commands
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, len(commands))
+
+	env := commands[0].(*instructions.EnvCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, len(env.Env))
+	// Backslashes aren't escapes, so they're kept when the words are resolved
+	for i, expected := range []string{`C:\app`, `a "quoted" name`} {
+		value, err := util.ResolveEnvironmentReplacement(env.Env[i].Value, nil, directives.Escape, false)
+		testutil.CheckErrorAndDeepEqual(t, false, err, expected, value)
+	}
+
+	copyCmd := commands[1].(*CopyCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, instructions.SourcesAndDest{`src\*.txt`, `C:\app\`}, copyCmd.SourcesAndDest)
+
+	run := commands[2].(*RunCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(run.CmdLine))
+	if !strings.HasPrefix(run.CmdLine[0], "echo one") || !strings.HasSuffix(run.CmdLine[0], "two") {
+		t.Errorf("continued RUN is %q", run.CmdLine[0])
+	}
+
+	heredoc := commands[3].(*RunCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"cat <<EOF     > C:\\app\\greeting\nhello `$NAME\nEOF\n"}, []string(heredoc.CmdLine))
+}
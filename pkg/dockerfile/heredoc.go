@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// heredocRegexp matches a heredoc in a RUN or COPY instruction, like <<EOF, <<-EOF or <<"EOF"
+var heredocRegexp = regexp.MustCompile(`(^|\s)<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// Heredoc is a here-document in a RUN or COPY instruction
+type Heredoc struct {
+	// Name is the delimiter, which is also the name of the file for COPY
+	Name string
+	// Content is the body, with each line ending in a newline. The leading tabs are already
+	// stripped from the lines of a <<- heredoc.
+	Content string
+	// Expand is false if the delimiter is quoted, in which case variables in the body aren't replaced
+	Expand bool
+	// Escape is the escape character of the Dockerfile the heredoc is in, or 0 for \
+	Escape rune
+}
+
+// Resolve returns the body of the heredoc, with the variables in envs replaced unless the delimiter is quoted
+func (h Heredoc) Resolve(envs []string) (string, error) {
+	if !h.Expand {
+		return h.Content, nil
+	}
+	// Quotes aren't special in a heredoc, so the body is resolved as a double quoted word with its quotes escaped
+	escape := h.Escape
+	if escape == 0 {
+		escape = parser.DefaultEscapeToken
+	}
+	var word strings.Builder
+	word.WriteString(`"`)
+	for i, ch := range h.Content {
+		switch {
+		case ch == '"':
+			word.WriteRune(escape)
+			word.WriteString(`"`)
+		case ch == escape && strings.HasPrefix(h.Content[i+1:], `"`):
+			word.WriteRune(escape)
+			word.WriteRune(escape)
+		default:
+			word.WriteRune(ch)
+		}
+	}
+	word.WriteString(`"`)
+	return util.ResolveEnvironmentReplacement(word.String(), envs, escape, false)
+}
+
+// extractHeredocs removes the bodies of the heredocs in RUN and COPY instructions from the Dockerfile b,
+// which the buildkit parser doesn't understand, and returns them by the line the instruction starts on.
+// The bodies are replaced with blank lines, so the parser still reports the right line numbers. Lines
+// ending in escape are continued on the next line.
+func extractHeredocs(b []byte, escape rune) ([]byte, map[int][]Heredoc, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	heredocs := map[int][]Heredoc{}
+	start := -1
+	var instruction []string
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if start < 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			start = i
+		} else if strings.HasPrefix(trimmed, "#") {
+			// Comments can be in the middle of an instruction that's continued over several lines
+			continue
+		}
+		if strings.HasSuffix(trimmed, string(escape)) {
+			instruction = append(instruction, strings.TrimSuffix(trimmed, string(escape)))
+			continue
+		}
+		instruction = append(instruction, trimmed)
+		line := strings.Join(instruction, " ")
+		startLine := start + 1
+		start = -1
+		instruction = nil
+
+		fields := strings.Fields(line)
+		keyword := strings.ToLower(fields[0])
+		if keyword != command.Run && keyword != command.Copy {
+			continue
+		}
+		args := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		if strings.HasPrefix(args, "[") {
+			// Heredocs are only supported in the shell form of RUN
+			continue
+		}
+		for _, m := range heredocRegexp.FindAllStringSubmatch(args, -1) {
+			marker := strings.TrimSpace(m[0])
+			strip, openQuote, name, closeQuote := m[2] == "-", m[3], m[4], m[5]
+			if openQuote != closeQuote {
+				return nil, nil, errors.Errorf("Dockerfile parse error line %d: unterminated quote in heredoc %s", startLine, marker)
+			}
+			heredoc := Heredoc{Name: name, Expand: openQuote == "", Escape: escape}
+			terminated := false
+			var content strings.Builder
+			for i++; i < len(lines); i++ {
+				body := lines[i]
+				lines[i] = ""
+				if strip {
+					body = strings.TrimLeft(body, "\t")
+				}
+				if body == name {
+					terminated = true
+					break
+				}
+				content.WriteString(body + "\n")
+			}
+			if !terminated {
+				return nil, nil, errors.Errorf("Dockerfile parse error line %d: heredoc %s isn't terminated", startLine, marker)
+			}
+			heredoc.Content = content.String()
+			heredocs[startLine] = append(heredocs[startLine], heredoc)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), heredocs, nil
+}
+
+// heredocScript returns the script a RUN instruction with heredocs runs. If the instruction is just heredocs,
+// like RUN <<EOF, their bodies are the script. Otherwise they're given back to the command in the shell's
+// own heredoc syntax, like in RUN python3 <<EOF, so the shell feeds them to the command.
+func heredocScript(cmdLine string, heredocs []Heredoc) string {
+	if strings.TrimSpace(heredocRegexp.ReplaceAllString(cmdLine, "")) == "" {
+		var script strings.Builder
+		for _, h := range heredocs {
+			script.WriteString(h.Content)
+		}
+		return script.String()
+	}
+	script := cmdLine + "\n"
+	for _, h := range heredocs {
+		script += h.Content + h.Name + "\n"
+	}
+	return script
+}
+
+// IsHeredoc returns true if the source of a COPY instruction is a heredoc, like <<EOF
+func IsHeredoc(src string) bool {
+	return heredocRegexp.MatchString(src)
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/docker/docker/pkg/signal"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// kanikoFlags are the flags kaniko supports for each instruction that the buildkit parser doesn't.
+// They're removed from the node before buildkit parses it, since it errors on unknown flags.
+var kanikoFlags = map[string][]string{
+	command.Add:  {"checksum", "chmod", "extract-nested"},
+	command.Copy: {"chmod", "link", "platform"},
+	command.Run:  {"mount"},
+}
+
+// repeatableFlags are the kaniko flags which can be given more than once
+var repeatableFlags = map[string]bool{
+	"mount":          true,
+	"extract-nested": true,
+}
+
+// AddCommand is an ADD instruction, along with the flags which are handled by kaniko
+type AddCommand struct {
+	*instructions.AddCommand
+	// Checksum is the expected digest of a remote source, as <algorithm>:<hex>
+	Checksum string
+	// Chmod is the octal mode to give added files and directories
+	Chmod string
+	// ExtractNested are the paths of archives in the local tar archives being added, relative to the
+	// destination, which are unpacked too once they have been
+	ExtractNested []string
+}
+
+// CopyCommand is a COPY instruction, along with the flags which are handled by kaniko
+type CopyCommand struct {
+	*instructions.CopyCommand
+	// Chmod is the octal mode to give copied files and directories
+	Chmod string
+	// Link copies the files into a layer of their own, which doesn't depend on the filesystem it's copied to
+	Link bool
+	// Heredocs are the contents of the sources which are heredocs, like <<EOF, in the order they're given
+	Heredocs []Heredoc
+	// Platform, if set, is the platform of the image to copy from with --from, instead of the build's
+	Platform *v1.Platform
+	// FromDigest is the digest of the image copied from with --from once it's been retrieved, unless
+	// the files are copied from a previous stage
+	FromDigest string
+	// Context is the directory of the --build-context the files are copied from with --from, if it's
+	// a directory instead of an image
+	Context string
+}
+
+// RunCommand is a RUN instruction, along with the flags which are handled by kaniko
+type RunCommand struct {
+	*instructions.RunCommand
+	// Mounts are the filesystems mounted while the command runs
+	Mounts []Mount
+}
+
+// parseInstruction parses node into a build stage or a command, like instructions.ParseInstruction,
+// but also parses the flags in kanikoFlags and adds the heredocs extracted from the instruction.
+// ADD, COPY and RUN instructions are returned as an *AddCommand, a *CopyCommand and a *RunCommand.
+func parseInstruction(node *parser.Node, heredocs []Heredoc) (interface{}, error) {
+	flags, err := extractKanikoFlags(node)
+	if err != nil {
+		return nil, err
+	}
+	ins, err := instructions.ParseInstruction(node)
+	if err != nil {
+		return nil, err
+	}
+	switch c := ins.(type) {
+	case *instructions.AddCommand:
+		cmd := &AddCommand{AddCommand: c}
+		if checksum, ok := flags["checksum"]; ok {
+			if _, err := util.ParseChecksum(checksum[0]); err != nil {
+				return nil, err
+			}
+			cmd.Checksum = checksum[0]
+		}
+		if chmod, ok := flags["chmod"]; ok {
+			if _, err := util.ParseChmod(chmod[0]); err != nil {
+				return nil, err
+			}
+			cmd.Chmod = chmod[0]
+		}
+		for _, value := range flags["extract-nested"] {
+			paths, err := parseExtractNested(value)
+			if err != nil {
+				return nil, err
+			}
+			cmd.ExtractNested = append(cmd.ExtractNested, paths...)
+		}
+		return cmd, nil
+	case *instructions.CopyCommand:
+		cmd := &CopyCommand{CopyCommand: c}
+		if chmod, ok := flags["chmod"]; ok {
+			if _, err := util.ParseChmod(chmod[0]); err != nil {
+				return nil, err
+			}
+			cmd.Chmod = chmod[0]
+		}
+		if link, ok := flags["link"]; ok {
+			// Like other boolean flags, --link is the same as --link=true
+			cmd.Link = true
+			if link[0] != "" {
+				if cmd.Link, err = strconv.ParseBool(link[0]); err != nil {
+					return nil, errors.Errorf("invalid --link=%s: must be true or false", link[0])
+				}
+			}
+		}
+		if platform, ok := flags["platform"]; ok {
+			platforms, err := util.ParsePlatforms(platform)
+			if err != nil {
+				return nil, err
+			}
+			if len(platforms) != 1 {
+				return nil, errors.Errorf("invalid --platform=%s: COPY only copies from one platform", platform[0])
+			}
+			cmd.Platform = &platforms[0]
+		}
+		cmd.Heredocs = heredocs
+		return cmd, nil
+	case *instructions.RunCommand:
+		cmd := &RunCommand{RunCommand: c}
+		if len(heredocs) > 0 {
+			cmd.CmdLine = []string{heredocScript(strings.Join(cmd.CmdLine, " "), heredocs)}
+		}
+		for _, value := range flags["mount"] {
+			mount, err := parseMount(value)
+			if err != nil {
+				return nil, err
+			}
+			cmd.Mounts = append(cmd.Mounts, mount)
+		}
+		return cmd, nil
+	case *instructions.StopSignalCommand:
+		// Signals using variables can only be checked once they're resolved, when the command runs
+		if !strings.Contains(c.Signal, "$") {
+			if _, err := signal.ParseSignal(c.Signal); err != nil {
+				return nil, errors.Wrapf(err, "invalid STOPSIGNAL %s", c.Signal)
+			}
+		}
+	}
+	return ins, nil
+}
+
+// extractKanikoFlags removes the flags in kanikoFlags from node, and returns their values
+func extractKanikoFlags(node *parser.Node) (map[string][]string, error) {
+	supported := kanikoFlags[strings.ToLower(node.Value)]
+	flags := map[string][]string{}
+	var remaining []string
+	for _, flag := range node.Flags {
+		name := strings.TrimPrefix(flag, "--")
+		value := ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		if !contains(supported, name) {
+			remaining = append(remaining, flag)
+			continue
+		}
+		if _, ok := flags[name]; ok && !repeatableFlags[name] {
+			return nil, errors.Errorf("Duplicate flag specified: %s", name)
+		}
+		flags[name] = append(flags[name], value)
+	}
+	node.Flags = remaining
+	return flags, nil
+}
+
+// parseExtractNested parses the value of ADD --extract-nested, a comma separated list of paths in the
+// destination, which can't be outside of it
+func parseExtractNested(value string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(value, ",") {
+		clean := filepath.Clean(strings.TrimPrefix(p, "/"))
+		if p == "" || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, errors.Errorf("invalid --extract-nested=%s: %q isn't a path in the destination", value, p)
+		}
+		paths = append(paths, clean)
+	}
+	return paths, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// MountTypeCache is a mount which keeps its contents between RUN instructions, but out of the image
+	MountTypeCache = "cache"
+	// MountTypeSecret is a mount of a secret given to the executor with --secret
+	MountTypeSecret = "secret"
+
+	// defaultSecretDir is where secrets are mounted if no target is given
+	defaultSecretDir = "/run/secrets"
+)
+
+// Mount is a filesystem mounted for a RUN instruction with --mount
+type Mount struct {
+	Type string
+	// ID identifies the cache or secret. Caches with the same ID share their contents.
+	ID     string
+	Target string
+	// Required fails the build if a secret isn't given to the executor, instead of skipping the mount
+	Required bool
+	// Mode, UID and GID are the permissions and ownership of the mounted cache directory or secret file
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// parseMount parses the value of a --mount flag, which is a comma separated list of key=value pairs
+func parseMount(value string) (Mount, error) {
+	fields, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return Mount{}, errors.Wrapf(err, "parsing --mount %s", value)
+	}
+	// Like docker, bind mounts are the default, even though kaniko doesn't support them
+	m := Mount{Type: "bind"}
+	mode := ""
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		key := strings.ToLower(parts[0])
+		if len(parts) != 2 {
+			// Boolean options can be given without a value
+			if key == "required" {
+				m.Required = true
+				continue
+			}
+			return Mount{}, errors.Errorf("invalid --mount option %s: expected key=value", field)
+		}
+		val := parts[1]
+		switch key {
+		case "type":
+			m.Type = strings.ToLower(val)
+		case "id":
+			m.ID = val
+		case "target", "dst", "destination":
+			m.Target = val
+		case "required":
+			if m.Required, err = strconv.ParseBool(val); err != nil {
+				return Mount{}, errors.Errorf("invalid --mount required %s", val)
+			}
+		case "mode":
+			mode = val
+		case "uid":
+			if m.UID, err = strconv.Atoi(val); err != nil {
+				return Mount{}, errors.Errorf("invalid --mount uid %s", val)
+			}
+		case "gid":
+			if m.GID, err = strconv.Atoi(val); err != nil {
+				return Mount{}, errors.Errorf("invalid --mount gid %s", val)
+			}
+		case "sharing":
+			// Caches are only used by one build at a time, so all sharing modes behave the same
+			if val != "shared" && val != "private" && val != "locked" {
+				return Mount{}, errors.Errorf("invalid --mount sharing %s", val)
+			}
+		default:
+			return Mount{}, errors.Errorf("unsupported --mount option %s", key)
+		}
+	}
+
+	switch m.Type {
+	case MountTypeCache:
+		if m.Target == "" {
+			return Mount{}, errors.Errorf("--mount %s requires a target", value)
+		}
+		m.Target = filepath.Clean(m.Target)
+		if m.ID == "" {
+			m.ID = m.Target
+		}
+		m.Mode = 0755
+	case MountTypeSecret:
+		if m.ID == "" && m.Target == "" {
+			return Mount{}, errors.Errorf("--mount %s requires an id or a target", value)
+		}
+		if m.ID == "" {
+			m.ID = filepath.Base(m.Target)
+		}
+		if m.Target == "" {
+			m.Target = filepath.Join(defaultSecretDir, m.ID)
+		}
+		m.Target = filepath.Clean(m.Target)
+		m.Mode = 0400
+	default:
+		return Mount{}, errors.Errorf("unsupported --mount type %s", m.Type)
+	}
+	if mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return Mount{}, errors.Errorf("invalid --mount mode %s", mode)
+		}
+		m.Mode = os.FileMode(parsed)
+	}
+	return m, nil
+}
@@ -17,21 +17,26 @@ limitations under the License.
 package executor
 
 import (
-	"bytes"
+	"archive/tar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/commands"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
@@ -40,29 +45,153 @@ import (
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 )
 
+var logger = util.ModuleLogger("executor")
+
+var (
+	// For testing, so builds run on directories of their own instead of the root filesystem
+	rootDir               = constants.RootDir
+	kanikoDir             = constants.KanikoDir
+	layersDir             = constants.LayersDir
+	baseImageDigestFile   = constants.BaseImageDigestFile
+	deleteStageFilesystem = util.DeleteFilesystem
+)
+
+// DoBuild builds the image for the platform kaniko is running on
 func DoBuild(opts *options.KanikoOptions) (v1.Image, error) {
+	return build(opts, nil)
+}
+
+// build builds the image. If platform is set, remote base images are the variant for that platform,
+// and the image's config is set to that platform.
+func build(opts *options.KanikoOptions, platform *v1.Platform) (_ v1.Image, err error) {
+	if err := setRegistries(opts); err != nil {
+		return nil, err
+	}
+	util.SetImageCache(newImageCache(opts))
+	// The layers are written outside of the filesystem which is snapshotted
+	util.SetLayerDir(layersDir)
 	// Parse dockerfile and unpack base image to root
-	stages, err := dockerfile.Stages(opts.DockerfilePath, opts.Target)
+	stages, metaArgs, directives, err := dockerfile.Stages(opts.DockerfilePath, opts.Target)
 	if err != nil {
 		return nil, err
 	}
+	// Each stage only sees the meta args, and the args it declares itself
+	stageArgs := dockerfile.NewBuildArgs(opts.BuildArgs)
+	if err := stageArgs.AddMetaArgs(metaArgs, directives.Escape); err != nil {
+		return nil, err
+	}
+	if err := dockerfile.ResolveBaseNames(stages, stageArgs, directives.Escape); err != nil {
+		return nil, err
+	}
+	contexts, err := dockerfile.ParseBuildContexts(opts.BuildContexts)
+	if err != nil {
+		return nil, err
+	}
+	if err := dockerfile.ResolveBuildContexts(stages, contexts); err != nil {
+		return nil, err
+	}
 
-	hasher, err := getHasher(opts.SnapshotMode)
+	if err := util.GetExcludedFiles(opts.SrcContext); err != nil {
+		return nil, err
+	}
+	for _, context := range contexts {
+		if context.Dir == "" {
+			continue
+		}
+		if err := util.AddExcludedFiles(context.Dir); err != nil {
+			return nil, err
+		}
+	}
+	sourceDateEpoch, err := util.ParseSourceDateEpoch(opts.ReproducibleTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := util.ParseLabels(opts.Labels)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := util.ParseAnnotations(opts.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	hook := newInstructionHook(opts)
+	maxLayerSize, err := util.ParseMaxLayerSize(opts.MaxLayerSize)
+	if err != nil {
+		return nil, err
+	}
+	// Caches for RUN --mount=type=cache are kept for the whole build, and out of the image
+	if opts.MountCacheDir != "" {
+		util.AddToWhitelist(opts.MountCacheDir)
+	}
+	for _, p := range opts.IgnorePaths {
+		util.AddToWhitelist(p)
+	}
+	if err := fetchExtraImages(stages, platform); err != nil {
+		return nil, err
+	}
+	layerCache, err := newLayerCache(opts)
 	if err != nil {
 		return nil, err
 	}
+	if layerCache != nil && !strings.HasPrefix(opts.CacheDir, constants.AzureBlobPrefix) {
+		util.AddToWhitelist(opts.CacheDir)
+	}
+	// The number of layers in the base image of each stage, to find where --squash-from starts
+	stageBaseLayers := map[int]int{}
+	// The end of each instruction is logged when the next one starts, whichever way it finished, or when the
+	// build fails during it
+	endInstruction := func(err error) error { return err }
+	defer func() {
+		if err != nil {
+			endInstruction(err)
+		}
+	}()
 	for index, stage := range stages {
+		// Some hashers remember the files they've hashed, so each stage's filesystem gets a new one
+		hasher, err := getHasher(opts.SnapshotMode)
+		if err != nil {
+			return nil, err
+		}
 		finalStage := finalStage(index, opts.Target, stages)
+		// The digests of the layers of the final image which are reused from the cache
+		cachedLayers := map[v1.Hash]bool{}
+		util.LogEvent(util.EventStageStart, logrus.Fields{"stage": index, "base_image": stage.BaseName, "final": finalStage},
+			"Building stage %d from %s", index, stage.BaseName)
+		// A stage with FROM --platform is built from the base image for that platform, whatever the
+		// platform of the final image is
+		stagePlatform, err := util.StagePlatform(stage, stageArgs.MetaEnvs(), directives.Escape, platform)
+		if err != nil {
+			return nil, err
+		}
 		// Unpack file system to root
-		sourceImage, err := util.RetrieveSourceImage(index, opts.BuildArgs, stages)
+		sourceImage, err := util.RetrieveSourceImage(index, stageArgs.MetaEnvs(), directives.Escape, stages, stagePlatform)
 		if err != nil {
 			return nil, err
 		}
-		if err := util.GetFSFromImage(constants.RootDir, sourceImage); err != nil {
+		// Only the layers built on top of the base image are compressed with --compression
+		baseLayers, err := sourceImage.Layers()
+		if err != nil {
 			return nil, err
 		}
+		stageBaseLayers[index] = len(baseLayers)
+		// Only the first stage is built on the filesystem which is already there, since later stages
+		// start from the filesystem deleted after the one before them
+		if err := unpackBaseImage(rootDir, baseImageDigestFile, sourceImage, opts.SkipUnpack && index == 0, opts.SkipUnpackForce); err != nil {
+			return nil, err
+		}
+		// Once the instructions start changing the filesystem, it's no longer the base image's to build on again
+		if len(stage.Commands) > 0 {
+			if err := util.InvalidateFSDigest(baseImageDigestFile); err != nil {
+				return nil, err
+			}
+		}
 		l := snapshot.NewLayeredMap(hasher)
-		snapshotter := snapshot.NewSnapshotter(l, constants.RootDir)
+		tarOpts := util.TarOptions{Reproducible: opts.Reproducible, SourceDateEpoch: sourceDateEpoch}
+		if rootDir != constants.RootDir {
+			tarOpts.Root = rootDir
+		}
+		snapshotter := snapshot.NewSnapshotter(l, rootDir, tarOpts)
+		snapshotter.SetConcurrency(opts.SnapshotConcurrency)
 		// Take initial snapshot
 		if err := snapshotter.Init(); err != nil {
 			return nil, err
@@ -71,25 +200,149 @@ func DoBuild(opts *options.KanikoOptions) (v1.Image, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err := resolveOnBuild(&stage, &imageConfig.Config); err != nil {
+		triggers, err := resolveOnBuild(&stage, &imageConfig.Config)
+		if err != nil {
 			return nil, err
 		}
-		buildArgs := dockerfile.NewBuildArgs(opts.BuildArgs)
+		buildArgs := stageArgs.Clone()
+		// Layers can only be cached for commands which are snapshotted on their own
+		useCache := layerCache != nil && finalStage && !opts.SingleSnapshot
+		var compositeKey *cache.CompositeCache
+		if useCache {
+			digest, err := sourceImage.Digest()
+			if err != nil {
+				return nil, err
+			}
+			compositeKey = cache.NewCompositeCache(digest.String())
+		}
+		cmdSet := false
+		stageIndex := index
 		for index, cmd := range stage.Commands {
 			finalCmd := index == len(stage.Commands)-1
-			dockerCommand, err := commands.GetCommand(cmd, opts.SrcContext)
+			escape := directives.Escape
+			if index < triggers {
+				// Like docker, the ONBUILD triggers of the base image are parsed with the default escape character
+				escape = parser.DefaultEscapeToken
+			}
+			dockerCommand, err := commands.GetCommand(cmd, opts.SrcContext, escape, opts)
 			if err != nil {
 				return nil, err
 			}
 			if dockerCommand == nil {
 				continue
 			}
-			if err := dockerCommand.ExecuteCommand(&imageConfig.Config, buildArgs); err != nil {
+			if err := endInstruction(nil); err != nil {
 				return nil, err
 			}
+			// The layer the instruction adds to the image, if it adds one
+			var addedLayer v1.Layer
+			ended := startInstruction(stageIndex, index, cmd.Name(), dockerCommand.CreatedBy(), hook)
+			endInstruction = func(err error) error { return ended(addedLayer, err) }
+			switch c := dockerCommand.(type) {
+			case *commands.CmdCommand:
+				cmdSet = cmdSet || c.SetsCmd()
+			case *commands.EntrypointCommand:
+				c.SetCmdSet(cmdSet)
+			}
+			// Files are written under the root the build is on, which is only another directory in tests
+			if r, ok := dockerCommand.(interface{ SetRoot(string) }); ok && rootDir != constants.RootDir {
+				r.SetRoot(rootDir)
+			}
 			// Don't snapshot if it's not the final stage and not the final command
 			// Also don't snapshot if it's the final stage, not the final command, and single snapshot is set
-			if (!finalStage && !finalCmd) || (finalStage && !finalCmd && opts.SingleSnapshot) {
+			skipSnapshot := (!finalStage && !finalCmd) || (finalStage && !finalCmd && opts.SingleSnapshot)
+			linked := false
+			if copyCmd, ok := dockerCommand.(*commands.CopyCommand); ok && copyCmd.Link() {
+				var linkCache cache.LayerCache
+				if useCache && !opts.NoCacheCopyLayers {
+					linkCache = layerCache
+				}
+				layer, err := linkedCopy(copyCmd, &imageConfig.Config, buildArgs, kanikoDir, tarOpts, linkCache)
+				if err != nil {
+					return nil, err
+				}
+				if err := util.ApplyLayer(rootDir, layer); err != nil {
+					return nil, errors.Wrapf(err, "applying layer for %s", dockerCommand.CreatedBy())
+				}
+				if useCache {
+					diffID, err := layer.DiffID()
+					if err != nil {
+						return nil, err
+					}
+					compositeKey.AddKey(dockerCommand.CreatedBy(), diffID.String())
+				}
+				// The layer can only be appended as is if every command before it was snapshotted.
+				// Otherwise the copied files end up in the next snapshot, like any other changes.
+				if finalStage && !opts.SingleSnapshot {
+					if err := snapshotter.Update(); err != nil {
+						return nil, err
+					}
+					addedLayer = layer
+					sourceImage, err = appendLayer(sourceImage, layer, dockerCommand.CreatedBy(), sourceDateEpoch)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				linked = true
+			}
+			var cacheKey string
+			if useCache && !linked {
+				cacheKey = addToCacheKey(compositeKey, dockerCommand, &imageConfig.Config, buildArgs, opts)
+			}
+			if cacheKey != "" {
+				layer, err := applyCachedLayer(layerCache, cacheKey, rootDir)
+				if err != nil {
+					return nil, err
+				}
+				if layer == nil {
+					util.LogEvent(util.EventCacheMiss, logrus.Fields{"instruction": dockerCommand.CreatedBy(), "key": cacheKey},
+						"No cached layer for %s", dockerCommand.CreatedBy())
+				} else {
+					util.LogEvent(util.EventCacheHit, logrus.Fields{"instruction": dockerCommand.CreatedBy(), "key": cacheKey},
+						"Using cached layer for %s", dockerCommand.CreatedBy())
+					if err := snapshotter.Update(); err != nil {
+						return nil, err
+					}
+					addedLayer = layer
+					sourceImage, err = appendLayer(sourceImage, layer, dockerCommand.CreatedBy(), sourceDateEpoch)
+					if err != nil {
+						return nil, err
+					}
+					if finalStage {
+						digest, err := layer.Digest()
+						if err != nil {
+							return nil, err
+						}
+						cachedLayers[digest] = true
+					}
+					continue
+				}
+			}
+			var watcher *snapshot.Watcher
+			if !linked {
+				if watchSnapshot(dockerCommand, opts, skipSnapshot, finalCmd) {
+					if watcher, err = snapshot.NewWatcher(rootDir, kanikoDir); err != nil {
+						logger.Warnf("Not watching the filesystem for the changes %s makes, so the full filesystem is snapshotted: %v", dockerCommand.CreatedBy(), err)
+						watcher = nil
+					}
+				}
+				if err := dockerCommand.ExecuteCommand(&imageConfig.Config, buildArgs); err != nil {
+					if watcher != nil {
+						watcher.Stop()
+					}
+					return nil, err
+				}
+			}
+			// Commands which aren't cached change the key for the commands after them by the files they add
+			if useCache && cacheKey == "" {
+				for _, f := range dockerCommand.FilesToSnapshot() {
+					if err := compositeKey.AddPath(f); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if skipSnapshot {
 				continue
 			}
 			// Now, we get the files to snapshot from this command and take the snapshot
@@ -97,47 +350,113 @@ func DoBuild(opts *options.KanikoOptions) (v1.Image, error) {
 			if finalCmd {
 				snapshotFiles = nil
 			}
-			contents, err := snapshotter.TakeSnapshot(snapshotFiles)
+			var tarPath string
+			if watcher != nil {
+				tarPath, err = watchedSnapshot(snapshotter, watcher)
+			} else {
+				tarPath, err = snapshotter.TakeSnapshot(snapshotFiles)
+			}
 			if err != nil {
 				return nil, err
 			}
 			util.MoveVolumeWhitelistToWhitelist()
-			if contents == nil {
-				logrus.Info("No files were changed, appending empty layer to config.")
+			if tarPath == "" {
+				logger.Info("No files were changed, appending empty layer to config.")
 				continue
 			}
 			// Append the layer to the image
-			opener := func() (io.ReadCloser, error) {
-				return ioutil.NopCloser(bytes.NewReader(contents)), nil
-			}
-			layer, err := tarball.LayerFromOpener(opener)
+			layer, err := tarball.LayerFromFile(tarPath)
 			if err != nil {
 				return nil, err
 			}
-			sourceImage, err = mutate.Append(sourceImage,
-				mutate.Addendum{
-					Layer: layer,
-					History: v1.History{
-						Author:    constants.Author,
-						CreatedBy: dockerCommand.CreatedBy(),
-					},
-				},
-			)
+			if cacheKey != "" {
+				if err := layerCache.Set(cacheKey, layer); err != nil {
+					logger.Warnf("Error caching layer for %s: %v", dockerCommand.CreatedBy(), err)
+				}
+			}
+			addedLayer = layer
+			sourceImage, err = appendLayer(sourceImage, layer, dockerCommand.CreatedBy(), sourceDateEpoch)
 			if err != nil {
 				return nil, err
 			}
 		}
+		if err := endInstruction(nil); err != nil {
+			return nil, err
+		}
+		if finalStage {
+			applyLabels(&imageConfig.Config, labels)
+		}
 		sourceImage, err = mutate.Config(sourceImage, imageConfig.Config)
 		if err != nil {
 			return nil, err
 		}
 		if finalStage {
+			compressFrom := len(baseLayers)
+			if opts.SquashFrom != "" {
+				layers, err := sourceImage.Layers()
+				if err != nil {
+					return nil, err
+				}
+				from, err := squashFromLayer(opts.SquashFrom, stages, index, stageBaseLayers, len(layers))
+				if err != nil {
+					return nil, err
+				}
+				logger.Infof("Squashing layers %d to %d", from, len(layers)-1)
+				sourceImage, err = util.SquashLayers(sourceImage, from)
+				if err != nil {
+					return nil, err
+				}
+				// A squashed layer with base image layers in it is built, so it's compressed too
+				if from < compressFrom {
+					compressFrom = from
+				}
+			}
+			if stagePlatform != nil {
+				sourceImage, err = util.SetPlatform(sourceImage, *stagePlatform)
+				if err != nil {
+					return nil, err
+				}
+			}
 			if opts.Reproducible {
 				sourceImage, err = mutate.Canonical(sourceImage)
 				if err != nil {
 					return nil, err
 				}
 			}
+			if sourceDateEpoch != nil {
+				sourceImage, err = mutate.CreatedAt(sourceImage, v1.Time{Time: *sourceDateEpoch})
+				if err != nil {
+					return nil, err
+				}
+			}
+			sourceImage, err = util.SetAnnotations(sourceImage, annotations)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Cleanup {
+				if err := removeUnusedDependencies(index, stages, constants.KanikoDir, constants.KanikoIntermediateStagesDir); err != nil {
+					return nil, err
+				}
+			}
+			// This rewrites the manifest, so it comes after anything else which changes the image
+			sourceImage, err = compressLayers(sourceImage, compressFrom, cachedLayers, opts)
+			if err != nil {
+				return nil, err
+			}
+			// The layers which are split are measured compressed, so this comes after they're compressed
+			if maxLayerSize > 0 {
+				sourceImage, err = util.SplitLayers(sourceImage, compressFrom, maxLayerSize, opts.Compression, opts.CompressionLevel)
+				if err != nil {
+					return nil, err
+				}
+			}
+			// The layers are the ones which are pushed, so this comes after they're split
+			if opts.FileManifestPath != "" {
+				path := fileManifestPath(opts.FileManifestPath, platform)
+				if err := util.WriteFileManifest(path, sourceImage, compressFrom); err != nil {
+					return nil, errors.Wrapf(err, "writing the file manifest to %s", path)
+				}
+			}
 			return sourceImage, nil
 		}
 		if dockerfile.SaveStage(index, stages) {
@@ -148,14 +467,330 @@ func DoBuild(opts *options.KanikoOptions) (v1.Image, error) {
 				return nil, err
 			}
 		}
+		if opts.Cleanup {
+			if err := removeUnusedDependencies(index, stages, constants.KanikoDir, constants.KanikoIntermediateStagesDir); err != nil {
+				return nil, err
+			}
+		}
 		// Delete the filesystem
-		if err := util.DeleteFilesystem(); err != nil {
+		if err := deleteStageFilesystem(); err != nil {
 			return nil, err
 		}
 	}
 	return nil, err
 }
 
+// compressLayers returns img with its layers from the one at index from on compressed with --compression at
+// --compression-level, if either is set. Otherwise, the layers with the digests in cached are compressed again at
+// the default level if --cache-compression-level is set, since they were reused at that level from the cache.
+func compressLayers(img v1.Image, from int, cached map[v1.Hash]bool, opts *options.KanikoOptions) (v1.Image, error) {
+	if opts.Compression == constants.CompressionZstd || opts.CompressionLevel != 0 {
+		return util.CompressLayers(img, from, opts.Compression, opts.CompressionLevel)
+	}
+	if opts.CacheCompressionLevel == 0 {
+		return img, nil
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for i := from; i < len(m.Layers); i++ {
+		if cached[m.Layers[i].Digest] {
+			indexes = append(indexes, i)
+		}
+	}
+	return util.CompressLayersAt(img, indexes, opts.Compression, opts.CompressionLevel)
+}
+
+// fileManifestPath returns where the --file-manifest-path of the image for platform is written. When
+// building for several platforms, each image's manifest has the platform added to its name.
+func fileManifestPath(path string, platform *v1.Platform) string {
+	if platform == nil {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + strings.Replace(util.PlatformString(*platform), "/", "-", -1) + ext
+}
+
+// setRegistries sets the mirrors, options and credentials used for the registries base images are pulled from,
+// and how many times unpacking their layers is retried
+func setRegistries(opts *options.KanikoOptions) error {
+	mirrors, err := util.ParseRegistryMirrors(opts.RegistryMirrors)
+	if err != nil {
+		return err
+	}
+	util.SetRegistryMirrors(mirrors)
+	registryOpts, err := pullRegistryOptions(opts)
+	if err != nil {
+		return err
+	}
+	util.SetRegistryOptions(registryOpts)
+	util.SetDockerConfig(opts.DockerConfig)
+	util.SetExtractRetries(opts.ImageFSExtractRetries, opts.ImageFSExtractRetryBackoff)
+	return nil
+}
+
+// pullRegistryOptions returns the options for the registries images are pulled from, which are all reached
+// over plain HTTP with --insecure-pull or --insecure
+func pullRegistryOptions(opts *options.KanikoOptions) (util.RegistryOptions, error) {
+	registryOpts, err := util.NewRegistryOptions(opts.InsecureRegistries, opts.SkipTLSVerifyRegistries)
+	registryOpts.AllInsecure = opts.InsecurePull || opts.Insecure
+	return registryOpts, err
+}
+
+// newImageCache returns the cache base images are read from, which is the one the warm command
+// caches them in under --cache-dir, or nil if there isn't one
+func newImageCache(opts *options.KanikoOptions) util.ImageCache {
+	if strings.HasPrefix(opts.CacheDir, constants.AzureBlobPrefix) {
+		return nil
+	}
+	imageCache := cache.NewImageCache(opts.CacheDir)
+	if !imageCache.Exists() {
+		return nil
+	}
+	return imageCache
+}
+
+// newLayerCache returns the cache layers are stored in with --cache, or nil if layers aren't cached. With
+// --cache-read-only, layers are only read from it, and with --cache-write-only, they're only stored in it.
+func newLayerCache(opts *options.KanikoOptions) (cache.LayerCache, error) {
+	if !opts.Cache {
+		return nil, nil
+	}
+	var layerCache cache.LayerCache
+	if strings.HasPrefix(opts.CacheDir, constants.AzureBlobPrefix) {
+		azureCache, err := cache.NewAzureBlobCache(strings.TrimPrefix(opts.CacheDir, constants.AzureBlobPrefix), opts.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		azureCache.SetVerify(opts.VerifyCache)
+		layerCache = azureCache
+	} else {
+		localCache := cache.NewLocalCache(opts.CacheDir, opts.CacheTTL)
+		localCache.SetVerify(opts.VerifyCache)
+		layerCache = localCache
+	}
+	if opts.CacheCompressionLevel != 0 {
+		layerCache = cache.CompressionLevel(layerCache, opts.CacheCompressionLevel)
+	}
+	switch {
+	case opts.CacheReadOnly:
+		return cache.ReadOnly(layerCache), nil
+	case opts.CacheWriteOnly:
+		return cache.WriteOnly(layerCache), nil
+	}
+	return layerCache, nil
+}
+
+// applyLabels sets the labels from --label in config, overriding any labels set by LABEL
+func applyLabels(config *v1.Config, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		logger.Infof("Applying label %s=%s", k, v)
+		config.Labels[k] = v
+	}
+}
+
+// appendLayer appends layer to image, with a history entry for the command which created it.
+// If sourceDateEpoch is set, it's used as the time the layer was created.
+func appendLayer(image v1.Image, layer v1.Layer, createdBy string, sourceDateEpoch *time.Time) (v1.Image, error) {
+	history := v1.History{
+		Author:    constants.Author,
+		CreatedBy: createdBy,
+	}
+	if sourceDateEpoch != nil {
+		history.Created = v1.Time{Time: *sourceDateEpoch}
+	}
+	return mutate.Append(image, mutate.Addendum{Layer: layer, History: history})
+}
+
+// addToCacheKey adds cmd to compositeKey, along with the build args it can see if it's a RUN whose layer is
+// cached, or the files it adds if it's a COPY or ADD. It returns the key to cache the layer of cmd with, or
+// "" if the layer isn't cached, which it isn't if opts turns off caching the layers of its kind of command.
+func addToCacheKey(compositeKey *cache.CompositeCache, cmd commands.DockerCommand, config *v1.Config, buildArgs *dockerfile.BuildArgs, opts *options.KanikoOptions) string {
+	compositeKey.AddKey(cmd.CreatedBy())
+	switch c := cmd.(type) {
+	case *commands.RunCommand:
+		if opts.NoCacheRunLayers {
+			return ""
+		}
+		// Args can change what a command does without appearing in it, e.g. through the environment of RUN
+		compositeKey.AddKey(buildArgs.VisibleArgs(config.Env)...)
+	case commands.CacheKeyCommand:
+		if opts.NoCacheCopyLayers {
+			return ""
+		}
+		keys, err := c.CacheKey(config, buildArgs)
+		if err != nil {
+			// The command fails the same way when it's run, if it's run at all
+			logger.Debugf("Not caching the layer of %s, since its files can't be read: %v", cmd.CreatedBy(), err)
+			return ""
+		}
+		if keys == nil {
+			return ""
+		}
+		compositeKey.AddKey(keys...)
+	default:
+		return ""
+	}
+	return compositeKey.Key()
+}
+
+// watchSnapshot returns true if the changes cmd makes are watched with --snapshot-watch, so just the paths
+// it changes are snapshotted. That's only for RUN, since other commands know which files they change, and
+// only if the snapshot after cmd has just its changes, so not the single snapshot of --single-snapshot.
+func watchSnapshot(cmd commands.DockerCommand, opts *options.KanikoOptions, skipSnapshot, finalCmd bool) bool {
+	if _, ok := cmd.(*commands.RunCommand); !ok || !opts.SnapshotWatch {
+		return false
+	}
+	return !skipSnapshot && !(finalCmd && opts.SingleSnapshot)
+}
+
+// watchedSnapshot takes a snapshot of the paths watcher saw change, or of the full filesystem if it may have
+// missed some
+func watchedSnapshot(snapshotter *snapshot.Snapshotter, watcher *snapshot.Watcher) (string, error) {
+	changed, err := watcher.Stop()
+	if err != nil {
+		logger.Warnf("Snapshotting the full filesystem, since changes may have been missed watching it: %v", err)
+		return snapshotter.TakeSnapshot(nil)
+	}
+	return snapshotter.TakeSnapshotOfChanges(changed)
+}
+
+// startInstruction logs the start of an instruction in the stage, and returns a function which logs its end, with
+// err if it failed, and then runs hook, if it's set and the instruction didn't fail, with the layer the instruction
+// added. Only the first call of the function logs anything, and it returns err if it's set.
+func startInstruction(stage, index int, name, instruction string, hook *instructionHook) func(layer v1.Layer, err error) error {
+	start := time.Now()
+	fields := logrus.Fields{"stage": stage, "index": index, "instruction": instruction}
+	util.LogEvent(util.EventInstructionStart, fields, "Running %s", instruction)
+	ended := false
+	return func(layer v1.Layer, err error) error {
+		if ended {
+			return err
+		}
+		ended = true
+		duration := time.Since(start)
+		fields["duration_seconds"] = duration.Seconds()
+		if err != nil {
+			fields["error"] = err.Error()
+			util.LogEvent(util.EventInstructionEnd, fields, "Failed %s after %s: %v", instruction, duration, err)
+			return err
+		}
+		util.LogEvent(util.EventInstructionEnd, fields, "Finished %s in %s", instruction, duration)
+		if hook == nil {
+			return nil
+		}
+		return hook.run(stage, index, name, instruction, layer)
+	}
+}
+
+// applyCachedLayer applies the layer cached for key to the filesystem at root, and returns it.
+// It returns nil if no layer is cached for key.
+func applyCachedLayer(layerCache cache.LayerCache, key, root string) (v1.Layer, error) {
+	layer, err := layerCache.Get(key)
+	if err == cache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		// A broken cache shouldn't break the build, the command can still be run
+		logger.Warnf("Error retrieving cached layer for key %s: %v", key, err)
+		return nil, nil
+	}
+	if err := util.ApplyLayer(root, layer); err != nil {
+		return nil, errors.Wrapf(err, "applying cached layer for key %s", key)
+	}
+	return layer, nil
+}
+
+// linkedCopy runs cmd, a COPY --link, in a directory of its own under stagingDir, and returns a layer of just
+// the files it copies. Since the layer doesn't depend on the filesystem, it's cached by the copied files alone
+// if layerCache is set, so changes to earlier layers don't stop it being reused. Like the other layers of the
+// image, it's applied over the filesystem: files replace whatever is at their path, even a symlink, and
+// directories are merged with the ones already there.
+func linkedCopy(cmd *commands.CopyCommand, config *v1.Config, buildArgs *dockerfile.BuildArgs, stagingDir string, tarOpts util.TarOptions, layerCache cache.LayerCache) (v1.Layer, error) {
+	dir, err := ioutil.TempDir(stagingDir, "link")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	cmd.SetRoot(dir)
+	if err := cmd.ExecuteCommand(config, buildArgs); err != nil {
+		return nil, err
+	}
+	var files []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		files = append(files, path)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	util.SortTarPaths(files)
+
+	var key string
+	if layerCache != nil {
+		// The files are added by their path in the layer, rather than the staging directory
+		compositeKey := cache.NewCompositeCache("COPY --link", cmd.CreatedBy())
+		hasher := util.CacheHasher()
+		for _, f := range files {
+			rel, err := filepath.Rel(dir, f)
+			if err != nil {
+				return nil, err
+			}
+			h, err := hasher(f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hashing %s for the cache key", rel)
+			}
+			compositeKey.AddKey(rel, h)
+		}
+		key = compositeKey.Key()
+		layer, err := layerCache.Get(key)
+		fields := logrus.Fields{"instruction": cmd.CreatedBy(), "key": key}
+		if err == nil {
+			util.LogEvent(util.EventCacheHit, fields, "Using cached layer for %s", cmd.CreatedBy())
+			return layer, nil
+		}
+		if err != cache.ErrCacheMiss {
+			logger.Warnf("Error retrieving cached layer for key %s: %v", key, err)
+		}
+		util.LogEvent(util.EventCacheMiss, fields, "No cached layer for %s", cmd.CreatedBy())
+	}
+
+	tarOpts.Root = dir
+	layer, err := util.LayerFromTar(func(f io.Writer) error {
+		w := tar.NewWriter(f)
+		hardlinks := map[util.FileID]string{}
+		for _, path := range files {
+			fi, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+			if err := util.AddToTar(path, fi, hardlinks, w, tarOpts); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if err := layerCache.Set(key, layer); err != nil {
+			logger.Warnf("Error caching layer for %s: %v", cmd.CreatedBy(), err)
+		}
+	}
+	return layer, nil
+}
+
 func finalStage(index int, target string, stages []instructions.Stage) bool {
 	if index == len(stages)-1 {
 		return true
@@ -166,13 +801,216 @@ func finalStage(index int, target string, stages []instructions.Stage) bool {
 	return target == stages[index].Name
 }
 
+// unpackBaseImage extracts the filesystem of img to root, and records its digest in digestFile. If skip is
+// set, the filesystem already at root is built on instead, as long as digestFile shows it's from img.
+func unpackBaseImage(root, digestFile string, img v1.Image, skip, force bool) error {
+	if skip {
+		return util.ReuseFSFromImage(root, digestFile, img, force)
+	}
+	// An interrupted extraction mustn't be mistaken for a whole filesystem
+	if err := util.InvalidateFSDigest(digestFile); err != nil {
+		return err
+	}
+	if err := util.GetFSFromImage(root, img); err != nil {
+		return err
+	}
+	return util.RecordFSDigest(digestFile, img)
+}
+
+// squashFromLayer returns the index of the first of the layers of the final stage at index which
+// --squash-from squashes. A number is the index of the layer itself. A stage name is the final stage or one
+// it's built on, and the layers it and the stages built on it add to its base image are squashed.
+// baseLayers is the number of layers in the base image of each stage, and layers in the final image.
+func squashFromLayer(squashFrom string, stages []instructions.Stage, index int, baseLayers map[int]int, layers int) (int, error) {
+	if from, err := strconv.Atoi(squashFrom); err == nil {
+		if from < 0 || from >= layers {
+			return 0, errors.Errorf("--squash-from %d isn't a layer of the image, which has %d layers", from, layers)
+		}
+		return from, nil
+	}
+	for i := index; i >= 0; {
+		if strings.EqualFold(stages[i].Name, squashFrom) {
+			return baseLayers[i], nil
+		}
+		base := -1
+		for j := 0; j < i; j++ {
+			if stages[j].Name == stages[i].BaseName {
+				base = j
+				break
+			}
+		}
+		i = base
+	}
+	return 0, errors.Errorf("--squash-from %s isn't the final stage or a stage it's built on", squashFrom)
+}
+
+// fetchExtraImages extracts the images which COPY --from instructions copy from, instead of a previous stage,
+// to the directory under the kaniko directory that COPY reads them from. Each image is the variant for the
+// COPY's --platform if it has one, and otherwise for platform. Only the paths the instructions copy are
+// extracted, unless one of them is only known once the build reaches it, like a path with an environment variable.
+func fetchExtraImages(stages []instructions.Stage, platform *v1.Platform) error {
+	type extraImage struct {
+		platform *v1.Platform
+		paths    []string
+		cmds     []*dockerfile.CopyCommand
+		// all is set if the whole filesystem of the image is needed
+		all bool
+	}
+	var names []string
+	images := map[string]*extraImage{}
+	platforms := map[string]string{}
+	for _, stage := range stages {
+		for _, cmd := range stage.Commands {
+			c, ok := cmd.(*dockerfile.CopyCommand)
+			if !ok || c.From == "" {
+				continue
+			}
+			// Previous stages have already been resolved to their index
+			if _, err := strconv.Atoi(c.From); err == nil {
+				continue
+			}
+			p := platform
+			if c.Platform != nil {
+				p = c.Platform
+			}
+			platformString := "the default platform"
+			if p != nil {
+				platformString = util.PlatformString(*p)
+			}
+			// Every COPY from an image reads the same directory, so they all need the same variant of it
+			if previous, ok := platforms[c.From]; ok {
+				if previous != platformString {
+					return errors.Errorf("COPY --from=%s is used for both %s and %s", c.From, previous, platformString)
+				}
+			} else {
+				platforms[c.From] = platformString
+				names = append(names, c.From)
+				images[c.From] = &extraImage{platform: p}
+			}
+			image := images[c.From]
+			image.cmds = append(image.cmds, c)
+			for _, src := range c.SourcesAndDest[:len(c.SourcesAndDest)-1] {
+				image.all = image.all || strings.Contains(src, "$")
+				image.paths = append(image.paths, src)
+			}
+		}
+	}
+	for _, name := range names {
+		image, err := util.RetrieveRemoteImage(name, images[name].platform)
+		if err != nil {
+			return errors.Wrapf(err, "retrieving image %s for COPY --from", name)
+		}
+		// The layers of COPY --from an image are cached by its digest
+		digest, err := image.Digest()
+		if err != nil {
+			return err
+		}
+		for _, c := range images[name].cmds {
+			c.FromDigest = digest.String()
+		}
+		var paths []string
+		if !images[name].all {
+			paths = images[name].paths
+		}
+		if err := extractImageToDir(filepath.Join(constants.KanikoDir, name), image, paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func extractImageToDependecyDir(index int, image v1.Image) error {
-	dependencyDir := filepath.Join(constants.KanikoDir, strconv.Itoa(index))
+	return extractImageToDir(filepath.Join(constants.KanikoDir, strconv.Itoa(index)), image, nil)
+}
+
+// extractImageToDir extracts the files at paths in image to dependencyDir, or all of them if paths is empty
+func extractImageToDir(dependencyDir string, image v1.Image, paths []string) error {
+	// Remove anything left from building for another platform
+	if err := os.RemoveAll(dependencyDir); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(dependencyDir, 0755); err != nil {
 		return err
 	}
-	logrus.Infof("trying to extract to %s", dependencyDir)
-	return util.GetFSFromImage(dependencyDir, image)
+	logger.Infof("trying to extract to %s", dependencyDir)
+	return util.GetPathsFromImage(dependencyDir, image, paths)
+}
+
+// removeUnusedDependencies removes the stages saved under stagesDir and kanikoDir, and the images extracted for
+// COPY --from under kanikoDir, once no stage after index uses them. The base image of the stage at index is kept,
+// since the layers of its image are still read from it.
+func removeUnusedDependencies(index int, stages []instructions.Stage, kanikoDir, stagesDir string) error {
+	usedStages := map[string]bool{}
+	usedDirs := map[string]bool{}
+	for i := index; i < len(stages); i++ {
+		for j := 0; j < i; j++ {
+			if stages[j].Name == stages[i].BaseName {
+				usedStages[strconv.Itoa(j)] = true
+			}
+		}
+		if i == index {
+			continue
+		}
+		for _, cmd := range stages[i].Commands {
+			if c, ok := cmd.(*dockerfile.CopyCommand); ok && c.From != "" {
+				usedDirs[c.From] = true
+			}
+		}
+	}
+	var paths []string
+	for i := 0; i <= index; i++ {
+		stage := strconv.Itoa(i)
+		if !usedStages[stage] {
+			paths = append(paths, filepath.Join(stagesDir, stage))
+		}
+		if !usedDirs[stage] {
+			paths = append(paths, filepath.Join(kanikoDir, stage))
+		}
+		for _, cmd := range stages[i].Commands {
+			if c, ok := cmd.(*dockerfile.CopyCommand); ok && c.From != "" && !usedDirs[c.From] {
+				paths = append(paths, filepath.Join(kanikoDir, c.From))
+			}
+		}
+	}
+	for _, p := range paths {
+		// An image for COPY --from could have the name of one of kaniko's own files. Its name can have
+		// slashes, like gcr.io/project/image, but it can't be outside of kanikoDir.
+		if kanikoPath(p) || !(under(p, kanikoDir) || under(p, stagesDir)) {
+			continue
+		}
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			continue
+		}
+		logger.Infof("Removing %s, since no later stage uses it", p)
+		if err := os.RemoveAll(p); err != nil {
+			return errors.Wrapf(err, "removing %s", p)
+		}
+	}
+	return nil
+}
+
+// under returns true if p is in dir, and isn't dir itself
+func under(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// kanikoPath returns true if p is one of the files or directories kaniko uses itself, or a directory with them
+func kanikoPath(p string) bool {
+	paths := append([]string{
+		constants.BuildContextDir,
+		constants.KanikoIntermediateStagesDir,
+		constants.KanikoMountCacheDir,
+		constants.KanikoSecretsDir,
+		constants.NamedContextsDir,
+		constants.LayersDir,
+	}, constants.KanikoBuildFiles...)
+	for _, f := range paths {
+		if util.HasFilepathPrefix(f, p) {
+			return true
+		}
+	}
+	return false
 }
 
 func saveStageAsTarball(stageIndex int, image v1.Image) error {
@@ -184,35 +1022,41 @@ func saveStageAsTarball(stageIndex int, image v1.Image) error {
 		return err
 	}
 	tarPath := filepath.Join(constants.KanikoIntermediateStagesDir, strconv.Itoa(stageIndex))
-	logrus.Infof("Storing source image from stage %d at path %s", stageIndex, tarPath)
+	logger.Infof("Storing source image from stage %d at path %s", stageIndex, tarPath)
 	return tarball.WriteToFile(tarPath, destRef, image, nil)
 }
 
 func getHasher(snapshotMode string) (func(string) (string, error), error) {
 	if snapshotMode == constants.SnapshotModeTime {
-		logrus.Info("Only file modification time will be considered when snapshotting")
+		logger.Info("Only file modification time will be considered when snapshotting")
 		return util.MtimeHasher(), nil
 	}
-	if snapshotMode == constants.SnapshotModeFull {
+	if snapshotMode == constants.SnapshotModeFull || snapshotMode == "" {
 		return util.Hasher(), nil
 	}
+	if snapshotMode == constants.SnapshotModeTimeSize {
+		logger.Info("File modification time and size will be considered when snapshotting, and contents if the size is unchanged")
+		return util.TimeSizeHasher(), nil
+	}
 	return nil, fmt.Errorf("%s is not a valid snapshot mode", snapshotMode)
 }
 
-func resolveOnBuild(stage *instructions.Stage, config *v1.Config) error {
+// resolveOnBuild adds the ONBUILD triggers of the base image to the beginning of the stage's commands,
+// and returns how many there are
+func resolveOnBuild(stage *instructions.Stage, config *v1.Config) (int, error) {
 	if config.OnBuild == nil {
-		return nil
+		return 0, nil
 	}
 	// Otherwise, parse into commands
 	cmds, err := dockerfile.ParseCommands(config.OnBuild)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	// Append to the beginning of the commands in the stage
 	stage.Commands = append(cmds, stage.Commands...)
-	logrus.Infof("Executing %v build triggers", len(cmds))
+	logger.Infof("Executing %v build triggers", len(cmds))
 
 	// Blank out the Onbuild command list for this image
 	config.OnBuild = nil
-	return nil
+	return len(cmds), nil
 }
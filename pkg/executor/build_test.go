@@ -0,0 +1,1364 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/snapshot"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func Test_resolveOnBuild(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM base\nWORKDIR /app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := stages[0]
+	config := &v1.Config{
+		OnBuild: []string{"RUN echo hi", "COPY foo /foo"},
+	}
+	triggers, err := resolveOnBuild(&stage, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, triggers)
+
+	// The triggers run before the stage's own commands, in the order they were recorded
+	var names []string
+	for _, cmd := range stage.Commands {
+		names = append(names, cmd.Name())
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"run", "copy", "workdir"}, names)
+	copyCmd := stage.Commands[1].(*dockerfile.CopyCommand)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, instructions.SourcesAndDest{"foo", "/foo"}, copyCmd.SourcesAndDest)
+	// Triggers only apply to the next build, so they shouldn't be passed on to the image being built
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string(nil), config.OnBuild)
+}
+
+func Test_resolveOnBuild_NoTriggers(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM base\nWORKDIR /app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := stages[0]
+	triggers, err := resolveOnBuild(&stage, &v1.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, triggers)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(stage.Commands))
+}
+
+// buildWithEpoch builds an image with a layer containing the file at path modified at mtime, the way
+// a build with sourceDateEpoch would, and returns it
+func buildWithEpoch(t *testing.T, path string, mtime time.Time, sourceDateEpoch *time.Time) v1.Image {
+	if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	if err := util.AddToTar(path, fi, map[util.FileID]string{}, w, util.TarOptions{SourceDateEpoch: sourceDateEpoch}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := appendLayer(empty.Image, layer, "RUN touch file", sourceDateEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sourceDateEpoch != nil {
+		image, err = mutate.CreatedAt(image, v1.Time{Time: *sourceDateEpoch})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return image
+}
+
+func Test_SourceDateEpoch(t *testing.T) {
+	epoch, err := util.ParseSourceDateEpoch("1500000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "file")
+
+	// The builds happen at different times, both after the epoch
+	first := buildWithEpoch(t, path, time.Now(), epoch)
+	second := buildWithEpoch(t, path, time.Now().Add(time.Hour), epoch)
+
+	firstConfig, err := first.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondConfig, err := second.ConfigName()
+	testutil.CheckErrorAndDeepEqual(t, false, err, firstConfig, secondConfig)
+
+	cfg, err := first.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, epoch.Unix(), cfg.Created.Unix())
+	testutil.CheckErrorAndDeepEqual(t, false, nil, epoch.Unix(), cfg.History[0].Created.Unix())
+
+	// Without an epoch, the file times end up in the layer
+	first = buildWithEpoch(t, path, time.Now(), nil)
+	second = buildWithEpoch(t, path, time.Now().Add(time.Hour), nil)
+	firstConfig, err = first.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondConfig, err = second.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstConfig == secondConfig {
+		t.Errorf("expected builds at different times to have different configs without an epoch")
+	}
+}
+
+func Test_applyCachedLayer(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	key := cache.NewCompositeCache("sha256:base", "RUN make").Key()
+	layer, err := applyCachedLayer(cache.NewLocalCache(cacheDir, 0), key, root)
+	testutil.CheckErrorAndDeepEqual(t, false, err, nil, layer)
+
+	// The first build caches the layer created by the command
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	contents := []byte("built")
+	if err := w.WriteHeader(&tar.Header{Name: "app/bin", Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg, Uid: os.Getuid(), Gid: os.Getgid()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	built, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.NewLocalCache(cacheDir, 0).Set(key, built); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second build finds it in the cache directory, and applies it instead of running the command
+	layer, err = applyCachedLayer(cache.NewLocalCache(cacheDir, 0), key, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer == nil {
+		t.Fatal("expected a cached layer")
+	}
+	expected, err := built.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := layer.Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, actual)
+	applied, err := ioutil.ReadFile(filepath.Join(root, "app/bin"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, contents, applied)
+}
+
+func Test_applyCachedLayer_Corrupt(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	key := cache.NewCompositeCache("sha256:base", "RUN make").Key()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.NewLocalCache(cacheDir, 0).Set(key, layers[0]); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another layer ends up where the cached one should be
+	corrupt, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptLayers, err := corrupt.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := corruptLayers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "blobs", digest.Algorithm, digest.Hex), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The build detects the mismatch, and runs the command instead of applying the layer
+	layerCache := cache.NewLocalCache(cacheDir, 0)
+	layerCache.SetVerify(true)
+	layer, err := applyCachedLayer(layerCache, key, root)
+	testutil.CheckErrorAndDeepEqual(t, false, err, nil, layer)
+	files, err := ioutil.ReadDir(root)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 0, len(files))
+}
+
+// cacheOptions caches the layers of every kind of command, as --cache does by default
+var cacheOptions = &options.KanikoOptions{Cache: true}
+
+func Test_addToCacheKey(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nARG VERSION\nRUN ./install.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key returns the cache key of the RUN command with buildArgs
+	key := func(buildArgs ...string) string {
+		args := dockerfile.NewBuildArgs(buildArgs)
+		config := &v1.Config{}
+		compositeKey := cache.NewCompositeCache("sha256:base")
+		var runKey string
+		for _, cmd := range stages[0].Commands {
+			dockerCommand, err := commands.GetCommand(cmd, "", '\\', &options.KanikoOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := dockerCommand.(*commands.ArgCommand); ok {
+				if err := dockerCommand.ExecuteCommand(config, args); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if k := addToCacheKey(compositeKey, dockerCommand, config, args, cacheOptions); k != "" {
+				runKey = k
+			}
+		}
+		return runKey
+	}
+
+	tests := []struct {
+		name      string
+		first     []string
+		second    []string
+		expectHit bool
+	}{
+		{
+			name:      "same value",
+			first:     []string{"VERSION=1"},
+			second:    []string{"VERSION=1"},
+			expectHit: true,
+		},
+		{
+			name:   "different value",
+			first:  []string{"VERSION=1"},
+			second: []string{"VERSION=2"},
+		},
+		{
+			name:      "arg which isn't declared",
+			first:     []string{"VERSION=1"},
+			second:    []string{"VERSION=1", "UNUSED=2"},
+			expectHit: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectHit, key(test.first...) == key(test.second...))
+		})
+	}
+}
+
+func Test_addToCacheKey_Copy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := testutil.SetupFiles(dir, map[string]string{"app/main.go": "package main", "app/README": "app"}); err != nil {
+		t.Fatal(err)
+	}
+	// key returns the cache key of the last command of dockerfileContents, with the build context in dir
+	key := func(dockerfileContents string, setUp func(cmd instructions.Command)) string {
+		stages, err := dockerfile.Parse([]byte(dockerfileContents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds := stages[0].Commands
+		if setUp != nil {
+			setUp(cmds[len(cmds)-1])
+		}
+		config := &v1.Config{}
+		args := dockerfile.NewBuildArgs(nil)
+		compositeKey := cache.NewCompositeCache("sha256:base")
+		var k string
+		for _, cmd := range cmds {
+			dockerCommand, err := commands.GetCommand(cmd, dir, '\\', &options.KanikoOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			k = addToCacheKey(compositeKey, dockerCommand, config, args, cacheOptions)
+		}
+		return k
+	}
+	copyApp := "FROM scratch\nCOPY app /app"
+	first := key(copyApp, nil)
+	if first == "" {
+		t.Fatal("expected COPY to be cached")
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, first, key(copyApp, nil))
+	// ADD unpacks archives, so it doesn't share the layers of COPY
+	if key("FROM scratch\nADD app /app", nil) == first {
+		t.Error("expected ADD to have a different key from COPY")
+	}
+
+	// The key changes with the copied files and how they're copied
+	for _, dockerfileContents := range []string{
+		"FROM scratch\nCOPY --chmod=0755 app /app",
+		"FROM scratch\nCOPY app /srv",
+		"FROM scratch\nWORKDIR /srv\nCOPY app app",
+	} {
+		if key(dockerfileContents, nil) == first {
+			t.Errorf("expected %q to have a different key from %q", dockerfileContents, copyApp)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app/main.go"), []byte("package app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key(copyApp, nil) == first {
+		t.Error("expected a different key once a copied file changed")
+	}
+
+	// Files copied from an image are keyed by its digest
+	copyFrom := "FROM scratch\nCOPY --from=gcr.io/kaniko-test/tools /bin/tool /bin/"
+	withDigest := func(digest string) func(cmd instructions.Command) {
+		return func(cmd instructions.Command) {
+			cmd.(*dockerfile.CopyCommand).FromDigest = digest
+		}
+	}
+	fromKey := key(copyFrom, withDigest("sha256:a"))
+	if fromKey == "" {
+		t.Fatal("expected COPY --from an image to be cached")
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, fromKey, key(copyFrom, withDigest("sha256:a")))
+	if key(copyFrom, withDigest("sha256:b")) == fromKey {
+		t.Error("expected a different key for another digest of the image")
+	}
+
+	// Remote files without a checksum aren't known until they're downloaded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file"))
+	}))
+	defer server.Close()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "", key("FROM scratch\nADD "+server.URL+"/file /file", nil))
+	if key("FROM scratch\nADD --checksum=sha256:24454f830cdb571e2c4ad15481119c43b3cafd48dd869a9b2945d1036d1dc68d "+server.URL+"/file /file", nil) == "" {
+		t.Error("expected ADD with a checksum to be cached")
+	}
+}
+
+func Test_addToCacheKey_Layers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := testutil.SetupFiles(dir, map[string]string{"app/main.go": "package main"}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nCOPY app /app\nRUN ./build.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys returns the cache keys of the commands, running the ones which aren't cached like a build does
+	keys := func(opts *options.KanikoOptions) []string {
+		config := &v1.Config{}
+		args := dockerfile.NewBuildArgs(nil)
+		compositeKey := cache.NewCompositeCache("sha256:base")
+		var keys []string
+		for _, cmd := range stages[0].Commands {
+			dockerCommand, err := commands.GetCommand(cmd, dir, '\\', opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k := addToCacheKey(compositeKey, dockerCommand, config, args, opts)
+			keys = append(keys, k)
+			copyCmd, ok := dockerCommand.(*commands.CopyCommand)
+			if k != "" || !ok {
+				continue
+			}
+			copyCmd.SetRoot(root)
+			if err := copyCmd.ExecuteCommand(config, args); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range copyCmd.FilesToSnapshot() {
+				if err := compositeKey.AddPath(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return keys
+	}
+
+	// Only caching RUN layers, COPY is run every time, and the RUN after it is cached by the files it copied
+	runOnly := &options.KanikoOptions{Cache: true, NoCacheCopyLayers: true}
+	first := keys(runOnly)
+	if first[0] != "" {
+		t.Errorf("expected COPY not to be cached, got key %s", first[0])
+	}
+	if first[1] == "" {
+		t.Fatal("expected RUN to be cached")
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, first, keys(runOnly))
+	if err := ioutil.WriteFile(filepath.Join(dir, "app/main.go"), []byte("package app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keys(runOnly)[1] == first[1] {
+		t.Error("expected a different key for RUN once a copied file changed")
+	}
+
+	// Only caching COPY layers, RUN is run every time
+	copyOnly := keys(&options.KanikoOptions{Cache: true, NoCacheRunLayers: true})
+	if copyOnly[0] == "" {
+		t.Error("expected COPY to be cached")
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "", copyOnly[1])
+}
+
+func Test_watchSnapshot(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nRUN ./build.sh\nCOPY app /app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []commands.DockerCommand
+	for _, cmd := range stages[0].Commands {
+		dockerCommand, err := commands.GetCommand(cmd, "", '\\', &options.KanikoOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, dockerCommand)
+	}
+	run, copyCmd := cmds[0], cmds[1]
+	watch := &options.KanikoOptions{SnapshotWatch: true}
+	tests := []struct {
+		name         string
+		cmd          commands.DockerCommand
+		opts         *options.KanikoOptions
+		skipSnapshot bool
+		finalCmd     bool
+		expected     bool
+	}{
+		{name: "run", cmd: run, opts: watch, expected: true},
+		{name: "final run", cmd: run, opts: watch, finalCmd: true, expected: true},
+		{name: "without --snapshot-watch", cmd: run, opts: &options.KanikoOptions{}},
+		{name: "copy", cmd: copyCmd, opts: watch},
+		{name: "no snapshot", cmd: run, opts: watch, skipSnapshot: true},
+		{name: "single snapshot", cmd: run, opts: &options.KanikoOptions{SnapshotWatch: true, SingleSnapshot: true}, finalCmd: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := watchSnapshot(test.cmd, test.opts, test.skipSnapshot, test.finalCmd)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, actual)
+		})
+	}
+}
+
+func Test_applyLabels(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nLABEL maintainer=dockerfile version=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		labels   []string
+		expected map[string]string
+	}{
+		{
+			name:     "no labels",
+			expected: map[string]string{"maintainer": "dockerfile", "version": "1"},
+		},
+		{
+			name:     "overrides LABEL",
+			labels:   []string{"version=2", "url=https://example.com/?a=b"},
+			expected: map[string]string{"maintainer": "dockerfile", "version": "2", "url": "https://example.com/?a=b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &v1.Config{}
+			for _, cmd := range stages[0].Commands {
+				dockerCommand, err := commands.GetCommand(cmd, "", '\\', &options.KanikoOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := dockerCommand.ExecuteCommand(config, dockerfile.NewBuildArgs(nil)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			labels, err := util.ParseLabels(test.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applyLabels(config, labels)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, config.Labels)
+		})
+	}
+
+	// The base image's config may not have any labels
+	config := &v1.Config{}
+	applyLabels(config, map[string]string{"maintainer": "kaniko"})
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{"maintainer": "kaniko"}, config.Labels)
+}
+
+func Test_linkedCopy(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	buildcontext := filepath.Join(testDir, "context")
+	stagingDir := filepath.Join(testDir, "staging")
+	cacheDir := filepath.Join(testDir, "cache")
+	for _, dir := range []string{buildcontext, stagingDir, cacheDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(buildcontext, "foo")
+	if err := ioutil.WriteFile(src, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nCOPY --link foo /app/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copy runs the COPY --link command, and returns the digest and tar entries of its layer
+	copy := func(layerCache cache.LayerCache) (v1.Hash, []string) {
+		dockerCommand, err := commands.GetCommand(stages[0].Commands[0], buildcontext, '\\', &options.KanikoOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := linkedCopy(dockerCommand.(*commands.CopyCommand), &v1.Config{}, dockerfile.NewBuildArgs(nil), stagingDir, util.TarOptions{}, layerCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := layer.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+		return digest, names
+	}
+
+	// The layer has just the copied files, whatever else is on the filesystem
+	first, names := copy(cache.NewLocalCache(cacheDir, 0))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/app", "/app/foo"}, names)
+	staged, err := ioutil.ReadDir(stagingDir)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 0, len(staged))
+
+	// Copying the same files again is a cache hit, although they're staged again
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	hits := &countingCache{LayerCache: cache.NewLocalCache(cacheDir, 0)}
+	second, _ := copy(hits)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, first, second)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, hits.hits)
+
+	// Changing the copied files is a miss
+	if err := ioutil.WriteFile(src, []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := copy(hits)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, hits.hits)
+	if changed == first {
+		t.Errorf("expected a new layer after changing the copied file")
+	}
+}
+
+func TestBuild_LinkedCopy(t *testing.T) {
+	tests := []struct {
+		name           string
+		singleSnapshot bool
+		expectedLayers [][]string
+	}{
+		{
+			name:           "a layer for each command",
+			expectedLayers: [][]string{{"a"}, {"b"}, {"c"}},
+		},
+		{
+			name:           "single snapshot",
+			singleSnapshot: true,
+			expectedLayers: [][]string{{"a", "b", "c"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, cleanup := setUpBuild(t, "FROM scratch\nCOPY --link a /a\nCOPY b /b\nCOPY --link c /c\n", map[string]string{"a": "a", "b": "b", "c": "c"})
+			defer cleanup()
+			opts.SingleSnapshot = test.singleSnapshot
+			image, err := DoBuild(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := image.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual [][]string
+			for _, layer := range layers {
+				var files []string
+				for _, name := range layerFiles(t, layer) {
+					files = append(files, strings.TrimPrefix(name, "/"))
+				}
+				sort.Strings(files)
+				actual = append(actual, files)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedLayers, actual)
+		})
+	}
+}
+
+func TestBuild_BuildContextDir(t *testing.T) {
+	files := map[string]string{
+		".dockerignore":        "*.md\nassets/*.md\n",
+		"app":                  "app",
+		"assets/.dockerignore": "*.tmp\n",
+		"assets/NOTES.md":      "notes",
+		"assets/build.tmp":     "tmp",
+		"assets/logo":          "logo",
+	}
+	opts, cleanup := setUpBuild(t, "FROM scratch\nCOPY app /app\nCOPY --from=assets . /assets/\n", files)
+	defer cleanup()
+	// The context is in the build context, but its files are only excluded by its own .dockerignore
+	opts.BuildContexts = []string{"assets=" + filepath.Join(opts.SrcContext, "assets")}
+	image, err := DoBuild(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual [][]string
+	for _, layer := range layers {
+		var files []string
+		for _, name := range layerFiles(t, layer) {
+			files = append(files, strings.TrimPrefix(name, "/"))
+		}
+		sort.Strings(files)
+		actual = append(actual, files)
+	}
+	expected := [][]string{{"app"}, {"assets/.dockerignore", "assets/NOTES.md", "assets/logo"}}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, actual)
+}
+
+func TestBuild_BuildContextImage(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&fakeRegistry{image: base})
+	defer server.Close()
+	opts, cleanup := setUpBuild(t, "FROM base\nCOPY app /app\n", map[string]string{"app": "app"})
+	defer cleanup()
+	opts.BuildContexts = []string{"base=docker-image://" + strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"}
+	image, err := DoBuild(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The image is built on the image of the context
+	baseLayers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("expected the layer of the base image and one for COPY, got %d layers", len(layers))
+	}
+	baseDigest, err := baseLayers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, baseDigest, digest)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/app"}, layerFiles(t, layers[1]))
+}
+
+func TestBuild_OnBuildEscape(t *testing.T) {
+	base, err := mutate.Config(empty.Image, v1.Config{OnBuild: []string{`ENV FROM_TRIGGER=a\$B`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&fakeRegistry{image: base})
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+	opts, cleanup := setUpBuild(t, "# escape=`\nFROM "+image+"\nENV FROM_DOCKERFILE=a\\$B `\n    B=b\n", nil)
+	defer cleanup()
+	built, err := DoBuild(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := built.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The trigger is resolved with \, and the Dockerfile's own instructions with `
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"FROM_TRIGGER=a$B", `FROM_DOCKERFILE=a\`, "B=b"}, cfg.Config.Env)
+}
+
+func Test_newLayerCache_ReadOnlyWriteOnly(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := layers[0]
+	tests := []struct {
+		name           string
+		opts           options.KanikoOptions
+		expectCacheHit bool
+		expectStored   bool
+	}{
+		{
+			name:           "read and write",
+			expectCacheHit: true,
+			expectStored:   true,
+		},
+		{
+			name:           "read-only",
+			opts:           options.KanikoOptions{CacheReadOnly: true},
+			expectCacheHit: true,
+		},
+		{
+			name:         "write-only",
+			opts:         options.KanikoOptions{CacheWriteOnly: true},
+			expectStored: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+			localCache := cache.NewLocalCache(cacheDir, 0)
+			if err := localCache.Set("cached", layer); err != nil {
+				t.Fatal(err)
+			}
+			opts := test.opts
+			opts.Cache = true
+			opts.CacheDir = cacheDir
+			layerCache, err := newLayerCache(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = layerCache.Get("cached")
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectCacheHit, err == nil)
+			testutil.CheckError(t, false, layerCache.Set("new", layer))
+			_, err = localCache.Get("new")
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectStored, err == nil)
+		})
+	}
+}
+
+// countingCache counts the layers found in a cache
+type countingCache struct {
+	cache.LayerCache
+	hits int
+}
+
+func (c *countingCache) Get(key string) (v1.Layer, error) {
+	layer, err := c.LayerCache.Get(key)
+	if err == nil {
+		c.hits++
+	}
+	return layer, err
+}
+
+func Test_removeUnusedDependencies(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte(`
+FROM scratch AS base
+COPY --from=busybox /bin/sh /sh
+FROM scratch AS builder
+COPY --from=0 /sh /sh
+FROM base
+COPY --from=builder /sh /sh2
+FROM scratch
+COPY --from=2 /sh2 /sh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dockerfile.ResolveStages(stages); err != nil {
+		t.Fatal(err)
+	}
+	kanikoDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kanikoDir)
+	stagesDir := filepath.Join(kanikoDir, "stages")
+	files := map[string]string{"busybox/bin/sh": "busybox"}
+	for _, stage := range []string{"0", "1", "2"} {
+		files[filepath.Join("stages", stage)] = "tarball of stage " + stage
+		files[filepath.Join(stage, "sh")] = "filesystem of stage " + stage
+	}
+	if err := testutil.SetupFiles(kanikoDir, files); err != nil {
+		t.Fatal(err)
+	}
+	// remaining returns the files left in kanikoDir, and their total size
+	remaining := func() ([]string, int64) {
+		var paths []string
+		var size int64
+		err := filepath.Walk(kanikoDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(kanikoDir, path)
+			paths = append(paths, rel)
+			size += info.Size()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths, size
+	}
+
+	expected := [][]string{
+		// The image is only copied from by the first stage, which is copied from and built on later
+		{"0/sh", "1/sh", "2/sh", "stages/0", "stages/1", "stages/2"},
+		// The third stage is built on the first, and copies from the second
+		{"1/sh", "2/sh", "stages/0", "stages/2"},
+		// The last stage copies from the third, which is still built on the first
+		{"2/sh", "stages/0"},
+		{},
+	}
+	_, size := remaining()
+	for index := range stages {
+		if err := removeUnusedDependencies(index, stages, kanikoDir, stagesDir); err != nil {
+			t.Fatal(err)
+		}
+		paths, newSize := remaining()
+		if len(paths) == 0 {
+			paths = []string{}
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, expected[index], paths)
+		if newSize >= size {
+			t.Errorf("expected less than %d bytes to be left after stage %d, got %d", size, index, newSize)
+		}
+		size = newSize
+	}
+}
+
+func Test_removeUnusedDependencies_NestedImage(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte(`
+FROM scratch
+COPY --from=gcr.io/kaniko-test/busybox /bin/sh /sh
+COPY --from=../outside /file /file
+FROM scratch
+COPY --from=0 /sh /sh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dockerfile.ResolveStages(stages); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kanikoDir := filepath.Join(dir, "kaniko")
+	files := map[string]string{
+		"kaniko/gcr.io/kaniko-test/busybox/bin/sh": "busybox",
+		"kaniko/0/sh":                              "filesystem of stage 0",
+		"outside/file":                             "outside of kanikoDir",
+	}
+	if err := testutil.SetupFiles(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeUnusedDependencies(0, stages, kanikoDir, filepath.Join(kanikoDir, "stages")); err != nil {
+		t.Fatal(err)
+	}
+	// The image nested in directories for its registry and repository is removed, but nothing outside
+	// of kanikoDir is
+	exists := func(p string) bool {
+		_, err := os.Lstat(filepath.Join(dir, p))
+		return err == nil
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, false, exists("kaniko/gcr.io/kaniko-test/busybox"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, exists("kaniko/0/sh"))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, exists("outside/file"))
+}
+
+func Test_squashFromLayer(t *testing.T) {
+	stages, err := dockerfile.Parse([]byte(`
+FROM ubuntu AS base
+RUN apt-get update
+FROM golang AS builder
+RUN go build
+FROM base AS app
+COPY --from=builder /app /app
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base is built on 3 layers, and app on the 4 of base
+	baseLayers := map[int]int{0: 3, 1: 5, 2: 4}
+	tests := []struct {
+		name       string
+		squashFrom string
+		expected   int
+		shouldErr  bool
+	}{
+		{name: "final stage", squashFrom: "app", expected: 4},
+		{name: "stage the final stage is built on", squashFrom: "base", expected: 3},
+		{name: "stage names are case insensitive", squashFrom: "Base", expected: 3},
+		{name: "layer index", squashFrom: "1", expected: 1},
+		{name: "stage the final stage isn't built on", squashFrom: "builder", shouldErr: true},
+		{name: "missing stage", squashFrom: "missing", shouldErr: true},
+		{name: "layer index past the layers", squashFrom: "5", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from, err := squashFromLayer(test.squashFrom, stages, 2, baseLayers, 5)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, from)
+		})
+	}
+}
+
+func Test_unpackBaseImage_Skip(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	digestFile := filepath.Join(root, "kaniko", "base-image-digest")
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseFiles []string
+	r, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseFiles = append(baseFiles, hdr.Name)
+	}
+	r.Close()
+
+	// The first build extracts the base image, and records its digest
+	if err := unpackBaseImage(root, digestFile, base, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range baseFiles {
+		if _, err := os.Lstat(filepath.Join(root, f)); err != nil {
+			t.Errorf("%s wasn't extracted: %v", f, err)
+		}
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := ioutil.ReadFile(digestFile)
+	testutil.CheckErrorAndDeepEqual(t, false, err, digest.String()+"\n", string(recorded))
+
+	// The next one builds on the filesystem which is already there, without extracting anything again
+	if err := os.RemoveAll(filepath.Join(root, baseFiles[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackBaseImage(root, digestFile, base, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, baseFiles[0])); !os.IsNotExist(err) {
+		t.Errorf("%s was extracted again: %v", baseFiles[0], err)
+	}
+
+	// The layer the build adds only has the files it changes, which includes the root, since a file is added to it
+	snapshotter := snapshot.NewSnapshotter(snapshot.NewLayeredMap(util.Hasher()), root, util.TarOptions{})
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "built"), []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var added []string
+	tr = tar.NewReader(bytes.NewReader(contents))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, hdr.Name)
+	}
+	sort.Strings(added)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{root, filepath.Join(root, "built")}, added)
+}
+
+func Test_unpackBaseImage_Mismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	digestFile := filepath.Join(root, "base-image-digest")
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing shows which base image the filesystem is from
+	testutil.CheckError(t, true, unpackBaseImage(root, digestFile, base, true, false))
+	testutil.CheckError(t, false, unpackBaseImage(root, digestFile, base, true, true))
+
+	// The filesystem is from a different base image
+	if err := unpackBaseImage(root, digestFile, other, false, false); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckError(t, true, unpackBaseImage(root, digestFile, base, true, false))
+	testutil.CheckError(t, false, unpackBaseImage(root, digestFile, base, true, true))
+}
+
+func Test_unpackBaseImage_Invalidated(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	digestFile := filepath.Join(root, "base-image-digest")
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once a build has started changing the filesystem, the next one can't build on it as the base image
+	for _, skip := range []bool{false, true} {
+		if err := unpackBaseImage(root, digestFile, base, skip, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := util.InvalidateFSDigest(digestFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(digestFile); !os.IsNotExist(err) {
+			t.Fatalf("%s wasn't removed: %v", digestFile, err)
+		}
+		testutil.CheckError(t, true, unpackBaseImage(root, digestFile, base, true, false))
+		testutil.CheckError(t, false, unpackBaseImage(root, digestFile, base, true, true))
+		if err := unpackBaseImage(root, digestFile, base, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing is left to remove
+	testutil.CheckError(t, false, util.InvalidateFSDigest(filepath.Join(root, "missing")))
+}
+
+func Test_fileManifestPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		platform *v1.Platform
+		expected string
+	}{
+		{name: "no platform", path: "/workspace/files.json", expected: "/workspace/files.json"},
+		{name: "platform", path: "/workspace/files.json", platform: &v1.Platform{OS: "linux", Architecture: "amd64"}, expected: "/workspace/files-linux-amd64.json"},
+		{name: "variant", path: "/workspace/files.json", platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, expected: "/workspace/files-linux-arm-v7.json"},
+		{name: "no extension", path: "/workspace/files", platform: &v1.Platform{OS: "linux", Architecture: "arm64"}, expected: "/workspace/files-linux-arm64"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, fileManifestPath(test.path, test.platform))
+		})
+	}
+}
+
+func Test_newLayerCache_CompressionLevel(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, built := layers[0], layers[1]
+	builtDigest, err := built.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestAt := func(level int) v1.Hash {
+		l, err := util.CompressLayer(layer, constants.CompressionGzip, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		name             string
+		compressionLevel int
+	}{
+		{name: "compression level", compressionLevel: 1},
+		{name: "default compression level"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+			opts := &options.KanikoOptions{Cache: true, CacheDir: cacheDir, CacheCompressionLevel: 9, CompressionLevel: test.compressionLevel}
+			layerCache, err := newLayerCache(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := layerCache.Set("key", layer); err != nil {
+				t.Fatal(err)
+			}
+
+			// The cached blob is compressed at the cache's level
+			cached, err := layerCache.Get("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cachedDigest, err := cached.Digest()
+			testutil.CheckErrorAndDeepEqual(t, false, err, digestAt(9), cachedDigest)
+
+			// The layer reused from the cache is pushed at the destination's level
+			image, err := mutate.AppendLayers(empty.Image, cached, built)
+			if err != nil {
+				t.Fatal(err)
+			}
+			image, err = compressLayers(image, 0, map[v1.Hash]bool{cachedDigest: true}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pushed, err := image.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pushedDigest, err := pushed[0].Digest()
+			testutil.CheckErrorAndDeepEqual(t, false, err, digestAt(test.compressionLevel), pushedDigest)
+
+			// The layer built isn't compressed again unless there's a --compression-level
+			expectedBuilt := builtDigest
+			if test.compressionLevel != 0 {
+				l, err := util.CompressLayer(built, constants.CompressionGzip, test.compressionLevel)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expectedBuilt, err = l.Digest(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			builtPushed, err := pushed[1].Digest()
+			testutil.CheckErrorAndDeepEqual(t, false, err, expectedBuilt, builtPushed)
+		})
+	}
+}
+
+// setUpBuild makes builds run on directories of their own instead of the root filesystem, and writes dockerfile
+// and files to a build context. It returns the options to build the context with, and a function which restores
+// the directories builds run on.
+func setUpBuild(t *testing.T, dockerfile string, files map[string]string) (*options.KanikoOptions, func()) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := filepath.Join(dir, "context")
+	if err := testutil.SetupFiles(context, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(context, map[string]string{"Dockerfile": dockerfile}); err != nil {
+		t.Fatal(err)
+	}
+	// Builds add the paths they don't snapshot, like the cache, to the whitelist
+	restoreWhitelist := util.SaveWhitelist()
+	originalRoot, originalKaniko, originalLayers, originalDigestFile, originalDelete := rootDir, kanikoDir, layersDir, baseImageDigestFile, deleteStageFilesystem
+	rootDir, kanikoDir = filepath.Join(dir, "root"), filepath.Join(dir, "kaniko")
+	layersDir, baseImageDigestFile = filepath.Join(kanikoDir, "layers"), filepath.Join(kanikoDir, "base-image-digest")
+	deleteStageFilesystem = func() error {
+		if err := os.RemoveAll(rootDir); err != nil {
+			return err
+		}
+		return os.Mkdir(rootDir, 0755)
+	}
+	for _, d := range []string{rootDir, kanikoDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &options.KanikoOptions{
+		DockerfilePath: filepath.Join(context, "Dockerfile"),
+		SrcContext:     context,
+		SnapshotMode:   constants.SnapshotModeFull,
+		NoPush:         true,
+	}
+	return opts, func() {
+		rootDir, kanikoDir, layersDir, baseImageDigestFile, deleteStageFilesystem = originalRoot, originalKaniko, originalLayers, originalDigestFile, originalDelete
+		util.SetLayerDir("")
+		restoreWhitelist()
+		os.RemoveAll(dir)
+	}
+}
+
+// layerFiles returns the names of the regular files in layer
+func layerFiles(t *testing.T, layer v1.Layer) []string {
+	r, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+}
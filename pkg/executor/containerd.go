@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/containerd"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+)
+
+type containerdStore interface {
+	containerd.Store
+	Close() error
+}
+
+// newContainerdStore connects to the containerd namespace --containerd-import imports into
+var newContainerdStore = func(address, namespace string) (containerdStore, error) {
+	return containerd.NewClient(address, namespace)
+}
+
+// importToContainerd writes the blobs of an image or manifest list to containerd's content store with
+// write, and names it as each destination. It returns the descriptor which is named.
+func importToContainerd(opts *options.KanikoOptions, write func(containerd.Store) (v1.Descriptor, error)) (v1.Descriptor, error) {
+	var refs []name.Tag
+	for _, destination := range opts.Destinations {
+		destRef, err := destinationTag(destination, opts)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		refs = append(refs, destRef)
+	}
+	store, err := newContainerdStore(opts.ContainerdAddress, opts.ContainerdNamespace)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer store.Close()
+	target, err := write(store)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return target, containerd.Tag(store, refs, target)
+}
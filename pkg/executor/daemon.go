@@ -0,0 +1,208 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/buildcontext"
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+var (
+	// For testing
+	daemonBuild     = buildAndPush
+	resetFilesystem = deleteFilesystem
+)
+
+// DaemonResponse is what the daemon responds to a build with
+type DaemonResponse struct {
+	// Digest is the digest of the image, or of the manifest list with --platform
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Daemon serves builds POSTed to /build, one at a time, so the base images they pull are only pulled once.
+// The body of a request is the options of the build as JSON, like {"SrcContext": "/workspace", "Destinations":
+// ["gcr.io/my-repo/my-image"]}, which are applied over the options the daemon was started with. The filesystem
+// and the environment are reset after each build, so a build can't see what an earlier one left behind.
+type Daemon struct {
+	opts   *options.KanikoOptions
+	images *cache.ImageCache
+	mu     sync.Mutex
+}
+
+// NewDaemon returns a daemon which builds with opts, and stores the base images its builds pull in cacheDir
+func NewDaemon(opts *options.KanikoOptions, cacheDir string) *Daemon {
+	return &Daemon{opts: opts, images: cache.NewImageCache(cacheDir)}
+}
+
+// Serve serves builds from l until it's closed
+func (d *Daemon) Serve(l net.Listener) error {
+	util.SetImageStore(d.images)
+	defer util.SetImageStore(nil)
+	logger.Infof("Serving builds on %s", l.Addr())
+	return http.Serve(l, d)
+}
+
+// ServeHTTP runs the build in r, and responds once it's done
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/build" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "builds must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The options in the request are decoded over the daemon's, so it only has to set the ones which differ
+	opts := copyOptions(d.opts)
+	if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+		respond(w, http.StatusBadRequest, DaemonResponse{Error: errors.Wrap(err, "parsing the options of the build").Error()})
+		return
+	}
+	digest, err := d.build(opts)
+	if err != nil {
+		respond(w, http.StatusInternalServerError, DaemonResponse{Error: err.Error()})
+		return
+	}
+	respond(w, http.StatusOK, DaemonResponse{Digest: digest})
+}
+
+// copyOptions returns a copy of opts with lists of their own. Decoding a list reuses the array of the one it's
+// decoded over, so otherwise a request would change the daemon's options for every build after it.
+func copyOptions(opts *options.KanikoOptions) *options.KanikoOptions {
+	c := *opts
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.Kind() == reflect.Slice && !f.IsNil() {
+			s := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(s, f)
+			f.Set(s)
+		}
+	}
+	return &c
+}
+
+func respond(w http.ResponseWriter, status int, resp DaemonResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Warnf("Couldn't respond to the build: %v", err)
+	}
+}
+
+// build runs a build once the one before it is done, and resets the filesystem and environment after it
+func (d *Daemon) build(opts *options.KanikoOptions) (string, error) {
+	if opts.SrcContext == "" || strings.Contains(opts.SrcContext, "://") {
+		return "", errors.Errorf("the build context must be a local directory, not %q", opts.SrcContext)
+	}
+	if opts.DockerfilePath == constants.DockerfileStdin {
+		return "", errors.New("the Dockerfile of a build can't be read from the daemon's stdin")
+	}
+	if opts.DryRun {
+		return "", errors.New("the daemon can't do a dry run of a build")
+	}
+	if !opts.NoPush && len(opts.Destinations) == 0 {
+		return "", errors.New("a build must have Destinations, or set NoPush")
+	}
+	if err := ValidateOptions(opts); err != nil {
+		return "", err
+	}
+	context, err := buildcontext.SubPath(opts.SrcContext, opts.ContextSubPath)
+	if err != nil {
+		return "", err
+	}
+	opts.SrcContext, opts.ContextSubPath = context, ""
+	if !filepath.IsAbs(opts.DockerfilePath) {
+		opts.DockerfilePath = filepath.Join(opts.SrcContext, opts.DockerfilePath)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// The contexts of each build are unpacked to the same directory, so they're only unpacked once it's its turn
+	contexts, err := buildcontext.UnpackNamedContexts(opts.BuildContexts, constants.NamedContextsDir)
+	if err != nil {
+		return "", errors.Wrap(err, "error resolving build contexts")
+	}
+	opts.BuildContexts = contexts
+	// Building whitelists the paths of the build, like --ignore-path, which are only kept out of its own image.
+	// They're restored once the filesystem is reset, so it doesn't delete them.
+	defer util.SaveWhitelist()()
+	// Building sets the environment of the base image in the daemon's, for RUN commands
+	env := os.Environ()
+	defer func() {
+		os.Clearenv()
+		for _, e := range env {
+			kv := strings.SplitN(e, "=", 2)
+			os.Setenv(kv[0], kv[1])
+		}
+		if err := resetFilesystem(); err != nil {
+			logger.Errorf("Couldn't delete the filesystem of the build, so the next build may see its files: %v", err)
+		}
+	}()
+	return daemonBuild(opts)
+}
+
+// buildAndPush builds and pushes the image opts describes, like the executor command, and returns its digest
+func buildAndPush(opts *options.KanikoOptions) (string, error) {
+	if len(opts.Platforms) > 0 {
+		index, err := BuildIndex(opts)
+		if err != nil {
+			return "", errors.Wrap(err, "error building image")
+		}
+		if err := DoPushIndex(index, opts); err != nil {
+			return "", err
+		}
+		digest, err := index.Digest()
+		return digest.String(), err
+	}
+	image, err := Build(opts)
+	if err != nil {
+		return "", errors.Wrap(err, "error building image")
+	}
+	if err := DoPush(image, opts); err != nil {
+		return "", err
+	}
+	digest, err := image.Digest()
+	return digest.String(), err
+}
+
+// deleteFilesystem deletes the filesystem a build was built in, and the stages, contexts and layers it saved
+func deleteFilesystem() error {
+	if err := util.DeleteFilesystem(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(constants.NamedContextsDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(constants.LayersDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(constants.KanikoIntermediateStagesDir)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestDaemon(t *testing.T) {
+	defer util.SetImageCache(nil)
+	util.SetImageCache(nil)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &fakeRegistry{image: img}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+
+	defer func(build func(*options.KanikoOptions) (string, error), reset func() error) {
+		daemonBuild, resetFilesystem = build, reset
+	}(daemonBuild, resetFilesystem)
+	resets := 0
+	resetFilesystem = func() error {
+		resets++
+		return nil
+	}
+	var builds []string
+	daemonBuild = func(opts *options.KanikoOptions) (string, error) {
+		if _, ok := os.LookupEnv("KANIKO_DAEMON_TEST"); ok {
+			return "", errors.New("the environment of the previous build was kept")
+		}
+		os.Setenv("KANIKO_DAEMON_TEST", opts.SrcContext)
+		builds = append(builds, opts.DockerfilePath)
+		// Unpacking the base image reads each of its layers
+		base, err := util.RetrieveRemoteImage(image, nil)
+		if err != nil {
+			return "", err
+		}
+		layers, err := base.Layers()
+		if err != nil {
+			return "", err
+		}
+		for _, l := range layers {
+			rc, err := l.Uncompressed()
+			if err != nil {
+				return "", err
+			}
+			_, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		digest, err := base.Digest()
+		return digest.String(), err
+	}
+
+	socket := filepath.Join(dir, "daemon.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- NewDaemon(&options.KanikoOptions{DockerfilePath: "Dockerfile"}, filepath.Join(dir, "cache")).Serve(l)
+	}()
+	// Serve stops storing pulled images once it returns
+	defer func() {
+		l.Close()
+		<-served
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	var requests []int
+	for _, srcContext := range []string{"/workspace/first", "/workspace/second"} {
+		resp, err := client.Post("http://kaniko/build", "application/json", strings.NewReader(`{"SrcContext": "`+srcContext+`", "NoPush": true}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var daemonResp DaemonResponse
+		err = json.NewDecoder(resp.Body).Decode(&daemonResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, DaemonResponse{Digest: imageDigest(t, img).String()}, daemonResp)
+		registry.mu.Lock()
+		requests = append(requests, registry.requests)
+		registry.mu.Unlock()
+	}
+	// The second build unpacks the base image the first one pulled, without the registry
+	if requests[0] == 0 || requests[1] != requests[0] {
+		t.Errorf("expected the base image to only be pulled by the first build, but the registry had %v requests after each build", requests)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/workspace/first/Dockerfile", "/workspace/second/Dockerfile"}, builds)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, resets)
+	if _, ok := os.LookupEnv("KANIKO_DAEMON_TEST"); ok {
+		t.Error("expected the environment to be reset after the last build")
+	}
+}
+
+func TestDaemon_InvalidBuild(t *testing.T) {
+	defer func(build func(*options.KanikoOptions) (string, error)) { daemonBuild = build }(daemonBuild)
+	daemonBuild = func(opts *options.KanikoOptions) (string, error) {
+		return "", errors.New("nothing should be built")
+	}
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{
+			name:   "not a POST",
+			method: http.MethodGet,
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "invalid options",
+			method: http.MethodPost,
+			body:   `{"SrcContext": 1}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "remote context",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "s3://bucket/context.tar.gz"}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "dockerfile from stdin",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "DockerfilePath": "-"}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "context sub path outside of the context",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "ContextSubPath": "../other", "NoPush": true}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "no destinations",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace"}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "dry run",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "NoPush": true, "DryRun": true}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "read-only and write-only cache",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "NoPush": true, "CacheReadOnly": true, "CacheWriteOnly": true}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "invalid snapshot mode",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "NoPush": true, "SnapshotMode": "sometimes"}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "invalid platform",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "NoPush": true, "Platforms": ["linux"]}`,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "invalid build context",
+			method: http.MethodPost,
+			body:   `{"SrcContext": "/workspace", "NoPush": true, "BuildContexts": ["no-source"]}`,
+			status: http.StatusInternalServerError,
+		},
+	}
+	d := NewDaemon(&options.KanikoOptions{DockerfilePath: "Dockerfile"}, "")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			d.ServeHTTP(w, httptest.NewRequest(test.method, "/build", strings.NewReader(test.body)))
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.status, w.Code)
+		})
+	}
+}
+
+func TestDaemon_Options(t *testing.T) {
+	defer func(build func(*options.KanikoOptions) (string, error), reset func() error) {
+		daemonBuild, resetFilesystem = build, reset
+	}(daemonBuild, resetFilesystem)
+	resetFilesystem = func() error { return nil }
+	var builds []*options.KanikoOptions
+	daemonBuild = func(opts *options.KanikoOptions) (string, error) {
+		builds = append(builds, opts)
+		return "sha256:digest", nil
+	}
+	opts := &options.KanikoOptions{
+		DockerfilePath: "Dockerfile",
+		Destinations:   []string{"gcr.io/project/a", "gcr.io/project/b"},
+		BuildArgs:      []string{"A=1", "B=2"},
+	}
+	d := NewDaemon(opts, "")
+	contextDir, err := filepath.Abs("context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"SrcContext": "/workspace", "Destinations": ["gcr.io/project/x"], "BuildArgs": ["C=3"], "BuildContexts": ["other=context"]}`,
+		`{"SrcContext": "/workspace"}`,
+	} {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(body)))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, http.StatusOK, w.Code)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(builds))
+	}
+	// The lists of a request replace the daemon's, without changing them for the builds after it
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"gcr.io/project/x"}, []string(builds[0].Destinations))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"C=3"}, []string(builds[0].BuildArgs))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"other=" + contextDir}, []string(builds[0].BuildContexts))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"gcr.io/project/a", "gcr.io/project/b"}, []string(builds[1].Destinations))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"A=1", "B=2"}, []string(builds[1].BuildArgs))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(builds[1].BuildContexts))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"gcr.io/project/a", "gcr.io/project/b"}, []string(opts.Destinations))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"A=1", "B=2"}, []string(opts.BuildArgs))
+}
+
+func TestDaemon_IgnorePaths(t *testing.T) {
+	defer func(build func(*options.KanikoOptions) (string, error), reset func() error) {
+		daemonBuild, resetFilesystem = build, reset
+	}(daemonBuild, resetFilesystem)
+	resetFilesystem = func() error { return nil }
+	paths := []string{"/first-ignored", "/second-ignored"}
+	var whitelisted [][]bool
+	daemonBuild = func(opts *options.KanikoOptions) (string, error) {
+		// Like Build, which whitelists the paths it ignores
+		for _, p := range opts.IgnorePaths {
+			util.AddToWhitelist(p)
+		}
+		var w []bool
+		for _, p := range paths {
+			ok, err := util.CheckWhitelist(p)
+			if err != nil {
+				return "", err
+			}
+			w = append(w, ok)
+		}
+		whitelisted = append(whitelisted, w)
+		return "sha256:digest", nil
+	}
+	d := NewDaemon(&options.KanikoOptions{DockerfilePath: "Dockerfile"}, "")
+	for _, p := range paths {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(`{"SrcContext": "/workspace", "NoPush": true, "IgnorePaths": ["`+p+`"]}`)))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, http.StatusOK, w.Code)
+	}
+	// Each build only ignores its own paths
+	testutil.CheckErrorAndDeepEqual(t, false, nil, [][]bool{{true, false}, {false, true}}, whitelisted)
+	for _, p := range paths {
+		ok, err := util.CheckWhitelist(p)
+		testutil.CheckErrorAndDeepEqual(t, false, err, false, ok)
+	}
+}
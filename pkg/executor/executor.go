@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"compress/gzip"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// Build builds the image described by opts, like the executor command, but without pushing it.
+// It lets programs use kaniko as a library. opts.SrcContext and opts.DockerfilePath must be local paths,
+// and like the executor, Build changes the root filesystem, so it should only be run in a container.
+func Build(opts *options.KanikoOptions) (v1.Image, error) {
+	opts, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Platforms) > 0 {
+		return nil, errors.New("building for platforms makes a manifest list, use BuildIndex instead")
+	}
+	return DoBuild(opts)
+}
+
+// BuildIndex builds the image described by opts for each of opts.Platforms, like Build, and returns the
+// manifest list of the images
+func BuildIndex(opts *options.KanikoOptions) (*ImageIndex, error) {
+	opts, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := util.ParsePlatforms(opts.Platforms)
+	if err != nil {
+		return nil, err
+	}
+	if len(platforms) == 0 {
+		return nil, errors.New("no platforms to build a manifest list for")
+	}
+	return DoMultiPlatformBuild(opts, platforms)
+}
+
+// ValidateOptions returns an error if opts can't be built, such as when a flag has an invalid value
+func ValidateOptions(opts *options.KanikoOptions) error {
+	if _, err := util.ParseSourceDateEpoch(opts.ReproducibleTimestamp); err != nil {
+		return err
+	}
+	switch opts.SnapshotMode {
+	case "", constants.SnapshotModeFull, constants.SnapshotModeTime, constants.SnapshotModeTimeSize:
+	default:
+		return errors.Errorf("--snapshotMode must be %s, %s or %s, not %s", constants.SnapshotModeFull, constants.SnapshotModeTime, constants.SnapshotModeTimeSize, opts.SnapshotMode)
+	}
+	if opts.CacheReadOnly && opts.CacheWriteOnly {
+		return errors.New("--cache-read-only and --cache-write-only can't both be set")
+	}
+	if opts.SnapshotConcurrency < 0 {
+		return errors.New("--snapshot-concurrency can't be negative")
+	}
+	if opts.PushConcurrency < 0 {
+		return errors.New("--push-concurrency can't be negative")
+	}
+	if opts.PushRetry < 0 {
+		return errors.New("--push-retry can't be negative")
+	}
+	if opts.ImageFSExtractRetries < 0 {
+		return errors.New("--image-fs-extract-retries can't be negative")
+	}
+	if opts.ImageFSExtractRetryBackoff < 0 {
+		return errors.New("--image-fs-extract-retry-backoff can't be negative")
+	}
+	if from, err := strconv.Atoi(opts.SquashFrom); err == nil && from < 0 {
+		return errors.New("--squash-from can't be a negative layer index")
+	}
+	if _, err := util.ParseMaxLayerSize(opts.MaxLayerSize); err != nil {
+		return err
+	}
+	if _, err := util.ParseRunLimits(opts.RunMemoryLimit, opts.RunCPULimit); err != nil {
+		return err
+	}
+	switch opts.RunNetwork {
+	case "", constants.RunNetworkHost, constants.RunNetworkNone:
+	default:
+		return errors.Errorf("--run-network must be %s or %s, not %s", constants.RunNetworkHost, constants.RunNetworkNone, opts.RunNetwork)
+	}
+	if opts.ContainerdImport && opts.TarPath != "" {
+		return errors.New("--containerd-import and --tarPath can't both be set")
+	}
+	if opts.CacheTTL < 0 {
+		return errors.New("--cache-ttl can't be negative")
+	}
+	if opts.CacheCompressionLevel < 0 || opts.CacheCompressionLevel > gzip.BestCompression {
+		return errors.Errorf("--cache-compression-level must be between 1 and %d, or 0 for the level of the layers built", gzip.BestCompression)
+	}
+	for _, p := range opts.IgnorePaths {
+		if !filepath.IsAbs(p) {
+			return errors.Errorf("--ignore-path %s must be an absolute path", p)
+		}
+	}
+	if _, err := util.ParseLabels(opts.Labels); err != nil {
+		return err
+	}
+	if _, err := util.ParseAnnotations(opts.Annotations); err != nil {
+		return err
+	}
+	if _, err := util.ParseSecrets(opts.Secrets); err != nil {
+		return err
+	}
+	if _, err := util.ParsePlatforms(opts.Platforms); err != nil {
+		return err
+	}
+	if _, err := util.ParseRegistryMirrors(opts.RegistryMirrors); err != nil {
+		return err
+	}
+	if _, err := util.NewRegistryOptions(opts.InsecureRegistries, opts.SkipTLSVerifyRegistries); err != nil {
+		return err
+	}
+	if opts.DockerConfig != "" {
+		if _, err := util.NewDockerConfigKeychain(opts.DockerConfig); err != nil {
+			return errors.Wrap(err, "--docker-config")
+		}
+	}
+	return util.ValidateCompression(opts.Compression, opts.CompressionLevel)
+}
+
+// resolveOptions validates opts, and returns a copy of them with the args from opts.BuildArgFile added
+func resolveOptions(opts *options.KanikoOptions) (*options.KanikoOptions, error) {
+	if err := ValidateOptions(opts); err != nil {
+		return nil, err
+	}
+	resolved := *opts
+	if opts.BuildArgFile != "" {
+		fileArgs, err := dockerfile.ReadBuildArgFile(opts.BuildArgFile)
+		if err != nil {
+			return nil, err
+		}
+		// Later args override earlier ones, so --build-arg takes precedence over the file
+		resolved.BuildArgs = append(fileArgs, opts.BuildArgs...)
+	}
+	return &resolved, nil
+}
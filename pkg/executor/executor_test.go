@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      options.KanikoOptions
+		shouldErr bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "valid options",
+			opts: options.KanikoOptions{
+				ReproducibleTimestamp:   "1500000000",
+				IgnorePaths:             []string{"/var/cache"},
+				Labels:                  []string{"version=1"},
+				Platforms:               []string{"linux/amd64,linux/arm64"},
+				Compression:             "zstd",
+				CompressionLevel:        19,
+				RegistryMirrors:         []string{"mirror.example.com/dockerhub,insecure"},
+				InsecureRegistries:      []string{"registry.example.com:5000"},
+				SkipTLSVerifyRegistries: []string{"self-signed.example.com"},
+			},
+		},
+		{
+			name:      "invalid timestamp",
+			opts:      options.KanikoOptions{ReproducibleTimestamp: "yesterday"},
+			shouldErr: true,
+		},
+		{
+			name:      "negative snapshot concurrency",
+			opts:      options.KanikoOptions{SnapshotConcurrency: -1},
+			shouldErr: true,
+		},
+		{
+			name:      "relative ignore path",
+			opts:      options.KanikoOptions{IgnorePaths: []string{"var/cache"}},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid label",
+			opts:      options.KanikoOptions{Labels: []string{"=1"}},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid annotation",
+			opts:      options.KanikoOptions{Annotations: []string{"org.opencontainers.image.source"}},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid registry mirror",
+			opts:      options.KanikoOptions{RegistryMirrors: []string{"http://mirror.example.com"}},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid insecure registry",
+			opts:      options.KanikoOptions{InsecureRegistries: []string{"http://registry.example.com"}},
+			shouldErr: true,
+		},
+		{
+			name:      "negative image fs extract retries",
+			opts:      options.KanikoOptions{ImageFSExtractRetries: -1},
+			shouldErr: true,
+		},
+		{
+			name:      "negative squash from layer index",
+			opts:      options.KanikoOptions{SquashFrom: "-1"},
+			shouldErr: true,
+		},
+		{
+			name:      "negative push concurrency",
+			opts:      options.KanikoOptions{PushConcurrency: -1},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid snapshot mode",
+			opts:      options.KanikoOptions{SnapshotMode: "sometimes"},
+			shouldErr: true,
+		},
+		{
+			name:      "read-only and write-only cache",
+			opts:      options.KanikoOptions{CacheReadOnly: true, CacheWriteOnly: true},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid cache compression level",
+			opts:      options.KanikoOptions{CacheCompressionLevel: 10},
+			shouldErr: true,
+		},
+		{
+			name: "cache compression level",
+			opts: options.KanikoOptions{CacheCompressionLevel: 9, CompressionLevel: 1},
+		},
+		{
+			name:      "invalid max layer size",
+			opts:      options.KanikoOptions{MaxLayerSize: "2 bananas"},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid run network",
+			opts:      options.KanikoOptions{RunNetwork: "bridge"},
+			shouldErr: true,
+		},
+		{
+			name:      "containerd import and tarball",
+			opts:      options.KanikoOptions{ContainerdImport: true, TarPath: "image.tar"},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid compression",
+			opts:      options.KanikoOptions{Compression: "xz"},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid compression level",
+			opts:      options.KanikoOptions{Compression: "gzip", CompressionLevel: 12},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid platform",
+			opts:      options.KanikoOptions{Platforms: []string{"linux"}},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckError(t, test.shouldErr, ValidateOptions(&test.opts))
+		})
+	}
+}
+
+func TestBuild_InvalidOptions(t *testing.T) {
+	// Invalid options are rejected before anything is built
+	_, err := Build(&options.KanikoOptions{PushRetry: -1})
+	testutil.CheckError(t, true, err)
+	_, err = Build(&options.KanikoOptions{Platforms: []string{"linux/amd64"}})
+	testutil.CheckError(t, true, err)
+	_, err = BuildIndex(&options.KanikoOptions{})
+	testutil.CheckError(t, true, err)
+}
+
+func TestBuild(t *testing.T) {
+	opts, cleanup := setUpBuild(t, "FROM scratch\nARG VERSION\nENV VERSION=$VERSION\nWORKDIR /app\n", map[string]string{"build-args": "VERSION=1\n"})
+	defer cleanup()
+	opts.BuildArgFile = filepath.Join(opts.SrcContext, "build-args")
+	opts.Labels = []string{"built-by=test"}
+	image, err := Build(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "/app", cfg.Config.WorkingDir)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "test", cfg.Config.Labels["built-by"])
+	found := false
+	for _, env := range cfg.Config.Env {
+		found = found || env == "VERSION=1"
+	}
+	if !found {
+		t.Errorf("expected VERSION=1 in %v", cfg.Config.Env)
+	}
+	// The options given aren't changed
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(opts.BuildArgs))
+}
+
+func TestBuild_Events(t *testing.T) {
+	opts, cleanup := setUpBuild(t, "FROM scratch AS first\nENV A=1\nFROM scratch\nENV B=2\nWORKDIR /app\n", nil)
+	defer cleanup()
+	events := captureEvents(t)
+	_, err := Build(opts)
+	logged := events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, event := range logged {
+		types = append(types, event["event"].(string))
+		if event["event"] == util.EventInstructionEnd {
+			if _, ok := event["duration_seconds"].(float64); !ok {
+				t.Errorf("%s event has no duration: %v", util.EventInstructionEnd, event)
+			}
+		}
+	}
+	expected := []string{
+		util.EventStageStart,
+		util.EventInstructionStart, util.EventInstructionEnd,
+		util.EventStageStart,
+		util.EventInstructionStart, util.EventInstructionEnd,
+		util.EventInstructionStart, util.EventInstructionEnd,
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, types)
+	// Instructions are logged like they're recorded in the history of the image
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "workdir /app", logged[6]["instruction"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, logged[3]["final"])
+}
+
+func TestBuild_EventsFailedInstruction(t *testing.T) {
+	opts, cleanup := setUpBuild(t, "FROM scratch\nENV A=1\nCOPY missing /missing\nENV B=2\n", nil)
+	defer cleanup()
+	events := captureEvents(t)
+	_, err := Build(opts)
+	logged := events()
+	testutil.CheckError(t, true, err)
+
+	// The instruction which failed is logged as ended, with its error, and nothing after it runs
+	var types []string
+	for _, event := range logged {
+		types = append(types, event["event"].(string))
+	}
+	expected := []string{
+		util.EventStageStart,
+		util.EventInstructionStart, util.EventInstructionEnd,
+		util.EventInstructionStart, util.EventInstructionEnd,
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, types)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "missing /missing", logged[4]["instruction"])
+	if _, ok := logged[4]["error"].(string); !ok {
+		t.Errorf("%s event of the failed instruction has no error: %v", util.EventInstructionEnd, logged[4])
+	}
+	if _, ok := logged[2]["error"]; ok {
+		t.Errorf("%s event of an instruction which didn't fail has an error: %v", util.EventInstructionEnd, logged[2])
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+)
+
+// instructionHook is the --post-instruction-hook, which is run after each instruction, like to record what it changed
+type instructionHook struct {
+	path        string
+	failOnError bool
+}
+
+// newInstructionHook returns the hook opts runs after each instruction, or nil if there isn't one
+func newInstructionHook(opts *options.KanikoOptions) *instructionHook {
+	if opts.PostInstructionHook == "" {
+		return nil
+	}
+	return &instructionHook{path: opts.PostInstructionHook, failOnError: opts.HookFailOnError}
+}
+
+// run runs the hook after the instruction at index in stage, with the instruction and the digest of the layer
+// it added, if it added one, in its environment. A hook which fails only fails the build with --hook-fail-on-error.
+func (h *instructionHook) run(stage, index int, name, instruction string, layer v1.Layer) error {
+	var digest string
+	if layer != nil {
+		d, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		digest = d.String()
+	}
+	cmd := exec.Command(h.path)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KANIKO_STAGE=%d", stage),
+		fmt.Sprintf("KANIKO_INSTRUCTION_INDEX=%d", index),
+		"KANIKO_INSTRUCTION_TYPE="+strings.ToUpper(name),
+		"KANIKO_INSTRUCTION="+instruction,
+		"KANIKO_LAYER_DIGEST="+digest,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if h.failOnError {
+			return errors.Wrapf(err, "running the post-instruction hook %s after %s", h.path, instruction)
+		}
+		logger.Warnf("The post-instruction hook %s failed after %s: %v", h.path, instruction, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func writeHook(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_instructionHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	hook := newInstructionHook(&options.KanikoOptions{
+		PostInstructionHook: writeHook(t, dir, `echo "$KANIKO_STAGE|$KANIKO_INSTRUCTION_INDEX|$KANIKO_INSTRUCTION_TYPE|$KANIKO_INSTRUCTION|$KANIKO_LAYER_DIGEST" >> `+out),
+	})
+
+	stages, err := dockerfile.Parse([]byte("FROM scratch\nENV PATH=/app\nRUN ./build.sh\nWORKDIR /app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the RUN adds a layer
+	var expected []string
+	for index, cmd := range stages[0].Commands {
+		dockerCommand, err := commands.GetCommand(cmd, "", '\\', &options.KanikoOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var layer v1.Layer
+		layerDigest := ""
+		if cmd.Name() == "run" {
+			layer = layers[0]
+			layerDigest = digest.String()
+		}
+		end := startInstruction(0, index, cmd.Name(), dockerCommand.CreatedBy(), hook)
+		if err := end(layer, nil); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, fmt.Sprintf("0|%d|%s|%s|%s", index, strings.ToUpper(cmd.Name()), dockerCommand.CreatedBy(), layerDigest))
+	}
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, actual)
+	if !strings.Contains(actual[0], "|ENV|") || !strings.Contains(actual[1], "|RUN|") || !strings.Contains(actual[2], "|WORKDIR|") {
+		t.Errorf("expected the hook to be run after ENV, RUN and WORKDIR, got %v", actual)
+	}
+}
+
+func Test_instructionHook_FailOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeHook(t, dir, "exit 1")
+	tests := []struct {
+		name        string
+		opts        *options.KanikoOptions
+		shouldError bool
+	}{
+		{name: "no hook", opts: &options.KanikoOptions{HookFailOnError: true}},
+		{name: "failing hook", opts: &options.KanikoOptions{PostInstructionHook: path}},
+		{name: "failing hook with --hook-fail-on-error", opts: &options.KanikoOptions{PostInstructionHook: path, HookFailOnError: true}, shouldError: true},
+		{name: "missing hook with --hook-fail-on-error", opts: &options.KanikoOptions{PostInstructionHook: filepath.Join(dir, "missing"), HookFailOnError: true}, shouldError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			end := startInstruction(0, 0, "run", "RUN ./build.sh", newInstructionHook(test.opts))
+			testutil.CheckError(t, test.shouldError, end(nil, nil))
+		})
+	}
+}
+
+func TestBuild_PostInstructionHook(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	out := filepath.Join(cacheDir, "out")
+	hook := writeHook(t, cacheDir, `echo "$KANIKO_INSTRUCTION_INDEX|$KANIKO_INSTRUCTION_TYPE|$KANIKO_LAYER_DIGEST" >> `+out)
+
+	// The second build reuses the layers of the first from the cache
+	for _, cached := range []bool{false, true} {
+		opts, cleanup := setUpBuild(t, "FROM scratch\nENV A=1\nCOPY a /a\nCOPY b /b\n", map[string]string{"a": "a", "b": "b"})
+		opts.PostInstructionHook = hook
+		opts.HookFailOnError = true
+		opts.Cache = true
+		opts.CacheDir = filepath.Join(cacheDir, "cache")
+		os.Remove(out)
+		events := captureEvents(t)
+		image, err := DoBuild(opts)
+		logged := events()
+		cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits := 0
+		for _, event := range logged {
+			if event["event"] == util.EventCacheHit {
+				hits++
+			}
+		}
+		expectedHits := 0
+		if cached {
+			expectedHits = 2
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, expectedHits, hits)
+
+		// The hook is run once after each instruction, with the layers which were added to the image
+		layers, err := image.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"0|ENV|"}
+		for i, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, fmt.Sprintf("%d|COPY|%s", i+1, digest))
+		}
+		contents, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, expected, strings.Split(strings.TrimSpace(string(contents)), "\n"))
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// ImageIndex is a manifest list of images built for different platforms
+type ImageIndex struct {
+	images   map[v1.Hash]v1.Image
+	manifest *v1.IndexManifest
+	raw      []byte
+}
+
+var _ v1.ImageIndex = (*ImageIndex)(nil)
+
+// DoMultiPlatformBuild builds the image once for each platform, and returns the manifest list of the images
+func DoMultiPlatformBuild(opts *options.KanikoOptions, platforms []v1.Platform) (*ImageIndex, error) {
+	var images []v1.Image
+	for i, platform := range platforms {
+		// Each build starts from its own base image
+		if i > 0 {
+			if err := deleteStageFilesystem(); err != nil {
+				return nil, err
+			}
+		}
+		logger.Infof("Building image for platform %s", util.PlatformString(platform))
+		image, err := build(opts, &platform)
+		if err != nil {
+			return nil, errors.Wrapf(err, "building image for platform %s", util.PlatformString(platform))
+		}
+		images = append(images, image)
+	}
+	annotations, err := util.ParseAnnotations(opts.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	return NewImageIndex(images, platforms, annotations)
+}
+
+// NewImageIndex returns a manifest list of images, where each image is for the platform at the same index,
+// with annotations in the manifest list
+func NewImageIndex(images []v1.Image, platforms []v1.Platform, annotations map[string]string) (*ImageIndex, error) {
+	if len(images) != len(platforms) {
+		return nil, errors.Errorf("%d images were given for %d platforms", len(images), len(platforms))
+	}
+	index := &ImageIndex{
+		images: map[v1.Hash]v1.Image{},
+		manifest: &v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.DockerManifestList,
+		},
+	}
+	if len(annotations) > 0 {
+		index.manifest.Annotations = annotations
+	}
+	for i, image := range images {
+		mediaType, err := image.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		rawManifest, err := image.RawManifest()
+		if err != nil {
+			return nil, err
+		}
+		digest, size, err := v1.SHA256(bytes.NewReader(rawManifest))
+		if err != nil {
+			return nil, err
+		}
+		platform := platforms[i]
+		index.images[digest] = image
+		index.manifest.Manifests = append(index.manifest.Manifests, v1.Descriptor{
+			MediaType: mediaType,
+			Size:      size,
+			Digest:    digest,
+			Platform:  &platform,
+		})
+	}
+	raw, err := json.Marshal(index.manifest)
+	if err != nil {
+		return nil, err
+	}
+	index.raw = raw
+	return index, nil
+}
+
+// MediaType implements v1.ImageIndex
+func (i *ImageIndex) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+// Digest implements v1.ImageIndex
+func (i *ImageIndex) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+// IndexManifest implements v1.ImageIndex
+func (i *ImageIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+
+// RawIndexManifest implements v1.ImageIndex
+func (i *ImageIndex) RawIndexManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+// Image returns the image in the manifest list with the manifest digest h
+func (i *ImageIndex) Image(h v1.Hash) (v1.Image, error) {
+	image, ok := i.images[h]
+	if !ok {
+		return nil, errors.Errorf("no image with digest %s in the manifest list", h)
+	}
+	return image, nil
+}
+
+// writeIndex pushes the manifest list to ref. The images in it must already have been pushed.
+func writeIndex(ref name.Tag, index *ImageIndex, auth authn.Authenticator, t http.RoundTripper) error {
+	tr, err := transport.New(ref.Context().Registry, auth, t, []string{ref.Scope(transport.PushScope)})
+	if err != nil {
+		return err
+	}
+	u := url.URL{
+		Scheme: ref.Context().Registry.Scheme(),
+		Host:   ref.Context().RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", ref.Context().RepositoryStr(), ref.Identifier()),
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(index.raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(index.manifest.MediaType))
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := remote.CheckError(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted); err != nil {
+		return err
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		return err
+	}
+	pushLogger.Infof("Pushed manifest list %s with digest %s", ref, digest)
+	return nil
+}
+
+// writeIndexLayout writes the manifest list and its images to a tarball at tarPath, as an OCI image
+// layout, or streams the tarball to stdout if tarPath is -. If ref is set, the manifest list is named with it.
+func writeIndexLayout(tarPath string, ref *name.Tag, index *ImageIndex) error {
+	if tarPath == constants.TarPathStdout {
+		return writeIndexLayoutTar(tarStdout, ref, index)
+	}
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeIndexLayoutTar(f, ref, index); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeIndexLayoutTar(out io.Writer, ref *name.Tag, index *ImageIndex) error {
+	w := tar.NewWriter(out)
+	desc, images, err := indexLayoutManifest(index)
+	if err != nil {
+		return err
+	}
+	if err := writeLayout(&tarLayoutWriter{w: w}, ref, desc, index.raw, images); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+var testPlatforms = []v1.Platform{
+	{OS: "linux", Architecture: "amd64"},
+	{OS: "linux", Architecture: "arm", Variant: "v7"},
+}
+
+func newTestIndex(t *testing.T) (*ImageIndex, []v1.Image) {
+	var images []v1.Image
+	for range testPlatforms {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, img)
+	}
+	index, err := NewImageIndex(images, testPlatforms, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index, images
+}
+
+func TestNewImageIndex(t *testing.T) {
+	index, images := newTestIndex(t)
+
+	m, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, int64(2), m.SchemaVersion)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, types.DockerManifestList, m.MediaType)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(images), len(m.Manifests))
+	for i, desc := range m.Manifests {
+		rawManifest, err := images[i].RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := images[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, digest, desc.Digest)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, int64(len(rawManifest)), desc.Size)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, types.DockerManifestSchema2, desc.MediaType)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, testPlatforms[i], *desc.Platform)
+
+		image, err := index.Image(desc.Digest)
+		testutil.CheckErrorAndDeepEqual(t, false, err, images[i], image)
+	}
+
+	// The digest is of the raw manifest list, which is what gets pushed
+	raw, err := index.RawIndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := index.Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, actual)
+
+	_, err = index.Image(v1.Hash{Algorithm: "sha256", Hex: "missing"})
+	testutil.CheckError(t, true, err)
+}
+
+func TestNewImageIndex_Annotations(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{"org.opencontainers.image.revision": "abc"}
+	index, err := NewImageIndex([]v1.Image{img}, testPlatforms[:1], annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := index.RawIndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m v1.IndexManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, annotations, m.Annotations)
+}
+
+func TestNewImageIndex_Mismatch(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewImageIndex([]v1.Image{img}, testPlatforms, nil)
+	testutil.CheckError(t, true, err)
+}
+
+func Test_writeIndex(t *testing.T) {
+	index, _ := newTestIndex(t)
+	var contentType, requestPath string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		requestPath = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ref, err := name.NewTag(strings.TrimPrefix(server.URL, "http://")+"/test/image:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeIndex(ref, index, authn.Anonymous, http.DefaultTransport); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := index.RawIndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "/v2/test/image/manifests/latest", requestPath)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, string(types.DockerManifestList), contentType)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, raw, body)
+}
+
+func Test_writeIndexLayout(t *testing.T) {
+	index, images := newTestIndex(t)
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	tarPath := filepath.Join(testDir, "image.tar")
+	ref, err := name.NewTag("gcr.io/kaniko-test/image:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeIndexLayout(tarPath, &ref, index); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			t.Errorf("%s was written more than once", hdr.Name)
+		}
+		files[hdr.Name] = contents
+	}
+
+	if _, ok := files["oci-layout"]; !ok {
+		t.Error("oci-layout is missing")
+	}
+	var layoutIndex v1.IndexManifest
+	if err := json.Unmarshal(files["index.json"], &layoutIndex); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(layoutIndex.Manifests))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, digest, layoutIndex.Manifests[0].Digest)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ref.String(), layoutIndex.Manifests[0].Annotations[ociRefNameAnnotation])
+
+	blob := func(h v1.Hash) []byte {
+		contents, ok := files[path.Join("blobs", h.Algorithm, h.Hex)]
+		if !ok {
+			t.Errorf("blob %s is missing", h)
+		}
+		return contents
+	}
+	raw, err := index.RawIndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, raw, blob(digest))
+	for _, image := range images {
+		imageDigest, err := image.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawManifest, err := image.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, rawManifest, blob(imageDigest))
+		m, err := image.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range append(m.Layers, m.Config) {
+			contents := blob(desc.Digest)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, desc.Size, int64(len(contents)))
+		}
+	}
+}
+
+func Test_writeIndexLayout_Stdout(t *testing.T) {
+	index, _ := newTestIndex(t)
+	var stdout bytes.Buffer
+	defer func(w io.Writer) { tarStdout = w }(tarStdout)
+	tarStdout = &stdout
+	if err := writeIndexLayout("-", nil, index); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&stdout)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	for _, expected := range []string{"oci-layout", "index.json"} {
+		found := false
+		for _, n := range names {
+			found = found || n == expected
+		}
+		if !found {
+			t.Errorf("%s is missing from %v", expected, names)
+		}
+	}
+}
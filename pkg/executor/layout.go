@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ociRefNameAnnotation is the annotation in an OCI layout's index.json which names an image
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// layoutWriter writes the files of an OCI image layout
+type layoutWriter interface {
+	WriteFile(name string, size int64, r io.Reader) error
+}
+
+// tarLayoutWriter writes an OCI image layout to a tarball
+type tarLayoutWriter struct {
+	w *tar.Writer
+}
+
+func (t *tarLayoutWriter) WriteFile(name string, size int64, r io.Reader) error {
+	if err := t.w.WriteHeader(&tar.Header{
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.w, r)
+	return err
+}
+
+// dirLayoutWriter writes an OCI image layout to a directory
+type dirLayoutWriter struct {
+	dir string
+}
+
+func (d *dirLayoutWriter) WriteFile(name string, size int64, r io.Reader) error {
+	p := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeImageLayoutDir writes image to dir as an OCI image layout. If ref is set, the image is named with it.
+func writeImageLayoutDir(dir string, ref *name.Tag, image v1.Image) error {
+	mediaType, err := image.MediaType()
+	if err != nil {
+		return err
+	}
+	raw, err := image.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Size:      size,
+		Digest:    digest,
+	}
+	return writeLayout(&dirLayoutWriter{dir: dir}, ref, desc, raw, []v1.Image{image})
+}
+
+// writeIndexLayoutDir writes the manifest list and its images to dir as an OCI image layout. If ref is set, the
+// manifest list is named with it.
+func writeIndexLayoutDir(dir string, ref *name.Tag, index *ImageIndex) error {
+	desc, images, err := indexLayoutManifest(index)
+	if err != nil {
+		return err
+	}
+	return writeLayout(&dirLayoutWriter{dir: dir}, ref, desc, index.raw, images)
+}
+
+// indexLayoutManifest returns the descriptor of the manifest list, and its images in order
+func indexLayoutManifest(index *ImageIndex) (v1.Descriptor, []v1.Image, error) {
+	digest, err := index.Digest()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	var images []v1.Image
+	for _, m := range index.manifest.Manifests {
+		images = append(images, index.images[m.Digest])
+	}
+	return v1.Descriptor{
+		MediaType: index.manifest.MediaType,
+		Size:      int64(len(index.raw)),
+		Digest:    digest,
+	}, images, nil
+}
+
+// writeLayout writes an OCI image layout whose index.json refers to the manifest raw, described by desc. images
+// are the image raw is the manifest of, or the images in the manifest list raw.
+func writeLayout(w layoutWriter, ref *name.Tag, desc v1.Descriptor, raw []byte, images []v1.Image) error {
+	if ref != nil {
+		desc.Annotations = map[string]string{ociRefNameAnnotation: ref.String()}
+	}
+	layoutIndex, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		Manifests:     []v1.Descriptor{desc},
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "oci-layout", contents: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{name: "index.json", contents: layoutIndex},
+	} {
+		if err := w.WriteFile(file.name, int64(len(file.contents)), bytes.NewReader(file.contents)); err != nil {
+			return err
+		}
+	}
+
+	// Images for different platforms often share layers, so only write each blob once
+	written := map[v1.Hash]bool{}
+	writeBlob := func(h v1.Hash, size int64, r io.Reader) error {
+		if written[h] {
+			return nil
+		}
+		written[h] = true
+		return w.WriteFile(path.Join("blobs", h.Algorithm, h.Hex), size, r)
+	}
+	if err := writeBlob(desc.Digest, desc.Size, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	for _, image := range images {
+		rawManifest, err := image.RawManifest()
+		if err != nil {
+			return err
+		}
+		digest, err := image.Digest()
+		if err != nil {
+			return err
+		}
+		if err := writeBlob(digest, int64(len(rawManifest)), bytes.NewReader(rawManifest)); err != nil {
+			return err
+		}
+		rawConfig, err := image.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		configName, err := image.ConfigName()
+		if err != nil {
+			return err
+		}
+		if err := writeBlob(configName, int64(len(rawConfig)), bytes.NewReader(rawConfig)); err != nil {
+			return err
+		}
+		layers, err := image.Layers()
+		if err != nil {
+			return err
+		}
+		for _, layer := range layers {
+			h, err := layer.Digest()
+			if err != nil {
+				return err
+			}
+			if written[h] {
+				continue
+			}
+			size, err := layer.Size()
+			if err != nil {
+				return err
+			}
+			r, err := layer.Compressed()
+			if err != nil {
+				return err
+			}
+			err = writeBlob(h, size, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
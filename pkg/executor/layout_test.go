@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// checkLayoutBlob checks that the blob for desc is in the layout at dir, and returns its contents
+func checkLayoutBlob(t *testing.T, dir string, desc v1.Descriptor) []byte {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "blobs", desc.Digest.Algorithm, desc.Digest.Hex))
+	if err != nil {
+		t.Fatalf("blob %s is missing: %v", desc.Digest, err)
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, desc.Digest, digest)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, desc.Size, size)
+	return contents
+}
+
+// checkImageLayout checks that the manifest, config and layers of the image described by desc are in the layout at dir
+func checkImageLayout(t *testing.T, dir string, desc v1.Descriptor) {
+	m, err := v1.ParseManifest(bytes.NewReader(checkLayoutBlob(t, dir, desc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLayoutBlob(t, dir, m.Config)
+	for _, layer := range m.Layers {
+		checkLayoutBlob(t, dir, layer)
+	}
+}
+
+func readLayoutIndex(t *testing.T, dir string) v1.IndexManifest {
+	layout, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, `{"imageLayoutVersion":"1.0.0"}`, string(layout))
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index v1.IndexManifest
+	if err := json.Unmarshal(raw, &index); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, int64(2), index.SchemaVersion)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(index.Manifests))
+	return index
+}
+
+func TestDoPush_OCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options.KanikoOptions{
+		Destinations:  []string{"gcr.io/kaniko-test/image:latest"},
+		OCILayoutPath: filepath.Join(dir, "out"),
+		NoPush:        true,
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	index := readLayoutIndex(t, opts.OCILayoutPath)
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := index.Manifests[0]
+	testutil.CheckErrorAndDeepEqual(t, false, nil, digest, desc.Digest)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, types.DockerManifestSchema2, desc.MediaType)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "gcr.io/kaniko-test/image:latest", desc.Annotations[ociRefNameAnnotation])
+	checkImageLayout(t, opts.OCILayoutPath, desc)
+}
+
+func TestDoPushIndex_OCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imageIndex, _ := newTestIndex(t)
+	opts := &options.KanikoOptions{
+		OCILayoutPath: dir,
+		NoPush:        true,
+	}
+	if err := DoPushIndex(imageIndex, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	index := readLayoutIndex(t, dir)
+	digest, err := imageIndex.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := index.Manifests[0]
+	testutil.CheckErrorAndDeepEqual(t, false, nil, digest, desc.Digest)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, types.DockerManifestList, desc.MediaType)
+	// Without a destination the manifest list isn't named
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(desc.Annotations))
+
+	manifestList, err := v1.ParseIndexManifest(bytes.NewReader(checkLayoutBlob(t, dir, desc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(testPlatforms), len(manifestList.Manifests))
+	for _, m := range manifestList.Manifests {
+		checkImageLayout(t, dir, m)
+	}
+}
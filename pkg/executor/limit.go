@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultPushConcurrency is how many blobs are uploaded to a destination at once, unless --push-concurrency
+// is set. It's what docker pushes with.
+const defaultPushConcurrency = 5
+
+// uploadLimiter bounds how many blobs are uploaded at once. Its limit is halved each time the registry
+// rate limits a request, down to one upload at a time, so retries put less load on the registry.
+type uploadLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newUploadLimiter(limit int) *uploadLimiter {
+	if limit < 1 {
+		limit = defaultPushConcurrency
+	}
+	l := &uploadLimiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until there are fewer uploads than the limit, and starts one
+func (l *uploadLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release ends an upload
+func (l *uploadLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// throttle halves the limit after the registry rate limited a request. The uploads which have
+// already started carry on.
+func (l *uploadLimiter) throttle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 1 {
+		l.limit /= 2
+		pushLogger.Warnf("The registry is rate limiting requests, so only %d blobs are uploaded at once now", l.limit)
+	}
+}
+
+// limitUploads returns t, with the requests which upload blobs sent when limiter allows it
+func limitUploads(t http.RoundTripper, limiter *uploadLimiter) http.RoundTripper {
+	return &uploadLimitTransport{t: t, limiter: limiter}
+}
+
+// uploadLimitTransport bounds how many requests uploading blobs are sent at once with limiter, and
+// throttles it when the registry rate limits a request
+type uploadLimitTransport struct {
+	t       http.RoundTripper
+	limiter *uploadLimiter
+}
+
+func (u *uploadLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isBlobUpload(req) {
+		u.limiter.acquire()
+		defer u.limiter.release()
+	}
+	resp, err := u.t.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		u.limiter.throttle()
+	}
+	return resp, err
+}
+
+// isBlobUpload returns true if req sends the contents of a blob to the registry, at the location the
+// registry gave for the upload. Only manifests are pushed with other requests that have a body.
+func isBlobUpload(req *http.Request) bool {
+	if req.Method == http.MethodPatch {
+		return true
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	return req.Method == http.MethodPut && hasBody && !strings.Contains(req.URL.Path, "/manifests/")
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// uploadCountingRegistry is a blobRegistry which counts how many blobs are being uploaded at once.
+// The first rateLimited uploads are answered with 429.
+type uploadCountingRegistry struct {
+	*blobRegistry
+	rateLimited int
+
+	lock      sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (u *uploadCountingRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		u.blobRegistry.ServeHTTP(w, r)
+		return
+	}
+	u.lock.Lock()
+	if u.rateLimited > 0 {
+		u.rateLimited--
+		u.lock.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	u.active++
+	if u.active > u.maxActive {
+		u.maxActive = u.active
+	}
+	u.lock.Unlock()
+	// Uploads take long enough for the others to start
+	time.Sleep(20 * time.Millisecond)
+	u.blobRegistry.ServeHTTP(w, r)
+	u.lock.Lock()
+	u.active--
+	u.lock.Unlock()
+}
+
+func TestDoPush_PushConcurrency(t *testing.T) {
+	image, err := random.Image(1024, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a limit of 1, more than one blob is uploaded at once, but no more than the limit
+	tests := []struct {
+		concurrency int
+		expectedMin int
+		expectedMax int
+	}{
+		{concurrency: 1, expectedMin: 1, expectedMax: 1},
+		{concurrency: 3, expectedMin: 2, expectedMax: 3},
+		{concurrency: 0, expectedMin: 2, expectedMax: defaultPushConcurrency},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("concurrency=%d", test.concurrency), func(t *testing.T) {
+			registry := &uploadCountingRegistry{blobRegistry: newBlobRegistry()}
+			server := httptest.NewServer(registry)
+			defer server.Close()
+			host := strings.TrimPrefix(server.URL, "http://")
+			opts := &options.KanikoOptions{Destinations: []string{host + "/a/image:latest"}, PushConcurrency: test.concurrency}
+			if err := DoPush(image, opts); err != nil {
+				t.Fatal(err)
+			}
+			if registry.maxActive > test.expectedMax {
+				t.Errorf("%d blobs were uploaded at once, more than %d", registry.maxActive, test.expectedMax)
+			}
+			if registry.maxActive < test.expectedMin {
+				t.Errorf("at most %d blobs were uploaded at once, fewer than %d", registry.maxActive, test.expectedMin)
+			}
+			// The 12 layers and the config are all uploaded
+			testutil.CheckErrorAndDeepEqual(t, false, nil, 13, len(registry.uploads))
+		})
+	}
+}
+
+func TestDoPush_RateLimitedPushConcurrency(t *testing.T) {
+	defer func(backoff time.Duration) { pushRetryBackoff = backoff }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+	image, err := random.Image(1024, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &uploadCountingRegistry{blobRegistry: newBlobRegistry(), rateLimited: 1}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	opts := &options.KanikoOptions{Destinations: []string{host + "/a/image:latest"}, PushConcurrency: 4, PushRetry: 3}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 13, len(registry.uploads))
+}
+
+func TestUploadLimiter(t *testing.T) {
+	l := newUploadLimiter(4)
+	for i := 0; i < 4; i++ {
+		l.acquire()
+	}
+	started := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("more uploads started than the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release()
+	<-started
+
+	// After being rate limited, only half as many uploads can start
+	l.throttle()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, l.limit)
+	for i := 0; i < 3; i++ {
+		l.release()
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, l.active)
+	l.acquire()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, l.active)
+
+	l.throttle()
+	l.throttle()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, l.limit)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, defaultPushConcurrency, newUploadLimiter(0).limit)
+}
+
+func Test_uploadLimitTransport_Throttle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	limiter := newUploadLimiter(8)
+	rt := limitUploads(http.DefaultTransport, limiter)
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, limiter.limit)
+}
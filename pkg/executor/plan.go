@@ -0,0 +1,258 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/commands"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// What a build would do for an instruction
+const (
+	// PlanRun is an instruction which would be run
+	PlanRun = "would-run"
+	// PlanCacheHit is an instruction whose layer would be taken from the cache instead of running it
+	PlanCacheHit = "cache-hit"
+	// PlanMetadata is an instruction which only changes the image config
+	PlanMetadata = "metadata"
+)
+
+// PlanStep is what a build would do for one instruction
+type PlanStep struct {
+	// Platform is the platform being built for with --platform, or "" for the platform kaniko is running on
+	Platform string
+	Stage    int
+	// Instruction is the instruction as it's written in the Dockerfile
+	Instruction string
+	Status      string
+	// Key is the cache key of the layer of the instruction, or "" if its layer isn't cached, or its key
+	// can't be known without building
+	Key string
+	// Digest is the digest of the cached layer, for a cache hit
+	Digest string
+}
+
+// Plan works out what building opts would do for each instruction, without running any of them or changing
+// the filesystem. Like the build, it looks up the cache key of each cached instruction in the cache. Keys include
+// the files added by the instructions before them which aren't cached, like COPY, so once one of those would run,
+// the instructions after it would run too, unless the build finds their layers in the cache.
+func Plan(opts *options.KanikoOptions) ([]PlanStep, error) {
+	opts, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Platforms) == 0 {
+		return plan(opts, nil)
+	}
+	platforms, err := util.ParsePlatforms(opts.Platforms)
+	if err != nil {
+		return nil, err
+	}
+	var steps []PlanStep
+	for i := range platforms {
+		platformSteps, err := plan(opts, &platforms[i])
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, platformSteps...)
+	}
+	return steps, nil
+}
+
+// plan is the plan of build for platform
+func plan(opts *options.KanikoOptions, platform *v1.Platform) ([]PlanStep, error) {
+	if err := setRegistries(opts); err != nil {
+		return nil, err
+	}
+	util.SetImageCache(newImageCache(opts))
+	stages, metaArgs, directives, err := dockerfile.Stages(opts.DockerfilePath, opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	stageArgs := dockerfile.NewBuildArgs(opts.BuildArgs)
+	if err := stageArgs.AddMetaArgs(metaArgs, directives.Escape); err != nil {
+		return nil, err
+	}
+	if err := dockerfile.ResolveBaseNames(stages, stageArgs, directives.Escape); err != nil {
+		return nil, err
+	}
+	contexts, err := dockerfile.ParseBuildContexts(opts.BuildContexts)
+	if err != nil {
+		return nil, err
+	}
+	if err := dockerfile.ResolveBuildContexts(stages, contexts); err != nil {
+		return nil, err
+	}
+	layerCache, err := newLayerCache(opts)
+	if err != nil {
+		return nil, err
+	}
+	var platformString string
+	if platform != nil {
+		platformString = util.PlatformString(*platform)
+	}
+	var steps []PlanStep
+	for index, stage := range stages {
+		finalStage := finalStage(index, opts.Target, stages)
+		useCache := layerCache != nil && finalStage && !opts.SingleSnapshot
+		config := &v1.Config{}
+		var compositeKey *cache.CompositeCache
+		triggers := 0
+		// The base image of a stage built from a previous stage doesn't exist until that stage is built
+		if !baseIsStage(index, stages) {
+			stagePlatform, err := util.StagePlatform(stage, stageArgs.MetaEnvs(), directives.Escape, platform)
+			if err != nil {
+				return nil, err
+			}
+			sourceImage, err := util.RetrieveSourceImage(index, stageArgs.MetaEnvs(), directives.Escape, stages, stagePlatform)
+			if err != nil {
+				return nil, err
+			}
+			imageConfig, err := util.RetrieveConfigFile(sourceImage)
+			if err != nil {
+				return nil, err
+			}
+			config = &imageConfig.Config
+			if triggers, err = resolveOnBuild(&stage, config); err != nil {
+				return nil, err
+			}
+			if useCache {
+				digest, err := sourceImage.Digest()
+				if err != nil {
+					return nil, err
+				}
+				compositeKey = cache.NewCompositeCache(digest.String())
+			}
+		}
+		buildArgs := stageArgs.Clone()
+		for i, cmd := range stage.Commands {
+			escape := directives.Escape
+			if i < triggers {
+				// Like docker, the ONBUILD triggers of the base image are parsed with the default escape character
+				escape = parser.DefaultEscapeToken
+			}
+			dockerCommand, err := commands.GetCommand(cmd, opts.SrcContext, escape, opts)
+			if err != nil {
+				return nil, err
+			}
+			if dockerCommand == nil {
+				continue
+			}
+			step := PlanStep{
+				Platform:    platformString,
+				Stage:       index,
+				Instruction: fmt.Sprint(cmd),
+				Status:      PlanRun,
+			}
+			files := dockerCommand.FilesToSnapshot()
+			metadata := files != nil && len(files) == 0
+			if metadata {
+				step.Status = PlanMetadata
+			}
+			if copyCmd, ok := dockerCommand.(*commands.CopyCommand); ok && copyCmd.Link() {
+				// The key includes the layer of the copied files, which is only made by copying them
+				compositeKey = nil
+			}
+			if compositeKey != nil {
+				step.Key = addToCacheKey(compositeKey, dockerCommand, config, buildArgs, opts)
+				if step.Key != "" {
+					digest, err := cachedLayerDigest(layerCache, step.Key)
+					if err != nil {
+						return nil, err
+					}
+					if digest != "" {
+						step.Status = PlanCacheHit
+						step.Digest = digest
+					}
+				} else if !metadata {
+					// The key includes the files the command adds, which are only known once it's run
+					compositeKey = nil
+				}
+			}
+			// Only ENV and ARG change the args cached commands can see. The other metadata commands aren't
+			// run, since some, like USER, look at the filesystem of the image.
+			switch dockerCommand.(type) {
+			case *commands.EnvCommand, *commands.ArgCommand:
+				if err := dockerCommand.ExecuteCommand(config, buildArgs); err != nil {
+					return nil, err
+				}
+			}
+			steps = append(steps, step)
+		}
+		if finalStage {
+			break
+		}
+	}
+	return steps, nil
+}
+
+// baseIsStage returns true if the base image of the stage at index is built by a previous stage
+func baseIsStage(index int, stages []instructions.Stage) bool {
+	for _, stage := range stages[:index] {
+		if stage.Name == stages[index].BaseName {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedLayerDigest returns the digest of the layer cached for key, or "" if no layer is cached for it
+func cachedLayerDigest(layerCache cache.LayerCache, key string) (string, error) {
+	layer, err := layerCache.Get(key)
+	if err == cache.ErrCacheMiss {
+		return "", nil
+	}
+	if err != nil {
+		// Like the build, a broken cache means the command would be run
+		logger.Warnf("Error retrieving cached layer for key %s: %v", key, err)
+		return "", nil
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// PrintPlan writes steps to w as a table, with a line for each instruction
+func PrintPlan(w io.Writer, steps []PlanStep) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tSTAGE\tSTATUS\tLAYER\tINSTRUCTION")
+	for _, step := range steps {
+		platform := step.Platform
+		if platform == "" {
+			platform = "-"
+		}
+		digest := step.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", platform, step.Stage, step.Status, digest, step.Instruction)
+	}
+	return tw.Flush()
+}
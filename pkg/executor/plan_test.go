@@ -0,0 +1,239 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+const planDockerfile = `FROM scratch AS build
+RUN make
+
+FROM scratch
+ARG VERSION
+ENV PATH=/bin
+RUN ./install.sh $VERSION
+RUN ./configure
+COPY app /app
+RUN ./test
+`
+
+func newPlanOptions(t *testing.T, dir string, buildArgs ...string) *options.KanikoOptions {
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte(planDockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &options.KanikoOptions{
+		DockerfilePath: dockerfilePath,
+		SrcContext:     dir,
+		BuildArgs:      buildArgs,
+		Cache:          true,
+		CacheDir:       filepath.Join(dir, "cache"),
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing is cached yet, so every command which isn't metadata would run
+	steps, err := Plan(newPlanOptions(t, dir, "VERSION=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, step := range steps {
+		statuses = append(statuses, step.Status)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{PlanRun, PlanMetadata, PlanMetadata, PlanRun, PlanRun, PlanRun, PlanRun}, statuses)
+	for _, i := range []int{3, 4} {
+		if steps[i].Key == "" {
+			t.Errorf("expected a cache key for %s", steps[i].Instruction)
+		}
+	}
+	// Only the final stage is cached, and the key of the RUN after the COPY depends on the copied files
+	for _, i := range []int{0, 6} {
+		testutil.CheckErrorAndDeepEqual(t, false, nil, "", steps[i].Key)
+	}
+
+	// Seed the cache with the layer of the first RUN of the final stage
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := layers[0]
+	if err := cache.NewLocalCache(filepath.Join(dir, "cache"), 0).Set(steps[3].Key, layer); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected []PlanStep
+	}{
+		{
+			name: "same args",
+			args: []string{"VERSION=1"},
+			expected: []PlanStep{
+				{Stage: 0, Instruction: "RUN make", Status: PlanRun},
+				{Stage: 1, Instruction: "ARG VERSION", Status: PlanMetadata},
+				{Stage: 1, Instruction: "ENV PATH=/bin", Status: PlanMetadata},
+				{Stage: 1, Instruction: "RUN ./install.sh $VERSION", Status: PlanCacheHit, Key: steps[3].Key, Digest: digest.String()},
+				{Stage: 1, Instruction: "RUN ./configure", Status: PlanRun, Key: steps[4].Key},
+				{Stage: 1, Instruction: "COPY app /app", Status: PlanRun},
+				{Stage: 1, Instruction: "RUN ./test", Status: PlanRun},
+			},
+		},
+		{
+			name: "different args",
+			args: []string{"VERSION=2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := Plan(newPlanOptions(t, dir, test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected != nil {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, actual)
+				return
+			}
+			for _, step := range actual {
+				if step.Status == PlanCacheHit {
+					t.Errorf("expected %s not to be a cache hit", step.Instruction)
+				}
+			}
+		})
+	}
+}
+
+func TestPlan_Target(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Pulling the image of the last stage, or the image it copies from, would fail
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte(`FROM scratch AS first
+RUN make
+FROM scratch AS middle
+COPY --from=first /app /app
+FROM missing.example.com/image AS last
+COPY --from=missing.example.com/other /bin /bin
+RUN ./test
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &options.KanikoOptions{DockerfilePath: dockerfilePath, SrcContext: dir, Target: "middle"}
+	steps, err := Plan(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instructions []string
+	for _, step := range steps {
+		instructions = append(instructions, step.Instruction)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"RUN make", "COPY --from=first /app /app"}, instructions)
+
+	// Nor are the images copied from by later stages pulled
+	stages, _, _, err := dockerfile.Stages(dockerfilePath, opts.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckError(t, false, fetchExtraImages(stages, nil))
+}
+
+func TestPlan_DockerfileFromStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	context := filepath.Join(dir, "context")
+	if err := testutil.SetupFiles(context, map[string]string{"app": "app"}); err != nil {
+		t.Fatal(err)
+	}
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte("FROM scratch\nCOPY app /app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(dockerfilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The Dockerfile is read from f, even if another test read it from stdin before
+	defer dockerfile.SetStdin(f)()
+
+	opts := &options.KanikoOptions{
+		DockerfilePath:   constants.DockerfileStdin,
+		SrcContext:       context,
+		Cache:            true,
+		NoCacheRunLayers: true,
+		CacheDir:         filepath.Join(dir, "cache"),
+	}
+	steps, err := Plan(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(steps))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "COPY app /app", steps[0].Instruction)
+	// The copied files are found in the context, so the layer of the COPY has a cache key
+	if steps[0].Key == "" {
+		t.Errorf("expected a cache key for %s, from the files in the context", steps[0].Instruction)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	var out bytes.Buffer
+	if err := PrintPlan(&out, []PlanStep{
+		{Stage: 0, Instruction: "RUN make", Status: PlanCacheHit, Digest: "sha256:abc"},
+		{Platform: "linux/arm64", Stage: 0, Instruction: "RUN test", Status: PlanRun},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 3, len(lines))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"-", "0", PlanCacheHit, "sha256:abc", "RUN", "make"}, strings.Fields(lines[1]))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"linux/arm64", "0", PlanRun, "-", "RUN", "test"}, strings.Fields(lines[2]))
+}
@@ -17,14 +17,20 @@ limitations under the License.
 package executor
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/containerd"
 	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/pkg/version"
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/authn/k8schain"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
@@ -33,6 +39,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// pushLogger is the logger of pushes, which are a module of their own
+var pushLogger = util.ModuleLogger("push")
+
+// tarStdout is where the tarball is streamed to with --tarPath=-. It's saved before the executor
+// command points os.Stdout at stderr, so that nothing else is written to the stream.
+var tarStdout io.Writer = os.Stdout
+
 type withUserAgent struct {
 	t http.RoundTripper
 }
@@ -44,52 +57,505 @@ func (w *withUserAgent) RoundTrip(r *http.Request) (*http.Response, error) {
 
 // DoPush is responsible for pushing image to the destinations specified in opts
 func DoPush(image v1.Image, opts *options.KanikoOptions) error {
+	if opts.OCILayoutPath != "" {
+		ref, err := layoutRef(opts)
+		if err != nil {
+			return err
+		}
+		if err := writeImageLayoutDir(opts.OCILayoutPath, ref, image); err != nil {
+			return errors.Wrapf(err, "writing OCI image layout to %s", opts.OCILayoutPath)
+		}
+	}
+	var names imageNamesWithDigest
 	if opts.NoPush {
-		logrus.Info("Skipping push to container registry due to --no-push flag")
-		return nil
+		pushLogger.Info("Skipping push to container registry due to --no-push flag")
+		digest, err := image.Digest()
+		if err != nil {
+			return err
+		}
+		if err := names.addAll(digest, opts); err != nil {
+			return err
+		}
+		return names.write(opts.ImageNameDigestFile)
 	}
+	if opts.ContainerdImport {
+		target, err := importToContainerd(opts, func(store containerd.Store) (v1.Descriptor, error) {
+			return containerd.ImportImage(store, image)
+		})
+		if err != nil {
+			return err
+		}
+		if err := names.addAll(target.Digest, opts); err != nil {
+			return err
+		}
+		return names.write(opts.ImageNameDigestFile)
+	}
+	pushed := pushedRepos{}
 	// continue pushing unless an error occurs
 	for _, destination := range opts.Destinations {
 		// Push the image
-		destRef, err := name.NewTag(destination, name.WeakValidation)
+		destRef, err := destinationTag(destination, opts)
 		if err != nil {
-			return errors.Wrap(err, "getting tag for destination")
+			return err
 		}
 
-		if opts.DockerInsecureSkipTLSVerify {
-			newReg, err := name.NewInsecureRegistry(destRef.Repository.Registry.Name(), name.WeakValidation)
+		if opts.TarPath != "" {
+			digest, err := writeTarball(opts.TarPath, destRef, image)
 			if err != nil {
-				return errors.Wrap(err, "getting new insecure registry")
+				return err
 			}
-			destRef.Repository.Registry = newReg
+			names.add(destRef, digest)
+			return names.write(opts.ImageNameDigestFile)
+		}
+
+		limiter := newUploadLimiter(opts.PushConcurrency)
+		pushAuth, rt, err := pushTransport(destRef, opts, limiter)
+		if err != nil {
+			return err
+		}
+		push := func(image v1.Image) error {
+			return withRetry(opts.PushRetry, fmt.Sprintf("push to %s", destination), func() error {
+				return remote.Write(destRef, pushed.mountable(destRef, withPushEvents(destRef, image)), pushAuth, rt, remote.WriteOptions{})
+			})
+		}
+		// The digest which is pushed is the gzipped image's if the registry rejects the zstd one
+		pushedImage := image
+		err = push(pushedImage)
+		if gzipped, ok := util.GzipFallback(image); ok && manifestRejected(err) {
+			pushLogger.Warnf("%s rejected the image with zstd layers, so it's pushed with gzip layers instead: %v", destination, err)
+			pushedImage = gzipped
+			err = push(pushedImage)
 		}
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to push to destination %s", destination))
+		}
+		pushed.add(destRef)
+		digest, err := pushedImage.Digest()
+		if err != nil {
+			return err
+		}
+		names.add(destRef, digest)
+	}
+	// The names are only written once the image is at every destination
+	return names.write(opts.ImageNameDigestFile)
+}
+
+// writeTarball saves image as a docker tarball at tarPath, or streams it to stdout if tarPath is -,
+// and returns the digest of the image which is saved.
+// Docker tarballs can't have zstd layers, so they're saved with gzip.
+func writeTarball(tarPath string, ref name.Tag, image v1.Image) (v1.Hash, error) {
+	if gzipped, ok := util.GzipFallback(image); ok {
+		image = gzipped
+	}
+	var err error
+	if tarPath == constants.TarPathStdout {
+		err = tarball.Write(ref, image, nil, tarStdout)
+	} else {
+		err = tarball.WriteToFile(tarPath, ref, image, nil)
+	}
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return image.Digest()
+}
 
+// DoPushIndex pushes the images in index, and then index itself, to the destinations specified in opts.
+// If --tarPath is set, the index is written there as an OCI image layout instead, even with --no-push.
+func DoPushIndex(index *ImageIndex, opts *options.KanikoOptions) error {
+	if opts.OCILayoutPath != "" {
+		ref, err := layoutRef(opts)
+		if err != nil {
+			return err
+		}
+		if err := writeIndexLayoutDir(opts.OCILayoutPath, ref, index); err != nil {
+			return errors.Wrapf(err, "writing OCI image layout to %s", opts.OCILayoutPath)
+		}
+	}
+	var names imageNamesWithDigest
+	if opts.TarPath != "" || opts.NoPush {
 		if opts.TarPath != "" {
-			return tarball.WriteToFile(opts.TarPath, destRef, image, nil)
+			// A manifest list can't be stored in a docker tarball, so use an OCI layout
+			ref, err := layoutRef(opts)
+			if err != nil {
+				return err
+			}
+			if err := writeIndexLayout(opts.TarPath, ref, index); err != nil {
+				return err
+			}
+		} else {
+			pushLogger.Info("Skipping push to container registry due to --no-push flag")
 		}
+		digest, err := index.Digest()
+		if err != nil {
+			return err
+		}
+		if err := names.addAll(digest, opts); err != nil {
+			return err
+		}
+		return names.write(opts.ImageNameDigestFile)
+	}
+	if opts.ContainerdImport {
+		target, err := importToContainerd(opts, func(store containerd.Store) (v1.Descriptor, error) {
+			return containerd.ImportIndex(store, index, index.Image)
+		})
+		if err != nil {
+			return err
+		}
+		if err := names.addAll(target.Digest, opts); err != nil {
+			return err
+		}
+		return names.write(opts.ImageNameDigestFile)
+	}
+	pushed := pushedRepos{}
+	for _, destination := range opts.Destinations {
+		destRef, err := destinationTag(destination, opts)
+		if err != nil {
+			return err
+		}
+		limiter := newUploadLimiter(opts.PushConcurrency)
+		pushAuth, rt, err := pushTransport(destRef, opts, limiter)
+		if err != nil {
+			return err
+		}
+		pushedIndex := index
+		err = pushIndex(destRef, pushedIndex, pushed, pushAuth, rt, opts.PushRetry)
+		if manifestRejected(err) {
+			gzipped, gzipErr := gzipIndex(index)
+			if gzipErr != nil {
+				return gzipErr
+			}
+			if gzipped != nil {
+				pushLogger.Warnf("%s rejected the images with zstd layers, so they're pushed with gzip layers instead: %v", destination, err)
+				pushedIndex = gzipped
+				err = pushIndex(destRef, pushedIndex, pushed, pushAuth, rt, opts.PushRetry)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		pushed.add(destRef)
+		digest, err := pushedIndex.Digest()
+		if err != nil {
+			return err
+		}
+		names.add(destRef, digest)
+	}
+	return names.write(opts.ImageNameDigestFile)
+}
 
-		k8sc, err := k8schain.NewNoClient()
+// pushIndex pushes the images in index, and then index itself, to destRef
+func pushIndex(destRef name.Tag, index *ImageIndex, pushed pushedRepos, pushAuth authn.Authenticator, rt http.RoundTripper, retries int) error {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	// The images have to be pushed before the manifest list which refers to them, so push them by digest
+	for _, desc := range manifest.Manifests {
+		image, err := index.Image(desc.Digest)
 		if err != nil {
-			return errors.Wrap(err, "getting k8schain client")
+			return err
 		}
-		kc := authn.NewMultiKeychain(authn.DefaultKeychain, k8sc)
-		pushAuth, err := kc.Resolve(destRef.Context().Registry)
+		imageRef, err := name.NewDigest(fmt.Sprintf("%s@%s", destRef.Context(), desc.Digest), name.WeakValidation)
 		if err != nil {
-			return errors.Wrap(err, "resolving pushAuth")
+			return errors.Wrap(err, "getting digest for destination")
+		}
+		// Keep the registry from destRef, which may be insecure
+		imageRef.Repository = destRef.Repository
+		if err := withRetry(retries, fmt.Sprintf("push to %s", imageRef), func() error {
+			return remote.Write(imageRef, pushed.mountable(imageRef, withPushEvents(imageRef, image)), pushAuth, rt, remote.WriteOptions{})
+		}); err != nil {
+			return errors.Wrapf(err, "failed to push image for platform %s to destination %s", util.PlatformString(*desc.Platform), destRef)
 		}
+	}
+	if err := withRetry(retries, fmt.Sprintf("push of manifest list to %s", destRef), func() error {
+		return writeIndex(destRef, index, pushAuth, rt)
+	}); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to push manifest list to destination %s", destRef))
+	}
+	return nil
+}
 
-		// Create a transport to set our user-agent.
-		tr := http.DefaultTransport
-		if opts.DockerInsecureSkipTLSVerify {
-			tr.(*http.Transport).TLSClientConfig = &tls.Config{
-				InsecureSkipVerify: true,
-			}
+// gzipIndex returns a manifest list of the images in index with gzip layers instead of zstd ones.
+// It returns nil if none of the images have zstd layers.
+func gzipIndex(index *ImageIndex) (*ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var images []v1.Image
+	var platforms []v1.Platform
+	fallback := false
+	for _, desc := range manifest.Manifests {
+		image, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, err
 		}
-		rt := &withUserAgent{t: tr}
+		if gzipped, ok := util.GzipFallback(image); ok {
+			image = gzipped
+			fallback = true
+		}
+		images = append(images, image)
+		platforms = append(platforms, *desc.Platform)
+	}
+	if !fallback {
+		return nil, nil
+	}
+	return NewImageIndex(images, platforms, manifest.Annotations)
+}
 
-		if err := remote.Write(destRef, image, pushAuth, rt, remote.WriteOptions{}); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("failed to push to destination %s", destination))
+// manifestRejected returns true if err is the registry rejecting a manifest, which is what registries
+// without support for zstd layers do with a manifest which has them
+func manifestRejected(err error) bool {
+	remoteErr, ok := errors.Cause(err).(*remote.Error)
+	if !ok {
+		return false
+	}
+	for _, d := range remoteErr.Errors {
+		if d.Code == remote.ManifestInvalidErrorCode || d.Code == remote.UnsupportedErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// pushedRepos is the first repository on each registry that the image has been pushed to
+type pushedRepos map[string]name.Reference
+
+// add records that the image has been pushed to ref
+func (p pushedRepos) add(ref name.Reference) {
+	if _, ok := p[ref.Context().RegistryStr()]; !ok {
+		p[ref.Context().RegistryStr()] = ref
+	}
+}
+
+// mountable returns image to push to ref. If the image has already been pushed to another repository on
+// the same registry, its blobs are mounted from there instead of being uploaded again.
+// Blobs already in ref's own repository are skipped anyway.
+func (p pushedRepos) mountable(ref name.Reference, image v1.Image) v1.Image {
+	from, ok := p[ref.Context().RegistryStr()]
+	if !ok || from.Context() == ref.Context() {
+		return image
+	}
+	return &mountableImage{Image: image, from: from}
+}
+
+// mountableImage is an image whose blobs can be mounted from the repository from
+type mountableImage struct {
+	v1.Image
+	from name.Reference
+}
+
+// Layers implements v1.Image
+func (m *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := m.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var mountable []v1.Layer
+	for _, l := range layers {
+		mountable = append(mountable, m.mountableLayer(l))
+	}
+	return mountable, nil
+}
+
+// LayerByDigest implements v1.Image. remote.Write looks up every blob it uploads with it, including the config.
+func (m *mountableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := m.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return m.mountableLayer(l), nil
+}
+
+func (m *mountableImage) mountableLayer(l v1.Layer) v1.Layer {
+	return &remote.MountableLayer{Layer: l, Reference: m.from}
+}
+
+// withPushEvents returns image, logging events when remote.Write uploads its layers to destination
+func withPushEvents(destination name.Reference, image v1.Image) v1.Image {
+	return &pushEventImage{Image: image, destination: destination}
+}
+
+// pushEventImage is an image which logs events when its layers are uploaded to destination
+type pushEventImage struct {
+	v1.Image
+	destination name.Reference
+}
+
+// LayerByDigest implements v1.Image. remote.Write uploads the blobs it returns, unless they're mounted.
+func (p *pushEventImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := p.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	configName, err := p.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	if h == configName {
+		return l, nil
+	}
+	return &pushEventLayer{Layer: l, destination: p.destination}, nil
+}
+
+// pushEventLayer is a layer which logs when it's read to be uploaded to destination, and when all of it has been
+type pushEventLayer struct {
+	v1.Layer
+	destination name.Reference
+}
+
+// Compressed implements v1.Layer
+func (l *pushEventLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	fields := logrus.Fields{"destination": l.destination.String(), "digest": digest.String(), "size": size}
+	util.LogEvent(util.EventLayerPushStart, fields, "Pushing layer %s to %s", digest, l.destination)
+	return &pushEventReader{ReadCloser: rc, fields: fields, remaining: size}, nil
+}
+
+// pushEventReader logs the push of a layer as complete once all of it is read
+type pushEventReader struct {
+	io.ReadCloser
+	fields    logrus.Fields
+	remaining int64
+}
+
+func (r *pushEventReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	complete := r.remaining > 0 && int64(n) >= r.remaining
+	r.remaining -= int64(n)
+	if complete {
+		util.LogEvent(util.EventLayerPushComplete, r.fields, "Pushed layer %s to %s", r.fields["digest"], r.fields["destination"])
+	}
+	return n, err
+}
+
+// imageNamesWithDigest are the destinations an image was written to, each with the digest of what was
+// written there, like gcr.io/project/image:tag@sha256:...
+type imageNamesWithDigest []string
+
+// add records that the image with digest was written to ref, unless it already has been
+func (n *imageNamesWithDigest) add(ref name.Tag, digest v1.Hash) {
+	line := fmt.Sprintf("%s@%s", ref, digest)
+	for _, l := range *n {
+		if l == line {
+			return
+		}
+	}
+	*n = append(*n, line)
+}
+
+// addAll records that the image with digest was written to every destination in opts
+func (n *imageNamesWithDigest) addAll(digest v1.Hash, opts *options.KanikoOptions) error {
+	for _, destination := range opts.Destinations {
+		destRef, err := destinationTag(destination, opts)
+		if err != nil {
+			return err
 		}
+		n.add(destRef, digest)
+	}
+	return nil
+}
+
+// write writes the names to path, one per line, so the image can be referred to by digest after it's
+// pushed. Nothing is written if path isn't set.
+func (n imageNamesWithDigest) write(path string) error {
+	if path == "" {
+		return nil
+	}
+	var contents bytes.Buffer
+	for _, l := range n {
+		fmt.Fprintln(&contents, l)
+	}
+	if err := ioutil.WriteFile(path, contents.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "writing image names with digest to %s", path)
 	}
 	return nil
 }
+
+// layoutRef returns the name of the image in an OCI image layout, which is the first destination if there is one
+func layoutRef(opts *options.KanikoOptions) (*name.Tag, error) {
+	if len(opts.Destinations) == 0 {
+		return nil, nil
+	}
+	ref, err := destinationTag(opts.Destinations[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// pushRegistryOptions returns the options for the registries images are pushed to, which are all reached
+// over plain HTTP with --insecure-push or --insecure
+func pushRegistryOptions(opts *options.KanikoOptions) (util.RegistryOptions, error) {
+	registryOpts, err := util.NewRegistryOptions(opts.InsecureRegistries, opts.SkipTLSVerifyRegistries)
+	registryOpts.AllInsecure = opts.InsecurePush || opts.Insecure
+	return registryOpts, err
+}
+
+// destinationTag parses destination, using an insecure registry if --insecure-skip-tls-verify is set,
+// or if it's an --insecure-registry, or every registry is insecure to push to
+func destinationTag(destination string, opts *options.KanikoOptions) (name.Tag, error) {
+	destRef, err := name.NewTag(destination, name.WeakValidation)
+	if err != nil {
+		return name.Tag{}, errors.Wrap(err, "getting tag for destination")
+	}
+	registryOpts, err := pushRegistryOptions(opts)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	if destRef.Repository.Registry, err = registryOpts.Registry(destRef.Repository.Registry); err != nil {
+		return name.Tag{}, errors.Wrap(err, "getting new insecure registry")
+	}
+
+	if opts.DockerInsecureSkipTLSVerify {
+		newReg, err := name.NewInsecureRegistry(destRef.Repository.Registry.Name(), name.WeakValidation)
+		if err != nil {
+			return name.Tag{}, errors.Wrap(err, "getting new insecure registry")
+		}
+		destRef.Repository.Registry = newReg
+	}
+	return destRef, nil
+}
+
+// pushTransport returns the credentials and transport for pushing to destRef
+func pushTransport(destRef name.Tag, opts *options.KanikoOptions, limiter *uploadLimiter) (authn.Authenticator, http.RoundTripper, error) {
+	kc, err := util.Keychain(opts.DockerConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	pushAuth, err := kc.Resolve(destRef.Context().Registry)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "resolving pushAuth")
+	}
+
+	registryOpts, err := pushRegistryOptions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Create a transport to set our user-agent.
+	tr := registryOpts.Transport(destRef.Context().Registry)
+	if opts.DockerInsecureSkipTLSVerify {
+		tr = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	if g, ok := pushAuth.(*util.GoogleAuthenticator); ok {
+		tr = g.Transport(destRef.Context().Registry, tr)
+	}
+	if limiter != nil {
+		tr = limitUploads(tr, limiter)
+	}
+	return pushAuth, &withUserAgent{t: &retryableStatusTransport{t: tr}}, nil
+}
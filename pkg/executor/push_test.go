@@ -0,0 +1,610 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_writeImageNamesWithDigest(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The digest of a pushed image is the digest of its manifest
+	digest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "digests")
+	opts := &options.KanikoOptions{
+		Destinations:        []string{"gcr.io/kaniko-test/image:latest", "gcr.io/kaniko-test/image:v1", "ubuntu:18.04", "ubuntu:18.04"},
+		ImageNameDigestFile: path,
+		NoPush:              true,
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Each tag is written once, even if it's more than one destination
+	expected := fmt.Sprintf("gcr.io/kaniko-test/image:latest@%s\ngcr.io/kaniko-test/image:v1@%s\nindex.docker.io/library/ubuntu:18.04@%s\n", digest, digest, digest)
+	actual, err := ioutil.ReadFile(path)
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, string(actual))
+}
+
+func Test_writeImageNamesWithDigest_Index(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	index, _ := newTestIndex(t)
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "digests")
+	opts := &options.KanikoOptions{
+		Destinations:        []string{"gcr.io/kaniko-test/image:latest"},
+		ImageNameDigestFile: path,
+		NoPush:              true,
+	}
+	if err := DoPushIndex(index, opts); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(path)
+	testutil.CheckErrorAndDeepEqual(t, false, err, fmt.Sprintf("gcr.io/kaniko-test/image:latest@%s\n", digest), string(actual))
+}
+
+func Test_writeImageNamesWithDigest_PushFails(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := httptest.NewServer(newBlobRegistry())
+	defer registry.Close()
+	// Nothing is listening once the server is closed
+	closed := httptest.NewServer(newBlobRegistry())
+	closed.Close()
+
+	path := filepath.Join(testDir, "digests")
+	opts := &options.KanikoOptions{
+		Destinations: []string{
+			strings.TrimPrefix(registry.URL, "http://") + "/image:latest",
+			strings.TrimPrefix(closed.URL, "http://") + "/image:latest",
+		},
+		ImageNameDigestFile: path,
+	}
+	testutil.CheckError(t, true, DoPush(image, opts))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s was written though a push failed: %v", path, err)
+	}
+}
+
+func TestDoPush_TarballToStdout(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	defer func(w io.Writer) { tarStdout = w }(tarStdout)
+	tarStdout = &stdout
+
+	destination := "gcr.io/kaniko-test/image:latest"
+	opts := &options.KanikoOptions{
+		Destinations: []string{destination},
+		TarPath:      "-",
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream should load like a tarball from docker save
+	tag, err := name.NewTag(destination, name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := tarball.Image(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(stdout.Bytes())), nil
+	}, &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDigest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := loaded.Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expectedDigest, digest)
+	layers, err := loaded.Layers()
+	testutil.CheckErrorAndDeepEqual(t, false, err, 2, len(layers))
+	for _, l := range layers {
+		r, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		testutil.CheckError(t, false, err)
+	}
+}
+
+// blobRegistry accepts pushes, mounting blobs between its repositories, and counts the blobs uploaded.
+// If rejectZstd is set, it rejects manifests with zstd layers like registries which don't support them.
+type blobRegistry struct {
+	mu         sync.Mutex
+	blobs      map[string]map[string]bool
+	uploads    map[string]int
+	mounts     int
+	rejectZstd bool
+	manifests  map[string]string
+}
+
+func newBlobRegistry() *blobRegistry {
+	return &blobRegistry{blobs: map[string]map[string]bool{}, uploads: map[string]int{}, manifests: map[string]string{}}
+}
+
+func (b *blobRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case p == "":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead && strings.Contains(p, "/blobs/"):
+		parts := strings.SplitN(p, "/blobs/", 2)
+		if b.blobs[parts[0]][parts[1]] {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/blobs/uploads/"):
+		repo := strings.TrimSuffix(p, "/blobs/uploads/")
+		digest, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if from != "" && b.blobs[from][digest] {
+			b.add(repo, digest)
+			b.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", "/upload/"+repo)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/upload/"):
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/"):
+		digest := r.URL.Query().Get("digest")
+		b.add(strings.TrimPrefix(r.URL.Path, "/upload/"), digest)
+		b.uploads[digest]++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.Contains(p, "/manifests/"):
+		body, _ := ioutil.ReadAll(r.Body)
+		if b.rejectZstd && bytes.Contains(body, []byte(util.ZstdLayer)) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_INVALID","message":"unsupported layer media type"}]}`))
+			return
+		}
+		b.manifests[p] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (b *blobRegistry) add(repo, digest string) {
+	if b.blobs[repo] == nil {
+		b.blobs[repo] = map[string]bool{}
+	}
+	b.blobs[repo][digest] = true
+}
+
+func TestDoPush_MountsBlobsAcrossDestinations(t *testing.T) {
+	image, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := image.BlobSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := newBlobRegistry(), newBlobRegistry()
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	firstHost := strings.TrimPrefix(firstServer.URL, "http://")
+	secondHost := strings.TrimPrefix(secondServer.URL, "http://")
+
+	opts := &options.KanikoOptions{
+		Destinations: []string{
+			firstHost + "/a/image:latest",
+			firstHost + "/b/image:latest",
+			firstHost + "/a/image:other",
+			secondHost + "/c/image:latest",
+		},
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each blob is uploaded once to each registry, and mounted in the other repository there
+	for _, registry := range []*blobRegistry{first, second} {
+		testutil.CheckErrorAndDeepEqual(t, false, nil, len(blobs), len(registry.uploads))
+		for h := range blobs {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, 1, registry.uploads[h.String()])
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(blobs), first.mounts)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, second.mounts)
+	for h := range blobs {
+		if !first.blobs["b/image"][h.String()] {
+			t.Errorf("blob %s is missing from b/image", h)
+		}
+	}
+}
+
+// captureEvents logs in JSON until the returned function is called, which returns the events logged
+func captureEvents(t *testing.T) func() []map[string]interface{} {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	if err := util.SetLogFormat(util.LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	return func() []map[string]interface{} {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+		var events []map[string]interface{}
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var entry map[string]interface{}
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatalf("%s isn't JSON: %v", line, err)
+			}
+			if _, ok := entry["event"]; ok {
+				events = append(events, entry)
+			}
+		}
+		return events
+	}
+}
+
+func TestDoPush_Events(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newBlobRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	opts := &options.KanikoOptions{Destinations: []string{host + "/a/image:latest", host + "/b/image:latest"}}
+
+	events := captureEvents(t)
+	err = DoPush(image, opts)
+	logged := events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers are only uploaded to the first destination, and mounted in the second
+	var started, completed []string
+	for _, event := range logged {
+		testutil.CheckErrorAndDeepEqual(t, false, nil, host+"/a/image:latest", event["destination"])
+		switch event["event"] {
+		case util.EventLayerPushStart:
+			started = append(started, event["digest"].(string))
+		case util.EventLayerPushComplete:
+			completed = append(completed, event["digest"].(string))
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(layers), len(started))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(layers), len(completed))
+	for _, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := l.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, event := range logged {
+			if event["event"] == util.EventLayerPushComplete && event["digest"] == digest.String() {
+				found = true
+				testutil.CheckErrorAndDeepEqual(t, false, nil, float64(size), event["size"])
+			}
+		}
+		if !found {
+			t.Errorf("no %s event for layer %s", util.EventLayerPushComplete, digest)
+		}
+	}
+}
+
+func TestDoPush_GzipFallback(t *testing.T) {
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := util.CompressLayers(base, 1, constants.CompressionZstd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supported, unsupported := newBlobRegistry(), newBlobRegistry()
+	unsupported.rejectZstd = true
+	supportedServer, unsupportedServer := httptest.NewServer(supported), httptest.NewServer(unsupported)
+	defer supportedServer.Close()
+	defer unsupportedServer.Close()
+
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "digests")
+	opts := &options.KanikoOptions{
+		Destinations: []string{
+			strings.TrimPrefix(supportedServer.URL, "http://") + "/image:latest",
+			strings.TrimPrefix(unsupportedServer.URL, "http://") + "/image:latest",
+		},
+		ImageNameDigestFile: path,
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Each destination is written with the digest of the image it was actually pushed
+	gzipped, ok := util.GzipFallback(image)
+	if !ok {
+		t.Fatal("the image has no zstd layers")
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzippedDigest, err := gzipped.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%s@%s\n%s@%s\n", opts.Destinations[0], digest, opts.Destinations[1], gzippedDigest)
+	actual, err := ioutil.ReadFile(path)
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, string(actual))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{"image/manifests/latest": string(types.OCIManifestSchema1)}, supported.manifests)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]string{"image/manifests/latest": string(types.DockerManifestSchema2)}, unsupported.manifests)
+	baseBlobs, err := base.BlobSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := range baseBlobs {
+		if !unsupported.blobs["image"][h.String()] {
+			t.Errorf("gzip blob %s wasn't pushed", h)
+		}
+	}
+}
+
+// fakeContainerdStore records the blobs written to it and the images created in it
+type fakeContainerdStore struct {
+	blobs  map[v1.Hash]bool
+	images map[string]v1.Hash
+	closed bool
+}
+
+func (s *fakeContainerdStore) Has(h v1.Hash) (bool, error) {
+	return s.blobs[h], nil
+}
+
+func (s *fakeContainerdStore) Write(desc v1.Descriptor, r io.Reader, labels map[string]string) error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	s.blobs[desc.Digest] = true
+	return nil
+}
+
+func (s *fakeContainerdStore) SetImage(name string, target v1.Descriptor) error {
+	s.images[name] = target.Digest
+	return nil
+}
+
+func (s *fakeContainerdStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestDoPush_ContainerdImport(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeContainerdStore{blobs: map[v1.Hash]bool{}, images: map[string]v1.Hash{}}
+	var address, namespace string
+	defer func(f func(string, string) (containerdStore, error)) { newContainerdStore = f }(newContainerdStore)
+	newContainerdStore = func(a, n string) (containerdStore, error) {
+		address, namespace = a, n
+		return store, nil
+	}
+
+	// --no-push doesn't import the image either
+	opts := &options.KanikoOptions{
+		Destinations:        []string{"busybox", "gcr.io/kaniko-test/app:v1"},
+		NoPush:              true,
+		ContainerdImport:    true,
+		ContainerdAddress:   "/run/containerd/containerd.sock",
+		ContainerdNamespace: "k8s.io",
+	}
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(store.blobs))
+
+	opts.NoPush = false
+	if err := DoPush(image, opts); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "/run/containerd/containerd.sock", address)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "k8s.io", namespace)
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, map[string]v1.Hash{
+		"docker.io/library/busybox:latest": digest,
+		"gcr.io/kaniko-test/app:v1":        digest,
+	}, store.images)
+	blobs, err := image.BlobSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs[digest] = struct{}{}
+	for h := range blobs {
+		if !store.blobs[h] {
+			t.Errorf("blob %s wasn't imported", h)
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, true, store.closed)
+}
+
+func Test_destinationTag_InsecureRegistries(t *testing.T) {
+	opts := &options.KanikoOptions{InsecureRegistries: []string{"insecure.example.com"}}
+	tests := []struct {
+		destination string
+		scheme      string
+	}{
+		{destination: "insecure.example.com/image:latest", scheme: "http"},
+		{destination: "gcr.io/project/image:latest", scheme: "https"},
+	}
+	for _, test := range tests {
+		destRef, err := destinationTag(test.destination, opts)
+		testutil.CheckErrorAndDeepEqual(t, false, err, test.scheme, destRef.Context().Registry.Scheme())
+	}
+}
+
+func Test_InsecurePullAndPush(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       options.KanikoOptions
+		pullScheme string
+		pushScheme string
+	}{
+		{
+			name:       "secure",
+			pullScheme: "https",
+			pushScheme: "https",
+		},
+		{
+			name:       "insecure push",
+			opts:       options.KanikoOptions{InsecurePush: true},
+			pullScheme: "https",
+			pushScheme: "http",
+		},
+		{
+			name:       "insecure pull",
+			opts:       options.KanikoOptions{InsecurePull: true},
+			pullScheme: "http",
+			pushScheme: "https",
+		},
+		{
+			name:       "insecure",
+			opts:       options.KanikoOptions{Insecure: true},
+			pullScheme: "http",
+			pushScheme: "http",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registryOpts, err := pullRegistryOptions(&test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base, err := name.ParseReference("registry.example.com/base:latest", name.WeakValidation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pullRef, err := registryOpts.Reference(base)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.pullScheme, pullRef.Context().Registry.Scheme())
+			destRef, err := destinationTag("registry.example.com/image:latest", &test.opts)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.pushScheme, destRef.Context().Registry.Scheme())
+		})
+	}
+}
+
+func Test_pushTransport_SkipTLSVerifyRegistries(t *testing.T) {
+	opts := &options.KanikoOptions{SkipTLSVerifyRegistries: []string{"self-signed.example.com"}}
+	tests := []struct {
+		destination   string
+		skipTLSVerify bool
+	}{
+		{destination: "self-signed.example.com/image:latest", skipTLSVerify: true},
+		{destination: "gcr.io/project/image:latest"},
+	}
+	for _, test := range tests {
+		destRef, err := destinationTag(test.destination, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, rt, err := pushTransport(destRef, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := rt.(*withUserAgent).t.(*retryableStatusTransport).t
+		skipTLSVerify := false
+		if httpTransport, ok := tr.(*http.Transport); ok && httpTransport.TLSClientConfig != nil {
+			skipTLSVerify = httpTransport.TLSClientConfig.InsecureSkipVerify
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, test.skipTLSVerify, skipTLSVerify)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pushRetryBackoff is how long to wait before retrying a push the first time. The wait doubles after each attempt.
+var pushRetryBackoff = time.Second
+
+// retryableStatusTransport fails requests which the registry answers with a status that may succeed
+// if the request is tried again, so they can be told apart from errors like failed authentication
+type retryableStatusTransport struct {
+	t http.RoundTripper
+}
+
+func (r *retryableStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		return nil, &retryableStatusError{method: req.Method, url: req.URL.String(), status: resp.Status}
+	}
+	return resp, nil
+}
+
+// retryableStatusError is returned by retryableStatusTransport for a status which may be transient
+type retryableStatusError struct {
+	method string
+	url    string
+	status string
+}
+
+func (e *retryableStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// isRetryable returns true if err may be transient: a network error, or a status like 429 or 503 from the registry
+func isRetryable(err error) bool {
+	err = errors.Cause(err)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch err.(type) {
+	case *retryableStatusError, net.Error:
+		return true
+	}
+	return false
+}
+
+// withRetry runs f, and runs it again up to retries more times while it fails with errors which may be
+// transient. The wait between attempts grows exponentially, with jitter so that builds retrying at the
+// same time spread out.
+func withRetry(retries int, description string, f func() error) error {
+	backoff := pushRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > retries || !isRetryable(err) {
+			return err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		logger.Warnf("Retrying %s in %s after attempt %d of %d failed: %v", description, wait, attempt, retries+1, err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
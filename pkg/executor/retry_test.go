@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// flakyRegistry is a registry which already has every blob, and fails the first failures pushes of a
+// manifest with status
+type flakyRegistry struct {
+	failures int
+	status   int
+
+	lock     sync.Mutex
+	attempts int
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+		f.lock.Lock()
+		f.attempts++
+		fail := f.attempts <= f.failures
+		f.lock.Unlock()
+		if fail {
+			w.WriteHeader(f.status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestWithRetry_Push(t *testing.T) {
+	defer func(backoff time.Duration) { pushRetryBackoff = backoff }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		failures         int
+		status           int
+		retries          int
+		shouldErr        bool
+		expectedAttempts int
+	}{
+		{
+			name:             "succeeds after unavailable",
+			failures:         2,
+			status:           http.StatusServiceUnavailable,
+			retries:          3,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "succeeds after too many requests",
+			failures:         1,
+			status:           http.StatusTooManyRequests,
+			retries:          3,
+			expectedAttempts: 2,
+		},
+		{
+			name:             "runs out of retries",
+			failures:         5,
+			status:           http.StatusBadGateway,
+			retries:          2,
+			shouldErr:        true,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "doesn't retry forbidden",
+			failures:         1,
+			status:           http.StatusForbidden,
+			retries:          3,
+			shouldErr:        true,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "doesn't retry bad request",
+			failures:         1,
+			status:           http.StatusBadRequest,
+			retries:          3,
+			shouldErr:        true,
+			expectedAttempts: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &flakyRegistry{failures: test.failures, status: test.status}
+			server := httptest.NewServer(registry)
+			defer server.Close()
+			ref, err := name.NewTag(strings.TrimPrefix(server.URL, "http://")+"/test/image:latest", name.WeakValidation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt := &retryableStatusTransport{t: http.DefaultTransport}
+			err = withRetry(test.retries, "push", func() error {
+				return remote.Write(ref, image, authn.Anonymous, rt, remote.WriteOptions{})
+			})
+			testutil.CheckError(t, test.shouldErr, err)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedAttempts, registry.attempts)
+		})
+	}
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "retryable status",
+			err:      &url.Error{Op: "Put", URL: "https://gcr.io", Err: &retryableStatusError{status: "503 Service Unavailable"}},
+			expected: true,
+		},
+		{
+			name:     "connection reset",
+			err:      &url.Error{Op: "Put", URL: "https://gcr.io", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}},
+			expected: true,
+		},
+		{
+			name:     "unexpected eof",
+			err:      errors.Wrap(io.ErrUnexpectedEOF, "uploading layer"),
+			expected: true,
+		},
+		{
+			name: "unauthorized",
+			err:  &remote.Error{Errors: []remote.Diagnostic{{Code: remote.UnauthorizedErrorCode}}},
+		},
+		{
+			name: "other error",
+			err:  &url.Error{Op: "Put", URL: "https://gcr.io", Err: errors.New("x509: certificate signed by unknown authority")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, isRetryable(test.err))
+		})
+	}
+}
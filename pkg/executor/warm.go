@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache"
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// Warm caches the images in warmOpts under opts.CacheDir, for each of opts.Platforms, so builds with the same
+// --cache-dir use them without pulling them. Each image is pinned to the digest it has now. Images which are
+// already cached aren't pulled again, unless warmOpts.Force is set.
+func Warm(opts *options.KanikoOptions, warmOpts *options.WarmerOptions) error {
+	if len(warmOpts.Images) == 0 {
+		return errors.New("no images to cache, set --image")
+	}
+	if strings.HasPrefix(opts.CacheDir, constants.AzureBlobPrefix) {
+		return errors.Errorf("--cache-dir %s must be a directory to cache images in", opts.CacheDir)
+	}
+	if err := setRegistries(opts); err != nil {
+		return err
+	}
+	// The images are pulled from their registries, not the cache being warmed
+	util.SetImageCache(nil)
+	platforms, err := util.ParsePlatforms(opts.Platforms)
+	if err != nil {
+		return err
+	}
+	targets := []*v1.Platform{nil}
+	if len(platforms) > 0 {
+		targets = nil
+		for i := range platforms {
+			targets = append(targets, &platforms[i])
+		}
+	}
+	imageCache := cache.NewImageCache(opts.CacheDir)
+	for _, image := range warmOpts.Images {
+		for _, platform := range targets {
+			description := image
+			if platform != nil {
+				description += " for platform " + util.PlatformString(*platform)
+			}
+			if !warmOpts.Force {
+				cached, err := imageCache.Image(image, platform)
+				if err != nil {
+					return errors.Wrapf(err, "reading %s from the cache", description)
+				}
+				if cached != nil {
+					digest, err := cached.Digest()
+					if err != nil {
+						return err
+					}
+					logger.Infof("%s is already cached as %s", description, digest)
+					continue
+				}
+			}
+			img, err := util.RetrieveRemoteImage(image, platform)
+			if err != nil {
+				return errors.Wrapf(err, "pulling %s", description)
+			}
+			if err := imageCache.Set(image, platform, img); err != nil {
+				return errors.Wrapf(err, "caching %s", description)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				return err
+			}
+			logger.Infof("Cached %s as %s", description, digest)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/options"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// fakeRegistry serves image as test/image:latest, and counts the requests for it
+type fakeRegistry struct {
+	mu       sync.Mutex
+	image    v1.Image
+	requests int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	f.requests++
+	if r.URL.Path == "/v2/test/image/manifests/latest" {
+		mediaType, err := f.image.MediaType()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		raw, err := f.image.RawManifest()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", string(mediaType))
+		w.Write(raw)
+		return
+	}
+	h, err := v1.NewHash(strings.TrimPrefix(r.URL.Path, "/v2/test/image/blobs/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if configName, err := f.image.ConfigName(); err == nil && configName == h {
+		raw, err := f.image.RawConfigFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(raw)
+		return
+	}
+	l, err := f.image.LayerByDigest(h)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	contents, err := ioutil.ReadAll(rc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(contents)
+}
+
+func (f *fakeRegistry) setImage(img v1.Image) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.image = img
+}
+
+func imageDigest(t *testing.T, img v1.Image) v1.Hash {
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestWarm(t *testing.T) {
+	defer util.SetImageCache(nil)
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	first, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &fakeRegistry{image: first}
+	server := httptest.NewServer(registry)
+	image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+	opts := &options.KanikoOptions{CacheDir: cacheDir}
+	if err := Warm(opts, &options.WarmerOptions{Images: []string{image}}); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// Builds read the image from the cache, without the registry
+	util.SetImageCache(newImageCache(opts))
+	cached, err := util.RetrieveRemoteImage(image, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, imageDigest(t, first), imageDigest(t, cached))
+	layers, err := cached.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		r, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	cfg, err := cached.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, len(layers), len(cfg.RootFS.DiffIDs))
+}
+
+func TestWarm_Pinned(t *testing.T) {
+	defer util.SetImageCache(nil)
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	first, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &fakeRegistry{image: first}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/test/image:latest"
+	opts := &options.KanikoOptions{CacheDir: cacheDir}
+	warmOpts := &options.WarmerOptions{Images: []string{image}}
+	if err := Warm(opts, warmOpts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag moves, but the image stays pinned to the digest it was cached with
+	registry.setImage(second)
+	registry.requests = 0
+	if err := Warm(opts, warmOpts); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, registry.requests)
+	util.SetImageCache(newImageCache(opts))
+	cached, err := util.RetrieveRemoteImage(image, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, imageDigest(t, first), imageDigest(t, cached))
+
+	// --force pulls it again
+	warmOpts.Force = true
+	if err := Warm(opts, warmOpts); err != nil {
+		t.Fatal(err)
+	}
+	util.SetImageCache(newImageCache(opts))
+	cached, err = util.RetrieveRemoteImage(image, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, imageDigest(t, second), imageDigest(t, cached))
+}
+
+func TestWarm_NoImages(t *testing.T) {
+	err := Warm(&options.KanikoOptions{CacheDir: "/cache"}, &options.WarmerOptions{})
+	testutil.CheckError(t, true, err)
+	err = Warm(&options.KanikoOptions{CacheDir: "azblob://container/cache"}, &options.WarmerOptions{Images: []string{"ubuntu"}})
+	testutil.CheckError(t, true, err)
+}
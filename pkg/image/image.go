@@ -20,11 +20,12 @@ import (
 	"os"
 	"strings"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/v1"
-
-	"github.com/sirupsen/logrus"
 )
 
+var logger = util.ModuleLogger("image")
+
 // SetEnvVariables sets environment variables as specified in the image
 func SetEnvVariables(img v1.Image) error {
 	cfg, err := img.ConfigFile()
@@ -37,7 +38,7 @@ func SetEnvVariables(img v1.Image) error {
 		if err := os.Setenv(split[0], split[1]); err != nil {
 			return err
 		}
-		logrus.Infof("Setting environment variable %s", envVar)
+		logger.Infof("Setting environment variable %s", envVar)
 	}
 	return nil
 }
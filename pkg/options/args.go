@@ -19,9 +19,11 @@ package options
 import (
 	"strings"
 
-	"github.com/sirupsen/logrus"
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
 )
 
+var logger = util.ModuleLogger("options")
+
 // This type is used to supported passing in multiple flags
 type multiArg []string
 
@@ -34,7 +36,7 @@ func (b *multiArg) String() string {
 
 // The second method is Set(value string) error
 func (b *multiArg) Set(value string) error {
-	logrus.Infof("appending to multi args %s", value)
+	logger.Infof("appending to multi args %s", value)
 	*b = append(*b, value)
 	return nil
 }
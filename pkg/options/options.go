@@ -16,18 +16,78 @@ limitations under the License.
 
 package options
 
+import "time"
+
+// WarmerOptions are the options of the warm command, which caches base images for builds
+type WarmerOptions struct {
+	Images multiArg
+	Force  bool
+}
+
 // KanikoOptions are options that are set by command line arguments
 type KanikoOptions struct {
 	DockerfilePath              string
 	Destinations                multiArg
 	SrcContext                  string
+	ContextSubPath              string
+	BuildContexts               multiArg
 	SnapshotMode                string
+	SnapshotConcurrency         int
+	SnapshotWatch               bool
 	Bucket                      string
+	S3Region                    string
 	DockerInsecureSkipTLSVerify bool
+	Insecure                    bool
+	InsecurePull                bool
+	InsecurePush                bool
 	BuildArgs                   multiArg
+	BuildArgFile                string
+	Labels                      multiArg
+	Annotations                 multiArg
 	TarPath                     string
+	OCILayoutPath               string
 	SingleSnapshot              bool
+	SquashFrom                  string
+	MaxLayerSize                string
+	SkipUnpack                  bool
+	SkipUnpackForce             bool
+	IgnorePaths                 multiArg
 	Reproducible                bool
+	ReproducibleTimestamp       string
 	Target                      string
 	NoPush                      bool
+	RunNetwork                  string
+	RunMemoryLimit              string
+	RunCPULimit                 string
+	ContainerdImport            bool
+	ContainerdAddress           string
+	ContainerdNamespace         string
+	DryRun                      bool
+	Cleanup                     bool
+	MountCacheDir               string
+	PostInstructionHook         string
+	HookFailOnError             bool
+	FileManifestPath            string
+	Secrets                     multiArg
+	Platforms                   multiArg
+	Cache                       bool
+	NoCacheRunLayers            bool
+	NoCacheCopyLayers           bool
+	CacheReadOnly               bool
+	CacheWriteOnly              bool
+	CacheDir                    string
+	CacheTTL                    time.Duration
+	CacheCompressionLevel       int
+	VerifyCache                 bool
+	ImageNameDigestFile         string
+	PushRetry                   int
+	PushConcurrency             int
+	ImageFSExtractRetries       int
+	ImageFSExtractRetryBackoff  time.Duration
+	Compression                 string
+	CompressionLevel            int
+	RegistryMirrors             multiArg
+	InsecureRegistries          multiArg
+	DockerConfig                string
+	SkipTLSVerifyRegistries     multiArg
 }
@@ -83,14 +83,19 @@ func (l *LayeredMap) MaybeAddWhiteout(s string) (bool, error) {
 }
 
 func (l *LayeredMap) MaybeAdd(s string) (bool, error) {
-	oldV, ok := l.Get(s)
 	newV, err := l.hasher(s)
 	if err != nil {
 		return false, err
 	}
+	return l.maybeAddHash(s, newV), nil
+}
+
+// maybeAddHash adds s to the current layer if its hash, newV, has changed
+func (l *LayeredMap) maybeAddHash(s, newV string) bool {
+	oldV, ok := l.Get(s)
 	if ok && newV == oldV {
-		return false, nil
+		return false
 	}
 	l.layers[len(l.layers)-1][s] = newV
-	return true, nil
+	return true
 }
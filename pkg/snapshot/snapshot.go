@@ -18,27 +18,44 @@ package snapshot
 
 import (
 	"archive/tar"
-	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
-	"github.com/sirupsen/logrus"
 )
 
+var logger = util.ModuleLogger("snapshot")
+
 // Snapshotter holds the root directory from which to take snapshots, and a list of snapshots taken
 type Snapshotter struct {
 	l         *LayeredMap
 	directory string
-	hardlinks map[uint64]string
+	hardlinks map[util.FileID]string
+	tarOpts   util.TarOptions
+	// concurrency is how many files are hashed at once when snapshotting the full filesystem
+	concurrency int
+	// isDir records whether each path was a directory when it was last snapshotted, to find the paths
+	// which have been replaced by something of another type since
+	isDir map[string]bool
 }
 
-// NewSnapshotter creates a new snapshotter rooted at d
-func NewSnapshotter(l *LayeredMap, d string) *Snapshotter {
-	return &Snapshotter{l: l, directory: d}
+// NewSnapshotter creates a new snapshotter rooted at d, which writes layers according to tarOpts
+func NewSnapshotter(l *LayeredMap, d string, tarOpts util.TarOptions) *Snapshotter {
+	return &Snapshotter{l: l, directory: d, tarOpts: tarOpts, concurrency: runtime.GOMAXPROCS(0), isDir: map[string]bool{}}
+}
+
+// SetConcurrency sets how many files are hashed at once when snapshotting the full filesystem.
+// If n isn't positive, GOMAXPROCS is used.
+func (s *Snapshotter) SetConcurrency(n int) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	s.concurrency = n
 }
 
 // Init initializes a new snapshotter
@@ -49,45 +66,70 @@ func (s *Snapshotter) Init() error {
 	return nil
 }
 
+// Update records the current state of the filesystem without creating a layer. It's used after the
+// filesystem is changed by applying a layer which already exists, such as one from the cache.
+func (s *Snapshotter) Update() error {
+	_, err := s.snapShotFS(ioutil.Discard)
+	return err
+}
+
 // TakeSnapshot takes a snapshot of the filesystem, avoiding directories in the whitelist, and creates
-// a tarball of the changed files. Return contents of the tarball, and whether or not any files were changed
-func (s *Snapshotter) TakeSnapshot(files []string) ([]byte, error) {
-	buf := bytes.NewBuffer([]byte{})
-	var filesAdded bool
-	var err error
-	if files == nil {
-		filesAdded, err = s.snapShotFS(buf)
-	} else {
-		filesAdded, err = s.snapshotFiles(buf, files)
-	}
+// a tarball of the changed files in a layer file, so it isn't held in memory. It returns the path to the
+// tarball, or an empty path if no files were changed.
+func (s *Snapshotter) TakeSnapshot(files []string) (string, error) {
+	return writeSnapshot(func(f io.Writer) (bool, error) {
+		if files == nil {
+			return s.snapShotFS(f)
+		}
+		return s.snapshotFiles(f, files)
+	})
+}
+
+// writeSnapshot writes the tarball snapshot writes to a layer file, and returns its path. The file is
+// removed if snapshot doesn't add any files, or fails.
+func writeSnapshot(snapshot func(f io.Writer) (bool, error)) (string, error) {
+	f, err := util.NewLayerFile()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	contents := buf.Bytes()
-	if !filesAdded {
-		return nil, nil
+	filesAdded, err := snapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	return contents, err
+	if err != nil || !filesAdded {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
 
 // snapshotFiles takes a snapshot of specific files
 // Used for ADD/COPY commands, when we know which files have changed
 func (s *Snapshotter) snapshotFiles(f io.Writer, files []string) (bool, error) {
-	s.hardlinks = map[uint64]string{}
+	s.hardlinks = map[util.FileID]string{}
 	s.l.Snapshot()
 	if len(files) == 0 {
-		logrus.Info("No files changed in this command, skipping snapshotting.")
+		logger.Info("No files changed in this command, skipping snapshotting.")
 		return false, nil
 	}
-	logrus.Infof("Taking snapshot of files %v...", files)
+	logger.Infof("Taking snapshot of files %v...", files)
+	w := tar.NewWriter(f)
+	defer w.Close()
+	return s.addFiles(f, w, files)
+}
+
+// addFiles adds files and their parent directories to w, which writes to f, if they've changed since they
+// were last snapshotted
+func (s *Snapshotter) addFiles(f io.Writer, w *tar.Writer, files []string) (bool, error) {
 	snapshottedFiles := make(map[string]bool)
 	for _, file := range files {
 		parentDirs := util.ParentDirectories(file)
 		files = append(parentDirs, files...)
 	}
+	util.SortTarPaths(files)
 	filesAdded := false
-	w := tar.NewWriter(f)
-	defer w.Close()
+	tarOpts := s.tarOpts
+	tarOpts.SparseWriter = f
 
 	// Now create the tar.
 	for _, file := range files {
@@ -100,7 +142,7 @@ func (s *Snapshotter) snapshotFiles(f io.Writer, files []string) (bool, error) {
 			return false, err
 		}
 		if whitelisted && !isBuildFile(file) {
-			logrus.Infof("Not adding %s to layer, as it's whitelisted", file)
+			logger.Infof("Not adding %s to layer, as it's whitelisted", file)
 			continue
 		}
 		snapshottedFiles[file] = true
@@ -113,9 +155,17 @@ func (s *Snapshotter) snapshotFiles(f io.Writer, files []string) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		if addFile {
+		typeChanged := s.typeChanged(file, info)
+		s.isDir[file] = info.IsDir()
+		if addFile || typeChanged {
 			filesAdded = true
-			if err := util.AddToTar(file, info, s.hardlinks, w); err != nil {
+			if typeChanged {
+				logger.Infof("Adding whiteout for %s, since it was replaced by a %s", file, fileType(info))
+				if err := util.Whiteout(file, w); err != nil {
+					return false, err
+				}
+			}
+			if err := util.AddToTar(file, info, s.hardlinks, w, tarOpts); err != nil {
 				return false, err
 			}
 		}
@@ -123,6 +173,83 @@ func (s *Snapshotter) snapshotFiles(f io.Writer, files []string) (bool, error) {
 	return filesAdded, nil
 }
 
+// TakeSnapshotOfChanges creates a tarball of paths, which are the paths which have changed since the last
+// snapshot, like the ones a Watcher saw change. Paths which no longer exist are whited out. Like
+// TakeSnapshot, it returns the path to the tarball, or an empty path if none of them were changed.
+func (s *Snapshotter) TakeSnapshotOfChanges(paths []string) (string, error) {
+	return writeSnapshot(func(f io.Writer) (bool, error) {
+		return s.snapshotChanges(f, paths)
+	})
+}
+
+func (s *Snapshotter) snapshotChanges(f io.Writer, paths []string) (bool, error) {
+	s.hardlinks = map[util.FileID]string{}
+	s.l.Snapshot()
+	logger.Infof("Taking snapshot of %d changed paths...", len(paths))
+	var existing, removedPaths []string
+	removed := map[string]bool{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if _, err := os.Lstat(path); err != nil {
+			if !os.IsNotExist(err) {
+				return false, err
+			}
+			removed[path] = true
+			removedPaths = append(removedPaths, path)
+			// Removing something changes its directory too
+			if info, err := os.Lstat(filepath.Dir(path)); err == nil && info.IsDir() {
+				existing = append(existing, filepath.Dir(path))
+			}
+			continue
+		}
+		existing = append(existing, path)
+	}
+	filesAdded := false
+	w := tar.NewWriter(f)
+	defer w.Close()
+
+	util.SortTarPaths(removedPaths)
+	for _, path := range removedPaths {
+		// Only paths which were in a layer are whited out, and only if their directory still exists, since
+		// otherwise the whiteout of the directory, or of what replaced it, hides them
+		if _, ok := s.l.Get(path); !ok {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			continue
+		}
+		whitelisted, err := util.CheckWhitelist(path)
+		if err != nil {
+			return false, err
+		}
+		if whitelisted {
+			continue
+		}
+		addWhiteout, err := s.l.MaybeAddWhiteout(path)
+		if err != nil {
+			return false, err
+		}
+		if addWhiteout {
+			logger.Infof("Adding whiteout for %s", path)
+			filesAdded = true
+			if err := util.Whiteout(path, w); err != nil {
+				return false, err
+			}
+		}
+	}
+	for path := range s.isDir {
+		if removed[path] || underChanged(path, removed) {
+			delete(s.isDir, path)
+		}
+	}
+
+	if len(existing) == 0 {
+		return filesAdded, nil
+	}
+	added, err := s.addFiles(f, w, existing)
+	return filesAdded || added, err
+}
+
 func isBuildFile(file string) bool {
 	for _, buildFile := range constants.KanikoBuildFiles {
 		if file == buildFile {
@@ -133,13 +260,15 @@ func isBuildFile(file string) bool {
 }
 
 func (s *Snapshotter) snapShotFS(f io.Writer) (bool, error) {
-	logrus.Info("Taking snapshot of full filesystem...")
-	s.hardlinks = map[uint64]string{}
+	logger.Info("Taking snapshot of full filesystem...")
+	s.hardlinks = map[util.FileID]string{}
 	s.l.Snapshot()
 	existingPaths := s.l.GetFlattenedPathsForWhiteOut()
 	filesAdded := false
 	w := tar.NewWriter(f)
 	defer w.Close()
+	tarOpts := s.tarOpts
+	tarOpts.SparseWriter = f
 
 	// Save the fs state in a map to iterate over later.
 	memFs := map[string]os.FileInfo{}
@@ -148,52 +277,208 @@ func (s *Snapshotter) snapShotFS(f io.Writer) (bool, error) {
 		return nil
 	})
 
+	// Paths which have been replaced by something of another type, like a file replaced by a directory,
+	// are whited out before the new entry is added, so the old one doesn't get merged with it
+	typeChanged := map[string]bool{}
+	for p, info := range memFs {
+		if s.typeChanged(p, info) {
+			typeChanged[p] = true
+		}
+	}
+
 	// First handle whiteouts
 	for p := range memFs {
 		delete(existingPaths, p)
 	}
+	var removedPaths []string
 	for path := range existingPaths {
-		// Only add the whiteout if the directory for the file still exists.
+		removedPaths = append(removedPaths, path)
+	}
+	util.SortTarPaths(removedPaths)
+	var whiteouts []string
+	for _, path := range removedPaths {
+		// Changes to whitelisted paths, including deletions, are never added to a layer
+		whitelisted, err := util.CheckWhitelist(path)
+		if err != nil {
+			return false, err
+		}
+		if whitelisted {
+			logger.Debugf("Not adding whiteout for %s to layer, as it's whitelisted", path)
+			continue
+		}
+		// Only add the whiteout if the directory for the file still exists, and hasn't been replaced,
+		// since the whiteout of the directory hides everything which was in it.
 		dir := filepath.Dir(path)
-		if _, ok := memFs[dir]; ok {
+		if info, ok := memFs[dir]; ok && info.IsDir() && !underChanged(path, typeChanged) {
 			addWhiteout, err := s.l.MaybeAddWhiteout(path)
 			if err != nil {
 				return false, nil
 			}
 			if addWhiteout {
-				logrus.Infof("Adding whiteout for %s", path)
-				filesAdded = true
-				if err := util.Whiteout(path, w); err != nil {
-					return false, err
-				}
+				whiteouts = append(whiteouts, path)
 			}
 		}
 	}
-
-	// Now create the tar.
-	for path, info := range memFs {
+	opaqueDirs := s.opaqueDirs(whiteouts, memFs)
+	var dirs []string
+	for dir := range opaqueDirs {
+		dirs = append(dirs, dir)
+	}
+	util.SortTarPaths(dirs)
+	for _, dir := range dirs {
+		logger.Infof("Adding opaque whiteout for %s", dir)
+		filesAdded = true
+		if err := util.WhiteoutOpaqueDir(dir, w); err != nil {
+			return false, err
+		}
+	}
+	for _, path := range whiteouts {
+		if _, ok := opaqueDirs[filepath.Dir(path)]; ok {
+			continue
+		}
+		logger.Infof("Adding whiteout for %s", path)
+		filesAdded = true
+		if err := util.Whiteout(path, w); err != nil {
+			return false, err
+		}
+	}
+	var changedPaths []string
+	for path := range typeChanged {
+		changedPaths = append(changedPaths, path)
+	}
+	util.SortTarPaths(changedPaths)
+	for _, path := range changedPaths {
 		whitelisted, err := util.CheckWhitelist(path)
 		if err != nil {
 			return false, err
 		}
 		if whitelisted {
-			logrus.Debugf("Not adding %s to layer, as it's whitelisted", path)
 			continue
 		}
+		logger.Infof("Adding whiteout for %s, since it was replaced by a %s", path, fileType(memFs[path]))
+		filesAdded = true
+		if err := util.Whiteout(path, w); err != nil {
+			return false, err
+		}
+	}
 
-		// Only add to the tar if we add it to the layeredmap.
-		maybeAdd, err := s.l.MaybeAdd(path)
+	// Now create the tar.
+	var paths []string
+	for path := range memFs {
+		paths = append(paths, path)
+	}
+	util.SortTarPaths(paths)
+	var hashPaths []string
+	for _, path := range paths {
+		whitelisted, err := util.CheckWhitelist(path)
 		if err != nil {
 			return false, err
 		}
-		if maybeAdd {
-			logrus.Debugf("Adding %s to layer, because it was changed.", path)
+		if whitelisted {
+			logger.Debugf("Not adding %s to layer, as it's whitelisted", path)
+			continue
+		}
+		hashPaths = append(hashPaths, path)
+	}
+	hashes, err := s.hashFiles(hashPaths)
+	if err != nil {
+		return false, err
+	}
+	// The files are added in the same order however they were hashed
+	for i, path := range hashPaths {
+		info := memFs[path]
+		// Only add to the tar if we add it to the layeredmap. A path whose type changed is always added,
+		// since it was whited out.
+		if s.l.maybeAddHash(path, hashes[i]) || typeChanged[path] {
+			logger.Debugf("Adding %s to layer, because it was changed.", path)
 			filesAdded = true
-			if err := util.AddToTar(path, info, s.hardlinks, w); err != nil {
+			if err := util.AddToTar(path, info, s.hardlinks, w, tarOpts); err != nil {
 				return false, err
 			}
 		}
 	}
 
+	s.isDir = map[string]bool{}
+	for path, info := range memFs {
+		s.isDir[path] = info.IsDir()
+	}
 	return filesAdded, nil
 }
+
+// typeChanged returns true if path was snapshotted before as a directory and isn't one now, or the other way around
+func (s *Snapshotter) typeChanged(path string, info os.FileInfo) bool {
+	wasDir, ok := s.isDir[path]
+	return ok && wasDir != info.IsDir()
+}
+
+// underChanged returns true if one of the parent directories of path is in changed
+func underChanged(path string, changed map[string]bool) bool {
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		if changed[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func fileType(info os.FileInfo) string {
+	if info.IsDir() {
+		return "directory"
+	}
+	return "file"
+}
+
+// hashFiles hashes paths with the layered map's hasher, hashing up to s.concurrency files at once. Each worker
+// hashes one file at a time, so this also limits how many files are open.
+func (s *Snapshotter) hashFiles(paths []string) ([]string, error) {
+	hashes := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				hashes[i], errs[i] = s.l.hasher(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// opaqueDirs returns the directories which still exist, but whose previous contents have all been
+// whited out by this snapshot, e.g. because the directory was deleted and recreated. These can be
+// marked opaque instead of adding a whiteout for each of their children.
+func (s *Snapshotter) opaqueDirs(whiteouts []string, memFs map[string]os.FileInfo) map[string]struct{} {
+	whitedOut := map[string]struct{}{}
+	dirs := map[string]struct{}{}
+	for _, path := range whiteouts {
+		whitedOut[path] = struct{}{}
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for path := range s.l.GetFlattenedPathsForWhiteOut() {
+		dir := filepath.Dir(path)
+		if _, ok := dirs[dir]; !ok {
+			continue
+		}
+		if _, ok := whitedOut[path]; ok {
+			continue
+		}
+		// Anything else in the directory was either kept, or whited out by an earlier snapshot
+		if _, ok := memFs[path]; ok {
+			delete(dirs, dir)
+		}
+	}
+	return dirs
+}
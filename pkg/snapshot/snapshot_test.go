@@ -18,14 +18,23 @@ package snapshot
 import (
 	"archive/tar"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/pkg/errors"
 )
 
@@ -45,7 +54,7 @@ func TestSnapshotFileChange(t *testing.T) {
 		t.Fatalf("Error setting up fs: %s", err)
 	}
 	// Take another snapshot
-	contents, err := snapshotter.TakeSnapshot(nil)
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
 	if err != nil {
 		t.Fatalf("Error taking snapshot of fs: %s", err)
 	}
@@ -93,7 +102,7 @@ func TestSnapshotChangePermissions(t *testing.T) {
 		t.Fatalf("Error changing permissions on %s: %v", batPath, err)
 	}
 	// Take another snapshot
-	contents, err := snapshotter.TakeSnapshot(nil)
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
 	if err != nil {
 		t.Fatalf("Error taking snapshot of fs: %s", err)
 	}
@@ -143,7 +152,7 @@ func TestSnapshotFiles(t *testing.T) {
 		filepath.Join(testDir, "foo"),
 		filepath.Join(testDir, "kaniko/file"),
 	}
-	contents, err := snapshotter.TakeSnapshot(filesToSnapshot)
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(filesToSnapshot))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,7 +182,7 @@ func TestEmptySnapshot(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Take snapshot with no changes
-	contents, err := snapshotter.TakeSnapshot(nil)
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
 	if err != nil {
 		t.Fatalf("Error taking snapshot of fs: %s", err)
 	}
@@ -183,6 +192,86 @@ func TestEmptySnapshot(t *testing.T) {
 	}
 }
 
+func TestSnapshotUpdate(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change the filesystem as applying a cached layer would
+	if err := testutil.SetupFiles(testDir, map[string]string{"cached": "cached"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(testDir, "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshotter.Update(); err != nil {
+		t.Fatal(err)
+	}
+	// Those changes are already in a layer, so the next snapshot shouldn't include them
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents != nil {
+		t.Errorf("expected no changes after updating the snapshotter, got a layer of %d bytes", len(contents))
+	}
+}
+
+func TestSnapshotMemory(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layerDir)
+	util.SetLayerDir(layerDir)
+	defer util.SetLayerDir("")
+
+	// The file is written a chunk at a time, so only the snapshot could need memory for all of it
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(testDir, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 1<<20)
+	for i := 0; i < size/len(chunk); i++ {
+		rand.Read(chunk)
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The heap can't grow by more than what's allocated, so that bounds the peak memory of the snapshot
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	tarPath, err := snapshotter.TakeSnapshot(nil)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tarPath)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("snapshotting a %d byte file allocated %d bytes", size, allocated)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, layerDir, filepath.Dir(tarPath))
+	info, err := os.Stat(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() < size {
+		t.Errorf("the snapshot of a %d byte file is only %d bytes", size, info.Size())
+	}
+}
+
 func setUpTestDir() (string, *Snapshotter, error) {
 	testDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -200,9 +289,418 @@ func setUpTestDir() (string, *Snapshotter, error) {
 
 	// Take the initial snapshot
 	l := NewLayeredMap(util.Hasher())
-	snapshotter := NewSnapshotter(l, testDir)
+	snapshotter := NewSnapshotter(l, testDir, util.TarOptions{})
 	if err := snapshotter.Init(); err != nil {
 		return testDir, nil, errors.Wrap(err, "initializing snapshotter")
 	}
 	return testDir, snapshotter, nil
 }
+
+func TestSnapshotReproducible(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	l := NewLayeredMap(util.Hasher())
+	snapshotter := NewSnapshotter(l, testDir, util.TarOptions{Reproducible: true})
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+	newFiles := map[string]string{
+		"foo":     "newbaz1",
+		"bar/bat": "baz",
+		"baz":     "baz",
+	}
+	if err := testutil.SetupFiles(testDir, newFiles); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of fs: %s", err)
+	}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("Header for %s was not stripped: %+v", hdr.Name, hdr)
+		}
+		names = append(names, hdr.Name)
+	}
+	expectedNames := []string{
+		testDir,
+		filepath.Join(testDir, "bar"),
+		filepath.Join(testDir, "bar/bat"),
+		filepath.Join(testDir, "baz"),
+		filepath.Join(testDir, "foo"),
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedNames, names)
+}
+
+func TestSnapshotFilesOrder(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFiles := map[string]string{
+		"foo":     "newbaz1",
+		"bar-bat": "baz",
+		"bar/bat": "baz",
+	}
+	if err := testutil.SetupFiles(testDir, newFiles); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	// The files are in the layer in the same order, without --reproducible, whatever order they're given in
+	files := []string{
+		filepath.Join(testDir, "foo"),
+		filepath.Join(testDir, "bar/bat"),
+		filepath.Join(testDir, "bar-bat"),
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(contents))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, testDir) {
+			names = append(names, hdr.Name)
+		}
+	}
+	expectedNames := []string{
+		testDir,
+		filepath.Join(testDir, "bar-bat"),
+		filepath.Join(testDir, "bar/bat"),
+		filepath.Join(testDir, "foo"),
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedNames, names)
+}
+
+func TestSnapshotOpaqueDir(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the contents of bar
+	barPath := filepath.Join(testDir, "bar")
+	if err := os.RemoveAll(barPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(testDir, map[string]string{"bar/new": "new"}); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of fs: %s", err)
+	}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	names := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[hdr.Name] = true
+	}
+	if !names[filepath.Join(barPath, ".wh..wh..opq")] {
+		t.Errorf("Expected opaque whiteout for %s, got %v", barPath, names)
+	}
+	if names[filepath.Join(barPath, ".wh.bat")] {
+		t.Errorf("Unexpected whiteout for %s/bat in opaque directory", barPath)
+	}
+	if !names[filepath.Join(barPath, "new")] {
+		t.Errorf("Expected %s/new in snapshot, got %v", barPath, names)
+	}
+}
+
+func TestSnapshotIgnorePath(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barPath := filepath.Join(testDir, "bar")
+	defer util.SaveWhitelist()()
+	util.AddToWhitelist(barPath + "/")
+
+	// Nothing under the ignored path is added to the layer, not even whiteouts
+	if err := os.Remove(filepath.Join(barPath, "bat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(testDir, map[string]string{"bar/new": "new", "foo": "newbaz1"}); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of fs: %s", err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{filepath.Join(testDir, "foo")}, tarNames(t, contents))
+
+	// The same goes for snapshotting specific files
+	contents, err = testutil.ReadLayerFile(snapshotter.TakeSnapshot([]string{filepath.Join(barPath, "new")}))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of files: %s", err)
+	}
+	for _, name := range tarNames(t, contents) {
+		if util.HasFilepathPrefix(name, barPath) {
+			t.Errorf("%s is under the ignored path %s, but was added to the layer", name, barPath)
+		}
+	}
+}
+
+func TestSnapshotTypeChange(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := testutil.SetupFiles(testDir, map[string]string{"file": "file", "dir/child": "child"}); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	l := NewLayeredMap(util.Hasher())
+	snapshotter := NewSnapshotter(l, testDir, util.TarOptions{Reproducible: true})
+	base, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of fs: %s", err)
+	}
+
+	// Replace the file with a directory, and the directory with a file
+	filePath := filepath.Join(testDir, "file")
+	dirPath := filepath.Join(testDir, "dir")
+	for _, p := range []string{filePath, dirPath} {
+		if err := os.RemoveAll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testutil.SetupFiles(testDir, map[string]string{"file/child": "new", "dir": "dir"}); err != nil {
+		t.Fatalf("Error setting up fs: %s", err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatalf("Error taking snapshot of fs: %s", err)
+	}
+	// The old entries are whited out before the new ones are added, and the child of the replaced
+	// directory doesn't get a whiteout of its own
+	expectedNames := []string{
+		filepath.Join(testDir, ".wh.dir"),
+		filepath.Join(testDir, ".wh.file"),
+		testDir,
+		dirPath,
+		filePath,
+		filepath.Join(filePath, "child"),
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedNames, tarNames(t, contents))
+
+	// Extracting the layers gives the new types, whether the image is unpacked or the layers applied in turn
+	var layers []v1.Layer
+	for _, c := range [][]byte{base, contents} {
+		c := c
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(c)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, layer)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(unpacked)
+	if err := util.GetFSFromImage(unpacked, img); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(applied)
+	for _, layer := range layers {
+		if err := util.ApplyLayer(applied, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, root := range []string{unpacked, applied} {
+		checkFile(t, filepath.Join(root, dirPath), "dir")
+		checkFile(t, filepath.Join(root, filePath, "child"), "new")
+	}
+}
+
+func checkFile(t *testing.T, path, expected string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("expected %s to be a file, but its mode is %s", path, info.Mode())
+		return
+	}
+	contents, err := ioutil.ReadFile(path)
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, string(contents))
+}
+
+func tarNames(t *testing.T, contents []byte) []string {
+	tr := tar.NewReader(bytes.NewReader(contents))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestSnapshotTimeSize(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := testutil.SetupFiles(testDir, map[string]string{"foo": "baz1", "bar/bat": "baz2"}); err != nil {
+		t.Fatal(err)
+	}
+	fooPath := filepath.Join(testDir, "foo")
+	batPath := filepath.Join(testDir, "bar/bat")
+	snapshotter := NewSnapshotter(NewLayeredMap(util.TimeSizeHasher()), testDir, util.TarOptions{})
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify foo in place, keeping its size and mtime
+	fi, err := os.Stat(fooPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fooPath, []byte("baz3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fooPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{fooPath}, tarNames(t, contents))
+
+	// Change the size of bat, keeping its mtime
+	fi, err = os.Stat(batPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(batPath, []byte("longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(batPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{batPath}, tarNames(t, contents))
+
+	// Nothing changed since, so nothing should be added
+	contents, err = testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents != nil {
+		t.Errorf("expected no changes, got %v", tarNames(t, contents))
+	}
+}
+
+// setUpManyFiles creates count files of size bytes in dirs directories under dir
+func setUpManyFiles(dir string, dirs, count, size int) error {
+	contents := bytes.Repeat([]byte("k"), size)
+	for i := 0; i < count; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i%dirs), fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, append(contents, []byte(path)...), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSnapshotConcurrency(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := setUpManyFiles(testDir, 10, 200, 1024); err != nil {
+		t.Fatal(err)
+	}
+	// snapshot returns the layer of the whole directory, hashing concurrency files at once
+	snapshot := func(concurrency int) []byte {
+		snapshotter := NewSnapshotter(NewLayeredMap(util.Hasher()), testDir, util.TarOptions{Reproducible: true})
+		snapshotter.SetConcurrency(concurrency)
+		snapshotter.l.Snapshot()
+		contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	serial := snapshot(1)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 211, len(tarNames(t, serial)))
+	for _, concurrency := range []int{0, 4, 16} {
+		if !bytes.Equal(serial, snapshot(concurrency)) {
+			t.Errorf("layer hashed with concurrency %d differs from the serial one", concurrency)
+		}
+	}
+}
+
+func BenchmarkSnapshotFS(b *testing.B) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := setUpManyFiles(testDir, 100, 5000, 16*1024); err != nil {
+		b.Fatal(err)
+	}
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				snapshotter := NewSnapshotter(NewLayeredMap(util.Hasher()), testDir, util.TarOptions{})
+				snapshotter.SetConcurrency(concurrency)
+				if err := snapshotter.Init(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// syncTimeout is how long Stop waits for the events from before it was called
+var syncTimeout = 10 * time.Second
+
+// Watcher watches a directory with inotify, and records the paths in it which change, so a snapshot
+// can be taken of just those instead of the whole directory.
+type Watcher struct {
+	watcher  *fsnotify.Watcher
+	syncDir  string
+	syncFile string
+	synced   chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	changed map[string]struct{}
+	// err is the first error watching, after which changes may have been missed
+	err error
+}
+
+// NewWatcher starts watching every directory in root, apart from whitelisted ones. Directories created
+// in root while it's watched are watched as well. A directory of its own is created in tmpDir, outside
+// of root, to find out when it's seen every change.
+func NewWatcher(root, tmpDir string) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating inotify watcher")
+	}
+	syncDir, err := ioutil.TempDir(tmpDir, "watch")
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	w := &Watcher{
+		watcher:  fw,
+		syncDir:  syncDir,
+		syncFile: filepath.Join(syncDir, "sync"),
+		synced:   make(chan struct{}),
+		done:     make(chan struct{}),
+		changed:  map[string]struct{}{},
+	}
+	go w.run()
+	if err := fw.Add(syncDir); err != nil {
+		w.close()
+		return nil, errors.Wrapf(err, "watching %s", syncDir)
+	}
+	if err := w.watchTree(root, false); err != nil {
+		w.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Stop stops watching, and returns the paths which have changed since the watcher was created, sorted.
+// It returns an error if changes may have been missed, like when the kernel's queue of events overflowed.
+func (w *Watcher) Stop() ([]string, error) {
+	defer w.close()
+	// Events are delivered in order, so once the sync file is seen, so has everything before it
+	if err := ioutil.WriteFile(w.syncFile, nil, 0644); err != nil {
+		return nil, err
+	}
+	select {
+	case <-w.synced:
+	case <-time.After(syncTimeout):
+		return nil, errors.Errorf("timed out after %s waiting for filesystem events", syncTimeout)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return nil, w.err
+	}
+	var changed []string
+	for p := range w.changed {
+		changed = append(changed, p)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func (w *Watcher) close() {
+	w.watcher.Close()
+	<-w.done
+	os.RemoveAll(w.syncDir)
+}
+
+// run records the paths of the events until the watcher is closed
+func (w *Watcher) run() {
+	defer close(w.done)
+	events, errs := w.watcher.Events, w.watcher.Errors
+	for events != nil || errs != nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.handleEvent(event)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			w.fail(err)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	if filepath.Dir(event.Name) == w.syncDir || event.Name == w.syncDir {
+		if event.Name == w.syncFile && event.Op&fsnotify.Create != 0 {
+			close(w.synced)
+		}
+		return
+	}
+	w.add(event.Name)
+	if event.Op&fsnotify.Create == 0 {
+		return
+	}
+	// Anything can be created in a new directory before it's watched, so whatever is in it has changed too
+	if fi, err := os.Lstat(event.Name); err == nil && fi.IsDir() {
+		if err := w.watchTree(event.Name, true); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+// watchTree watches dir and the directories in it, and records them and everything in them as changed if
+// record is set
+func (w *Watcher) watchTree(dir string, record bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Something can be removed while it's being walked, which is an event of its own
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		whitelisted, err := util.CheckWhitelist(path)
+		if err != nil {
+			return err
+		}
+		if whitelisted {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if record {
+			w.add(path)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// The directory is watched before what's in it is walked, so nothing created in it is missed
+		if err := w.watcher.Add(path); err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return errors.Wrapf(err, "watching %s", path)
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) add(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changed[path] = struct{}{}
+}
+
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		logger.Debugf("Changes may have been missed watching the filesystem: %v", err)
+		w.err = err
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/fsnotify/fsnotify"
+)
+
+// newTestWatcher returns a watcher of dir, along with the directory it syncs in
+func newTestWatcher(t *testing.T, dir string) (*Watcher, string) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcher(dir, tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Skipf("inotify isn't available: %v", err)
+	}
+	return w, tmpDir
+}
+
+func TestWatcher(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := testutil.SetupFiles(testDir, map[string]string{
+		"keep":    "keep",
+		"modify":  "modify",
+		"remove":  "remove",
+		"chmod":   "chmod",
+		"rename":  "rename",
+		"dir/old": "old",
+		"sub/dir": "dir",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	w, tmpDir := newTestWatcher(t, testDir)
+	defer os.RemoveAll(tmpDir)
+
+	path := func(p string) string {
+		return filepath.Join(testDir, p)
+	}
+	if err := ioutil.WriteFile(path("modify"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path("remove")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path("chmod"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path("rename"), path("renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path("dir")); err != nil {
+		t.Fatal(err)
+	}
+	// What's created in a new directory is seen, even if it's before the directory is watched
+	if err := os.MkdirAll(path("new/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path("new/sub/file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := w.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, p := range []string{"chmod", "dir", "dir/old", "modify", "new", "new/sub", "new/sub/file", "remove", "rename", "renamed"} {
+		expected = append(expected, path(p))
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, changed)
+}
+
+func TestWatcher_MissedEvents(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	w, tmpDir := newTestWatcher(t, testDir)
+	defer os.RemoveAll(tmpDir)
+	// The kernel's queue of events overflowing is reported as an error, so a full snapshot is taken instead
+	w.fail(fsnotify.ErrEventOverflow)
+	_, err = w.Stop()
+	testutil.CheckError(t, true, err)
+}
+
+func TestSnapshotChanges(t *testing.T) {
+	testDir, snapshotter, err := setUpTestDir()
+	defer os.RemoveAll(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, tmpDir := newTestWatcher(t, testDir)
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(filepath.Join(testDir, "foo"), []byte("newbaz1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(testDir, "bar/bat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.SetupFiles(testDir, map[string]string{"new/file": "new", "tmp/file": "tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	// Files which are created and removed again aren't in the layer
+	if err := os.RemoveAll(filepath.Join(testDir, "tmp")); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := w.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := testutil.ReadLayerFile(snapshotter.TakeSnapshotOfChanges(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(contents))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(hdr.Name, testDir) {
+			names = append(names, hdr.Name)
+		}
+	}
+	expected := []string{
+		filepath.Join(testDir, "bar/.wh.bat"),
+		testDir,
+		filepath.Join(testDir, "bar"),
+		filepath.Join(testDir, "foo"),
+		filepath.Join(testDir, "new"),
+		filepath.Join(testDir, "new/file"),
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, names)
+
+	// Nothing else has changed since
+	contents, err = testutil.ReadLayerFile(snapshotter.TakeSnapshot(nil))
+	testutil.CheckErrorAndDeepEqual(t, false, err, []byte(nil), contents)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/authn/k8schain"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// dockerConfigPath is the docker config set with SetDockerConfig
+var dockerConfigPath string
+
+// SetDockerConfig sets the docker config.json, or directory with one, which credentials for the registries
+// images are pulled from are looked up in first
+func SetDockerConfig(path string) {
+	dockerConfigPath = path
+}
+
+// Keychain returns the keychain registry credentials are looked up in. If dockerConfig is set, the docker
+// config.json there takes precedence, followed by the credentials ECR gives for its registries, the application
+// default credentials for GCR and Artifact Registry, then the default docker config in $DOCKER_CONFIG or
+// ~/.docker, and then the credentials of the kubernetes service account.
+func Keychain(dockerConfig string) (authn.Keychain, error) {
+	k8sc, err := k8schain.NewNoClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting k8schain client")
+	}
+	keychains := []authn.Keychain{ecrKeychain, googleKeychain, authn.DefaultKeychain, k8sc}
+	if dockerConfig == "" {
+		return authn.NewMultiKeychain(keychains...), nil
+	}
+	kc, err := NewDockerConfigKeychain(dockerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return authn.NewMultiKeychain(append([]authn.Keychain{kc}, keychains...)...), nil
+}
+
+// DockerConfigKeychain is a keychain for the credentials in a docker config.json. Like docker, the credential
+// helper for a registry in credHelpers comes first, then the credsStore helper, and then the credentials in auths.
+type DockerConfigKeychain struct {
+	path   string
+	config dockerConfigFile
+	// run runs credential helpers
+	run func(*exec.Cmd) error
+}
+
+var _ authn.Keychain = (*DockerConfigKeychain)(nil)
+
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+	CredsStore  string                     `json:"credsStore"`
+}
+
+type dockerAuthEntry struct {
+	// Auth is the base64 encoded username:password
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// dockerRegistryForms are the ways a registry can be written in a docker config.json
+var dockerRegistryForms = []string{
+	"%s",
+	"https://%s",
+	"http://%s",
+	"https://%s/v1/",
+	"http://%s/v1/",
+	"https://%s/v2/",
+	"http://%s/v2/",
+}
+
+// NewDockerConfigKeychain reads the docker config.json at path, or in the directory at path
+func NewDockerConfigKeychain(path string) (*DockerConfigKeychain, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "config.json")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading docker config")
+	}
+	var config dockerConfigFile
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing docker config %s", path)
+	}
+	return &DockerConfigKeychain{
+		path:   path,
+		config: config,
+		run:    func(cmd *exec.Cmd) error { return cmd.Run() },
+	}, nil
+}
+
+// Resolve implements authn.Keychain
+func (k *DockerConfigKeychain) Resolve(reg name.Registry) (authn.Authenticator, error) {
+	for _, form := range dockerRegistryForms {
+		if helper, ok := k.config.CredHelpers[fmt.Sprintf(form, reg.Name())]; ok {
+			return &credentialHelper{name: helper, registry: reg, run: k.run}, nil
+		}
+	}
+	if k.config.CredsStore != "" {
+		return &credentialHelper{name: k.config.CredsStore, registry: reg, run: k.run}, nil
+	}
+	for _, form := range dockerRegistryForms {
+		entry, ok := k.config.Auths[fmt.Sprintf(form, reg.Name())]
+		if !ok {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decoding auth for %s in %s", reg.Name(), k.path)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("auth for %s in %s isn't a username:password", reg.Name(), k.path)
+			}
+			return &authn.Basic{Username: parts[0], Password: parts[1]}, nil
+		}
+		if entry.Username != "" {
+			return &authn.Basic{Username: entry.Username, Password: entry.Password}, nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// credentialHelperNotFound is what credential helpers output when they don't have credentials for a registry
+const credentialHelperNotFound = "credentials not found in native keychain"
+
+// credentialHelper is an authn.Authenticator which gets the credentials for registry from the docker credential
+// helper docker-credential-<name>
+type credentialHelper struct {
+	name     string
+	registry name.Registry
+	run      func(*exec.Cmd) error
+}
+
+// Authorization implements authn.Authenticator
+func (h *credentialHelper) Authorization() (string, error) {
+	cmd := exec.Command("docker-credential-"+h.name, "get")
+	// Docker Hub credentials are stored under the address of its v1 API
+	serverURL := h.registry.Name()
+	if serverURL == name.DefaultRegistry {
+		serverURL = "https://index.docker.io/v1/"
+	}
+	cmd.Stdin = strings.NewReader(serverURL)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := h.run(cmd)
+	output := strings.TrimSpace(out.String())
+	if output == credentialHelperNotFound {
+		return authn.Anonymous.Authorization()
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "running docker-credential-%s for %s", h.name, h.registry.Name())
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal([]byte(output), &creds); err != nil {
+		return "", errors.Wrapf(err, "parsing the output of docker-credential-%s", h.name)
+	}
+	return (&authn.Basic{Username: creds.Username, Password: creds.Secret}).Authorization()
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+const testDockerConfig = `{
+	"auths": {
+		"registry.example.com": {"auth": "dXNlcjpwYXNz"},
+		"https://index.docker.io/v1/": {"username": "hub", "password": "secret"},
+		"helper.example.com": {"auth": "aWdub3JlZDppZ25vcmVk"}
+	},
+	"credHelpers": {
+		"helper.example.com": "example"
+	}
+}`
+
+func writeDockerConfig(t *testing.T, dir, contents string) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestDockerConfigKeychain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeDockerConfig(t, dir, testDockerConfig)
+	// The directory with the config.json can be given too
+	kc, err := NewDockerConfigKeychain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var helperInput string
+	kc.run = func(cmd *exec.Cmd) error {
+		testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"docker-credential-example", "get"}, cmd.Args)
+		input, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		helperInput = string(input)
+		_, err = fmt.Fprint(cmd.Stdout, `{"ServerURL": "helper.example.com", "Username": "helped", "Secret": "token"}`)
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		registry string
+		expected string
+	}{
+		{
+			name:     "base64 auth",
+			registry: "registry.example.com",
+			expected: basicAuthorization("user", "pass"),
+		},
+		{
+			name:     "username and password for docker hub",
+			registry: "index.docker.io",
+			expected: basicAuthorization("hub", "secret"),
+		},
+		{
+			name:     "credential helper takes precedence over auths",
+			registry: "helper.example.com",
+			expected: basicAuthorization("helped", "token"),
+		},
+		{
+			name:     "registry without credentials",
+			registry: "other.example.com",
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg, err := name.NewRegistry(test.registry, name.WeakValidation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth, err := kc.Resolve(reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected == "" {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, authn.Anonymous, auth)
+				return
+			}
+			authorization, err := auth.Authorization()
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, authorization)
+		})
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "helper.example.com", helperInput)
+}
+
+func TestDockerConfigKeychain_HelperNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kc, err := NewDockerConfigKeychain(writeDockerConfig(t, dir, `{"credsStore": "store"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc.run = func(cmd *exec.Cmd) error {
+		fmt.Fprintln(cmd.Stdout, credentialHelperNotFound)
+		return &exec.ExitError{}
+	}
+	reg, err := name.NewRegistry("registry.example.com", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := kc.Resolve(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization, err := auth.Authorization()
+	testutil.CheckErrorAndDeepEqual(t, false, err, "", authorization)
+}
+
+func TestNewDockerConfigKeychain_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = NewDockerConfigKeychain(filepath.Join(dir, "missing.json"))
+	testutil.CheckError(t, true, err)
+	_, err = NewDockerConfigKeychain(writeDockerConfig(t, dir, "not json"))
+	testutil.CheckError(t, true, err)
+}
+
+func TestKeychain_Precedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The default docker config has credentials for both registries
+	defaultDir := filepath.Join(dir, "default")
+	writeDockerConfig(t, defaultDir, `{"auths": {
+		"registry.example.com": {"username": "default", "password": "default"},
+		"other.example.com": {"username": "default", "password": "default"}
+	}}`)
+	defer func(value string) { os.Setenv("DOCKER_CONFIG", value) }(os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", defaultDir)
+	custom := writeDockerConfig(t, filepath.Join(dir, "custom"), `{"auths": {
+		"registry.example.com": {"username": "custom", "password": "custom"}
+	}}`)
+
+	kc, err := Keychain(custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for registry, expected := range map[string]string{
+		"registry.example.com": basicAuthorization("custom", "custom"),
+		"other.example.com":    basicAuthorization("default", "default"),
+	} {
+		reg, err := name.NewRegistry(registry, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := kc.Resolve(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorization, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, expected, authorization)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+// azureStorageVersion is the version of the blob service REST API which requests use
+const azureStorageVersion = "2019-12-12"
+
+// azureStorageResource is what tokens from Azure AD are requested for
+const azureStorageResource = "https://storage.azure.com/"
+
+// ErrAzureBlobNotFound is returned by AzureBlobClient.Get when there's no blob with the name
+var ErrAzureBlobNotFound = errors.New("blob not found")
+
+// AzureBlobClient reads and writes blobs in an Azure storage account, with the blob service REST API
+type AzureBlobClient struct {
+	account string
+	// endpoint is the URL of the blob service, like https://<account>.blob.core.windows.net
+	endpoint string
+	// Requests are authorized with the account's shared key, a SAS token or a token from Azure AD
+	key   []byte
+	sas   string
+	token *adal.ServicePrincipalToken
+	now   func() time.Time
+}
+
+// NewAzureBlobClient returns a client for the storage account in $AZURE_STORAGE_ACCOUNT. Requests are
+// authorized with $AZURE_STORAGE_KEY or $AZURE_STORAGE_SAS_TOKEN if either is set. Otherwise they use a token for
+// the service principal in $AZURE_TENANT_ID, $AZURE_CLIENT_ID and $AZURE_CLIENT_SECRET, or for the managed
+// identity, which is the one with $AZURE_CLIENT_ID if that's set. $AZURE_STORAGE_ENDPOINT overrides the endpoint
+// of the blob service, such as for another cloud.
+func NewAzureBlobClient() (*AzureBlobClient, error) {
+	c := &AzureBlobClient{
+		account:  os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		endpoint: os.Getenv("AZURE_STORAGE_ENDPOINT"),
+		sas:      strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		now:      time.Now,
+	}
+	if c.account == "" {
+		return nil, errors.New("set $AZURE_STORAGE_ACCOUNT to the storage account to use Azure Blob Storage")
+	}
+	if c.endpoint == "" {
+		c.endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", c.account)
+	}
+	c.endpoint = strings.TrimSuffix(c.endpoint, "/")
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding $AZURE_STORAGE_KEY")
+		}
+		c.key = decoded
+		return c, nil
+	}
+	if c.sas != "" {
+		return c, nil
+	}
+	token, err := azureADToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting a token for Azure Blob Storage")
+	}
+	c.token = token
+	return c, nil
+}
+
+// azureADToken returns a token for the service principal in the environment, or the managed identity
+func azureADToken() (*adal.ServicePrincipalToken, error) {
+	tenantID, clientID, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenantID != "" && secret != "" {
+		config, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return adal.NewServicePrincipalToken(*config, clientID, secret, azureStorageResource)
+	}
+	endpoint, err := adal.GetMSIVMEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if clientID != "" {
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(endpoint, azureStorageResource, clientID)
+	}
+	return adal.NewServicePrincipalTokenFromMSI(endpoint, azureStorageResource)
+}
+
+// Get returns the contents of the blob in container, or ErrAzureBlobNotFound if there isn't one
+func (c *AzureBlobClient) Get(container, blob string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, container, blob, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAzureBlobResponse(resp, container, blob, http.StatusOK); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Exists returns true if there's a blob in container with the name
+func (c *AzureBlobClient) Exists(container, blob string) (bool, error) {
+	resp, err := c.do(http.MethodHead, container, blob, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	err = checkAzureBlobResponse(resp, container, blob, http.StatusOK)
+	if err == ErrAzureBlobNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put writes size bytes from r to the blob in container, replacing it if there's one already
+func (c *AzureBlobClient) Put(container, blob string, r io.Reader, size int64) error {
+	resp, err := c.do(http.MethodPut, container, blob, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkAzureBlobResponse(resp, container, blob, http.StatusCreated)
+}
+
+func (c *AzureBlobClient) do(method, container, blob string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s", c.endpoint, container, blob))
+	if err != nil {
+		return nil, err
+	}
+	if c.key == nil && c.sas != "" {
+		u.RawQuery = c.sas
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	req.Header.Set("x-ms-date", c.now().UTC().Format(http.TimeFormat))
+	if method == http.MethodPut {
+		req.ContentLength = size
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	switch {
+	case c.key != nil:
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", c.account, c.sign(req)))
+	case c.token != nil:
+		if err := c.token.EnsureFresh(); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token.OAuthToken())
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// sign returns the signature of req with the account's shared key
+func (c *AzureBlobClient) sign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders string
+	for _, name := range msHeaders {
+		canonicalHeaders += name + ":" + req.Header.Get(name) + "\n"
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, which x-ms-date is used instead of
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders + "/" + c.account + req.URL.EscapedPath(),
+	}, "\n")
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkAzureBlobResponse(resp *http.Response, container, blob string, expected int) error {
+	switch resp.StatusCode {
+	case expected:
+		return nil
+	case http.StatusNotFound:
+		return ErrAzureBlobNotFound
+	}
+	return errors.Errorf("unexpected status %s for blob %s in container %s", resp.Status, blob, container)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func setAzureStorageEnv(env map[string]string) func() {
+	original := map[string]string{}
+	for _, k := range []string{"AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_KEY", "AZURE_STORAGE_SAS_TOKEN", "AZURE_STORAGE_ENDPOINT"} {
+		original[k] = os.Getenv(k)
+		os.Setenv(k, env[k])
+	}
+	return func() {
+		for k, v := range original {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func TestNewAzureBlobClient(t *testing.T) {
+	tests := []struct {
+		name             string
+		env              map[string]string
+		expectedEndpoint string
+		shouldErr        bool
+	}{
+		{
+			name:      "no account",
+			env:       map[string]string{"AZURE_STORAGE_KEY": "a2V5"},
+			shouldErr: true,
+		},
+		{
+			name:      "invalid key",
+			env:       map[string]string{"AZURE_STORAGE_ACCOUNT": "kaniko", "AZURE_STORAGE_KEY": "not base64"},
+			shouldErr: true,
+		},
+		{
+			name:             "shared key",
+			env:              map[string]string{"AZURE_STORAGE_ACCOUNT": "kaniko", "AZURE_STORAGE_KEY": "a2V5"},
+			expectedEndpoint: "https://kaniko.blob.core.windows.net",
+		},
+		{
+			name: "sas token and endpoint",
+			env: map[string]string{
+				"AZURE_STORAGE_ACCOUNT":   "kaniko",
+				"AZURE_STORAGE_SAS_TOKEN": "?sv=2019-12-12&sig=abc",
+				"AZURE_STORAGE_ENDPOINT":  "https://kaniko.blob.core.chinacloudapi.cn/",
+			},
+			expectedEndpoint: "https://kaniko.blob.core.chinacloudapi.cn",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setAzureStorageEnv(test.env)()
+			c, err := NewAzureBlobClient()
+			testutil.CheckError(t, test.shouldErr, err)
+			if err == nil {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedEndpoint, c.endpoint)
+			}
+		})
+	}
+}
+
+func TestAzureBlobClient_SASToken(t *testing.T) {
+	var query, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth = r.URL.RawQuery, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	defer setAzureStorageEnv(map[string]string{
+		"AZURE_STORAGE_ACCOUNT":   "kaniko",
+		"AZURE_STORAGE_SAS_TOKEN": "?sv=2019-12-12&sig=abc",
+		"AZURE_STORAGE_ENDPOINT":  server.URL,
+	})()
+	c, err := NewAzureBlobClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := c.Exists("container", "blob")
+	testutil.CheckErrorAndDeepEqual(t, false, err, false, exists)
+	_, err = c.Get("container", "blob")
+	testutil.CheckErrorAndDeepEqual(t, false, nil, ErrAzureBlobNotFound, err)
+	// The SAS token authorizes the request, instead of a header
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "sv=2019-12-12&sig=abc", query)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "", auth)
+}
+
+func TestAzureBlobClient_SharedKey(t *testing.T) {
+	storage, cleanup := testutil.NewFakeAzureBlobStorage()
+	defer cleanup()
+	tests := []struct {
+		name      string
+		key       []byte
+		shouldErr bool
+	}{
+		{
+			name: "shared key",
+			key:  []byte("key"),
+		},
+		{
+			name:      "wrong shared key",
+			key:       []byte("wrong"),
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setAzureStorageEnv(map[string]string{
+				"AZURE_STORAGE_ACCOUNT":  os.Getenv("AZURE_STORAGE_ACCOUNT"),
+				"AZURE_STORAGE_KEY":      base64.StdEncoding.EncodeToString(test.key),
+				"AZURE_STORAGE_ENDPOINT": storage.URL,
+			})()
+			c, err := NewAzureBlobClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := []byte("layer")
+			blob := "cache/sha256 abc"
+			err = c.Put("container", blob, bytes.NewReader(contents), int64(len(contents)))
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			exists, err := c.Exists("container", blob)
+			testutil.CheckErrorAndDeepEqual(t, false, err, true, exists)
+			r, err := c.Get("container", blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			testutil.CheckErrorAndDeepEqual(t, false, err, contents, got)
+			exists, err = c.Exists("container", "other")
+			testutil.CheckErrorAndDeepEqual(t, false, err, false, exists)
+		})
+	}
+}
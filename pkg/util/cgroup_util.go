@@ -0,0 +1,265 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the period cpu.max is set with, in microseconds
+const cpuPeriod = 100000
+
+// RunLimits are the resources each RUN command can use
+type RunLimits struct {
+	// Memory is the most memory the command can use in bytes, or 0 for no limit
+	Memory int64
+	// CPUs is how many CPUs worth of time the command can use, or 0 for no limit
+	CPUs float64
+}
+
+// Set returns true if there's a limit
+func (l RunLimits) Set() bool {
+	return l.Memory > 0 || l.CPUs > 0
+}
+
+// ParseRunLimits parses the values of --run-memory-limit, a size like 512m in binary units, and
+// --run-cpu-limit, a number of CPUs like 1.5. Either can be empty for no limit.
+func ParseRunLimits(memory, cpus string) (RunLimits, error) {
+	var limits RunLimits
+	if memory != "" {
+		size, err := units.RAMInBytes(memory)
+		if err != nil {
+			return limits, errors.Wrapf(err, "--run-memory-limit %s", memory)
+		}
+		if size <= 0 {
+			return limits, errors.Errorf("--run-memory-limit %s must be more than 0 bytes", memory)
+		}
+		limits.Memory = size
+	}
+	if cpus != "" {
+		n, err := strconv.ParseFloat(cpus, 64)
+		if err != nil {
+			return limits, errors.Wrapf(err, "--run-cpu-limit %s", cpus)
+		}
+		// The quota can't be less than 1ms a period
+		if n*cpuPeriod < 1000 {
+			return limits, errors.Errorf("--run-cpu-limit %s must be at least 0.01", cpus)
+		}
+		limits.CPUs = n
+	}
+	return limits, nil
+}
+
+// Cgroup is a cgroup v2 which limits the resources the processes in it can use
+type Cgroup struct {
+	dir string
+}
+
+var (
+	// cgroupParentMu guards cgroupParent, which is only set once the controllers have been enabled in it,
+	// so that a failure to enable them is tried again by the next RUN command
+	cgroupParentMu sync.Mutex
+	cgroupParent   string
+)
+
+// NewCgroup creates a cgroup with limits, under the cgroup kaniko is in. The memory and cpu controllers
+// are enabled for the cgroups under kaniko's. Since a cgroup with processes in it can't have controllers
+// enabled for its children, kaniko is first moved into a child of its own if it has to be.
+func NewCgroup(limits RunLimits) (*Cgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, errors.Errorf("cgroups v2 aren't mounted at %s", cgroupRoot)
+	}
+	cgroupParentMu.Lock()
+	if cgroupParent == "" {
+		parent, err := enableCgroupControllers()
+		if err != nil {
+			cgroupParentMu.Unlock()
+			return nil, err
+		}
+		cgroupParent = parent
+	}
+	parent := cgroupParent
+	cgroupParentMu.Unlock()
+	dir, err := ioutil.TempDir(parent, "kaniko-run")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cgroup")
+	}
+	c := &Cgroup{dir: dir}
+	if limits.Memory > 0 {
+		if err := c.write("memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+			c.Remove()
+			return nil, err
+		}
+		// Without swap, going over the limit gets the command killed, instead of slowing it down
+		if _, err := os.Stat(filepath.Join(dir, "memory.swap.max")); err == nil {
+			if err := c.write("memory.swap.max", "0"); err != nil {
+				c.Remove()
+				return nil, err
+			}
+		}
+	}
+	if limits.CPUs > 0 {
+		if err := c.write("cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod)); err != nil {
+			c.Remove()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// enableCgroupControllers enables the memory and cpu controllers for the cgroups under the one kaniko is in,
+// and returns its directory
+func enableCgroupControllers() (string, error) {
+	contents, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var parent string
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			parent = filepath.Join(cgroupRoot, strings.TrimPrefix(scanner.Text(), "0::"))
+		}
+	}
+	if parent == "" {
+		return "", errors.New("kaniko isn't in a cgroup v2")
+	}
+	controllers, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range []string{"memory", "cpu"} {
+		if !containsField(string(controllers), controller) {
+			return "", errors.Errorf("the %s controller isn't available in cgroup %s", controller, parent)
+		}
+	}
+	subtreeControl := filepath.Join(parent, "cgroup.subtree_control")
+	err = ioutil.WriteFile(subtreeControl, []byte("+memory +cpu"), 0644)
+	if err != nil && isErrno(err, syscall.EBUSY) {
+		leaf := filepath.Join(parent, "kaniko")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", errors.Wrap(err, "creating cgroup for kaniko")
+		}
+		logger.Debugf("Moving kaniko to cgroup %s, so controllers can be enabled in %s", leaf, parent)
+		if err := ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return "", errors.Wrap(err, "moving kaniko to a cgroup of its own")
+		}
+		err = ioutil.WriteFile(subtreeControl, []byte("+memory +cpu"), 0644)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "enabling the memory and cpu controllers in cgroup %s", parent)
+	}
+	return parent, nil
+}
+
+// Start starts the command newCmd returns in the cgroup, so that neither it nor anything it forks ever runs
+// outside of it. Starting a process in a cgroup needs Linux 5.7, so on older kernels a new command from
+// newCmd is started without the limits instead, with a warning.
+func (c *Cgroup) Start(newCmd func() *exec.Cmd) (*exec.Cmd, error) {
+	dir, err := os.Open(c.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening cgroup %s", c.dir)
+	}
+	defer dir.Close()
+	cmd := newCmd()
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	err = cmd.Start()
+	if err == nil || !(isErrno(err, syscall.ENOSYS) || isErrno(err, syscall.E2BIG) || isErrno(err, syscall.EINVAL)) {
+		return cmd, err
+	}
+	logger.Warnf("Running the command without --run-memory-limit and --run-cpu-limit, since the kernel can't start it in a cgroup: %v", err)
+	cmd = newCmd()
+	return cmd, cmd.Start()
+}
+
+// OOMKilled returns true if a process in the cgroup was killed for using more memory than its limit
+func (c *Cgroup) OOMKilled() bool {
+	contents, err := ioutil.ReadFile(filepath.Join(c.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+	return false
+}
+
+// Remove kills any processes left in the cgroup, and removes it
+func (c *Cgroup) Remove() error {
+	if _, err := os.Stat(filepath.Join(c.dir, "cgroup.kill")); err == nil {
+		if err := c.write("cgroup.kill", "1"); err != nil {
+			return err
+		}
+	}
+	// A cgroup can only be removed once the processes which were killed have exited
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(c.dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return errors.Wrapf(err, "removing cgroup %s", c.dir)
+}
+
+func (c *Cgroup) write(file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, file), []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "setting %s of cgroup %s to %s", file, c.dir, value)
+	}
+	return nil
+}
+
+func containsField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == errno
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParseRunLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		memory      string
+		cpus        string
+		expected    RunLimits
+		shouldError bool
+	}{
+		{
+			name: "no limits",
+		},
+		{
+			name:     "binary units",
+			memory:   "512m",
+			cpus:     "1.5",
+			expected: RunLimits{Memory: 512 * 1024 * 1024, CPUs: 1.5},
+		},
+		{
+			name:     "bytes",
+			memory:   "1048576",
+			expected: RunLimits{Memory: 1048576},
+		},
+		{
+			name:        "invalid memory",
+			memory:      "lots",
+			shouldError: true,
+		},
+		{
+			name:        "zero memory",
+			memory:      "0",
+			shouldError: true,
+		},
+		{
+			name:        "invalid cpus",
+			cpus:        "two",
+			shouldError: true,
+		},
+		{
+			name:        "too few cpus",
+			cpus:        "0.001",
+			shouldError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits, err := ParseRunLimits(test.memory, test.cpus)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldError, err, test.expected, limits)
+		})
+	}
+}
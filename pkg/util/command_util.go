@@ -22,26 +22,28 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	containeruser "github.com/opencontainers/runc/libcontainer/user"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 // ResolveEnvironmentReplacementList resolves a list of values by calling resolveEnvironmentReplacement
-func ResolveEnvironmentReplacementList(values, envs []string, isFilepath bool) ([]string, error) {
+func ResolveEnvironmentReplacementList(values, envs []string, escape rune, isFilepath bool) ([]string, error) {
 	var resolvedValues []string
 	for _, value := range values {
-		if IsSrcRemoteFileURL(value) {
+		if isSrcRemote(value) {
 			resolvedValues = append(resolvedValues, value)
 			continue
 		}
-		resolved, err := ResolveEnvironmentReplacement(value, envs, isFilepath)
-		logrus.Debugf("Resolved %s to %s", value, resolved)
+		resolved, err := ResolveEnvironmentReplacement(value, envs, escape, isFilepath)
+		logger.Debugf("Resolved %s to %s", value, resolved)
 		if err != nil {
 			return nil, err
 		}
@@ -59,8 +61,13 @@ func ResolveEnvironmentReplacementList(values, envs []string, isFilepath bool) (
 // ""a'b'c"" -> "a'b'c"
 // "Rex\ The\ Dog \" -> "Rex The Dog"
 // "a\"b" -> "a"b"
-func ResolveEnvironmentReplacement(value string, envs []string, isFilepath bool) (string, error) {
-	shlex := shell.NewLex(parser.DefaultEscapeToken)
+// The escape character is the one of the Dockerfile value is from, which its escape parser directive can set,
+// or \ if escape is 0.
+func ResolveEnvironmentReplacement(value string, envs []string, escape rune, isFilepath bool) (string, error) {
+	if escape == 0 {
+		escape = parser.DefaultEscapeToken
+	}
+	shlex := shell.NewLex(escape)
 	fp, err := shlex.ProcessWord(value, envs)
 	if !isFilepath {
 		return fp, err
@@ -91,7 +98,7 @@ func ResolveSources(srcsAndDest instructions.SourcesAndDest, root string) ([]str
 	srcs := srcsAndDest[:len(srcsAndDest)-1]
 	// If sources contain wildcards, we first need to resolve them to actual paths
 	if ContainsWildcards(srcs) {
-		logrus.Debugf("Resolving srcs %v...", srcs)
+		logger.Debugf("Resolving srcs %v...", srcs)
 		files, err := RelativeFiles("", root)
 		if err != nil {
 			return nil, err
@@ -100,8 +107,20 @@ func ResolveSources(srcsAndDest instructions.SourcesAndDest, root string) ([]str
 		if err != nil {
 			return nil, err
 		}
-		logrus.Debugf("Resolved sources to %v", srcs)
+		logger.Debugf("Resolved sources to %v", srcs)
+	}
+	// Excluded directories are still copied, since files in them can be included again
+	var included []string
+	for _, src := range srcs {
+		if !isSrcRemote(src) && ExcludeFile(filepath.Join(root, src)) {
+			if fi, err := os.Lstat(filepath.Join(root, src)); err == nil && !fi.IsDir() {
+				logger.Debugf("Not copying %s, since .dockerignore excludes it", src)
+				continue
+			}
+		}
+		included = append(included, src)
 	}
+	srcs = included
 	// Check to make sure the sources are valid
 	return srcs, IsSrcsValid(srcsAndDest, srcs, root)
 }
@@ -110,7 +129,7 @@ func ResolveSources(srcsAndDest instructions.SourcesAndDest, root string) ([]str
 func matchSources(srcs, files []string) ([]string, error) {
 	var matchedSources []string
 	for _, src := range srcs {
-		if IsSrcRemoteFileURL(src) {
+		if isSrcRemote(src) {
 			matchedSources = append(matchedSources, src)
 			continue
 		}
@@ -182,7 +201,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 
 	// If there is only one source and it's a directory, docker assumes the dest is a directory
 	if len(resolvedSources) == 1 {
-		if IsSrcRemoteFileURL(resolvedSources[0]) {
+		if isSrcRemote(resolvedSources[0]) {
 			return nil
 		}
 		fi, err := os.Lstat(filepath.Join(root, resolvedSources[0]))
@@ -196,7 +215,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 
 	totalFiles := 0
 	for _, src := range resolvedSources {
-		if IsSrcRemoteFileURL(src) {
+		if isSrcRemote(src) {
 			totalFiles++
 			continue
 		}
@@ -205,7 +224,11 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 		if err != nil {
 			return err
 		}
-		totalFiles += len(files)
+		for _, file := range files {
+			if !ExcludeFile(filepath.Join(root, file)) {
+				totalFiles++
+			}
+		}
 	}
 	if totalFiles == 0 {
 		return errors.New("copy failed: no source files specified")
@@ -218,6 +241,11 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 	return nil
 }
 
+// isSrcRemote returns true if src is downloaded or cloned by ADD, rather than coming from the build context
+func isSrcRemote(src string) bool {
+	return IsSrcRemoteGitURL(src) || IsSrcRemoteFileURL(src)
+}
+
 func IsSrcRemoteFileURL(rawurl string) bool {
 	_, err := url.ParseRequestURI(rawurl)
 	if err != nil {
@@ -230,17 +258,21 @@ func IsSrcRemoteFileURL(rawurl string) bool {
 	return true
 }
 
-func UpdateConfigEnv(newEnvs []instructions.KeyValuePair, config *v1.Config, replacementEnvs []string) error {
+// UpdateConfigEnv sets the variables in newEnvs in config, after expanding them with replacementEnvs.
+// Each pair is expanded with the variables from before the instruction, not the ones before it on the
+// same line, like docker does. newEnvs itself isn't changed, so it's still the instruction as written.
+func UpdateConfigEnv(newEnvs []instructions.KeyValuePair, config *v1.Config, replacementEnvs []string, escape rune) error {
+	expandedEnvs := make([]instructions.KeyValuePair, len(newEnvs))
 	for index, pair := range newEnvs {
-		expandedKey, err := ResolveEnvironmentReplacement(pair.Key, replacementEnvs, false)
+		expandedKey, err := ResolveEnvironmentReplacement(pair.Key, replacementEnvs, escape, false)
 		if err != nil {
 			return err
 		}
-		expandedValue, err := ResolveEnvironmentReplacement(pair.Value, replacementEnvs, false)
+		expandedValue, err := ResolveEnvironmentReplacement(pair.Value, replacementEnvs, escape, false)
 		if err != nil {
 			return err
 		}
-		newEnvs[index] = instructions.KeyValuePair{
+		expandedEnvs[index] = instructions.KeyValuePair{
 			Key:   expandedKey,
 			Value: expandedValue,
 		}
@@ -258,11 +290,11 @@ func UpdateConfigEnv(newEnvs []instructions.KeyValuePair, config *v1.Config, rep
 	// Iterate through new environment variables, and replace existing keys
 	// We can't use a map because we need to preserve the order of the environment variables
 Loop:
-	for _, newEnv := range newEnvs {
+	for _, newEnv := range expandedEnvs {
 		for index, kvp := range kvps {
 			// If key exists, replace the KeyValuePair...
 			if kvp.Key == newEnv.Key {
-				logrus.Debugf("Replacing environment variable %v with %v in config", kvp, newEnv)
+				logger.Debugf("Replacing environment variable %v with %v in config", kvp, newEnv)
 				kvps[index] = newEnv
 				continue Loop
 			}
@@ -319,3 +351,52 @@ func GetUserFromUsername(userStr string, groupStr string) (string, string, error
 
 	return uid, gid, nil
 }
+
+// ParseChown resolves the user and group in chown, as given to the --chown flag, to ids. Names are
+// looked up in the /etc/passwd and /etc/group files under root, which is the filesystem being built,
+// rather than the executor's. If no group is given, the group is the user's primary group in /etc/passwd,
+// or the same id as the user if it's an id which isn't in it.
+func ParseChown(chown, root string) (idtools.IDPair, error) {
+	parts := strings.Split(chown, ":")
+	if len(parts) > 2 || parts[0] == "" {
+		return idtools.IDPair{}, errors.Errorf("invalid --chown %q: must be <user>[:<group>]", chown)
+	}
+	userStr := parts[0]
+	uid, uidErr := strconv.Atoi(userStr)
+	users, err := containeruser.ParsePasswdFileFilter(filepath.Join(root, "etc/passwd"), func(u containeruser.User) bool {
+		if uidErr == nil {
+			return u.Uid == uid
+		}
+		return u.Name == userStr
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return idtools.IDPair{}, errors.Wrapf(err, "resolving --chown user %s", userStr)
+	}
+	if uidErr != nil {
+		if len(users) == 0 {
+			return idtools.IDPair{}, errors.Errorf("resolving --chown %s: no user %s in /etc/passwd", chown, userStr)
+		}
+		uid = users[0].Uid
+	}
+	if len(parts) == 1 {
+		if len(users) == 0 {
+			return idtools.IDPair{UID: uid, GID: uid}, nil
+		}
+		return idtools.IDPair{UID: uid, GID: users[0].Gid}, nil
+	}
+	groupStr := parts[1]
+	gid, err := strconv.Atoi(groupStr)
+	if err != nil {
+		groups, err := containeruser.ParseGroupFileFilter(filepath.Join(root, "etc/group"), func(g containeruser.Group) bool {
+			return g.Name == groupStr
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return idtools.IDPair{}, errors.Wrapf(err, "resolving --chown group %s", groupStr)
+		}
+		if len(groups) == 0 {
+			return idtools.IDPair{}, errors.Errorf("resolving --chown %s: no group %s in /etc/group", chown, groupStr)
+		}
+		gid = groups[0].Gid
+	}
+	return idtools.IDPair{UID: uid, GID: gid}, nil
+}
@@ -17,10 +17,13 @@ limitations under the License.
 package util
 
 import (
+	"io/ioutil"
+	"os"
 	"sort"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/docker/docker/pkg/idtools"
 )
 
 var testUrl = "https://github.com/GoogleContainerTools/runtimes-common/blob/master/LICENSE"
@@ -101,7 +104,7 @@ var testEnvReplacement = []struct {
 
 func Test_EnvReplacement(t *testing.T) {
 	for _, test := range testEnvReplacement {
-		actualPath, err := ResolveEnvironmentReplacement(test.path, test.envs, test.isFilepath)
+		actualPath, err := ResolveEnvironmentReplacement(test.path, test.envs, 0, test.isFilepath)
 		testutil.CheckErrorAndDeepEqual(t, false, err, test.expectedPath, actualPath)
 
 	}
@@ -384,6 +387,34 @@ func Test_ResolveSources(t *testing.T) {
 	}
 }
 
+func Test_ResolveSources_Dockerignore(t *testing.T) {
+	defer func() { excluded = nil }()
+	context, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(context)
+	files := map[string]string{
+		".dockerignore":    "*.md\n!README*.md\nREADME-secret.md\n",
+		"README.md":        "readme",
+		"README-secret.md": "secret",
+		"CHANGES.md":       "changes",
+	}
+	if err := testutil.SetupFiles(context, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetExcludedFiles(context); err != nil {
+		t.Fatal(err)
+	}
+
+	srcs, err := ResolveSources([]string{"*.md", "dest/"}, context)
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{"README.md"}, srcs)
+
+	// Copying only excluded files fails like it does with docker
+	_, err = ResolveSources([]string{"CHANGES.md", "dest"}, context)
+	testutil.CheckError(t, true, err)
+}
+
 var testRemoteUrls = []struct {
 	name  string
 	url   string
@@ -415,3 +446,96 @@ func Test_RemoteUrls(t *testing.T) {
 	}
 
 }
+
+func TestParseChown(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\nnode:x:1000:1000::/home/node:/bin/sh\napp:x:1002:100::/home/app:/bin/sh\n",
+		"etc/group":  "root:x:0:\nnode:x:1000:\nstaff:x:50:node\nusers:x:100:\n",
+	}
+	if err := testutil.SetupFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		chown     string
+		expected  idtools.IDPair
+		shouldErr bool
+	}{
+		{
+			chown:    "node",
+			expected: idtools.IDPair{UID: 1000, GID: 1000},
+		},
+		{
+			chown:    "node:staff",
+			expected: idtools.IDPair{UID: 1000, GID: 50},
+		},
+		{
+			// There's no group named app, so the group is the user's primary group
+			chown:    "app",
+			expected: idtools.IDPair{UID: 1002, GID: 100},
+		},
+		{
+			chown:    "1002",
+			expected: idtools.IDPair{UID: 1002, GID: 100},
+		},
+		{
+			chown:    "app:staff",
+			expected: idtools.IDPair{UID: 1002, GID: 50},
+		},
+		{
+			chown:    "1001",
+			expected: idtools.IDPair{UID: 1001, GID: 1001},
+		},
+		{
+			chown:    "1001:1002",
+			expected: idtools.IDPair{UID: 1001, GID: 1002},
+		},
+		{
+			chown:    "node:1002",
+			expected: idtools.IDPair{UID: 1000, GID: 1002},
+		},
+		{
+			chown:    "1001:staff",
+			expected: idtools.IDPair{UID: 1001, GID: 50},
+		},
+		{
+			chown:     "missing",
+			shouldErr: true,
+		},
+		{
+			chown:     "node:missing",
+			shouldErr: true,
+		},
+		{
+			chown:     "node:staff:extra",
+			shouldErr: true,
+		},
+		{
+			chown:     ":staff",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.chown, func(t *testing.T) {
+			ids, err := ParseChown(test.chown, root)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, ids)
+		})
+	}
+}
+
+func TestParseChown_NoPasswd(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// Numeric ids don't need /etc/passwd or /etc/group, but names do
+	ids, err := ParseChown("1000:1000", root)
+	testutil.CheckErrorAndDeepEqual(t, false, err, idtools.IDPair{UID: 1000, GID: 1000}, ids)
+	_, err = ParseChown("node", root)
+	testutil.CheckError(t, true, err)
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+)
+
+// ZstdLayer is the media type of OCI layers compressed with zstd
+const ZstdLayer types.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// ValidateCompression returns an error unless compression is gzip or zstd, or empty for gzip, and level
+// is a level of it. A level of 0 is the default level of the algorithm.
+func ValidateCompression(compression string, level int) error {
+	switch compression {
+	case "", constants.CompressionGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return errors.Errorf("--compression-level for gzip must be between 1 and %d, or 0 for the default level", gzip.BestCompression)
+		}
+	case constants.CompressionZstd:
+		if level < 0 || level > 22 {
+			return errors.New("--compression-level for zstd must be between 1 and 22, or 0 for the default level")
+		}
+	default:
+		return errors.Errorf("--compression must be %s or %s, not %s", constants.CompressionGzip, constants.CompressionZstd, compression)
+	}
+	return nil
+}
+
+// CompressLayers returns img with its layers from the one at index from on compressed again with
+// compression, at level unless it's 0. Layers compressed with zstd need an OCI manifest, so the
+// manifest of img is converted to one then, and GzipFallback returns img.
+func CompressLayers(img v1.Image, from int, compression string, level int) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for i := from; i < len(layers); i++ {
+		indexes = append(indexes, i)
+	}
+	return CompressLayersAt(img, indexes, compression, level)
+}
+
+// CompressLayersAt returns img with its layers at indexes compressed again, like CompressLayers. It
+// returns img itself if there are no indexes.
+func CompressLayersAt(img v1.Image, indexes []int, compression string, level int) (v1.Image, error) {
+	if len(indexes) == 0 {
+		return img, nil
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	compressed := map[v1.Hash]v1.Layer{}
+	at := map[int]bool{}
+	for _, i := range indexes {
+		at[i] = true
+		l, err := CompressLayer(layers[i], compression, level)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		compressed[digest] = l
+		m.Layers[i].Digest = digest
+		if m.Layers[i].Size, err = l.Size(); err != nil {
+			return nil, err
+		}
+	}
+	zstdImage := compression == constants.CompressionZstd
+	if zstdImage {
+		mediaType = types.OCIManifestSchema1
+		m.MediaType = mediaType
+		m.Config.MediaType = types.OCIConfigJSON
+		for i := range m.Layers {
+			m.Layers[i].MediaType = ociLayerMediaType(m.Layers[i].MediaType)
+			if at[i] {
+				m.Layers[i].MediaType = ZstdLayer
+			}
+		}
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	compressedImg := &compressedImage{
+		Image:       img,
+		mediaType:   mediaType,
+		rawManifest: rawManifest,
+		layers:      compressed,
+	}
+	if zstdImage {
+		return &zstdFallbackImage{Image: compressedImg, gzipped: img}, nil
+	}
+	return compressedImg, nil
+}
+
+// GzipFallback returns the image with the layers compressed with gzip instead, if img was returned by
+// CompressLayers with zstd, for registries and formats which don't support zstd
+func GzipFallback(img v1.Image) (v1.Image, bool) {
+	if z, ok := img.(*zstdFallbackImage); ok {
+		return z.gzipped, true
+	}
+	return nil, false
+}
+
+// ociLayerMediaType returns the OCI media type for a docker layer media type
+func ociLayerMediaType(mediaType types.MediaType) types.MediaType {
+	switch mediaType {
+	case types.DockerLayer:
+		return types.OCILayer
+	case types.DockerForeignLayer:
+		return types.OCIRestrictedLayer
+	case types.DockerUncompressedLayer:
+		return types.OCIUncompressedLayer
+	}
+	return mediaType
+}
+
+// compressWriter is a gzip or zstd writer
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressWriter returns a writer which compresses what's written to it to w with compression, at
+// level unless it's 0
+func newCompressWriter(w io.Writer, compression string, level int) (compressWriter, error) {
+	if compression == constants.CompressionZstd {
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// CompressLayer returns l compressed with compression, at level unless it's 0. The compressed layer is
+// written to a layer file, rather than held in memory.
+func CompressLayer(l v1.Layer, compression string, level int) (v1.Layer, error) {
+	f, err := NewLayerFile()
+	if err != nil {
+		return nil, err
+	}
+	digest, size, err := compressTo(f, l, compression, level)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &compressedLayer{Layer: l, path: f.Name(), digest: digest, size: size}, nil
+}
+
+// compressTo writes l compressed with compression to f, and returns the digest and size of what's written
+func compressTo(f io.Writer, l v1.Layer, compression string, level int) (v1.Hash, int64, error) {
+	hasher := sha256.New()
+	var counter countingWriter
+	w, err := newCompressWriter(io.MultiWriter(f, hasher, &counter), compression, level)
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	r, err := l.Uncompressed()
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return v1.Hash{}, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return v1.Hash{}, 0, err
+	}
+	digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(hasher.Sum(nil))}
+	return digest, counter.n, nil
+}
+
+// compressedLayer is a layer compressed again, with the same uncompressed contents and diff ID as the
+// layer it embeds. The compressed layer is in the file at path.
+type compressedLayer struct {
+	v1.Layer
+	path   string
+	digest v1.Hash
+	size   int64
+}
+
+// Digest implements v1.Layer
+func (c *compressedLayer) Digest() (v1.Hash, error) {
+	return c.digest, nil
+}
+
+// Compressed implements v1.Layer
+func (c *compressedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(c.path)
+}
+
+// Size implements v1.Layer
+func (c *compressedLayer) Size() (int64, error) {
+	return c.size, nil
+}
+
+// compressedImage is an image with some of the layers of the image it embeds compressed again.
+// Its config is the same, since the uncompressed layers are.
+type compressedImage struct {
+	v1.Image
+	mediaType   types.MediaType
+	rawManifest []byte
+	layers      map[v1.Hash]v1.Layer
+}
+
+// MediaType implements v1.Image
+func (c *compressedImage) MediaType() (types.MediaType, error) {
+	return c.mediaType, nil
+}
+
+// RawManifest implements v1.Image
+func (c *compressedImage) RawManifest() ([]byte, error) {
+	return c.rawManifest, nil
+}
+
+// Manifest implements v1.Image
+func (c *compressedImage) Manifest() (*v1.Manifest, error) {
+	return partial.Manifest(c)
+}
+
+// Digest implements v1.Image
+func (c *compressedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(c)
+}
+
+// BlobSet implements v1.Image
+func (c *compressedImage) BlobSet() (map[v1.Hash]struct{}, error) {
+	return partial.BlobSet(c)
+}
+
+// Layers implements v1.Image
+func (c *compressedImage) Layers() ([]v1.Layer, error) {
+	digests, err := partial.FSLayers(c)
+	if err != nil {
+		return nil, err
+	}
+	var layers []v1.Layer
+	for _, h := range digests {
+		l, err := c.LayerByDigest(h)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// LayerByDigest implements v1.Image
+func (c *compressedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	if l, ok := c.layers[h]; ok {
+		return l, nil
+	}
+	return c.Image.LayerByDigest(h)
+}
+
+// LayerByDiffID implements v1.Image
+func (c *compressedImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	digest, err := partial.DiffIDToBlob(c, h)
+	if err != nil {
+		return nil, err
+	}
+	return c.LayerByDigest(digest)
+}
+
+// zstdFallbackImage is an image with zstd layers, which keeps the image it was compressed from
+type zstdFallbackImage struct {
+	v1.Image
+	gzipped v1.Image
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// compressibleImage returns an image with layers which compress well, so that compression levels matter
+func compressibleImage(t *testing.T, layers int) v1.Image {
+	img := empty.Image
+	for i := 0; i < layers; i++ {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		contents := []byte(strings.Repeat("kaniko builds images in a container ", 1000+i))
+		if err := w.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = mutate.AppendLayers(img, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return img
+}
+
+func TestValidateCompression(t *testing.T) {
+	tests := []struct {
+		compression string
+		level       int
+		shouldErr   bool
+	}{
+		{compression: "", level: 0},
+		{compression: "gzip", level: 9},
+		{compression: "zstd", level: 22},
+		{compression: "gzip", level: 10, shouldErr: true},
+		{compression: "zstd", level: -1, shouldErr: true},
+		{compression: "xz", level: 0, shouldErr: true},
+	}
+	for _, test := range tests {
+		err := ValidateCompression(test.compression, test.level)
+		testutil.CheckError(t, test.shouldErr, err)
+	}
+}
+
+func TestCompressLayers(t *testing.T) {
+	gzipLevel := func(level int) func([]byte) ([]byte, error) {
+		return func(b []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w, err := gzip.NewWriterLevel(&buf, level)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(b); err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			return buf.Bytes(), err
+		}
+	}
+	zstdLevel := func(opts ...zstd.EOption) func([]byte) ([]byte, error) {
+		return func(b []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w, err := zstd.NewWriter(&buf, opts...)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(b); err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			return buf.Bytes(), err
+		}
+	}
+	tests := []struct {
+		name              string
+		compression       string
+		level             int
+		compress          func([]byte) ([]byte, error)
+		manifestMediaType types.MediaType
+		layerMediaTypes   []types.MediaType
+	}{
+		{
+			name:              "zstd",
+			compression:       constants.CompressionZstd,
+			compress:          zstdLevel(),
+			manifestMediaType: types.OCIManifestSchema1,
+			layerMediaTypes:   []types.MediaType{types.OCILayer, ZstdLayer, ZstdLayer},
+		},
+		{
+			name:              "zstd with a level",
+			compression:       constants.CompressionZstd,
+			level:             19,
+			compress:          zstdLevel(zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(19))),
+			manifestMediaType: types.OCIManifestSchema1,
+			layerMediaTypes:   []types.MediaType{types.OCILayer, ZstdLayer, ZstdLayer},
+		},
+		{
+			name:              "fastest gzip",
+			compression:       constants.CompressionGzip,
+			level:             1,
+			compress:          gzipLevel(1),
+			manifestMediaType: types.DockerManifestSchema2,
+			layerMediaTypes:   []types.MediaType{types.DockerLayer, types.DockerLayer, types.DockerLayer},
+		},
+		{
+			name:              "best gzip",
+			compression:       constants.CompressionGzip,
+			level:             9,
+			compress:          gzipLevel(9),
+			manifestMediaType: types.DockerManifestSchema2,
+			layerMediaTypes:   []types.MediaType{types.DockerLayer, types.DockerLayer, types.DockerLayer},
+		},
+	}
+	img := compressibleImage(t, 3)
+	originalLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalManifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The first layer is the base image's, and stays as it is
+			actual, err := CompressLayers(img, 1, test.compression, test.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := actual.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, err := actual.MediaType()
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.manifestMediaType, mediaType)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.manifestMediaType, m.MediaType)
+			var layerMediaTypes []types.MediaType
+			for _, l := range m.Layers {
+				layerMediaTypes = append(layerMediaTypes, l.MediaType)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.layerMediaTypes, layerMediaTypes)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, originalManifest.Layers[0].Digest, m.Layers[0].Digest)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, originalManifest.Config.Digest, m.Config.Digest)
+
+			layers, err := actual.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(layers); i++ {
+				r, err := originalLayers[i].Uncompressed()
+				if err != nil {
+					t.Fatal(err)
+				}
+				uncompressed, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := test.compress(uncompressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r, err = layers[i].Compressed()
+				if err != nil {
+					t.Fatal(err)
+				}
+				compressed, err := ioutil.ReadAll(r)
+				r.Close()
+				testutil.CheckErrorAndDeepEqual(t, false, err, expected, compressed)
+				testutil.CheckErrorAndDeepEqual(t, false, nil, int64(len(compressed)), m.Layers[i].Size)
+
+				// The diff IDs, and so the config, don't change
+				diffID, err := layers[i].DiffID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectedDiffID, err := originalLayers[i].DiffID()
+				testutil.CheckErrorAndDeepEqual(t, false, err, expectedDiffID, diffID)
+			}
+
+			gzipped, ok := GzipFallback(actual)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.compression == constants.CompressionZstd, ok)
+			if ok {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, img, gzipped)
+			}
+		})
+	}
+}
+
+func TestCompressLayers_LevelChangesSize(t *testing.T) {
+	img := compressibleImage(t, 1)
+	size := func(compression string, level int) int64 {
+		actual, err := CompressLayers(img, 0, compression, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := actual.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Layers[0].Size
+	}
+	if fastest, best := size(constants.CompressionGzip, 1), size(constants.CompressionGzip, 9); best >= fastest {
+		t.Errorf("gzip level 9 layer is %d bytes, which isn't smaller than %d bytes with level 1", best, fastest)
+	}
+	if fastest, best := size(constants.CompressionZstd, 1), size(constants.CompressionZstd, 19); best >= fastest {
+		t.Errorf("zstd level 19 layer is %d bytes, which isn't smaller than %d bytes with level 1", best, fastest)
+	}
+}
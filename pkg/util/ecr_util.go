@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// ecrRegistryPattern matches the registries of ECR, like 123456789012.dkr.ecr.us-east-1.amazonaws.com,
+// capturing the registry ID and the region
+var ecrRegistryPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrTokenExpiryMargin is how long before it expires a token is fetched again, so it doesn't expire mid push
+const ecrTokenExpiryMargin = 5 * time.Minute
+
+// ECRKeychain is a keychain for ECR registries, which gets their credentials from ECR with the AWS credentials
+// in the environment, like the instance role or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. This is what the
+// docker-credential-ecr-login helper does, without needing it. Each token is used until shortly before it expires.
+type ECRKeychain struct {
+	// endpoint is the ECR API to use instead of AWS, like a fake one in tests
+	endpoint string
+	now      func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]ecrToken
+}
+
+var _ authn.Keychain = (*ECRKeychain)(nil)
+
+type ecrToken struct {
+	auth    *authn.Basic
+	expires time.Time
+}
+
+// NewECRKeychain returns a keychain for ECR registries
+func NewECRKeychain() *ECRKeychain {
+	return &ECRKeychain{now: time.Now, tokens: map[string]ecrToken{}}
+}
+
+// ecrKeychain is shared by every pull and push, so tokens are only fetched once
+var ecrKeychain = NewECRKeychain()
+
+// Resolve implements authn.Keychain. Registries which aren't in ECR are anonymous, as are ECR registries
+// whose credentials can't be fetched, so they can come from another keychain instead.
+func (k *ECRKeychain) Resolve(reg name.Registry) (authn.Authenticator, error) {
+	match := ecrRegistryPattern.FindStringSubmatch(reg.RegistryStr())
+	if match == nil {
+		return authn.Anonymous, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if token, ok := k.tokens[reg.RegistryStr()]; ok && k.now().Add(ecrTokenExpiryMargin).Before(token.expires) {
+		return token.auth, nil
+	}
+	token, err := k.fetchToken(match[1], match[2])
+	if err != nil {
+		logger.Warnf("Couldn't get credentials for %s from ECR: %v", reg.RegistryStr(), err)
+		return authn.Anonymous, nil
+	}
+	k.tokens[reg.RegistryStr()] = token
+	return token.auth, nil
+}
+
+// fetchToken gets a token for the registry with registryID in region from ECR
+func (k *ECRKeychain) fetchToken(registryID, region string) (ecrToken, error) {
+	config := aws.NewConfig().WithRegion(region)
+	if k.endpoint != "" {
+		config = config.WithEndpoint(k.endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return ecrToken{}, err
+	}
+	out, err := ecr.New(sess).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(registryID)},
+	})
+	if err != nil {
+		return ecrToken{}, err
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return ecrToken{}, errors.New("ECR didn't return a token")
+	}
+	data := out.AuthorizationData[0]
+	// The token is the base64 encoded username:password
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return ecrToken{}, errors.Wrap(err, "decoding the ECR token")
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return ecrToken{}, errors.New("the ECR token isn't a username:password")
+	}
+	return ecrToken{
+		auth:    &authn.Basic{Username: parts[0], Password: parts[1]},
+		expires: aws.TimeValue(data.ExpiresAt),
+	}, nil
+}
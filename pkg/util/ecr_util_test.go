@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func setAWSCredentials(t *testing.T) func() {
+	vars := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+	}
+	old := map[string]string{}
+	for k, v := range vars {
+		old[k] = os.Getenv(k)
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k, v := range old {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// fakeECR serves GetAuthorizationToken for the registry ID 123456789012, with tokens which expire in expiresIn
+func fakeECR(t *testing.T, requests *int, expiresIn time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		testutil.CheckErrorAndDeepEqual(t, false, nil, "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken", r.Header.Get("X-Amz-Target"))
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/ecr/aws4_request") {
+			t.Errorf("request isn't signed for us-west-2: %s", r.Header.Get("Authorization"))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, `{"registryIds":["123456789012"]}`, string(body))
+		token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password%d", *requests)))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"authorizationData": [{"authorizationToken": %q, "expiresAt": %d, "proxyEndpoint": "https://123456789012.dkr.ecr.us-west-2.amazonaws.com"}]}`,
+			token, time.Now().Add(expiresIn).Unix())
+	}))
+}
+
+func TestECRKeychain(t *testing.T) {
+	defer setAWSCredentials(t)()
+	var requests int
+	server := fakeECR(t, &requests, 12*time.Hour)
+	defer server.Close()
+
+	kc := NewECRKeychain()
+	kc.endpoint = server.URL
+	reg, err := name.NewRegistry("123456789012.dkr.ecr.us-west-2.amazonaws.com", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		auth, err := kc.Resolve(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorization, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, basicAuthorization("AWS", "password1"), authorization)
+	}
+	// The token is cached until it expires
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, requests)
+
+	kc.now = func() time.Time { return time.Now().Add(12 * time.Hour) }
+	auth, err := kc.Resolve(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization, err := auth.Authorization()
+	testutil.CheckErrorAndDeepEqual(t, false, err, basicAuthorization("AWS", "password2"), authorization)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, requests)
+}
+
+func TestECRKeychain_ExpiringToken(t *testing.T) {
+	defer setAWSCredentials(t)()
+	var requests int
+	// Tokens which are about to expire aren't reused
+	server := fakeECR(t, &requests, time.Minute)
+	defer server.Close()
+
+	kc := NewECRKeychain()
+	kc.endpoint = server.URL
+	reg, err := name.NewRegistry("123456789012.dkr.ecr.us-west-2.amazonaws.com", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := kc.Resolve(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, requests)
+}
+
+func TestECRKeychain_NotECR(t *testing.T) {
+	var requests int
+	server := fakeECR(t, &requests, 12*time.Hour)
+	defer server.Close()
+
+	kc := NewECRKeychain()
+	kc.endpoint = server.URL
+	for _, registry := range []string{"gcr.io", "123456789012.dkr.ecr.us-west-2.example.com", "dkr.ecr.us-west-2.amazonaws.com", "index.docker.io"} {
+		reg, err := name.NewRegistry(registry, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := kc.Resolve(reg)
+		testutil.CheckErrorAndDeepEqual(t, false, err, authn.Anonymous, auth)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, requests)
+}
+
+func TestECRKeychain_Error(t *testing.T) {
+	defer setAWSCredentials(t)()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type": "AccessDeniedException", "message": "denied"}`)
+	}))
+	defer server.Close()
+
+	kc := NewECRKeychain()
+	kc.endpoint = server.URL
+	reg, err := name.NewRegistry("123456789012.dkr.ecr.us-west-2.amazonaws.com", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other keychains can still have credentials for the registry
+	auth, err := kc.Resolve(reg)
+	testutil.CheckErrorAndDeepEqual(t, false, err, authn.Anonymous, auth)
+}
+
+func Test_ecrRegistryPattern(t *testing.T) {
+	tests := []struct {
+		registry string
+		expected []string
+	}{
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com", []string{"123456789012", "us-west-2"}},
+		{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", []string{"123456789012", "us-gov-west-1"}},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", []string{"123456789012", "cn-north-1"}},
+		{"12345.dkr.ecr.us-west-2.amazonaws.com", nil},
+		{"123456789012.dkr.ecr.us-west-2.amazonaws.com.example.com", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.registry, func(t *testing.T) {
+			var actual []string
+			if match := ecrRegistryPattern.FindStringSubmatch(test.registry); match != nil {
+				actual = match[1:]
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats for --log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Types of the events logged for build milestones, in the event field of their log entries
+const (
+	EventStageStart        = "stage_start"
+	EventInstructionStart  = "instruction_start"
+	EventInstructionEnd    = "instruction_end"
+	EventCacheHit          = "cache_hit"
+	EventCacheMiss         = "cache_miss"
+	EventLayerPushStart    = "layer_push_start"
+	EventLayerPushComplete = "layer_push_complete"
+)
+
+// SetLogFormat sets the logrus formatter for format. With json, each log entry, including events,
+// is a line of JSON.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		setFormatter(&logrus.TextFormatter{})
+	case LogFormatJSON:
+		setFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("log format must be %s or %s, not %s", LogFormatText, LogFormatJSON, format)
+	}
+	return nil
+}
+
+// LogEvent logs an event of eventType with fields, so tools wrapping kaniko can follow the build
+// without parsing messages
+func LogEvent(eventType string, fields logrus.Fields, format string, args ...interface{}) {
+	logrus.WithFields(fields).WithField("event", eventType).Infof(format, args...)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestLogEvent_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	if err := SetLogFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	LogEvent(EventStageStart, logrus.Fields{"stage": 0, "base_image": "scratch"}, "Building stage %d", 0)
+	LogEvent(EventCacheHit, logrus.Fields{"instruction": "RUN make"}, "Using cached layer")
+
+	// Each event is a line of JSON
+	var events []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var event map[string]interface{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("%s isn't JSON: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, len(events))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, EventStageStart, events[0]["event"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "scratch", events[0]["base_image"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, float64(0), events[0]["stage"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "Building stage 0", events[0]["msg"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, EventCacheHit, events[1]["event"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "RUN make", events[1]["instruction"])
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	testutil.CheckError(t, false, SetLogFormat(LogFormatText))
+	testutil.CheckError(t, false, SetLogFormat(LogFormatJSON))
+	testutil.CheckError(t, true, SetLogFormat("yaml"))
+}
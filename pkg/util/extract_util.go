@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// How many more times unpacking a layer of a base image is tried after it fails to download, and how
+// long to wait before the first retry. The wait doubles after each attempt.
+var (
+	extractRetries      = 0
+	extractRetryBackoff = time.Second
+)
+
+// SetExtractRetries sets how many times unpacking a layer of a base image is retried, waiting backoff before the first retry
+func SetExtractRetries(retries int, backoff time.Duration) {
+	extractRetries = retries
+	extractRetryBackoff = backoff
+}
+
+// statusCodePattern matches the errors for responses from the registry without a structured error
+var statusCodePattern = regexp.MustCompile(`^unsupported status code (\d+)`)
+
+// layerReadError is an error from downloading a layer, rather than from writing its files
+type layerReadError struct {
+	err error
+}
+
+func (e *layerReadError) Error() string {
+	return e.err.Error()
+}
+
+// Cause is used by errors.Cause
+func (e *layerReadError) Cause() error {
+	return e.err
+}
+
+// layerReader remembers whether reading the layer failed, so those errors can be told apart from others
+type layerReader struct {
+	r   io.Reader
+	err error
+}
+
+func (l *layerReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if err != nil {
+		l.err = err
+	}
+	return n, err
+}
+
+// wrap returns err as a layerReadError if it's because reading the layer failed or the layer ended early
+func (l *layerReader) wrap(err error) error {
+	if l.err == nil {
+		return err
+	}
+	if l.err == io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF {
+		return err
+	}
+	return &layerReadError{err: err}
+}
+
+// isRetryableLayerError returns true if err is from a layer download which may succeed if the layer is
+// fetched again: a truncated or corrupt download, a network error, or a 429 or 5xx response. Errors
+// from the registry like failed authentication or a missing blob aren't retryable, nor is writing the files.
+func isRetryableLayerError(err error) bool {
+	readErr, ok := err.(*layerReadError)
+	if !ok {
+		return false
+	}
+	cause := errors.Cause(readErr.err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	switch cause.(type) {
+	case *remote.Error:
+		return false
+	case net.Error, flate.CorruptInputError:
+		return true
+	}
+	switch cause {
+	case io.ErrUnexpectedEOF, gzip.ErrChecksum, gzip.ErrHeader, tar.ErrHeader:
+		return true
+	}
+	if match := statusCodePattern.FindStringSubmatch(cause.Error()); match != nil {
+		code, err := strconv.Atoi(match[1])
+		return err == nil && (code == 429 || code >= 500)
+	}
+	// The digest of the layer doesn't match the one in the manifest
+	return strings.Contains(cause.Error(), "checksum")
+}
+
+// withExtractRetry runs f, and runs it again up to extractRetries more times while it fails to download a
+// layer. The wait between attempts grows exponentially, with jitter.
+func withExtractRetry(description string, f func() error) error {
+	backoff := extractRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > extractRetries || !isRetryableLayerError(err) {
+			return err
+		}
+		wait := backoff / 2
+		if backoff > 0 {
+			wait += time.Duration(rand.Int63n(int64(backoff)))
+		}
+		logger.Warnf("Retrying %s in %s after attempt %d of %d failed: %v", description, wait, attempt, extractRetries+1, err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
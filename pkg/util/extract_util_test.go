@@ -0,0 +1,273 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// truncatingTransport cuts the first download of each blob in half
+type truncatingTransport struct {
+	mu        sync.Mutex
+	truncated map[string]bool
+	blobGets  int
+}
+
+func (t *truncatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil || !strings.Contains(r.URL.Path, "/blobs/") {
+		return resp, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blobGets++
+	if t.truncated[r.URL.Path] || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	t.truncated[r.URL.Path] = true
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, resp.ContentLength/2), resp.Body}
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+// serveImage serves img as test/image:latest, responding to requests for its layers with layerStatus if it's set
+func serveImage(t *testing.T, img v1.Image, layerStatus int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if r.URL.Path == "/v2/test/image/manifests/latest" {
+			mediaType, err := img.MediaType()
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := img.RawManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Header().Set("Content-Type", string(mediaType))
+			w.Write(raw)
+			return
+		}
+		h, err := v1.NewHash(strings.TrimPrefix(r.URL.Path, "/v2/test/image/blobs/"))
+		if err != nil {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		configName, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h == configName {
+			raw, err := img.RawConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(raw)
+			return
+		}
+		if layerStatus != 0 {
+			w.WriteHeader(layerStatus)
+			return
+		}
+		l, err := img.LayerByDigest(h)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		contents, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(contents)))
+		w.Write(contents)
+	}))
+}
+
+// extractTestImage runs GetPathsFromImage, putting back the whitelist it adds the mounted directories to
+func extractTestImage(root string, img v1.Image, paths []string) error {
+	defer func(w []string) { whitelist = w }(append([]string{}, whitelist...))
+	return GetPathsFromImage(root, img, paths)
+}
+
+func remoteTestImage(t *testing.T, server *httptest.Server, tr http.RoundTripper) v1.Image {
+	ref, err := name.NewTag(strings.TrimPrefix(server.URL, "http://")+"/test/image:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(ref, remote.WithTransport(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestGetFSFromImage_Retry(t *testing.T) {
+	defer SetExtractRetries(extractRetries, extractRetryBackoff)
+	SetExtractRetries(1, 0)
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveImage(t, img, 0)
+	defer server.Close()
+	tr := &truncatingTransport{truncated: map[string]bool{}}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := extractTestImage(root, remoteTestImage(t, server, tr), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Each layer is downloaded again after the first download is truncated
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 4, tr.blobGets)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		r, err := l.Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarReader := tar.NewReader(r)
+		for {
+			hdr, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(filepath.Join(root, hdr.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, hdr.Size, fi.Size())
+		}
+		r.Close()
+	}
+}
+
+func TestGetFSFromImage_NoRetries(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveImage(t, img, 0)
+	defer server.Close()
+	tr := &truncatingTransport{truncated: map[string]bool{}}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = extractTestImage(root, remoteTestImage(t, server, tr), nil)
+	testutil.CheckError(t, true, err)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, tr.blobGets)
+}
+
+func TestGetFSFromImage_Unrecoverable(t *testing.T) {
+	defer SetExtractRetries(extractRetries, extractRetryBackoff)
+	SetExtractRetries(3, 0)
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{http.StatusNotFound, http.StatusUnauthorized} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := serveImage(t, img, status)
+			defer server.Close()
+			tr := &truncatingTransport{truncated: map[string]bool{}}
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			err = extractTestImage(root, remoteTestImage(t, server, tr), nil)
+			testutil.CheckError(t, true, err)
+			// The layer isn't downloaded again
+			testutil.CheckErrorAndDeepEqual(t, false, nil, 1, tr.blobGets)
+		})
+	}
+}
+
+func Test_isRetryableLayerError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"truncated", &layerReadError{err: io.ErrUnexpectedEOF}, true},
+		{"checksum", &layerReadError{err: errors.New(`error verifying sha256 checksum; got "a", want "b"`)}, true},
+		{"server error", &layerReadError{err: errors.New("unsupported status code 503; body: ")}, true},
+		{"too many requests", &layerReadError{err: errors.New("unsupported status code 429; body: ")}, true},
+		{"not found", &layerReadError{err: errors.New("unsupported status code 404; body: ")}, false},
+		{"denied", &layerReadError{err: &remote.Error{Errors: []remote.Diagnostic{{Code: remote.DeniedErrorCode}}}}, false},
+		{"writing files", io.ErrUnexpectedEOF, false},
+		{"wrapped", errors.Wrap(&layerReadError{err: io.ErrUnexpectedEOF}, "unpacking"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, isRetryableLayerError(test.err))
+		})
+	}
+}
+
+func Test_withExtractRetry(t *testing.T) {
+	defer SetExtractRetries(extractRetries, extractRetryBackoff)
+	SetExtractRetries(2, time.Millisecond)
+	attempts := 0
+	err := withExtractRetry("test", func() error {
+		attempts++
+		return &layerReadError{err: io.ErrUnexpectedEOF}
+	})
+	testutil.CheckError(t, true, err)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 3, attempts)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxFileFlags is the PAX record star and bsdtar store file flags in, as a comma separated list of names
+const paxFileFlags = "SCHILY.fflags"
+
+// The inode flags kaniko preserves, which chattr sets as +i and +a
+const (
+	fsImmutableFl = 0x10
+	fsAppendFl    = 0x20
+)
+
+// fileFlagNames are the names of the flags in paxFileFlags, as star and bsdtar name them
+var fileFlagNames = []struct {
+	name string
+	flag int
+}{
+	{name: "schg", flag: fsImmutableFl},
+	{name: "sappnd", flag: fsAppendFl},
+}
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, which are _IOR('f', 1, long) and _IOW('f', 2, long)
+var (
+	fsIocGetFlags = uintptr(2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1)
+	fsIocSetFlags = uintptr(1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2)
+)
+
+// restoredFlags are the paths which extracting tars set file flags on, which have to be cleared
+// before they can be deleted
+var (
+	restoredFlagsMu sync.Mutex
+	restoredFlags   []string
+)
+
+// fileFlagsIoctl runs the FS_IOC_GETFLAGS or FS_IOC_SETFLAGS ioctl on the file or directory at p
+func fileFlagsIoctl(p string, req uintptr, flags *int) error {
+	f, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(flags))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getFileFlags returns the immutable and append-only flags of the file or directory at p
+func getFileFlags(p string) (int, error) {
+	var flags int
+	if err := fileFlagsIoctl(p, fsIocGetFlags, &flags); err != nil {
+		return 0, err
+	}
+	return flags & (fsImmutableFl | fsAppendFl), nil
+}
+
+// setFileFlags sets the immutable and append-only flags of the file or directory at p to the ones in
+// flags, keeping its other flags
+func setFileFlags(p string, flags int) error {
+	var current int
+	if err := fileFlagsIoctl(p, fsIocGetFlags, &current); err != nil {
+		return err
+	}
+	current = current&^(fsImmutableFl|fsAppendFl) | flags
+	return fileFlagsIoctl(p, fsIocSetFlags, &current)
+}
+
+// addFileFlags stores the immutable and append-only flags of the file or directory at p in the PAX
+// records of hdr
+func addFileFlags(p string, hdr *tar.Header) {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+		return
+	}
+	flags, err := getFileFlags(p)
+	if err != nil {
+		// Like on filesystems without file flags, which don't support the ioctl, the file is added without them
+		logger.Debugf("Not adding the file flags of %s: %v", p, err)
+		return
+	}
+	if flags == 0 {
+		return
+	}
+	var names []string
+	for _, f := range fileFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[paxFileFlags] = strings.Join(names, ",")
+	hdr.Format = tar.FormatPAX
+}
+
+// headerFileFlags returns the immutable and append-only flags in the PAX records of hdr
+func headerFileFlags(hdr *tar.Header) int {
+	flags := 0
+	for _, name := range strings.Split(hdr.PAXRecords[paxFileFlags], ",") {
+		for _, f := range fileFlagNames {
+			if strings.TrimSpace(name) == f.name {
+				flags |= f.flag
+			}
+		}
+	}
+	return flags
+}
+
+// fileFlagsRestorer sets the file flags of the files extracted from a tar. They're only set once all
+// of it is extracted, since nothing can be created in an immutable directory.
+type fileFlagsRestorer struct {
+	paths []string
+	flags []int
+}
+
+// add records the flags of the file extracted to path from hdr
+func (r *fileFlagsRestorer) add(path string, hdr *tar.Header) {
+	if !isRegularTarEntry(hdr) && hdr.Typeflag != tar.TypeDir {
+		return
+	}
+	if flags := headerFileFlags(hdr); flags != 0 {
+		r.paths = append(r.paths, path)
+		r.flags = append(r.flags, flags)
+	}
+}
+
+// restore sets the recorded flags. Files whose flags can't be set, such as on a filesystem without
+// them or without CAP_LINUX_IMMUTABLE, are extracted without them.
+func (r *fileFlagsRestorer) restore() {
+	for i, path := range r.paths {
+		if err := setFileFlags(path, r.flags[i]); err != nil {
+			logger.Warnf("Unable to set the immutable and append-only flags of %s: %v", path, err)
+			continue
+		}
+		restoredFlagsMu.Lock()
+		restoredFlags = append(restoredFlags, path)
+		restoredFlagsMu.Unlock()
+	}
+	r.paths, r.flags = nil, nil
+}
+
+// clearRestoredFileFlags clears the flags which extracting tars set, so the files can be deleted
+func clearRestoredFileFlags() {
+	restoredFlagsMu.Lock()
+	defer restoredFlagsMu.Unlock()
+	for _, path := range restoredFlags {
+		if err := setFileFlags(path, 0); err != nil && !os.IsNotExist(err) {
+			logger.Debugf("Unable to clear the file flags of %s: %v", path, err)
+		}
+	}
+	restoredFlags = nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_FileFlags_RoundTrip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting the immutable flag requires root")
+	}
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	defer clearRestoredFileFlags()
+	path := filepath.Join(testDir, "immutable")
+	if err := ioutil.WriteFile(path, []byte("immutable"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFileFlags(path, fsImmutableFl); err != nil {
+		t.Skipf("unable to set the immutable flag: %v", err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	err = AddToTar(path, fi, map[FileID]string{}, w, TarOptions{Root: testDir})
+	// The file has to be mutable again for the test directory to be removed
+	if err := setFileFlags(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	contents := buf.Bytes()
+
+	hdr, err := tar.NewReader(bytes.NewReader(contents)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "schg", hdr.PAXRecords[paxFileFlags])
+
+	dest := filepath.Join(testDir, "dest")
+	if err := unTar(bytes.NewReader(contents), dest, CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := getFileFlags(filepath.Join(dest, "immutable"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, fsImmutableFl, flags)
+	if err := ioutil.WriteFile(filepath.Join(dest, "immutable"), []byte("changed"), 0644); err == nil {
+		t.Error("the extracted file should be immutable")
+	}
+
+	// Clearing the flags which were restored lets the file be deleted
+	clearRestoredFileFlags()
+	testutil.CheckError(t, false, os.Remove(filepath.Join(dest, "immutable")))
+}
+
+func Test_headerFileFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  map[string]string
+		expected int
+	}{
+		{name: "no flags"},
+		{name: "immutable", records: map[string]string{paxFileFlags: "schg"}, expected: fsImmutableFl},
+		{name: "append-only", records: map[string]string{paxFileFlags: "sappnd"}, expected: fsAppendFl},
+		{name: "both", records: map[string]string{paxFileFlags: "schg,sappnd"}, expected: fsImmutableFl | fsAppendFl},
+		{name: "unknown flags are ignored", records: map[string]string{paxFileFlags: "nodump,schg"}, expected: fsImmutableFl},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, headerFileFlags(&tar.Header{PAXRecords: test.records}))
+		})
+	}
+}
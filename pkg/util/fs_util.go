@@ -19,18 +19,29 @@ package util
 import (
 	"archive/tar"
 	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/google/go-containerregistry/pkg/v1"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 var whitelist = []string{
@@ -42,12 +53,217 @@ var whitelist = []string{
 }
 var volumeWhitelist = []string{}
 
+// whitelistedVolumes are the volumes MoveVolumeWhitelistToWhitelist added to the whitelist, which only
+// apply to the stage which declared them
+var whitelistedVolumes = []string{}
+
+// excluded has the patterns in the .dockerignore of each context, which match the files it excludes, or nil
+// for a context without one
+var excluded map[string]*fileutils.PatternMatcher
+
 func GetFSFromImage(root string, img v1.Image) error {
+	return getFSFromImage(root, img, nil)
+}
+
+// maxPathSelectionRounds is how many times the paths to extract can grow to include the targets of the symlinks
+// in them before the whole filesystem is extracted instead, like the limit on symlinks in a path
+const maxPathSelectionRounds = 40
+
+// GetPathsFromImage extracts the files at paths in img to root, with the directories they're in, and the
+// contents of the ones which are directories, instead of the whole filesystem. Paths can have wildcards,
+// in which case everything in the directory before the first wildcard is extracted. The targets of symlinks
+// in the paths are extracted too, so the paths lead to the same files they would if the whole filesystem
+// was extracted. If paths is empty or selects everything, the whole filesystem is extracted.
+func GetPathsFromImage(root string, img v1.Image, paths []string) error {
+	selection := newPathSelection(paths)
+	if selection == nil {
+		return GetFSFromImage(root, img)
+	}
+	for round := 0; round < maxPathSelectionRounds; round++ {
+		// Files which are already there can't be extracted over
+		if round > 0 {
+			if err := removeContents(root); err != nil {
+				return err
+			}
+		}
+		logger.Infof("Extracting %v", selection.paths)
+		if err := getFSFromImage(root, img, selection); err != nil {
+			return err
+		}
+		added := false
+		for _, p := range symlinkTargets(root, selection.paths) {
+			added = selection.add(p) || added
+		}
+		if !added {
+			return nil
+		}
+	}
+	logger.Warnf("Extracting the whole filesystem because the links in %v lead to too many other paths", paths)
+	if err := removeContents(root); err != nil {
+		return err
+	}
+	return GetFSFromImage(root, img)
+}
+
+// removeContents removes everything in dir, but not dir itself
+func removeContents(dir string) error {
+	clearRestoredFileFlags()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathSelection is the paths of an image to extract
+type pathSelection struct {
+	paths []string
+}
+
+// newPathSelection returns the selection of paths, or nil if they select the whole filesystem
+func newPathSelection(paths []string) *pathSelection {
+	if len(paths) == 0 {
+		return nil
+	}
+	s := &pathSelection{}
+	for _, p := range paths {
+		var parts []string
+		for _, part := range strings.Split(filepath.Clean("/"+p), "/")[1:] {
+			if strings.ContainsAny(part, `*?[\`) {
+				break
+			}
+			parts = append(parts, part)
+		}
+		prefix := "/" + strings.Join(parts, "/")
+		if prefix == "/" {
+			return nil
+		}
+		s.add(prefix)
+	}
+	return s
+}
+
+// add adds p to the selection, and returns false if it was already selected
+func (s *pathSelection) add(p string) bool {
+	for _, selected := range s.paths {
+		if HasFilepathPrefix(p, selected) {
+			return false
+		}
+	}
+	s.paths = append(s.paths, p)
+	return true
+}
+
+// matches returns true if path is one of the selected paths, inside of one, or one of the directories they're in
+func (s *pathSelection) matches(path string) bool {
+	if path == "/" {
+		return true
+	}
+	for _, selected := range s.paths {
+		if HasFilepathPrefix(path, selected) || HasFilepathPrefix(selected, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkTargets returns the paths which the symlinks extracted to root on the way to paths lead to instead,
+// like /usr/bin/sh for /bin/sh if /bin is a symlink to usr/bin
+func symlinkTargets(root string, paths []string) []string {
+	var targets []string
+	for _, p := range paths {
+		parts := strings.Split(p, "/")[1:]
+		current := "/"
+		for i, part := range parts {
+			current = filepath.Join(current, part)
+			fi, err := os.Lstat(filepath.Join(root, current))
+			if err != nil {
+				break
+			}
+			if fi.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			target, err := os.Readlink(filepath.Join(root, current))
+			if err != nil {
+				break
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(current), target)
+			}
+			targets = append(targets, filepath.Join(append([]string{filepath.Clean(target)}, parts[i+1:]...)...))
+			break
+		}
+	}
+	return targets
+}
+
+// ReuseFSFromImage checks that the filesystem at root was extracted from img, by the digest of the image
+// which digestFile records, so that it can be built on instead of extracting img again. If force is set,
+// a missing or different digest is only warned about.
+func ReuseFSFromImage(root, digestFile string, img v1.Image, force bool) error {
 	whitelist, err := fileSystemWhitelist(constants.WhitelistPath)
 	if err != nil {
 		return err
 	}
-	logrus.Infof("Mounted directories: %v", whitelist)
+	logger.Infof("Mounted directories: %v", whitelist)
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	recorded, err := ioutil.ReadFile(digestFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var mismatch error
+	if os.IsNotExist(err) {
+		mismatch = errors.Errorf("%s has no base image digest in %s to show it was extracted from %s", root, digestFile, digest)
+	} else if strings.TrimSpace(string(recorded)) != digest.String() {
+		mismatch = errors.Errorf("%s was extracted from base image %s, not %s", root, strings.TrimSpace(string(recorded)), digest)
+	}
+	if mismatch != nil {
+		if !force {
+			return mismatch
+		}
+		logger.Warnf("Building on %s anyway, since --skip-unpack-force is set: %v", root, mismatch)
+	}
+	logger.Infof("Skipping unpacking base image %s, which is already extracted to %s", digest, root)
+	return nil
+}
+
+// RecordFSDigest records the digest of img in digestFile, after its filesystem is extracted, for
+// ReuseFSFromImage to check
+func RecordFSDigest(digestFile string, img v1.Image) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(digestFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(digestFile, []byte(digest.String()+"\n"), 0644)
+}
+
+// InvalidateFSDigest removes the digest RecordFSDigest recorded in digestFile, before the filesystem is
+// changed, so that ReuseFSFromImage doesn't take it for the one extracted from the image
+func InvalidateFSDigest(digestFile string) error {
+	if err := os.Remove(digestFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getFSFromImage extracts the files in img to root, or only the ones selection matches if it's set
+func getFSFromImage(root string, img v1.Image, selection *pathSelection) error {
+	whitelist, err := fileSystemWhitelist(constants.WhitelistPath)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Mounted directories: %v", whitelist)
 	layers, err := img.Layers()
 	if err != nil {
 		return err
@@ -55,79 +271,208 @@ func GetFSFromImage(root string, img v1.Image) error {
 
 	fs := map[string]struct{}{}
 	whiteouts := map[string]struct{}{}
+	opaqueDirs := map[string]struct{}{}
 
 	for i := len(layers) - 1; i >= 0; i-- {
-		logrus.Infof("Unpacking layer: %d", i)
-		l := layers[i]
-		r, err := l.Uncompressed()
+		var extracted *extractedLayer
+		err := withExtractRetry(fmt.Sprintf("unpacking layer %d", i), func() error {
+			logger.Infof("Unpacking layer: %d", i)
+			var err error
+			extracted, err = extractLayer(root, layers[i], fs, whiteouts, opaqueDirs, selection)
+			return err
+		})
 		if err != nil {
 			return err
 		}
-		tr := tar.NewReader(r)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
+		for path := range extracted.files {
+			fs[path] = struct{}{}
+		}
+		for path := range extracted.whiteouts {
+			whiteouts[path] = struct{}{}
+		}
+		// Opaque directories only hide the contents of lower layers
+		for dir := range extracted.opaqueDirs {
+			opaqueDirs[dir] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// extractedLayer is what extracting a layer added to the files, whiteouts and opaque directories of the layers above it
+type extractedLayer struct {
+	files      map[string]struct{}
+	whiteouts  map[string]struct{}
+	opaqueDirs map[string]struct{}
+}
+
+// extractLayer extracts the files in l to root which aren't hidden by the files, whiteouts and opaque
+// directories of the layers above it, and which selection matches if it's set. They're only read, so if
+// extracting fails it can be tried again.
+func extractLayer(root string, l v1.Layer, fs, whiteouts, opaqueDirs map[string]struct{}, selection *pathSelection) (*extractedLayer, error) {
+	extracted := &extractedLayer{
+		files:      map[string]struct{}{},
+		whiteouts:  map[string]struct{}{},
+		opaqueDirs: map[string]struct{}{},
+	}
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, &layerReadError{err: err}
+	}
+	defer rc.Close()
+	r := &layerReader{r: rc}
+	tr := tar.NewReader(r)
+	var flags fileFlagsRestorer
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		path := filepath.Join(root, filepath.Clean(hdr.Name))
+		base := filepath.Base(path)
+		dir := filepath.Dir(path)
+		if base == opaqueWhiteout {
+			logger.Infof("Whiting out contents of %s", dir)
+			extracted.opaqueDirs[dir] = struct{}{}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			logger.Infof("Whiting out %s", path)
+			name := strings.TrimPrefix(base, ".wh.")
+			extracted.whiteouts[filepath.Join(dir, name)] = struct{}{}
+			continue
+		}
+
+		// Whiteouts only hide the files of lower layers, so a path can be whited out and added again
+		// in the same layer, e.g. when a file is replaced by a directory
+		if checkWhiteouts(path, whiteouts) {
+			logger.Infof("Not adding %s because it is whited out", path)
+			continue
+		}
+		if checkOpaqueDirs(path, opaqueDirs) {
+			logger.Infof("Not adding %s because its directory is opaque in a later layer", path)
+			continue
+		}
+		if selection != nil && !selection.matches(filepath.Clean("/"+hdr.Name)) {
+			continue
+		}
+		if _, ok := fs[path]; ok {
+			logger.Infof("Not adding %s because it was added by a prior layer", path)
+			continue
+		}
+		if _, ok := extracted.files[path]; ok {
+			logger.Infof("Not adding %s because it was added by a prior layer", path)
+			continue
+		}
+		whitelisted, err := CheckWhitelist(path)
+		if err != nil {
+			return nil, err
+		}
+		if whitelisted && !checkWhitelistRoot(root) {
+			logger.Infof("Not adding %s because it is whitelisted", path)
+			continue
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			whitelisted, err := CheckWhitelist(hdr.Linkname)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			path := filepath.Join(root, filepath.Clean(hdr.Name))
-			base := filepath.Base(path)
-			dir := filepath.Dir(path)
-			if strings.HasPrefix(base, ".wh.") {
-				logrus.Infof("Whiting out %s", path)
-				name := strings.TrimPrefix(base, ".wh.")
-				whiteouts[filepath.Join(dir, name)] = struct{}{}
+			if whitelisted {
+				logger.Debugf("skipping symlink from %s to %s because %s is whitelisted", hdr.Linkname, path, hdr.Linkname)
 				continue
 			}
+		}
+		extracted.files[path] = struct{}{}
 
-			if checkWhiteouts(path, whiteouts) {
-				logrus.Infof("Not adding %s because it is whited out", path)
-				continue
-			}
-			if _, ok := fs[path]; ok {
-				logrus.Infof("Not adding %s because it was added by a prior layer", path)
-				continue
-			}
-			whitelisted, err := CheckWhitelist(path)
-			if err != nil {
+		if err := extractFile(root, hdr, tr); err != nil {
+			return nil, r.wrap(err)
+		}
+		flags.add(path, hdr)
+	}
+	flags.restore()
+	return extracted, nil
+}
+
+// ApplyLayer extracts layer onto the filesystem at root, on top of the files already there.
+// Whiteouts in the layer delete the files they hide, so afterwards root is as it would be
+// after running the command which created the layer.
+func ApplyLayer(root string, layer v1.Layer) error {
+	r, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	var flags fileFlagsRestorer
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTarEntryInDest(root, hdr); err != nil {
+			return err
+		}
+		path := filepath.Join(root, filepath.Clean(hdr.Name))
+		base := filepath.Base(path)
+		dir := filepath.Dir(path)
+		if base == opaqueWhiteout {
+			logger.Debugf("Deleting contents of %s", dir)
+			children, err := ioutil.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
-			if whitelisted && !checkWhitelistRoot(root) {
-				logrus.Infof("Not adding %s because it is whitelisted", path)
-				continue
-			}
-			if hdr.Typeflag == tar.TypeSymlink {
-				whitelisted, err := CheckWhitelist(hdr.Linkname)
-				if err != nil {
+			for _, child := range children {
+				if err := os.RemoveAll(filepath.Join(dir, child.Name())); err != nil {
 					return err
 				}
-				if whitelisted {
-					logrus.Debugf("skipping symlink from %s to %s because %s is whitelisted", hdr.Linkname, path, hdr.Linkname)
-					continue
-				}
 			}
-			fs[path] = struct{}{}
-
-			if err := extractFile(root, hdr, tr); err != nil {
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			name := filepath.Join(dir, strings.TrimPrefix(base, ".wh."))
+			logger.Debugf("Deleting %s", name)
+			if err := os.RemoveAll(name); err != nil {
 				return err
 			}
+			continue
+		}
+		// Replace whatever is at path, unless a directory is being updated
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		if err := extractFile(root, hdr, tr); err != nil {
+			return err
 		}
+		flags.add(path, hdr)
 	}
+	flags.restore()
 	return nil
 }
 
-// DeleteFilesystem deletes the extracted image file system
+// DeleteFilesystem deletes the extracted image file system. The volumes of the stage are deleted too,
+// since the next stage doesn't have them.
 func DeleteFilesystem() error {
-	logrus.Info("Deleting filesystem...")
+	logger.Info("Deleting filesystem...")
+	resetVolumeWhitelist()
+	clearRestoredFileFlags()
+	// The filesystem of the base image is about to be gone, so it can't be reused
+	if err := InvalidateFSDigest(constants.BaseImageDigestFile); err != nil {
+		return err
+	}
 	err := filepath.Walk(constants.RootDir, func(path string, info os.FileInfo, err error) error {
 		whitelisted, err := CheckWhitelist(path)
 		if err != nil {
 			return err
 		}
 		if whitelisted || ChildDirInWhitelist(path, constants.RootDir) {
-			logrus.Debugf("Not deleting %s, as it's whitelisted", path)
+			logger.Debugf("Not deleting %s, as it's whitelisted", path)
 			return nil
 		}
 		if path == constants.RootDir {
@@ -155,8 +500,11 @@ func ChildDirInWhitelist(path, directory string) bool {
 	return false
 }
 
-func unTar(r io.Reader, dest string) error {
+// unTar extracts the tar archive in r to dest. The files and directories in it are given the mode in
+// opts.Chmod, and everything in it the ownership in opts.Chown, instead of what's stored in the archive.
+func unTar(r io.Reader, dest string, opts CopyOptions) error {
 	tr := tar.NewReader(r)
+	var flags fileFlagsRestorer
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -165,13 +513,182 @@ func unTar(r io.Reader, dest string) error {
 		if err != nil {
 			return err
 		}
+		if err := checkTarEntryInDest(dest, hdr); err != nil {
+			return err
+		}
+		if opts.Chmod != nil && (isRegularTarEntry(hdr) || hdr.Typeflag == tar.TypeDir) {
+			hdr.Mode = tarMode(*opts.Chmod)
+		}
+		if opts.Chown != nil {
+			hdr.Uid, hdr.Gid = opts.Chown.UID, opts.Chown.GID
+		}
 		if err := extractFile(dest, hdr, tr); err != nil {
 			return err
 		}
+		path := filepath.Join(dest, filepath.Clean(hdr.Name))
+		flags.add(path, hdr)
+		// Links are extracted as symlinks, which extractFile leaves owned by root
+		if opts.Chown != nil && (hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink) {
+			if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+	}
+	flags.restore()
+	return nil
+}
+
+// tarMode returns mode as the mode of a tar header
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// checkTarEntryInDest returns an error if extracting hdr would create a file, or a link pointing to a file,
+// outside of dest, which can happen with malicious archives containing entries like ../../etc/passwd.
+// Paths are resolved through the links already extracted to dest, the way the filesystem resolves them,
+// so links to links, like b/c -> .. and x -> b/c/../.., can't lead out of it either.
+func checkTarEntryInDest(dest string, hdr *tar.Header) error {
+	path := filepath.Join(dest, filepath.Clean(hdr.Name))
+	if !isPathInDir(path, dest) {
+		return errors.Errorf("tar entry %s would be extracted outside of %s", hdr.Name, dest)
+	}
+	// Nothing is outside of the root
+	if filepath.Clean(dest) == constants.RootDir {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		root = filepath.Clean(dest)
+	}
+	rel, err := filepath.Rel(filepath.Clean(dest), path)
+	if err != nil {
+		return err
+	}
+	// Links are created in place of path, but files and directories are written through a link already there
+	isLink := hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink
+	var resolved string
+	if isLink {
+		dir, err := resolveLinks(root, filepath.Dir(rel))
+		if err != nil {
+			return err
+		}
+		resolved = filepath.Join(dir, filepath.Base(rel))
+	} else if resolved, err = resolveLinks(root, rel); err != nil {
+		return err
+	}
+	if !isPathInDir(resolved, root) {
+		return errors.Errorf("tar entry %s would be extracted outside of %s, through a link in it", hdr.Name, dest)
+	}
+	if !isLink {
+		return nil
+	}
+	target := hdr.Linkname
+	if hdr.Typeflag == tar.TypeLink {
+		if !isPathInDir(filepath.Join(dest, filepath.Clean(hdr.Linkname)), dest) {
+			return errors.Errorf("tar entry %s links to %s, which is outside of %s", hdr.Name, hdr.Linkname, dest)
+		}
+		if target, err = hardlinkTarget(root, filepath.Dir(resolved), hdr.Linkname); err != nil {
+			return err
+		}
+	}
+	linkPath, err := resolveLinks(filepath.Dir(resolved), target)
+	if err != nil {
+		return err
+	}
+	if !isPathInDir(linkPath, root) {
+		return errors.Errorf("tar entry %s links to %s, which is outside of %s", hdr.Name, hdr.Linkname, dest)
 	}
 	return nil
 }
 
+// maxLinks is how many links resolveLinks follows before giving up, like the limit on symlinks in a path
+const maxLinks = 255
+
+// resolveLinks returns the path p leads to from dir, which has no links in it, following the links on disk
+// the way the filesystem does. Unlike filepath.EvalSymlinks, p doesn't have to exist, and .. is only resolved
+// once the links before it are, so b/c/.. is the parent of what b/c links to.
+func resolveLinks(dir, p string) (string, error) {
+	resolved := dir
+	if filepath.IsAbs(p) {
+		resolved = constants.RootDir
+	}
+	remaining := strings.Split(p, string(filepath.Separator))
+	links := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Files which don't exist yet will be created where they're named
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxLinks {
+			return "", errors.Errorf("too many links in %s", p)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = constants.RootDir
+		}
+		remaining = append(strings.Split(target, string(filepath.Separator)), remaining...)
+	}
+	return resolved, nil
+}
+
+// hardlinkTarget returns the target of the symlink a hardlink to linkname in root is extracted as, when it's
+// in dir. It's relative to dir, so it's the file in root, not the one on the host with the same name. Both
+// root and dir must be free of links.
+func hardlinkTarget(root, dir, linkname string) (string, error) {
+	return filepath.Rel(dir, filepath.Join(root, filepath.Clean(filepath.Join("/", linkname))))
+}
+
+// isPathInDir returns true if path is dir or is contained within it
+func isPathInDir(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// isRegularTarEntry returns true if hdr is a regular file. Besides TypeReg, which the tar reader also returns for
+// the files of old archives, files can be contiguous files, which are extracted like regular files, or old GNU
+// sparse files, whose holes the tar reader fills in.
+func isRegularTarEntry(hdr *tar.Header) bool {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeCont, tar.TypeGNUSparse:
+		return true
+	}
+	return false
+}
+
+// extractFile extracts the file in hdr to dest. Its name is the full name, even if it's longer than the 100 bytes
+// of a tar header, since the tar reader reads the GNU long names and PAX records which hold long names and links.
 func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 	path := filepath.Join(dest, filepath.Clean(hdr.Name))
 	base := filepath.Base(path)
@@ -179,12 +696,12 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 	mode := hdr.FileInfo().Mode()
 	uid := hdr.Uid
 	gid := hdr.Gid
-	switch hdr.Typeflag {
-	case tar.TypeReg:
-		logrus.Debugf("creating file %s", path)
+	switch {
+	case isRegularTarEntry(hdr):
+		logger.Debugf("creating file %s", path)
 		// It's possible a file is in the tar before it's directory.
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			logrus.Debugf("base %s for file %s does not exist. Creating.", base, path)
+			logger.Debugf("base %s for file %s does not exist. Creating.", base, path)
 			if err := os.MkdirAll(dir, 0755); err != nil {
 				return err
 			}
@@ -205,8 +722,8 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 		}
 		currFile.Close()
 
-	case tar.TypeDir:
-		logrus.Debugf("creating dir %s", path)
+	case hdr.Typeflag == tar.TypeDir:
+		logger.Debugf("creating dir %s", path)
 		if err := os.MkdirAll(path, mode); err != nil {
 			return err
 		}
@@ -218,19 +735,32 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 			return err
 		}
 
-	case tar.TypeLink:
-		logrus.Debugf("link from %s to %s", hdr.Linkname, path)
+	case hdr.Typeflag == tar.TypeLink:
+		logger.Debugf("link from %s to %s", hdr.Linkname, path)
 		// The base directory for a link may not exist before it is created.
 		dir := filepath.Dir(path)
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return err
 		}
-		if err := os.Symlink(filepath.Clean(filepath.Join("/", hdr.Linkname)), path); err != nil {
+		// The target is found from where the link really is, which is the same place checkTarEntryInDest checks
+		root, err := filepath.EvalSymlinks(dest)
+		if err != nil {
+			return err
+		}
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		target, err := hardlinkTarget(root, realDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
 			return err
 		}
 
-	case tar.TypeSymlink:
-		logrus.Debugf("symlink from %s to %s", hdr.Linkname, path)
+	case hdr.Typeflag == tar.TypeSymlink:
+		logger.Debugf("symlink from %s to %s", hdr.Linkname, path)
 		// The base directory for a symlink may not exist before it is created.
 		dir := filepath.Dir(path)
 		if err := os.MkdirAll(dir, 0755); err != nil {
@@ -240,6 +770,11 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
 			return err
 		}
 
+	case hdr.Typeflag == tar.TypeXGlobalHeader:
+		// The PAX records for every entry after it, like the commit git archive writes, which aren't a file
+
+	default:
+		logger.Warnf("Not extracting %s, since tar entries of type %q aren't supported", path, hdr.Typeflag)
 	}
 	return nil
 }
@@ -251,7 +786,18 @@ func checkWhiteouts(path string, whiteouts map[string]struct{}) bool {
 	}
 	for wd := range whiteouts {
 		if HasFilepathPrefix(path, wd) {
-			logrus.Infof("Not adding %s because it's directory is whited out", path)
+			logger.Infof("Not adding %s because it's directory is whited out", path)
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpaqueDirs returns true if path is inside one of opaqueDirs. The opaque directories
+// themselves are kept.
+func checkOpaqueDirs(path string, opaqueDirs map[string]struct{}) bool {
+	for dir := range opaqueDirs {
+		if path != dir && HasFilepathPrefix(path, dir) {
 			return true
 		}
 	}
@@ -261,7 +807,7 @@ func checkWhiteouts(path string, whiteouts map[string]struct{}) bool {
 func CheckWhitelist(path string) (bool, error) {
 	abs, err := filepath.Abs(path)
 	if err != nil {
-		logrus.Infof("unable to get absolute path for %s", path)
+		logger.Infof("unable to get absolute path for %s", path)
 		return false, err
 	}
 	for _, wl := range whitelist {
@@ -299,35 +845,128 @@ func fileSystemWhitelist(path string) ([]string, error) {
 	reader := bufio.NewReader(f)
 	for {
 		line, err := reader.ReadString('\n')
-		logrus.Debugf("Read the following line from %s: %s", path, line)
+		logger.Debugf("Read the following line from %s: %s", path, line)
 		if err != nil && err != io.EOF {
 			return nil, err
 		}
 		lineArr := strings.Split(line, " ")
 		if len(lineArr) < 5 {
 			if err == io.EOF {
-				logrus.Debugf("Reached end of file %s", path)
+				logger.Debugf("Reached end of file %s", path)
 				break
 			}
 			continue
 		}
 		if lineArr[4] != constants.RootDir {
-			logrus.Debugf("Appending %s from line: %s", lineArr[4], line)
+			logger.Debugf("Appending %s from line: %s", lineArr[4], line)
 			whitelist = append(whitelist, lineArr[4])
 		}
 		if err == io.EOF {
-			logrus.Debugf("Reached end of file %s", path)
+			logger.Debugf("Reached end of file %s", path)
 			break
 		}
 	}
 	return whitelist, nil
 }
 
+// GetExcludedFiles reads the patterns in the .dockerignore of buildcontext, if it has one, so that
+// ExcludeFile excludes the files they match
+func GetExcludedFiles(buildcontext string) error {
+	excluded = map[string]*fileutils.PatternMatcher{}
+	return AddExcludedFiles(buildcontext)
+}
+
+// AddExcludedFiles reads the patterns in the .dockerignore of another context, like a --build-context
+// directory, after GetExcludedFiles. Its files are only matched against its own patterns, even if it's
+// in the build context.
+func AddExcludedFiles(context string) error {
+	context = filepath.Clean(context)
+	excluded[context] = nil
+	f, err := os.Open(filepath.Join(context, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	patterns, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Excluding files matching %v from %s", patterns, context)
+	matcher, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return errors.Wrap(err, "parsing .dockerignore")
+	}
+	excluded[context] = matcher
+	return nil
+}
+
+// ExcludeFile returns true if the .dockerignore of the context path is in excludes it. If one context is in
+// another, the files in it are only matched against its own .dockerignore. Like docker, the patterns are
+// matched in order, so a later !pattern includes files again, and a later pattern can exclude them again.
+func ExcludeFile(path string) bool {
+	var matcher *fileutils.PatternMatcher
+	context, rel := "", ""
+	for c, m := range excluded {
+		r, err := filepath.Rel(c, path)
+		if err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// The context nearest to path is the one it's in
+		if len(c) > len(context) {
+			matcher, context, rel = m, c, r
+		}
+	}
+	if matcher == nil {
+		return false
+	}
+	match, err := matcher.Matches(rel)
+	if err != nil {
+		logger.Warnf("Error matching %s against .dockerignore: %v", rel, err)
+		return false
+	}
+	return match
+}
+
+// ContextPath returns the path of the source src in the build context root. Like docker, symlinks in the
+// directories of src are followed as if root were the root of the filesystem, so they can't lead out of the
+// context, while src itself isn't followed, so a symlink is copied as a symlink.
+func ContextPath(root, src string) (string, error) {
+	p := filepath.Join(root, src)
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	// The context itself has no directories in it to follow
+	if !HasFilepathPrefix(absDir, absRoot) {
+		return p, nil
+	}
+	dir, err := symlink.FollowSymlinkInScope(absDir, absRoot)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving %s in the build context", src)
+	}
+	if dir == absDir {
+		return p, nil
+	}
+	rel, err := filepath.Rel(absRoot, dir)
+	if err != nil {
+		return "", err
+	}
+	logger.Debugf("Resolved %s to %s in the build context", src, filepath.Join(rel, filepath.Base(p)))
+	return filepath.Join(root, rel, filepath.Base(p)), nil
+}
+
 // RelativeFiles returns a list of all files at the filepath relative to root
 func RelativeFiles(fp string, root string) ([]string, error) {
 	var files []string
 	fullPath := filepath.Join(root, fp)
-	logrus.Debugf("Getting files and contents at root %s", fullPath)
+	logger.Debugf("Getting files and contents at root %s", fullPath)
 	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
 		whitelisted, err := CheckWhitelist(path)
 		if err != nil {
@@ -352,7 +991,7 @@ func RelativeFiles(fp string, root string) ([]string, error) {
 // Files returns a list of all files rooted at root
 func Files(root string) ([]string, error) {
 	var files []string
-	logrus.Debugf("Getting files and contents at root %s", root)
+	logger.Debugf("Getting files and contents at root %s", root)
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		whitelisted, err := CheckWhitelist(path)
 		if err != nil {
@@ -395,7 +1034,7 @@ func CreateFile(path string, reader io.Reader, perm os.FileMode, uid uint32, gid
 	// Create directory path if it doesn't exist
 	baseDir := filepath.Dir(path)
 	if _, err := os.Lstat(baseDir); os.IsNotExist(err) {
-		logrus.Debugf("baseDir %s for file %s does not exist. Creating.", baseDir, path)
+		logger.Debugf("baseDir %s for file %s does not exist. Creating.", baseDir, path)
 		if err := os.MkdirAll(baseDir, 0755); err != nil {
 			return err
 		}
@@ -408,46 +1047,110 @@ func CreateFile(path string, reader io.Reader, perm os.FileMode, uid uint32, gid
 	if _, err := io.Copy(dest, reader); err != nil {
 		return err
 	}
-	if err := dest.Chmod(perm); err != nil {
+	// Changing ownership clears the setuid and setgid bits, so set the mode afterwards
+	if err := dest.Chown(int(uid), int(gid)); err != nil {
 		return err
 	}
-	return dest.Chown(int(uid), int(gid))
+	return dest.Chmod(perm)
 }
 
 // AddPathToVolumeWhitelist adds the given path to the volume whitelist
 // It will get snapshotted when the VOLUME command is run then ignored
 // for subsequent commands.
 func AddPathToVolumeWhitelist(path string) error {
-	logrus.Infof("adding %s to volume whitelist", path)
+	logger.Infof("adding %s to volume whitelist", path)
 	volumeWhitelist = append(volumeWhitelist, path)
 	return nil
 }
 
+// AddToWhitelist adds path to the whitelist, so that it isn't snapshotted or deleted between stages
+func AddToWhitelist(path string) {
+	logger.Debugf("adding %s to whitelist", path)
+	whitelist = append(whitelist, filepath.Clean(path))
+}
+
+// SaveWhitelist returns a function which restores the whitelist to the paths in it now, such as after a
+// build or a test has added paths of its own
+func SaveWhitelist() func() {
+	saved := append([]string{}, whitelist...)
+	return func() {
+		whitelist = saved
+	}
+}
+
 // MoveVolumeWhitelistToWhitelist copies over all directories that were volume mounted
 // in this step to be whitelisted for all subsequent docker commands.
 func MoveVolumeWhitelistToWhitelist() error {
-	if len(volumeWhitelist) > 0 {
-		whitelist = append(whitelist, volumeWhitelist...)
-		volumeWhitelist = []string{}
+	for _, volume := range volumeWhitelist {
+		whitelisted, err := CheckWhitelist(volume)
+		if err != nil {
+			return err
+		}
+		if whitelisted {
+			continue
+		}
+		whitelist = append(whitelist, volume)
+		whitelistedVolumes = append(whitelistedVolumes, volume)
 	}
+	volumeWhitelist = []string{}
 	return nil
 }
 
+// resetVolumeWhitelist removes the volumes of the stage from the whitelist, including the ones which
+// haven't been moved to it yet
+func resetVolumeWhitelist() {
+	volumeWhitelist = []string{}
+	if len(whitelistedVolumes) == 0 {
+		return
+	}
+	volumes := map[string]bool{}
+	for _, volume := range whitelistedVolumes {
+		volumes[volume] = true
+	}
+	var kept []string
+	for _, wl := range whitelist {
+		if !volumes[wl] {
+			kept = append(kept, wl)
+		}
+	}
+	whitelist = kept
+	whitelistedVolumes = []string{}
+}
+
 // DownloadFileToDest downloads the file at rawurl to the given dest for the ADD command
 // From add command docs:
 // 	1. If <src> is a remote file URL:
-// 		- destination will have permissions of 0600
+// 		- destination will have permissions of 0600, unless opts.Chmod is set
+// 		- destination is owned by root, unless opts.Chown is set
 // 		- If remote file has HTTP Last-Modified header, we set the mtime of the file to that timestamp
-func DownloadFileToDest(rawurl, dest string) error {
+func DownloadFileToDest(rawurl, dest string, checksum *Checksum, opts CopyOptions) error {
 	resp, err := http.Get(rawurl)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	// TODO: set uid and gid according to current user
-	if err := CreateFile(dest, resp.Body, 0600, 0, 0); err != nil {
+	var body io.Reader = resp.Body
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.newHash()
+		body = io.TeeReader(resp.Body, h)
+	}
+	mode, uid, gid := os.FileMode(0600), uint32(0), uint32(0)
+	if opts.Chmod != nil {
+		mode = *opts.Chmod
+	}
+	if opts.Chown != nil {
+		uid, gid = uint32(opts.Chown.UID), uint32(opts.Chown.GID)
+	}
+	if err := CreateFile(dest, body, mode, uid, gid); err != nil {
 		return err
 	}
+	if checksum != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != checksum.Hex {
+			os.Remove(dest)
+			return errors.Errorf("checksum mismatch for %s: expected %s:%s, got %s:%s", rawurl, checksum.Algorithm, checksum.Hex, checksum.Algorithm, actual)
+		}
+	}
 	mTime := time.Time{}
 	lastMod := resp.Header.Get("Last-Modified")
 	if lastMod != "" {
@@ -458,24 +1161,95 @@ func DownloadFileToDest(rawurl, dest string) error {
 	return os.Chtimes(dest, mTime, mTime)
 }
 
+// Checksum is the expected digest of a downloaded file, as given to ADD --checksum
+type Checksum struct {
+	Algorithm string
+	Hex       string
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// ParseChecksum parses a checksum like sha256:<hex>, as given to the --checksum flag
+func ParseChecksum(checksum string) (*Checksum, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid --checksum %q: must be <algorithm>:<hex>", checksum)
+	}
+	c := &Checksum{Algorithm: strings.ToLower(parts[0]), Hex: strings.ToLower(parts[1])}
+	newHash, ok := checksumAlgorithms[c.Algorithm]
+	if !ok {
+		return nil, errors.Errorf("invalid --checksum %q: unsupported algorithm %s", checksum, parts[0])
+	}
+	if _, err := hex.DecodeString(c.Hex); err != nil || len(c.Hex) != newHash().Size()*2 {
+		return nil, errors.Errorf("invalid --checksum %q: not a %s digest", checksum, c.Algorithm)
+	}
+	return c, nil
+}
+
+func (c *Checksum) newHash() hash.Hash {
+	return checksumAlgorithms[c.Algorithm]()
+}
+
+// CopyOptions configures how CopyDir and CopyFile copy files
+type CopyOptions struct {
+	// Chmod, if set, is the mode given to copied files and directories instead of their source mode
+	Chmod *os.FileMode
+	// Chown, if set, is the ownership given to copied files, directories and symlinks instead of their source ownership
+	Chown *idtools.IDPair
+	// Hardlinks, if set, is where the first copy of each hardlinked source file is recorded, so the
+	// other files linked to it are copied as hardlinks to that copy instead of as files of their own
+	Hardlinks map[FileID]string
+}
+
+// ParseChmod parses an octal mode like 0755, as given to the --chmod flag
+func ParseChmod(chmod string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, errors.Errorf("invalid --chmod %q: must be an octal mode", chmod)
+	}
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
 // CopyDir copies the file or directory at src to dest
-func CopyDir(src, dest string) error {
+func CopyDir(src, dest string, opts CopyOptions) error {
 	files, err := RelativeFiles("", src)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
 		fullPath := filepath.Join(src, file)
+		// Files in an excluded directory can be included again, so they're checked on their own
+		if ExcludeFile(fullPath) {
+			logger.Debugf("Not copying %s, since .dockerignore excludes it", fullPath)
+			continue
+		}
 		fi, err := os.Lstat(fullPath)
 		if err != nil {
 			return err
 		}
 		destPath := filepath.Join(dest, file)
 		if fi.IsDir() {
-			logrus.Infof("Creating directory %s", destPath)
+			logger.Infof("Creating directory %s", destPath)
 
 			uid := int(fi.Sys().(*syscall.Stat_t).Uid)
 			gid := int(fi.Sys().(*syscall.Stat_t).Gid)
+			if opts.Chown != nil {
+				uid, gid = opts.Chown.UID, opts.Chown.GID
+			}
 
 			if err := os.MkdirAll(destPath, fi.Mode()); err != nil {
 				return err
@@ -483,14 +1257,19 @@ func CopyDir(src, dest string) error {
 			if err := os.Chown(destPath, uid, gid); err != nil {
 				return err
 			}
+			if opts.Chmod != nil {
+				if err := os.Chmod(destPath, *opts.Chmod); err != nil {
+					return err
+				}
+			}
 		} else if fi.Mode()&os.ModeSymlink != 0 {
 			// If file is a symlink, we want to create the same relative symlink
-			if err := CopySymlink(fullPath, destPath); err != nil {
+			if err := CopySymlink(fullPath, destPath, opts); err != nil {
 				return err
 			}
 		} else {
 			// ... Else, we want to copy over a file
-			if err := CopyFile(fullPath, destPath); err != nil {
+			if err := CopyFile(fullPath, destPath, opts); err != nil {
 				return err
 			}
 		}
@@ -499,22 +1278,34 @@ func CopyDir(src, dest string) error {
 }
 
 // CopySymlink copies the symlink at src to dest
-func CopySymlink(src, dest string) error {
+func CopySymlink(src, dest string, opts CopyOptions) error {
 	link, err := os.Readlink(src)
 	if err != nil {
 		return err
 	}
-	linkDst := filepath.Join(dest, link)
-	return os.Symlink(linkDst, dest)
+	// Like docker, the target is copied as is, so relative links still point within the copied files
+	if err := os.Symlink(link, dest); err != nil {
+		return err
+	}
+	if opts.Chown != nil {
+		return os.Lchown(dest, opts.Chown.UID, opts.Chown.GID)
+	}
+	return nil
 }
 
 // CopyFile copies the file at src to dest
-func CopyFile(src, dest string) error {
+func CopyFile(src, dest string, opts CopyOptions) error {
 	fi, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
-	logrus.Infof("Copying file %s to %s", src, dest)
+	if opts.Hardlinks != nil {
+		if linked, first := checkHardlink(dest, opts.Hardlinks, fi); linked {
+			logger.Infof("Linking %s to %s, since %s is a hardlink of a file already copied", dest, first, src)
+			return linkFile(first, dest)
+		}
+	}
+	logger.Infof("Copying file %s to %s", src, dest)
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -522,7 +1313,25 @@ func CopyFile(src, dest string) error {
 	defer srcFile.Close()
 	uid := fi.Sys().(*syscall.Stat_t).Uid
 	gid := fi.Sys().(*syscall.Stat_t).Gid
-	return CreateFile(dest, srcFile, fi.Mode(), uid, gid)
+	mode := fi.Mode()
+	if opts.Chmod != nil {
+		mode = *opts.Chmod
+	}
+	if opts.Chown != nil {
+		uid, gid = uint32(opts.Chown.UID), uint32(opts.Chown.GID)
+	}
+	return CreateFile(dest, srcFile, mode, uid, gid)
+}
+
+// linkFile creates dest as a hardlink to the file at target, replacing whatever is at dest
+func linkFile(target, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Link(target, dest)
 }
 
 // HasFilepathPrefix checks if the given file path begins with prefix
@@ -19,14 +19,25 @@ package util
 import (
 	"archive/tar"
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 func Test_fileSystemWhitelist(t *testing.T) {
@@ -216,6 +227,45 @@ func Test_checkWhiteouts(t *testing.T) {
 	}
 }
 
+func Test_checkOpaqueDirs(t *testing.T) {
+	opaqueDirs := map[string]struct{}{
+		"/usr/lib": {},
+	}
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{
+			name: "opaque dir itself",
+			path: "/usr/lib",
+			want: false,
+		},
+		{
+			name: "file in opaque dir",
+			path: "/usr/lib/foo",
+			want: true,
+		},
+		{
+			name: "nested file in opaque dir",
+			path: "/usr/lib/foo/bar",
+			want: true,
+		},
+		{
+			name: "sibling with same prefix",
+			path: "/usr/lib64/foo",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkOpaqueDirs(tt.path, opaqueDirs); got != tt.want {
+				t.Errorf("checkOpaqueDirs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_CheckWhitelist(t *testing.T) {
 	type args struct {
 		path      string
@@ -277,6 +327,32 @@ func Test_CheckWhitelist(t *testing.T) {
 	}
 }
 
+func Test_resetVolumeWhitelist(t *testing.T) {
+	original := whitelist
+	defer func() {
+		whitelist = original
+	}()
+	whitelist = []string{"/kaniko", "/cache"}
+
+	// A volume is only whitelisted for the commands after the one which declares it
+	for _, volume := range []string{"/data", "/cache"} {
+		if err := AddPathToVolumeWhitelist(volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	whitelisted, err := CheckWhitelist("/data/file")
+	testutil.CheckErrorAndDeepEqual(t, false, err, false, whitelisted)
+	if err := MoveVolumeWhitelistToWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+	whitelisted, err = CheckWhitelist("/data/file")
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, whitelisted)
+
+	// The next stage doesn't have the volume, but anything which was already whitelisted stays whitelisted
+	resetVolumeWhitelist()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/kaniko", "/cache"}, whitelist)
+}
+
 func TestHasFilepathPrefix(t *testing.T) {
 	type args struct {
 		path   string
@@ -506,7 +582,7 @@ func TestExtractFile(t *testing.T) {
 				hardlinkHeader("/bin/uncompress", "/bin/gzip"),
 			},
 			checkers: []checker{
-				linkPointsTo("/bin/uncompress", "/bin/gzip"),
+				linkPointsTo("/bin/uncompress", "gzip"),
 			},
 		},
 	}
@@ -531,3 +607,703 @@ func TestExtractFile(t *testing.T) {
 		})
 	}
 }
+
+func TestUnTar_PathTraversal(t *testing.T) {
+	type tc struct {
+		name      string
+		hdrs      []*tar.Header
+		shouldErr bool
+	}
+
+	tcs := []tc{
+		{
+			name: "file within dest",
+			hdrs: []*tar.Header{fileHeader("./foo/../bar", "", 0644)},
+		},
+		{
+			name:      "file escaping dest",
+			hdrs:      []*tar.Header{fileHeader("../../etc/passwd", "", 0644)},
+			shouldErr: true,
+		},
+		{
+			name: "absolute file is rooted at dest",
+			hdrs: []*tar.Header{fileHeader("/etc/passwd", "", 0644)},
+		},
+		{
+			name: "symlink within dest",
+			hdrs: []*tar.Header{linkHeader("./foo/bar", "../baz")},
+		},
+		{
+			name:      "relative symlink escaping dest",
+			hdrs:      []*tar.Header{linkHeader("./foo/bar", "../../../etc/passwd")},
+			shouldErr: true,
+		},
+		{
+			name:      "absolute symlink escaping dest",
+			hdrs:      []*tar.Header{linkHeader("./bar", "/etc/passwd")},
+			shouldErr: true,
+		},
+		{
+			name:      "hardlink escaping dest",
+			hdrs:      []*tar.Header{hardlinkHeader("./bar", "../../etc/passwd")},
+			shouldErr: true,
+		},
+		{
+			name: "absolute hardlink is rooted at dest",
+			hdrs: []*tar.Header{
+				fileHeader("/etc/passwd", "", 0644),
+				hardlinkHeader("./lnk", "/etc/passwd"),
+			},
+		},
+		{
+			name: "symlinks to symlinks within dest",
+			hdrs: []*tar.Header{
+				dirHeader("./b", 0755),
+				linkHeader("./b/c", ".."),
+				linkHeader("./x", "b/c"),
+				fileHeader("./x/b/file", "", 0644),
+			},
+		},
+		{
+			name: "symlinks to symlinks escaping dest",
+			hdrs: []*tar.Header{
+				dirHeader("./b", 0755),
+				linkHeader("./b/c", ".."),
+				linkHeader("./x", "b/c/../.."),
+				fileHeader("./x/escaped", "", 0644),
+			},
+			shouldErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(r)
+			buf := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(buf)
+			for _, hdr := range tc.hdrs {
+				if err := w.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Close()
+			err = unTar(buf, r, CopyOptions{})
+			testutil.CheckError(t, tc.shouldErr, err)
+		})
+	}
+}
+
+func TestUnTar_ChainedSymlinkDoesNotEscape(t *testing.T) {
+	parent, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	r := filepath.Join(parent, "a", "dest")
+	if err := os.MkdirAll(r, 0755); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		dirHeader("./b", 0755),
+		linkHeader("./b/c", ".."),
+		linkHeader("./x", "b/c/../.."),
+		fileHeader("./x/escaped", "", 0644),
+	} {
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	if err := unTar(buf, r, CopyOptions{}); err == nil {
+		t.Error("expected an error extracting through a symlink escaping dest")
+	}
+	if _, err := os.Lstat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to have been written, got %v", filepath.Join(parent, "escaped"), err)
+	}
+}
+
+func TestApplyLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := testutil.SetupFiles(root, map[string]string{
+		"deleted":         "deleted",
+		"opaque/old":      "old",
+		"kept":            "kept",
+		"replaced/target": "target",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(root, "replaced/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	for _, f := range []struct {
+		hdr      *tar.Header
+		contents string
+	}{
+		{hdr: fileHeader("/.wh.deleted", "", 0644)},
+		{hdr: fileHeader("/opaque/.wh..wh..opq", "", 0644)},
+		{hdr: fileHeader("/opaque/new", "new", 0644), contents: "new"},
+		{hdr: fileHeader("/replaced/link", "file", 0644), contents: "file"},
+		{hdr: fileHeader("/added/file", "added", 0644), contents: "added"},
+	} {
+		if err := w.WriteHeader(f.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyLayer(root, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := RelativeFiles("", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	expected := []string{".", "added", "added/file", "kept", "opaque", "opaque/new", "replaced", "replaced/link", "replaced/target"}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, files)
+	for _, check := range []checker{
+		fileMatches("opaque/new", []byte("new")),
+		fileMatches("replaced/link", []byte("file")),
+		fileMatches("added/file", []byte("added")),
+		fileMatches("kept", []byte("kept")),
+	} {
+		check(root, t)
+	}
+	if fi, err := os.Lstat(filepath.Join(root, "replaced/link")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("expected replaced/link to be replaced by a regular file: %v", err)
+	}
+}
+
+func TestParseChmod(t *testing.T) {
+	tests := []struct {
+		chmod     string
+		expected  os.FileMode
+		shouldErr bool
+	}{
+		{
+			chmod:    "0755",
+			expected: 0755,
+		},
+		{
+			chmod:    "644",
+			expected: 0644,
+		},
+		{
+			chmod:    "4755",
+			expected: os.ModeSetuid | 0755,
+		},
+		{
+			chmod:    "3777",
+			expected: os.ModeSetgid | os.ModeSticky | 0777,
+		},
+		{
+			chmod:     "0789",
+			shouldErr: true,
+		},
+		{
+			chmod:     "10000",
+			shouldErr: true,
+		},
+		{
+			chmod:     "u+x",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.chmod, func(t *testing.T) {
+			mode, err := ParseChmod(test.chmod)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, mode)
+		})
+	}
+}
+
+func TestCopyDir_Chmod(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	files := map[string]string{
+		"foo":     "foo",
+		"bar/baz": "baz",
+	}
+	if err := testutil.SetupFiles(src, files); err != nil {
+		t.Fatal(err)
+	}
+	mode := os.FileMode(0750)
+	destDir := filepath.Join(dest, "copied")
+	if err := CopyDir(src, destDir, CopyOptions{Chmod: &mode}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"", "foo", "bar", "bar/baz"} {
+		fi, err := os.Lstat(filepath.Join(destDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, mode, fi.Mode().Perm())
+	}
+}
+
+func TestCopyDir_Dockerignore(t *testing.T) {
+	defer func() { excluded = nil }()
+	files := map[string]string{
+		"README.md":        "readme",
+		"README-secret.md": "secret",
+		"CHANGES.md":       "changes",
+		"main.go":          "main",
+		"keep.txt":         "keep",
+		"docs/guide.md":    "guide",
+		"sub/keep.txt":     "keep",
+		"sub/other":        "other",
+	}
+	tests := []struct {
+		name         string
+		dockerignore string
+		expected     []string
+	}{
+		{
+			name:     "no .dockerignore",
+			expected: []string{"CHANGES.md", "README-secret.md", "README.md", "docs/guide.md", "keep.txt", "main.go", "sub/keep.txt", "sub/other"},
+		},
+		{
+			name:         "exception",
+			dockerignore: "*.md\n!README.md\n",
+			expected:     []string{".dockerignore", "README.md", "docs/guide.md", "keep.txt", "main.go", "sub/keep.txt", "sub/other"},
+		},
+		{
+			name:         "later pattern excludes again",
+			dockerignore: "*.md\n!README*.md\nREADME-secret.md\n",
+			expected:     []string{".dockerignore", "README.md", "docs/guide.md", "keep.txt", "main.go", "sub/keep.txt", "sub/other"},
+		},
+		{
+			name:         "everything but one file",
+			dockerignore: "# only keep.txt\n*\n!keep.txt\n",
+			expected:     []string{"keep.txt"},
+		},
+		{
+			name:         "exception before exclusion",
+			dockerignore: "!keep.txt\n*\n",
+		},
+		{
+			name:         "file in excluded directory",
+			dockerignore: "sub\n!sub/keep.txt\n.dockerignore\n",
+			expected:     []string{"CHANGES.md", "README-secret.md", "README.md", "docs/guide.md", "keep.txt", "main.go", "sub/keep.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(src)
+			dest, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+			if err := testutil.SetupFiles(src, files); err != nil {
+				t.Fatal(err)
+			}
+			if test.dockerignore != "" {
+				if err := ioutil.WriteFile(filepath.Join(src, ".dockerignore"), []byte(test.dockerignore), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := GetExcludedFiles(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := CopyDir(src, dest, CopyOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			var copied []string
+			err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				copied = append(copied, rel)
+				return err
+			})
+			sort.Strings(copied)
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, copied)
+		})
+	}
+}
+
+func TestExcludeFile_NestedContext(t *testing.T) {
+	defer func() { excluded = nil }()
+	context, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(context)
+	files := map[string]string{
+		".dockerignore":        "*.md\nassets/logo\n",
+		"README.md":            "readme",
+		"assets/.dockerignore": "*.tmp\n",
+		"assets/logo":          "logo",
+		"assets/NOTES.md":      "notes",
+		"assets/build.tmp":     "tmp",
+	}
+	if err := testutil.SetupFiles(context, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetExcludedFiles(context); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddExcludedFiles(filepath.Join(context, "assets")); err != nil {
+		t.Fatal(err)
+	}
+	// The files in assets are only excluded by its own .dockerignore
+	expected := map[string]bool{
+		"README.md":        true,
+		"assets/logo":      false,
+		"assets/NOTES.md":  false,
+		"assets/build.tmp": true,
+	}
+	actual := map[string]bool{}
+	for file := range expected {
+		actual[file] = ExcludeFile(filepath.Join(context, file))
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, actual)
+}
+
+func TestParseChecksum(t *testing.T) {
+	sha256Hex := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	tests := []struct {
+		checksum  string
+		expected  *Checksum
+		shouldErr bool
+	}{
+		{
+			checksum: "sha256:" + sha256Hex,
+			expected: &Checksum{Algorithm: "sha256", Hex: sha256Hex},
+		},
+		{
+			checksum: "SHA256:" + strings.ToUpper(sha256Hex),
+			expected: &Checksum{Algorithm: "sha256", Hex: sha256Hex},
+		},
+		{
+			checksum:  "sha512:" + sha256Hex,
+			shouldErr: true,
+		},
+		{
+			checksum:  "md5:5eb63bbbe01eeed093cb22bb8f5acdc3",
+			shouldErr: true,
+		},
+		{
+			checksum:  sha256Hex,
+			shouldErr: true,
+		},
+		{
+			checksum:  "sha256:not-hex",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.checksum, func(t *testing.T) {
+			checksum, err := ParseChecksum(test.checksum)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, checksum)
+		})
+	}
+}
+
+func TestDownloadFileToDest_Checksum(t *testing.T) {
+	content := "hello world"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	tests := []struct {
+		name      string
+		checksum  string
+		shouldErr bool
+	}{
+		{
+			name: "no checksum",
+		},
+		{
+			name:     "matching sha256",
+			checksum: "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+		{
+			name:     "matching sha512",
+			checksum: "sha512:309ecc489c12d6eb4cc40f50c902f2b4d0ed77ee511a7c7a9bcd3ca86d4cd86f989dd35bc5ff499670da34255b45b0cfd830e81f605dcf7dc5542e93ae9cd76f",
+		},
+		{
+			name:      "mismatching sha256",
+			checksum:  "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var checksum *Checksum
+			if test.checksum != "" {
+				if checksum, err = ParseChecksum(test.checksum); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dest := filepath.Join(testDir, test.name)
+			err := DownloadFileToDest(server.URL+"/file", dest, checksum, CopyOptions{})
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				// The file shouldn't be left behind if it doesn't match
+				testutil.CheckErrorAndDeepEqual(t, false, nil, false, FilepathExists(dest))
+				return
+			}
+			contents, err := ioutil.ReadFile(dest)
+			testutil.CheckErrorAndDeepEqual(t, false, err, content, string(contents))
+		})
+	}
+}
+
+func TestCopyDir_Chown(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	files := map[string]string{
+		"foo":     "foo",
+		"bar/baz": "baz",
+	}
+	if err := testutil.SetupFiles(src, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	chown := idtools.IDPair{UID: 1000, GID: 1001}
+	destDir := filepath.Join(dest, "copied")
+	if err := CopyDir(src, destDir, CopyOptions{Chown: &chown}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"", "foo", "bar", "bar/baz", "link"} {
+		fi, err := os.Lstat(filepath.Join(destDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		testutil.CheckErrorAndDeepEqual(t, false, nil, chown, idtools.IDPair{UID: int(stat.Uid), GID: int(stat.Gid)})
+	}
+	target, err := os.Readlink(filepath.Join(destDir, "link"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "foo", target)
+}
+
+type layerEntry struct {
+	hdr      *tar.Header
+	contents string
+}
+
+func layerFromEntries(t *testing.T, entries []layerEntry) v1.Layer {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		if err := w.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func TestGetPathsFromImage(t *testing.T) {
+	base := layerFromEntries(t, []layerEntry{
+		{hdr: dirHeader("usr/", 0755)},
+		{hdr: dirHeader("usr/bin/", 0755)},
+		{hdr: fileHeader("usr/bin/tool", "tool", 0755), contents: "tool"},
+		{hdr: fileHeader("usr/bin/other", "other", 0755), contents: "other"},
+		{hdr: linkHeader("bin", "usr/bin")},
+		{hdr: dirHeader("opt/app/", 0755)},
+		{hdr: fileHeader("opt/app/lib/libx", "lib", 0644), contents: "lib"},
+		{hdr: linkHeader("opt/app/bin/run", "../lib/libx")},
+		{hdr: fileHeader("opt/app/old", "old", 0644), contents: "old"},
+		{hdr: fileHeader("big/file", "big", 0644), contents: "big"},
+	})
+	top := layerFromEntries(t, []layerEntry{
+		{hdr: fileHeader("opt/app/.wh.old", "", 0644)},
+		{hdr: fileHeader("opt/app/new", "new", 0644), contents: "new"},
+	})
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(full)
+	if err := extractTestImage(full, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	selected, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(selected)
+	if err := extractTestImage(selected, img, []string{"/bin/tool", "opt/app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory is the same as when the whole filesystem is extracted
+	fullFiles, err := RelativeFiles("opt/app", full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectedFiles, err := RelativeFiles("opt/app", selected)
+	testutil.CheckErrorAndDeepEqual(t, false, err, fullFiles, selectedFiles)
+	for _, check := range []checker{
+		fileMatches("bin/tool", []byte("tool")),
+		fileMatches("opt/app/new", []byte("new")),
+		fileMatches("opt/app/bin/run", []byte("lib")),
+		linkPointsTo("opt/app/bin/run", "../lib/libx"),
+	} {
+		check(selected, t)
+	}
+	for _, p := range []string{"opt/app/old", "usr/bin/other", "big/file"} {
+		if _, err := os.Lstat(filepath.Join(selected, p)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be extracted: %v", p, err)
+		}
+	}
+}
+
+func TestGetPathsFromImage_Wildcard(t *testing.T) {
+	layer := layerFromEntries(t, []layerEntry{
+		{hdr: fileHeader("etc/a.conf", "a", 0644), contents: "a"},
+		{hdr: fileHeader("etc/b.conf", "b", 0644), contents: "b"},
+		{hdr: fileHeader("var/c", "c", 0644), contents: "c"},
+	})
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		paths    []string
+		expected []string
+	}{
+		{paths: []string{"/etc/*.conf"}, expected: []string{"etc", "etc/a.conf", "etc/b.conf"}},
+		{paths: []string{"/*"}, expected: []string{"etc", "etc/a.conf", "etc/b.conf", "var", "var/c"}},
+		{paths: []string{"/"}, expected: []string{"etc", "etc/a.conf", "etc/b.conf", "var", "var/c"}},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.paths, ","), func(t *testing.T) {
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			if err := extractTestImage(root, img, test.paths); err != nil {
+				t.Fatal(err)
+			}
+			files, err := RelativeFiles("", root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(files)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, append([]string{"."}, test.expected...), files)
+		})
+	}
+}
+
+func TestContextPath(t *testing.T) {
+	buildcontext, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildcontext)
+	if err := testutil.SetupFiles(buildcontext, map[string]string{"dir/file": "file"}); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"internal": "dir",
+		"absolute": "/dir",
+		"escape":   "../../../../dir",
+		"dangling": "missing",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(buildcontext, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{name: "file", src: "dir/file", expected: "dir/file"},
+		{name: "context", src: ".", expected: "."},
+		{name: "symlink isn't followed", src: "internal", expected: "internal"},
+		{name: "dangling symlink isn't followed", src: "dangling", expected: "dangling"},
+		{name: "symlinked directory", src: "internal/file", expected: "dir/file"},
+		{name: "absolute symlink stays in the context", src: "absolute/file", expected: "dir/file"},
+		{name: "relative symlink stays in the context", src: "escape/file", expected: "dir/file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ContextPath(buildcontext, test.src)
+			testutil.CheckErrorAndDeepEqual(t, false, err, filepath.Join(buildcontext, test.expected), actual)
+		})
+	}
+}
+
+func TestSaveWhitelist(t *testing.T) {
+	original := append([]string{}, whitelist...)
+	restore := SaveWhitelist()
+	AddToWhitelist("/cache")
+	whitelisted, err := CheckWhitelist("/cache/layer")
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, whitelisted)
+	restore()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, original, whitelist)
+}
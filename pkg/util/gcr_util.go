@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// googleRegistryPattern matches the registries of GCR, like gcr.io and eu.gcr.io, and of Artifact Registry,
+// like us-docker.pkg.dev
+var googleRegistryPattern = regexp.MustCompile(`^(?:[a-z0-9-]+\.)?gcr\.io$|^[a-z0-9-]+-docker\.pkg\.dev$`)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GoogleKeychain is a keychain for GCR and Artifact Registry, which uses the application default credentials,
+// like the service account given by the metadata server, which is the one of the workload identity on GKE,
+// or a key in $GOOGLE_APPLICATION_CREDENTIALS.
+type GoogleKeychain struct {
+	newTokenSource func() (oauth2.TokenSource, error)
+
+	once sync.Once
+	ts   oauth2.TokenSource
+}
+
+var _ authn.Keychain = (*GoogleKeychain)(nil)
+
+// NewGoogleKeychain returns a keychain for GCR and Artifact Registry
+func NewGoogleKeychain() *GoogleKeychain {
+	return &GoogleKeychain{
+		newTokenSource: func() (oauth2.TokenSource, error) {
+			return google.DefaultTokenSource(context.Background(), cloudPlatformScope)
+		},
+	}
+}
+
+// googleKeychain is shared by every pull and push, so the credentials are only looked for once
+var googleKeychain = NewGoogleKeychain()
+
+// Resolve implements authn.Keychain. Registries which aren't in GCR or Artifact Registry are anonymous,
+// as they all are if there are no application default credentials, so they can come from another keychain instead.
+func (k *GoogleKeychain) Resolve(reg name.Registry) (authn.Authenticator, error) {
+	if !googleRegistryPattern.MatchString(reg.RegistryStr()) {
+		return authn.Anonymous, nil
+	}
+	k.once.Do(func() {
+		ts, err := k.newTokenSource()
+		if err != nil {
+			logger.Debugf("No application default credentials for %s: %v", reg.RegistryStr(), err)
+			return
+		}
+		if _, err := ts.Token(); err != nil {
+			logger.Warnf("Couldn't get an access token from the application default credentials: %v", err)
+			return
+		}
+		k.ts = ts
+	})
+	if k.ts == nil {
+		return authn.Anonymous, nil
+	}
+	return &GoogleAuthenticator{ts: k.ts}, nil
+}
+
+// GoogleAuthenticator authenticates to GCR and Artifact Registry with access tokens from a token source,
+// which gets a new token when the last one is about to expire
+type GoogleAuthenticator struct {
+	ts oauth2.TokenSource
+}
+
+var _ authn.Authenticator = (*GoogleAuthenticator)(nil)
+
+// Authorization implements authn.Authenticator
+func (g *GoogleAuthenticator) Authorization() (string, error) {
+	token, err := g.ts.Token()
+	if err != nil {
+		return "", err
+	}
+	return (&authn.Basic{Username: "oauth2accesstoken", Password: token.AccessToken}).Authorization()
+}
+
+// Transport returns a transport which authenticates each request to registry with the current access token.
+// The registry token the access token is exchanged for when a push starts lasts as long as the access token does,
+// so otherwise requests toward the end of a long push would fail once it expires.
+func (g *GoogleAuthenticator) Transport(registry name.Registry, inner http.RoundTripper) http.RoundTripper {
+	return &googleTokenTransport{inner: inner, registry: registry.RegistryStr(), ts: g.ts}
+}
+
+type googleTokenTransport struct {
+	inner    http.RoundTripper
+	registry string
+	ts       oauth2.TokenSource
+}
+
+func (g *googleTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Redirects to where blobs are stored have their own credentials in the URL, and the basic credentials
+	// the access token is first exchanged with are left alone
+	if r.URL.Host != g.registry || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return g.inner.RoundTrip(r)
+	}
+	token, err := g.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	return g.inner.RoundTrip(r)
+}
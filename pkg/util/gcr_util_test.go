@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// fakeTokenSource gives tokens which expire after an hour, getting a new one once the last has expired
+type fakeTokenSource struct {
+	mu        sync.Mutex
+	now       time.Time
+	token     *oauth2.Token
+	refreshes int
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token == nil || !f.now.Before(f.token.Expiry) {
+		f.refreshes++
+		f.token = &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", f.refreshes), Expiry: f.now.Add(time.Hour)}
+	}
+	return f.token, nil
+}
+
+func (f *fakeTokenSource) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestGoogleKeychain(t *testing.T) {
+	ts := &fakeTokenSource{now: time.Now()}
+	kc := &GoogleKeychain{newTokenSource: func() (oauth2.TokenSource, error) { return ts, nil }}
+	for _, registry := range []string{"gcr.io", "eu.gcr.io", "us-docker.pkg.dev"} {
+		reg, err := name.NewRegistry(registry, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := kc.Resolve(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorization, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, basicAuthorization("oauth2accesstoken", "token-1"), authorization)
+	}
+	for _, registry := range []string{"index.docker.io", "gcr.io.example.com", "docker.pkg.dev"} {
+		reg, err := name.NewRegistry(registry, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := kc.Resolve(reg)
+		testutil.CheckErrorAndDeepEqual(t, false, err, authn.Anonymous, auth)
+	}
+}
+
+func TestGoogleKeychain_NoCredentials(t *testing.T) {
+	kc := &GoogleKeychain{newTokenSource: func() (oauth2.TokenSource, error) {
+		return nil, errors.New("could not find default credentials")
+	}}
+	reg, err := name.NewRegistry("gcr.io", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := kc.Resolve(reg)
+	testutil.CheckErrorAndDeepEqual(t, false, err, authn.Anonymous, auth)
+}
+
+func TestGoogleAuthenticator_Transport(t *testing.T) {
+	ts := &fakeTokenSource{now: time.Now()}
+	var mu sync.Mutex
+	var tokenAuthorization string
+	var expired bool
+	authorizations := map[string]string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v2/":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/v2/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/token":
+			tokenAuthorization = r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"token": "registry-token"}`)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost:
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch:
+			// The access token expires while the first blob is uploaded
+			if !expired {
+				ts.advance(2 * time.Hour)
+				expired = true
+			}
+			w.Header().Set("Location", "/upload")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && r.URL.Path == "/upload":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut:
+			authorizations["manifest"] = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	ref, err := name.NewTag(strings.TrimPrefix(server.URL, "http://")+"/test/image:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &GoogleAuthenticator{ts: ts}
+	if err := remote.Write(ref, image, auth, auth.Transport(ref.Context().Registry, http.DefaultTransport), remote.WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The access token is exchanged as usual, but the requests after it expired use a new one
+	testutil.CheckErrorAndDeepEqual(t, false, nil, basicAuthorization("oauth2accesstoken", "token-1"), tokenAuthorization)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "Bearer token-2", authorizations["manifest"])
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, ts.refreshes)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IsSrcRemoteGitURL returns true if rawurl is a git repository, which ADD clones instead of downloading.
+// Like docker, these are git:// and git@ urls, and http(s) or ssh urls ending in .git, optionally
+// followed by #<ref> or #<ref>:<subdirectory>.
+func IsSrcRemoteGitURL(rawurl string) bool {
+	if strings.HasPrefix(rawurl, "git@") {
+		return true
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "git":
+		return true
+	case "http", "https", "ssh":
+		return strings.HasSuffix(u.Path, ".git")
+	}
+	return false
+}
+
+// parseGitURL splits a git url into the repository, and the ref and subdirectory in its fragment
+func parseGitURL(rawurl string) (repo, ref, subdir string) {
+	repo = rawurl
+	if i := strings.LastIndex(rawurl, "#"); i >= 0 {
+		repo = rawurl[:i]
+		ref = rawurl[i+1:]
+		if j := strings.Index(ref, ":"); j >= 0 {
+			ref, subdir = ref[:j], ref[j+1:]
+		}
+	}
+	return repo, ref, subdir
+}
+
+// CloneGitRepo makes a shallow clone of the ref in the git url rawurl into dir, which must be empty or
+// not exist, and removes the .git directory from it. It returns the directory which should be added,
+// which is the subdirectory in the url if there is one. git uses its usual credentials, so credential
+// helpers, ssh keys and credentials in the url all work.
+func CloneGitRepo(rawurl, dir string) (string, error) {
+	repo, ref, subdir := parseGitURL(rawurl)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// The executor image doesn't include git, so it has to be added to use git repositories
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", errors.Wrapf(err, "adding git repository %s requires git", redactGitURL(repo))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	logger.Infof("Cloning %s at %s", redactGitURL(repo), ref)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", repo},
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		// Fail instead of waiting for a username and password that will never come
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", errors.Wrapf(err, "cloning %s: git %s: %s", redactGitURL(repo), args[0], strings.Replace(string(out), repo, redactGitURL(repo), -1))
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", err
+	}
+	if subdir == "" {
+		return dir, nil
+	}
+	contents := filepath.Join(dir, filepath.Clean("/"+subdir))
+	fi, err := os.Stat(contents)
+	if err != nil {
+		return "", errors.Wrapf(err, "finding %s in %s", subdir, redactGitURL(repo))
+	}
+	if !fi.IsDir() {
+		return "", errors.Errorf("%s in %s is not a directory", subdir, redactGitURL(repo))
+	}
+	return contents, nil
+}
+
+// redactGitURL hides any password in rawurl, so it can be logged
+func redactGitURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
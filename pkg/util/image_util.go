@@ -17,18 +17,17 @@ limitations under the License.
 package util
 
 import (
+	"net/http"
 	"path/filepath"
 	"strconv"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/authn/k8schain"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
-	"github.com/sirupsen/logrus"
 
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
 )
@@ -39,16 +38,50 @@ var (
 	retrieveTarImage    = tarballImage
 )
 
-// RetrieveSourceImage returns the base image of the stage at index
-func RetrieveSourceImage(index int, buildArgs []string, stages []instructions.Stage) (v1.Image, error) {
+// ImageCache is a cache of images, like one warmed with the base images of builds, which images are read
+// from instead of pulling them
+type ImageCache interface {
+	// Image returns the image cached for image on platform, or nil if there isn't one
+	Image(image string, platform *v1.Platform) (v1.Image, error)
+}
+
+// imageCache is where images are read from before they're pulled, if it's set
+var imageCache ImageCache
+
+// SetImageCache sets the cache images are read from before they're pulled, or stops reading them from one if c is nil
+func SetImageCache(c ImageCache) {
+	imageCache = c
+}
+
+// ImageStore is an ImageCache which pulled images are added to, like the one the daemon keeps the base
+// images of its builds in
+type ImageStore interface {
+	ImageCache
+	// Set stores img as the image for image on platform
+	Set(image string, platform *v1.Platform, img v1.Image) error
+}
+
+// imageStore is where images are stored once they're pulled, if it's set
+var imageStore ImageStore
+
+// SetImageStore sets the store images are read from after the image cache, and stored in once they're pulled, so
+// they're only pulled once. Like in the image cache, each image is pinned to the digest it was pulled with. If s is
+// nil, images aren't stored.
+func SetImageStore(s ImageStore) {
+	imageStore = s
+}
+
+// RetrieveSourceImage returns the base image of the stage at index. If platform is set, remote base
+// images are the variant for that platform. escape is the escape character of the Dockerfile.
+func RetrieveSourceImage(index int, buildArgs []string, escape rune, stages []instructions.Stage, platform *v1.Platform) (v1.Image, error) {
 	currentStage := stages[index]
-	currentBaseName, err := ResolveEnvironmentReplacement(currentStage.BaseName, buildArgs, false)
+	currentBaseName, err := ResolveEnvironmentReplacement(currentStage.BaseName, buildArgs, escape, false)
 	if err != nil {
 		return nil, err
 	}
 	// First, check if the base image is a scratch image
 	if currentBaseName == constants.NoBaseImage {
-		logrus.Info("No base image, nothing to extract")
+		logger.Info("No base image, nothing to extract")
 		return empty.Image, nil
 	}
 	// Next, check if the base image of the current stage is built from a previous stage
@@ -62,7 +95,7 @@ func RetrieveSourceImage(index int, buildArgs []string, stages []instructions.St
 		}
 	}
 	// Otherwise, initialize image as usual
-	return retrieveRemoteImage(currentBaseName)
+	return retrieveRemoteImage(currentBaseName, platform)
 }
 
 // RetrieveConfigFile returns the config file for an image
@@ -79,20 +112,116 @@ func RetrieveConfigFile(sourceImage v1.Image) (*v1.ConfigFile, error) {
 
 func tarballImage(index int) (v1.Image, error) {
 	tarPath := filepath.Join(constants.KanikoIntermediateStagesDir, strconv.Itoa(index))
-	logrus.Infof("Base image from previous stage %d found, using saved tar at path %s", index, tarPath)
+	logger.Infof("Base image from previous stage %d found, using saved tar at path %s", index, tarPath)
 	return tarball.ImageFromPath(tarPath, nil)
 }
 
-func remoteImage(image string) (v1.Image, error) {
-	logrus.Infof("Downloading base image %s", image)
+func remoteImage(image string, platform *v1.Platform) (v1.Image, error) {
+	logger.Infof("Downloading base image %s", image)
+	return fetchRemoteImage(image, platform, false)
+}
+
+// RetrieveRemoteImage returns the image a COPY --from copies files from. If platform is set and the image
+// is a manifest list, the variant for platform is used. An image which isn't a manifest list is used as is,
+// since it's often only built for one platform.
+func RetrieveRemoteImage(image string, platform *v1.Platform) (v1.Image, error) {
+	logger.Infof("Downloading image %s", image)
+	return fetchRemoteImage(image, platform, true)
+}
+
+// fetchRemoteImage pulls image, from the registry mirrors set with SetRegistryMirrors if it's on
+// Docker Hub. Each mirror is tried in turn, and if none of them has the image, it's pulled from Docker Hub.
+// The registries are reached as the options set with SetRegistryOptions say. Images in the cache set with
+// SetImageCache, or the store set with SetImageStore, aren't pulled at all, and pulled images are added to the store.
+func fetchRemoteImage(image string, platform *v1.Platform, anyPlatform bool) (v1.Image, error) {
 	ref, err := name.ParseReference(image, name.WeakValidation)
 	if err != nil {
 		return nil, err
 	}
-	k8sc, err := k8schain.NewNoClient()
+	if imageCache != nil {
+		img, err := imageCache.Image(image, platform)
+		if err != nil {
+			logger.Warnf("Couldn't read %s from the image cache: %v", image, err)
+		}
+		if img != nil {
+			logger.Infof("Using %s from the image cache", image)
+			return img, nil
+		}
+	}
+	if imageStore == nil {
+		return pullRemoteImage(ref, image, platform, anyPlatform)
+	}
+	img, err := imageStore.Image(image, platform)
 	if err != nil {
+		logger.Warnf("Couldn't read %s from the image store: %v", image, err)
+	}
+	if img != nil {
+		logger.Infof("Using %s from the image store, as it was pulled by an earlier build", image)
+		return img, nil
+	}
+	if img, err = pullRemoteImage(ref, image, platform, anyPlatform); err != nil {
+		return nil, err
+	}
+	if err := imageStore.Set(image, platform, img); err != nil {
+		logger.Warnf("Couldn't add %s to the image store: %v", image, err)
+		return img, nil
+	}
+	// The layers are read from the store from now on, instead of downloading them again
+	stored, err := imageStore.Image(image, platform)
+	if err != nil || stored == nil {
+		return img, nil
+	}
+	return stored, nil
+}
+
+// pullRemoteImage pulls image, which is ref, from the registry mirrors or its registry
+func pullRemoteImage(ref name.Reference, image string, platform *v1.Platform, anyPlatform bool) (v1.Image, error) {
+	kc, err := Keychain(dockerConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Context().RegistryStr() == name.DefaultRegistry {
+		for _, mirror := range registryMirrors {
+			mirrorRef, err := mirror.reference(ref)
+			if err != nil {
+				return nil, err
+			}
+			// Mirrors are insecure, or skip TLS verification, if their registries are listed as such too
+			if !mirror.Insecure {
+				if mirrorRef, err = registryOptions.Reference(mirrorRef); err != nil {
+					return nil, err
+				}
+			}
+			t := mirror.transport()
+			if !mirror.SkipTLSVerify {
+				t = registryOptions.Transport(mirrorRef.Context().Registry)
+			}
+			img, err := pullImage(mirrorRef, kc, t, platform, anyPlatform)
+			if err == nil {
+				logger.Infof("Pulling %s from registry mirror %s", image, mirror.Host)
+				return img, nil
+			}
+			logger.Warnf("Couldn't pull %s from registry mirror %s: %v", image, mirror.Host, err)
+		}
+	}
+	if ref, err = registryOptions.Reference(ref); err != nil {
+		return nil, err
+	}
+	return pullImage(ref, kc, registryOptions.Transport(ref.Context().Registry), platform, anyPlatform)
+}
+
+// pullImage returns the image at ref, once its manifest has been fetched
+func pullImage(ref name.Reference, kc authn.Keychain, t http.RoundTripper, platform *v1.Platform, anyPlatform bool) (v1.Image, error) {
+	if platform != nil {
+		return remoteImageForPlatform(ref, kc, t, *platform, anyPlatform)
+	}
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(kc), remote.WithTransport(t))
+	if err != nil {
+		return nil, err
+	}
+	// remote.Image doesn't fetch anything until it's used, so make sure the image exists
+	if _, err := img.RawManifest(); err != nil {
 		return nil, err
 	}
-	kc := authn.NewMultiKeychain(authn.DefaultKeychain, k8sc)
-	return remote.Image(ref, remote.WithAuthFromKeychain(kc))
+	return img, nil
 }
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// layerDir is the directory the tarballs of the layers a build creates are written to
+var layerDir string
+
+// SetLayerDir sets the directory the tarballs of the layers a build creates are written to, so they
+// aren't held in memory. It has to be outside of the filesystem which is snapshotted. If dir is empty,
+// the default directory for temporary files is used.
+func SetLayerDir(dir string) {
+	layerDir = dir
+}
+
+// NewLayerFile creates a file in the layer directory to write the tarball of a layer to
+func NewLayerFile() (*os.File, error) {
+	if layerDir != "" {
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.TempFile(layerDir, "layer")
+}
+
+// LayerFromTar returns a layer of the tarball write writes, which is written to a file in the layer
+// directory instead of memory
+func LayerFromTar(write func(w io.Writer) error) (v1.Layer, error) {
+	f, err := NewLayerFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return tarball.LayerFromFile(f.Name())
+}
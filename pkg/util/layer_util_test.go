@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestLayerFromTar(t *testing.T) {
+	layerDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layerDir)
+	SetLayerDir(layerDir)
+	defer SetLayerDir("")
+
+	layer, err := LayerFromTar(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte("file")); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(layerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, len(files))
+	r, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(tr)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "file:file", hdr.Name+":"+string(contents))
+
+	// Nothing is left behind if the tarball can't be written
+	_, err = LayerFromTar(func(w io.Writer) error {
+		return errors.New("failed")
+	})
+	testutil.CheckError(t, true, err)
+	files, err = ioutil.ReadDir(layerDir)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, len(files))
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ModuleField is the field of the log entries from kaniko's packages with the module they're from,
+// which --verbosity can set the level of
+const ModuleField = "module"
+
+// modules are the modules loggers have been created for
+var modules = map[string]bool{}
+
+var logger = ModuleLogger("util")
+
+// ModuleLogger returns the logger for the log calls of module. It should only be called to initialize
+// a package's variables, before --verbosity is parsed.
+func ModuleLogger(module string) *logrus.Entry {
+	modules[module] = true
+	return logrus.WithField(ModuleField, module)
+}
+
+// LogLevels are the levels set with --verbosity
+type LogLevels struct {
+	// Default is the level of the modules which aren't in Modules, and of entries without a module
+	Default logrus.Level
+	Modules map[string]logrus.Level
+}
+
+// Level returns the level of module
+func (l LogLevels) Level(module string) logrus.Level {
+	if lvl, ok := l.Modules[module]; ok {
+		return lvl
+	}
+	return l.Default
+}
+
+// max returns the most verbose of the levels
+func (l LogLevels) max() logrus.Level {
+	max := l.Default
+	for _, lvl := range l.Modules {
+		if lvl > max {
+			max = lvl
+		}
+	}
+	return max
+}
+
+// ParseLogLevels parses the value of --verbosity, which is either a level like debug, or a comma separated
+// list of module=level, like snapshot=debug,push=warn,*=info. The level of * is the level of every other
+// module, and is info if it isn't set.
+func ParseLogLevels(value string) (LogLevels, error) {
+	if !strings.Contains(value, "=") {
+		lvl, err := logrus.ParseLevel(value)
+		return LogLevels{Default: lvl}, err
+	}
+	levels := LogLevels{Modules: map[string]logrus.Level{}}
+	defaultLevel := constants.DefaultLogLevel
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return LogLevels{}, errors.Errorf("%q must be <module>=<level>", part)
+		}
+		module, level := kv[0], kv[1]
+		if seen[module] {
+			return LogLevels{}, errors.Errorf("the level of %s was set more than once", module)
+		}
+		seen[module] = true
+		if module == "*" {
+			defaultLevel = level
+			continue
+		}
+		if !modules[module] {
+			return LogLevels{}, errors.Errorf("unknown module %s, must be one of %s", module, strings.Join(moduleNames(), ", "))
+		}
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return LogLevels{}, errors.Wrapf(err, "level of %s", module)
+		}
+		levels.Modules[module] = lvl
+	}
+	lvl, err := logrus.ParseLevel(defaultLevel)
+	if err != nil {
+		return LogLevels{}, errors.Wrap(err, "level of *")
+	}
+	levels.Default = lvl
+	return levels, nil
+}
+
+func moduleNames() []string {
+	var names []string
+	for module := range modules {
+		names = append(names, module)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// moduleFilter drops the entries from modules which are more verbose than the module's level, and
+// formats the rest with its formatter
+type moduleFilter struct {
+	logrus.Formatter
+	levels LogLevels
+}
+
+func (f *moduleFilter) Format(entry *logrus.Entry) ([]byte, error) {
+	module, _ := entry.Data[ModuleField].(string)
+	if entry.Level > f.levels.Level(module) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// setLogLevels sets the level of each module. The logger itself is set to the most verbose of them,
+// and the entries from the other modules are dropped by a filter around its formatter.
+func setLogLevels(levels LogLevels) {
+	formatter := logrus.StandardLogger().Formatter
+	if filter, ok := formatter.(*moduleFilter); ok {
+		formatter = filter.Formatter
+	}
+	logrus.SetLevel(levels.max())
+	logrus.SetFormatter(&moduleFilter{Formatter: formatter, levels: levels})
+}
+
+// setFormatter sets the logger's formatter, keeping the filter of the module levels if there is one
+func setFormatter(formatter logrus.Formatter) {
+	if filter, ok := logrus.StandardLogger().Formatter.(*moduleFilter); ok {
+		formatter = &moduleFilter{Formatter: formatter, levels: filter.levels}
+	}
+	logrus.SetFormatter(formatter)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	snapshotLogger = ModuleLogger("snapshot")
+	pushLogger     = ModuleLogger("push")
+)
+
+func TestParseLogLevels(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected LogLevels
+		err      bool
+	}{
+		{
+			name:     "level",
+			value:    "debug",
+			expected: LogLevels{Default: logrus.DebugLevel},
+		},
+		{
+			name:  "modules",
+			value: "snapshot=debug,push=warn,*=error",
+			expected: LogLevels{
+				Default: logrus.ErrorLevel,
+				Modules: map[string]logrus.Level{"snapshot": logrus.DebugLevel, "push": logrus.WarnLevel},
+			},
+		},
+		{
+			name:  "default is info",
+			value: "snapshot=debug",
+			expected: LogLevels{
+				Default: logrus.InfoLevel,
+				Modules: map[string]logrus.Level{"snapshot": logrus.DebugLevel},
+			},
+		},
+		{
+			name:  "spaces",
+			value: "snapshot=debug, *=warn",
+			expected: LogLevels{
+				Default: logrus.WarnLevel,
+				Modules: map[string]logrus.Level{"snapshot": logrus.DebugLevel},
+			},
+		},
+		{
+			name:  "unknown level",
+			value: "verbose",
+			err:   true,
+		},
+		{
+			name:  "unknown level of module",
+			value: "snapshot=verbose",
+			err:   true,
+		},
+		{
+			name:  "unknown default level",
+			value: "snapshot=debug,*=verbose",
+			err:   true,
+		},
+		{
+			name:  "unknown module",
+			value: "snapshots=debug",
+			err:   true,
+		},
+		{
+			name:  "module without level",
+			value: "snapshot=debug,push",
+			err:   true,
+		},
+		{
+			name:  "level without module",
+			value: "=debug",
+			err:   true,
+		},
+		{
+			name:  "module set more than once",
+			value: "snapshot=debug,snapshot=warn",
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			levels, err := ParseLogLevels(test.value)
+			testutil.CheckErrorAndDeepEqual(t, test.err, err, test.expected, levels)
+		})
+	}
+}
+
+func TestSetLogLevel_Modules(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	defer logrus.SetLevel(logrus.InfoLevel)
+	if err := SetLogLevel("snapshot=debug,push=warn,*=info"); err != nil {
+		t.Fatal(err)
+	}
+	// The formatter can be set after the levels, and the levels are kept
+	if err := SetLogFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotLogger.Debug("snapshot debug")
+	pushLogger.Debug("push debug")
+	pushLogger.Info("push info")
+	pushLogger.Warn("push warn")
+	logger.Debug("util debug")
+	logger.Info("util info")
+	logrus.Debug("debug without a module")
+	logrus.Info("info without a module")
+
+	var logged []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		for _, msg := range []string{"snapshot debug", "push debug", "push info", "push warn", "util debug", "util info", "debug without a module", "info without a module"} {
+			if strings.Contains(line, `"msg":"`+msg+`"`) {
+				logged = append(logged, msg)
+			}
+		}
+	}
+	expected := []string{"snapshot debug", "push warn", "util info", "info without a module"}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, logged)
+	if !strings.Contains(buf.String(), `"module":"snapshot"`) {
+		t.Errorf("the module of the entries isn't logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// FileManifest is the inventory of the files in the layers a build added to its image, which tools like
+// SBOM generators can read instead of unpacking the layers
+type FileManifest struct {
+	Layers []LayerFiles `json:"layers"`
+}
+
+// LayerFiles are the paths a layer adds or changes, and the ones it deletes with whiteouts
+type LayerFiles struct {
+	Digest string      `json:"digest"`
+	Files  []FileEntry `json:"files"`
+	// Deleted are the paths whited out in the layers below
+	Deleted []string `json:"deleted,omitempty"`
+	// OpaqueDirs are the directories whose contents in the layers below are all deleted
+	OpaqueDirs []string `json:"opaque_dirs,omitempty"`
+}
+
+// FileEntry is a file in a layer. Digest is the sha256 of the contents of regular files, and Linkname
+// is the target of symlinks and hardlinks.
+type FileEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Mode     string `json:"mode"`
+	Digest   string `json:"digest,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// NewFileManifest returns the manifest of img's layers from the one at index from on
+func NewFileManifest(img v1.Image, from int) (*FileManifest, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > len(layers) {
+		return nil, errors.Errorf("can't list the files in layer %d of an image with %d layers", from, len(layers))
+	}
+	m := &FileManifest{Layers: []LayerFiles{}}
+	for i, l := range layers[from:] {
+		files, err := layerFiles(l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing the files in layer %d", from+i)
+		}
+		m.Layers = append(m.Layers, files)
+	}
+	return m, nil
+}
+
+// WriteFileManifest writes the manifest of img's layers from the one at index from on to path, as JSON
+func WriteFileManifest(path string, img v1.Image, from int) error {
+	m, err := NewFileManifest(img, from)
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+func layerFiles(l v1.Layer) (LayerFiles, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return LayerFiles{}, err
+	}
+	files := LayerFiles{Digest: digest.String(), Files: []FileEntry{}}
+	r, err := l.Uncompressed()
+	if err != nil {
+		return LayerFiles{}, err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return LayerFiles{}, err
+		}
+		p := filepath.Clean("/" + hdr.Name)
+		base := filepath.Base(p)
+		if base == opaqueWhiteout {
+			files.OpaqueDirs = append(files.OpaqueDirs, filepath.Dir(p))
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			files.Deleted = append(files.Deleted, filepath.Join(filepath.Dir(p), strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+		entry := FileEntry{
+			Path:     p,
+			Size:     hdr.Size,
+			Mode:     hdr.FileInfo().Mode().String(),
+			Linkname: hdr.Linkname,
+		}
+		if isRegularTarEntry(hdr) {
+			d, _, err := v1.SHA256(tr)
+			if err != nil {
+				return LayerFiles{}, errors.Wrapf(err, "hashing %s", p)
+			}
+			entry.Digest = d.String()
+		}
+		files.Files = append(files.Files, entry)
+	}
+	return files, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestWriteFileManifest(t *testing.T) {
+	first := layerFromEntries(t, []layerEntry{
+		{hdr: dirHeader("app/", 0755)},
+		{hdr: fileHeader("app/a", "a", 0644), contents: "a"},
+		{hdr: linkHeader("app/link", "a")},
+	})
+	// Deletes a file of the first layer, and everything in a directory
+	second := layerFromEntries(t, []layerEntry{
+		{hdr: fileHeader("app/.wh.a", "", 0644)},
+		{hdr: fileHeader("app/b", "bb", 0755), contents: "bb"},
+		{hdr: fileHeader("var/cache/.wh..wh..opq", "", 0644)},
+	})
+	img, err := mutate.AppendLayers(empty.Image, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "files.json")
+	if err := WriteFileManifest(path, img, 0); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m FileManifest
+	if err := json.Unmarshal(contents, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(l v1.Layer) string {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.String()
+	}
+	sha256 := func(s string) string {
+		d, _, err := v1.SHA256(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.String()
+	}
+	expected := FileManifest{Layers: []LayerFiles{
+		{
+			Digest: digest(first),
+			Files: []FileEntry{
+				{Path: "/app", Mode: "drwxr-xr-x"},
+				{Path: "/app/a", Size: 1, Mode: "-rw-r--r--", Digest: sha256("a")},
+				{Path: "/app/link", Mode: "L---------", Linkname: "a"},
+			},
+		},
+		{
+			Digest:     digest(second),
+			Files:      []FileEntry{{Path: "/app/b", Size: 2, Mode: "-rwxr-xr-x", Digest: sha256("bb")}},
+			Deleted:    []string{"/app/a"},
+			OpaqueDirs: []string{"/var/cache"},
+		},
+	}}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, m)
+}
+
+func TestNewFileManifest_From(t *testing.T) {
+	img := squashTestImage(t)
+	tests := []struct {
+		name        string
+		from        int
+		layers      int
+		shouldError bool
+	}{
+		{name: "all layers", from: 0, layers: 4},
+		{name: "built layers", from: 1, layers: 3},
+		{name: "no layers", from: 4, layers: 0},
+		{name: "past the last layer", from: 5, shouldError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewFileManifest(img, test.from)
+			testutil.CheckError(t, test.shouldError, err)
+			if err == nil {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.layers, len(m.Layers))
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// RegistryMirror is a registry which images on Docker Hub are pulled from instead, set with --registry-mirror
+type RegistryMirror struct {
+	// Host is the registry, optionally with a path which the repositories are under, like mirror.local/dockerhub
+	Host string
+	// Insecure mirrors are reached over plain HTTP
+	Insecure bool
+	// SkipTLSVerify mirrors are reached over HTTPS without verifying their certificates
+	SkipTLSVerify bool
+}
+
+// registryMirrors are tried in order when pulling images on Docker Hub
+var registryMirrors []RegistryMirror
+
+// SetRegistryMirrors sets the mirrors which images on Docker Hub are pulled from, in order of priority
+func SetRegistryMirrors(mirrors []RegistryMirror) {
+	registryMirrors = mirrors
+}
+
+// ParseRegistryMirrors parses the values of --registry-mirror flags, which are <host>[/<path>], followed
+// by ,insecure for a mirror reached over plain HTTP or ,skip-tls-verify for one with a certificate which
+// can't be verified
+func ParseRegistryMirrors(values []string) ([]RegistryMirror, error) {
+	var mirrors []RegistryMirror
+	for _, value := range values {
+		if strings.Contains(value, "://") {
+			return nil, errors.Errorf("invalid --registry-mirror %s: it's a registry, not a URL, so use ,insecure for plain HTTP", value)
+		}
+		parts := strings.Split(value, ",")
+		mirror := RegistryMirror{Host: strings.TrimSuffix(parts[0], "/")}
+		for _, option := range parts[1:] {
+			switch option {
+			case "insecure":
+				mirror.Insecure = true
+			case "skip-tls-verify":
+				mirror.SkipTLSVerify = true
+			default:
+				return nil, errors.Errorf("invalid --registry-mirror %s: unknown option %q", value, option)
+			}
+		}
+		host := strings.SplitN(mirror.Host, "/", 2)[0]
+		if _, err := name.NewRegistry(host, name.StrictValidation); err != nil {
+			return nil, errors.Wrapf(err, "invalid --registry-mirror %s", value)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// reference returns ref, a reference to an image on Docker Hub, in the mirror
+func (m RegistryMirror) reference(ref name.Reference) (name.Reference, error) {
+	repo := m.Host + "/" + ref.Context().RepositoryStr()
+	var mirrorRef name.Reference
+	var err error
+	switch r := ref.(type) {
+	case name.Digest:
+		mirrorRef, err = name.NewDigest(fmt.Sprintf("%s@%s", repo, r.DigestStr()), name.WeakValidation)
+	default:
+		mirrorRef, err = name.NewTag(fmt.Sprintf("%s:%s", repo, ref.Identifier()), name.WeakValidation)
+	}
+	if err != nil || !m.Insecure {
+		return mirrorRef, err
+	}
+	registry, err := name.NewInsecureRegistry(mirrorRef.Context().RegistryStr(), name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+	return withRegistry(mirrorRef, registry), nil
+}
+
+// transport returns the transport for requests to the mirror
+func (m RegistryMirror) transport() http.RoundTripper {
+	if !m.SkipTLSVerify {
+		return http.DefaultTransport
+	}
+	return skipTLSVerifyTransport()
+}
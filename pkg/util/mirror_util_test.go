@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []string
+		expected  []RegistryMirror
+		shouldErr bool
+	}{
+		{
+			name:   "mirrors in order",
+			values: []string{"mirror.example.com", "mirror.gcr.io/", "mirror.example.com:5000/dockerhub,insecure", "self-signed.example.com,skip-tls-verify"},
+			expected: []RegistryMirror{
+				{Host: "mirror.example.com"},
+				{Host: "mirror.gcr.io"},
+				{Host: "mirror.example.com:5000/dockerhub", Insecure: true},
+				{Host: "self-signed.example.com", SkipTLSVerify: true},
+			},
+		},
+		{
+			name:      "unknown option",
+			values:    []string{"mirror.example.com,fast"},
+			shouldErr: true,
+		},
+		{
+			name:      "no host",
+			values:    []string{",insecure"},
+			shouldErr: true,
+		},
+		{
+			name:      "url",
+			values:    []string{"https://mirror.example.com"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ParseRegistryMirrors(test.values)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestRegistryMirror_reference(t *testing.T) {
+	tests := []struct {
+		name     string
+		mirror   RegistryMirror
+		image    string
+		expected string
+		scheme   string
+	}{
+		{
+			name:     "official image",
+			mirror:   RegistryMirror{Host: "mirror.example.com"},
+			image:    "alpine:3.9",
+			expected: "mirror.example.com/library/alpine:3.9",
+			scheme:   "https",
+		},
+		{
+			name:     "path prefix",
+			mirror:   RegistryMirror{Host: "mirror.example.com/dockerhub"},
+			image:    "docker.io/gcr/kaniko",
+			expected: "mirror.example.com/dockerhub/gcr/kaniko:latest",
+			scheme:   "https",
+		},
+		{
+			name:     "digest",
+			mirror:   RegistryMirror{Host: "mirror.example.com:5000", Insecure: true},
+			image:    "alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			expected: "mirror.example.com:5000/library/alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			scheme:   "http",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, err := name.ParseReference(test.image, name.WeakValidation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := test.mirror.reference(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, actual.Name())
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.scheme, actual.Context().Registry.Scheme())
+		})
+	}
+}
+
+func TestFetchRemoteImage_RegistryMirror(t *testing.T) {
+	defer SetRegistryMirrors(nil)
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// empty is a mirror which doesn't have the image, so it's pulled from the next one
+	empty, mirror := newFakeRegistry(), newFakeRegistry()
+	mirror.addImage(t, "dockerhub/library/alpine", "latest", img)
+	for _, registry := range []*fakeRegistry{empty, mirror} {
+		server := httptest.NewServer(registry)
+		defer server.Close()
+		host := strings.TrimPrefix(server.URL, "http://")
+		if registry == mirror {
+			host += "/dockerhub"
+		}
+		registryMirrors = append(registryMirrors, RegistryMirror{Host: host, Insecure: true})
+	}
+
+	tests := []struct {
+		name     string
+		platform *v1.Platform
+	}{
+		{name: "any platform"},
+		{name: "platform", platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mirror.read = map[string]bool{}
+			actual, err := RetrieveRemoteImage("docker.io/library/alpine", test.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPulledLayers(t, mirror, actual, img)
+		})
+	}
+
+	// Images which aren't on Docker Hub are pulled from their registry
+	other := newFakeRegistry()
+	other.addImage(t, "alpine", "latest", img)
+	server := httptest.NewServer(other)
+	defer server.Close()
+	mirror.read = map[string]bool{}
+	actual, err := RetrieveRemoteImage(strings.TrimPrefix(server.URL, "http://")+"/alpine", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPulledLayers(t, other, actual, img)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(mirror.read))
+}
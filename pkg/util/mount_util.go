@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// MountPath makes src available at target until the returned function is called, which puts target
+// back the way it was. kaniko usually isn't allowed to mount filesystems, so target is replaced with
+// a symlink to src instead; anything written to target is stored in src, and not in the filesystem.
+func MountPath(src, target string) (func() error, error) {
+	target = filepath.Clean(target)
+	parent := filepath.Dir(target)
+	// Remember the first parent directory that we create, so they can all be removed afterwards
+	created := ""
+	for dir := parent; !FilepathExists(dir); dir = filepath.Dir(dir) {
+		created = dir
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating parent directories for mount %s", target)
+	}
+	parentInfo, err := os.Stat(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move anything already at target out of the way
+	backup := ""
+	if _, err := os.Lstat(target); err == nil {
+		backup = filepath.Join(parent, ".kaniko-mount-"+filepath.Base(target))
+		if err := os.Rename(target, backup); err != nil {
+			return nil, errors.Wrapf(err, "moving %s out of the way of mount", target)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	unmount := func() error {
+		logger.Debugf("Unmounting %s", target)
+		if err := os.RemoveAll(target); err != nil {
+			return errors.Wrapf(err, "removing mount %s", target)
+		}
+		if backup != "" {
+			if err := os.Rename(backup, target); err != nil {
+				return errors.Wrapf(err, "restoring %s after mount", target)
+			}
+		}
+		if created != "" {
+			return os.RemoveAll(created)
+		}
+		// Changing the directory's contents updates its mtime, which would add it to the snapshot
+		return os.Chtimes(parent, parentInfo.ModTime(), parentInfo.ModTime())
+	}
+
+	logger.Debugf("Mounting %s at %s", src, target)
+	if err := os.Symlink(src, target); err != nil {
+		if unmountErr := unmount(); unmountErr != nil {
+			logger.Warnf("Error cleaning up mount %s: %v", target, unmountErr)
+		}
+		return nil, errors.Wrapf(err, "mounting %s at %s", src, target)
+	}
+	return unmount, nil
+}
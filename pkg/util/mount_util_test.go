@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestMountPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name: "target exists",
+			files: map[string]string{
+				"root/target/original": "original",
+			},
+		},
+		{
+			name: "target doesn't exist",
+			files: map[string]string{
+				"root/other": "other",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(testDir)
+			if err := testutil.SetupFiles(testDir, test.files); err != nil {
+				t.Fatal(err)
+			}
+			src := filepath.Join(testDir, "src")
+			if err := os.Mkdir(src, 0755); err != nil {
+				t.Fatal(err)
+			}
+			root := filepath.Join(testDir, "root")
+			target := filepath.Join(root, "target")
+			before, err := Files(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rootInfo, err := os.Stat(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unmount, err := MountPath(src, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(target, "written"), []byte("written"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := unmount(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The file should have been written to src, and root should be unchanged
+			contents, err := ioutil.ReadFile(filepath.Join(src, "written"))
+			testutil.CheckErrorAndDeepEqual(t, false, err, "written", string(contents))
+			after, err := Files(root)
+			testutil.CheckErrorAndDeepEqual(t, false, err, before, after)
+			newRootInfo, err := os.Stat(root)
+			testutil.CheckErrorAndDeepEqual(t, false, err, rootInfo.ModTime(), newRootInfo.ModTime())
+		})
+	}
+}
+
+func TestMountPath_CreatesParents(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	src := filepath.Join(testDir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(testDir, "a", "b", "target")
+	unmount, err := MountPath(src, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Fatalf("expected %s to be mounted: %v", target, err)
+	}
+	if err := unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if FilepathExists(filepath.Join(testDir, "a")) {
+		t.Errorf("expected parent directories of %s to be removed", target)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+)
+
+// ParsePlatforms parses the values of --platform flags, which are comma separated lists of
+// platforms like linux/amd64 or linux/arm/v7
+func ParsePlatforms(values []string) ([]v1.Platform, error) {
+	var platforms []v1.Platform
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, p := range strings.Split(value, ",") {
+			parts := strings.Split(strings.TrimSpace(p), "/")
+			if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+				return nil, errors.Errorf("invalid --platform %q: must be <os>/<architecture>[/<variant>]", p)
+			}
+			platform := v1.Platform{OS: parts[0], Architecture: parts[1]}
+			if len(parts) == 3 {
+				platform.Variant = parts[2]
+			}
+			if seen[PlatformString(platform)] {
+				return nil, errors.Errorf("--platform %s was given more than once", PlatformString(platform))
+			}
+			seen[PlatformString(platform)] = true
+			platforms = append(platforms, platform)
+		}
+	}
+	return platforms, nil
+}
+
+// PlatformString formats platform like the --platform flag
+func PlatformString(platform v1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// StagePlatform returns the platform of the stage's base image, which is the one in its FROM
+// --platform if it has one, and otherwise platform. The value of --platform can use the meta args in
+// buildArgs, as well as BUILDPLATFORM, the platform kaniko is running on, and TARGETPLATFORM, the
+// platform being built for. escape is the escape character of the Dockerfile.
+func StagePlatform(stage instructions.Stage, buildArgs []string, escape rune, platform *v1.Platform) (*v1.Platform, error) {
+	if stage.Platform == "" {
+		return platform, nil
+	}
+	buildPlatform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	targetPlatform := buildPlatform
+	if platform != nil {
+		targetPlatform = *platform
+	}
+	envs := append([]string{
+		"BUILDPLATFORM=" + PlatformString(buildPlatform),
+		"TARGETPLATFORM=" + PlatformString(targetPlatform),
+	}, buildArgs...)
+	value, err := ResolveEnvironmentReplacement(stage.Platform, envs, escape, false)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := ParsePlatforms([]string{value})
+	if err != nil {
+		return nil, errors.Wrapf(err, "FROM --platform of stage %s", stage.BaseName)
+	}
+	if len(platforms) != 1 {
+		return nil, errors.Errorf("FROM --platform of stage %s must be a single platform, not %s", stage.BaseName, value)
+	}
+	return &platforms[0], nil
+}
+
+// matchPlatform returns the manifest in index for platform. A variant is only compared if platform has one.
+func matchPlatform(index *v1.IndexManifest, platform v1.Platform) (v1.Descriptor, error) {
+	for _, desc := range index.Manifests {
+		p := desc.Platform
+		if p == nil || p.OS != platform.OS || p.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && p.Variant != platform.Variant {
+			continue
+		}
+		return desc, nil
+	}
+	return v1.Descriptor{}, errors.Errorf("no manifest for platform %s", PlatformString(platform))
+}
+
+// remoteImageForPlatform returns the variant of the image at ref for platform. If ref is a manifest
+// list, the manifest for platform is chosen from it; otherwise the image must already be for platform,
+// unless anyPlatform is set. Requests to the registry go through t.
+func remoteImageForPlatform(ref name.Reference, kc authn.Keychain, t http.RoundTripper, platform v1.Platform, anyPlatform bool) (v1.Image, error) {
+	auth, err := kc.Resolve(ref.Context().Registry)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := transport.New(ref.Context().Registry, auth, t, []string{ref.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{
+		Scheme: ref.Context().Registry.Scheme(),
+		Host:   ref.Context().RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", ref.Context().RepositoryStr(), ref.Identifier()),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		string(types.DockerManifestList),
+		string(types.OCIImageIndex),
+		string(types.DockerManifestSchema2),
+	}, ","))
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := remote.CheckError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch types.MediaType(resp.Header.Get("Content-Type")) {
+	case types.DockerManifestList, types.OCIImageIndex:
+		index, err := v1.ParseIndexManifest(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		desc, err := matchPlatform(index, platform)
+		if err != nil {
+			return nil, errors.Wrapf(err, "base image %s", ref)
+		}
+		digest, err := name.NewDigest(fmt.Sprintf("%s@%s", ref.Context(), desc.Digest), name.WeakValidation)
+		if err != nil {
+			return nil, err
+		}
+		return remote.Image(digest, remote.WithAuth(auth), remote.WithTransport(t))
+	}
+
+	img, err := remote.Image(ref, remote.WithAuth(auth), remote.WithTransport(t))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.OS != platform.OS || cfg.Architecture != platform.Architecture {
+		if anyPlatform {
+			logger.Warnf("%s isn't a manifest list, so its image for platform %s/%s is used instead of one for %s", ref, cfg.OS, cfg.Architecture, PlatformString(platform))
+			return img, nil
+		}
+		return nil, errors.Errorf("base image %s is for platform %s/%s, and isn't a manifest list with a manifest for platform %s", ref, cfg.OS, cfg.Architecture, PlatformString(platform))
+	}
+	return img, nil
+}
+
+// SetPlatform returns img with the os and architecture in its config set to platform's
+func SetPlatform(img v1.Image, platform v1.Platform) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS = platform.OS
+	cfg.Architecture = platform.Architecture
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	m.Config.Digest, m.Config.Size, err = v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&configImage{
+		base:        img,
+		rawConfig:   rawConfig,
+		rawManifest: rawManifest,
+		configName:  m.Config.Digest,
+	})
+}
+
+// SetAnnotations returns img with annotations added to the annotations in its manifest. Unlike labels,
+// which are in the config, annotations can be read from the manifest without fetching anything else.
+func SetAnnotations(img v1.Image, annotations map[string]string) (v1.Image, error) {
+	if len(annotations) == 0 {
+		return img, nil
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	if m.Annotations == nil {
+		m.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		logger.Infof("Applying annotation %s=%s", k, v)
+		m.Annotations[k] = v
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&configImage{
+		base:        img,
+		rawConfig:   rawConfig,
+		rawManifest: rawManifest,
+		configName:  m.Config.Digest,
+	})
+}
+
+// configImage is an image with a different config file or manifest than its base, and the same layers,
+// apart from any in layers
+type configImage struct {
+	base        v1.Image
+	rawConfig   []byte
+	rawManifest []byte
+	configName  v1.Hash
+	layers      map[v1.Hash]v1.Layer
+}
+
+func (c *configImage) MediaType() (types.MediaType, error) {
+	return c.base.MediaType()
+}
+
+func (c *configImage) RawConfigFile() ([]byte, error) {
+	return c.rawConfig, nil
+}
+
+func (c *configImage) RawManifest() ([]byte, error) {
+	return c.rawManifest, nil
+}
+
+func (c *configImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if h == c.configName {
+		return partial.ConfigLayer(c)
+	}
+	if l, ok := c.layers[h]; ok {
+		return l, nil
+	}
+	return c.base.LayerByDigest(h)
+}
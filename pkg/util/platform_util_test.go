@@ -0,0 +1,549 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []string
+		expected  []v1.Platform
+		shouldErr bool
+	}{
+		{
+			name:     "single platform",
+			values:   []string{"linux/amd64"},
+			expected: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+		},
+		{
+			name:   "comma separated with variant",
+			values: []string{"linux/amd64, linux/arm/v7", "linux/arm64"},
+			expected: []v1.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm", Variant: "v7"},
+				{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		{
+			name:      "missing architecture",
+			values:    []string{"linux"},
+			shouldErr: true,
+		},
+		{
+			name:      "empty os",
+			values:    []string{"/amd64"},
+			shouldErr: true,
+		},
+		{
+			name:      "too many parts",
+			values:    []string{"linux/arm/v7/extra"},
+			shouldErr: true,
+		},
+		{
+			name:      "duplicate",
+			values:    []string{"linux/amd64", "linux/amd64"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ParsePlatforms(test.values)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func Test_matchPlatform(t *testing.T) {
+	amd64 := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "amd64"}, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}
+	armv6 := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "armv6"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}}
+	armv7 := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "armv7"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}}
+	index := &v1.IndexManifest{
+		Manifests: []v1.Descriptor{
+			{Digest: v1.Hash{Algorithm: "sha256", Hex: "noplatform"}},
+			amd64,
+			armv6,
+			armv7,
+		},
+	}
+	tests := []struct {
+		name      string
+		platform  v1.Platform
+		expected  v1.Descriptor
+		shouldErr bool
+	}{
+		{
+			name:     "os and architecture",
+			platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+			expected: amd64,
+		},
+		{
+			name:     "variant",
+			platform: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			expected: armv7,
+		},
+		{
+			name:     "any variant",
+			platform: v1.Platform{OS: "linux", Architecture: "arm"},
+			expected: armv6,
+		},
+		{
+			name:      "no match",
+			platform:  v1.Platform{OS: "windows", Architecture: "amd64"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := matchPlatform(index, test.platform)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestSetPlatform(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := SetPlatform(img, v1.Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := actual.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "linux", cfg.OS)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "arm64", cfg.Architecture)
+
+	// The manifest should point at the new config
+	m, err := actual.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig, err := actual.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configName, _, err := v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, configName, m.Config.Digest)
+	configLayer, err := actual.LayerByDigest(configName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := configLayer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	testutil.CheckErrorAndDeepEqual(t, false, err, rawConfig, contents)
+
+	// The layers shouldn't change
+	expectedManifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedManifest.Layers, m.Layers)
+	for _, l := range m.Layers {
+		if _, err := actual.LayerByDigest(l.Digest); err != nil {
+			t.Errorf("layer %s missing: %v", l.Digest, err)
+		}
+	}
+}
+
+func TestSetAnnotations(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/GoogleContainerTools/kaniko",
+		"org.opencontainers.image.revision": "abc",
+	}
+	actual, err := SetAnnotations(img, annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The annotations are in the manifest which is pushed, not the config
+	rawManifest, err := actual.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m v1.Manifest
+	if err := json.Unmarshal(rawManifest, &m); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, annotations, m.Annotations)
+	cfg, err := actual.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, len(cfg.Config.Labels))
+
+	expectedConfig, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConfig, err := actual.RawConfigFile()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expectedConfig, rawConfig)
+	expectedManifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedManifest.Layers, m.Layers)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedManifest.Config, m.Config)
+	for _, l := range m.Layers {
+		if _, err := actual.LayerByDigest(l.Digest); err != nil {
+			t.Errorf("layer %s missing: %v", l.Digest, err)
+		}
+	}
+
+	// Without annotations the image is the same
+	unchanged, err := SetAnnotations(img, nil)
+	testutil.CheckErrorAndDeepEqual(t, false, err, img, unchanged)
+}
+
+// fakeRegistry serves the images and manifest lists in it, and records the blobs which are read
+type fakeRegistry struct {
+	manifests map[string][]byte
+	types     map[string]types.MediaType
+	blobs     map[string][]byte
+	read      map[string]bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		manifests: map[string][]byte{},
+		types:     map[string]types.MediaType{},
+		blobs:     map[string][]byte{},
+		read:      map[string]bool{},
+	}
+}
+
+// addImage adds img as repo:tag, and as repo@digest
+func (f *fakeRegistry) addImage(t *testing.T, repo, tag string, img v1.Image) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{tag, digest.String()} {
+		f.manifests[repo+"/manifests/"+ref] = raw
+		f.types[repo+"/manifests/"+ref] = types.DockerManifestSchema2
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.blobs[repo+"/blobs/"+configName.String()] = rawConfig
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.blobs[repo+"/blobs/"+d.String()] = contents
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if p == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if manifest, ok := f.manifests[p]; ok {
+		w.Header().Set("Content-Type", string(f.types[p]))
+		w.Write(manifest)
+		return
+	}
+	if blob, ok := f.blobs[p]; ok {
+		f.read[path.Base(p)] = true
+		w.Write(blob)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// newPlatformRegistry serves multi, a manifest list with an image for each of platforms, and single,
+// an image for the first of them
+func newPlatformRegistry(t *testing.T, platforms []v1.Platform) (*fakeRegistry, map[string]v1.Image, v1.Image) {
+	registry := newFakeRegistry()
+	images := map[string]v1.Image{}
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.DockerManifestList}
+	for _, platform := range platforms {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = SetPlatform(img, platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry.addImage(t, "multi", PlatformString(platform), img)
+		images[PlatformString(platform)] = img
+		raw, err := img.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, size, err := v1.SHA256(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := platform
+		index.Manifests = append(index.Manifests, v1.Descriptor{MediaType: types.DockerManifestSchema2, Size: size, Digest: digest, Platform: &p})
+	}
+	rawIndex, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.manifests["multi/manifests/latest"] = rawIndex
+	registry.types["multi/manifests/latest"] = types.DockerManifestList
+
+	single, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err = SetPlatform(single, platforms[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.addImage(t, "single", "latest", single)
+	return registry, images, single
+}
+
+// checkPulledLayers checks that img has the layers of expected, and that they were read from registry
+func checkPulledLayers(t *testing.T, registry *fakeRegistry, img, expected v1.Image) {
+	expectedLayers, err := expected.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	testutil.CheckErrorAndDeepEqual(t, false, err, len(expectedLayers), len(layers))
+	for i, l := range layers {
+		expectedDigest, err := expectedLayers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, _, err := v1.SHA256(bytes.NewReader(contents))
+		testutil.CheckErrorAndDeepEqual(t, false, err, expectedDigest, digest)
+		if !registry.read[expectedDigest.String()] {
+			t.Errorf("layer %s wasn't read from the registry", expectedDigest)
+		}
+	}
+}
+
+func TestRetrieveRemoteImage_Platform(t *testing.T) {
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}}
+	registry, images, single := newPlatformRegistry(t, platforms)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name     string
+		image    string
+		platform *v1.Platform
+		expected v1.Image
+	}{
+		{
+			name:     "variant from a manifest list",
+			image:    host + "/multi:latest",
+			platform: &platforms[1],
+			expected: images["linux/arm/v7"],
+		},
+		{
+			name:     "another platform from a manifest list",
+			image:    host + "/multi:latest",
+			platform: &platforms[0],
+			expected: images["linux/amd64"],
+		},
+		{
+			name:     "image which isn't a manifest list",
+			image:    host + "/single:latest",
+			platform: &platforms[1],
+			expected: single,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry.read = map[string]bool{}
+			img, err := RetrieveRemoteImage(test.image, test.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPulledLayers(t, registry, img, test.expected)
+		})
+	}
+
+	// Base images still have to be for the platform being built
+	_, err := remoteImage(host+"/single:latest", &platforms[1])
+	testutil.CheckError(t, true, err)
+}
+
+func TestStagePlatform(t *testing.T) {
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	buildPlatform := &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	tests := []struct {
+		name      string
+		platform  string
+		buildArgs []string
+		target    *v1.Platform
+		expected  *v1.Platform
+		shouldErr bool
+	}{
+		{
+			name:     "no FROM --platform",
+			target:   amd64,
+			expected: amd64,
+		},
+		{
+			name:     "no FROM --platform or target",
+			expected: nil,
+		},
+		{
+			name:     "FROM --platform",
+			platform: "linux/arm/v7",
+			target:   amd64,
+			expected: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		{
+			name:      "meta arg",
+			platform:  "linux/$ARCH",
+			buildArgs: []string{"ARCH=arm64"},
+			target:    amd64,
+			expected:  &v1.Platform{OS: "linux", Architecture: "arm64"},
+		},
+		{
+			name:     "BUILDPLATFORM",
+			platform: "$BUILDPLATFORM",
+			target:   &v1.Platform{OS: "linux", Architecture: "s390x"},
+			expected: buildPlatform,
+		},
+		{
+			name:     "TARGETPLATFORM",
+			platform: "${TARGETPLATFORM}",
+			target:   &v1.Platform{OS: "linux", Architecture: "s390x"},
+			expected: &v1.Platform{OS: "linux", Architecture: "s390x"},
+		},
+		{
+			name:     "TARGETPLATFORM without a target",
+			platform: "$TARGETPLATFORM",
+			expected: buildPlatform,
+		},
+		{
+			name:      "invalid",
+			platform:  "linux",
+			shouldErr: true,
+		},
+		{
+			name:      "more than one platform",
+			platform:  "linux/amd64,linux/arm64",
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stage := instructions.Stage{BaseName: "base", Platform: test.platform}
+			actual, err := StagePlatform(stage, test.buildArgs, 0, test.target)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestRetrieveSourceImage_StagePlatform(t *testing.T) {
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}}
+	registry, images, _ := newPlatformRegistry(t, platforms)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	stages, err := parse(fmt.Sprintf(`
+FROM --platform=linux/arm/v7 %s/multi:latest AS builder
+FROM %s/multi:latest
+`, host, host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The builder stage is always for arm, and the final stage for the platform being built
+	expected := []v1.Image{images["linux/arm/v7"], images["linux/amd64"]}
+	for index, stage := range stages {
+		registry.read = map[string]bool{}
+		platform, err := StagePlatform(stage, nil, 0, &platforms[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := RetrieveSourceImage(index, nil, 0, stages, platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPulledLayers(t, registry, img, expected[index])
+	}
+}
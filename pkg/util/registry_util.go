@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// RegistryOptions relax security for some registries only, from --insecure-registry and --skip-tls-verify-registry,
+// or for every registry, like --insecure-pull does for the ones images are pulled from
+type RegistryOptions struct {
+	// AllInsecure is set if every registry is reached over plain HTTP
+	AllInsecure bool
+	// Insecure registries are reached over plain HTTP
+	Insecure []string
+	// SkipTLSVerify registries are reached over HTTPS without verifying their certificates
+	SkipTLSVerify []string
+}
+
+// registryOptions are used to pull images
+var registryOptions RegistryOptions
+
+// SetRegistryOptions sets the options for the registries images are pulled from
+func SetRegistryOptions(opts RegistryOptions) {
+	registryOptions = opts
+}
+
+// NewRegistryOptions returns the options for the registries in insecure and skipTLSVerify, which are
+// registry hosts like registry.example.com:5000
+func NewRegistryOptions(insecure, skipTLSVerify []string) (RegistryOptions, error) {
+	var opts RegistryOptions
+	for _, r := range insecure {
+		registry, err := name.NewRegistry(r, name.StrictValidation)
+		if err != nil {
+			return RegistryOptions{}, errors.Wrapf(err, "invalid --insecure-registry %s", r)
+		}
+		opts.Insecure = append(opts.Insecure, registry.RegistryStr())
+	}
+	for _, r := range skipTLSVerify {
+		registry, err := name.NewRegistry(r, name.StrictValidation)
+		if err != nil {
+			return RegistryOptions{}, errors.Wrapf(err, "invalid --skip-tls-verify-registry %s", r)
+		}
+		opts.SkipTLSVerify = append(opts.SkipTLSVerify, registry.RegistryStr())
+	}
+	return opts, nil
+}
+
+// Registry returns registry, reached over plain HTTP if it's one of the insecure registries
+func (o RegistryOptions) Registry(registry name.Registry) (name.Registry, error) {
+	if !o.AllInsecure && !contains(o.Insecure, registry.RegistryStr()) {
+		return registry, nil
+	}
+	return name.NewInsecureRegistry(registry.RegistryStr(), name.WeakValidation)
+}
+
+// Reference returns ref, with its registry reached over plain HTTP if it's one of the insecure registries
+func (o RegistryOptions) Reference(ref name.Reference) (name.Reference, error) {
+	registry, err := o.Registry(ref.Context().Registry)
+	if err != nil {
+		return nil, err
+	}
+	return withRegistry(ref, registry), nil
+}
+
+// Transport returns the transport for requests to registry, which doesn't verify certificates if it's
+// one of the registries to skip TLS verification for
+func (o RegistryOptions) Transport(registry name.Registry) http.RoundTripper {
+	if contains(o.SkipTLSVerify, registry.RegistryStr()) {
+		return skipTLSVerifyTransport()
+	}
+	return http.DefaultTransport
+}
+
+// withRegistry returns ref with its registry replaced by registry
+func withRegistry(ref name.Reference, registry name.Registry) name.Reference {
+	switch r := ref.(type) {
+	case name.Digest:
+		r.Registry = registry
+		return r
+	case name.Tag:
+		r.Registry = registry
+		return r
+	}
+	return ref
+}
+
+// skipTLSVerifyTransport returns a transport which doesn't verify certificates
+func skipTLSVerifyTransport() http.RoundTripper {
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
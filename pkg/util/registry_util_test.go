@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestNewRegistryOptions(t *testing.T) {
+	actual, err := NewRegistryOptions([]string{"registry.example.com:5000", "docker.io"}, []string{"self-signed.example.com"})
+	expected := RegistryOptions{
+		Insecure:      []string{"registry.example.com:5000", "index.docker.io"},
+		SkipTLSVerify: []string{"self-signed.example.com"},
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, actual)
+
+	_, err = NewRegistryOptions([]string{"http://registry.example.com"}, nil)
+	testutil.CheckError(t, true, err)
+	_, err = NewRegistryOptions(nil, []string{""})
+	testutil.CheckError(t, true, err)
+}
+
+func TestRegistryOptions(t *testing.T) {
+	opts, err := NewRegistryOptions([]string{"insecure.example.com"}, []string{"self-signed.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		image         string
+		scheme        string
+		skipTLSVerify bool
+	}{
+		{image: "insecure.example.com/image:latest", scheme: "http"},
+		{image: "insecure.example.com/image@sha256:0000000000000000000000000000000000000000000000000000000000000000", scheme: "http"},
+		{image: "self-signed.example.com/image", scheme: "https", skipTLSVerify: true},
+		{image: "gcr.io/project/image", scheme: "https"},
+		{image: "insecure.example.com:5000/image", scheme: "https"},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			ref, err := name.ParseReference(test.image, name.WeakValidation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := opts.Reference(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, ref.Name(), actual.Name())
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.scheme, actual.Context().Registry.Scheme())
+
+			tr := opts.Transport(actual.Context().Registry)
+			if !test.skipTLSVerify {
+				if tr != http.DefaultTransport {
+					t.Errorf("expected the default transport for %s", test.image)
+				}
+				return
+			}
+			httpTransport, ok := tr.(*http.Transport)
+			if !ok || httpTransport.TLSClientConfig == nil || !httpTransport.TLSClientConfig.InsecureSkipVerify {
+				t.Errorf("expected a transport which skips TLS verification for %s", test.image)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Secret is a secret given to the executor with --secret, which RUN instructions can mount
+type Secret struct {
+	ID string
+	// Src is the file containing the secret
+	Src string
+	// Env is the environment variable containing the secret, if Src isn't set
+	Env string
+}
+
+// ParseSecret parses the value of a --secret flag, such as id=mytoken,src=/path/to/token or id=mytoken,env=TOKEN
+func ParseSecret(value string) (Secret, error) {
+	var s Secret
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return Secret{}, errors.Errorf("invalid --secret option %s: expected key=value", field)
+		}
+		switch strings.ToLower(parts[0]) {
+		case "id":
+			s.ID = parts[1]
+		case "src", "source":
+			s.Src = parts[1]
+		case "env":
+			s.Env = parts[1]
+		default:
+			return Secret{}, errors.Errorf("unsupported --secret option %s", parts[0])
+		}
+	}
+	if s.ID == "" {
+		return Secret{}, errors.Errorf("--secret %s requires an id", value)
+	}
+	if (s.Src == "") == (s.Env == "") {
+		return Secret{}, errors.Errorf("--secret %s requires exactly one of src or env", value)
+	}
+	return s, nil
+}
+
+// ParseSecrets parses the values of --secret flags, and returns the secrets by ID
+func ParseSecrets(values []string) (map[string]Secret, error) {
+	secrets := map[string]Secret{}
+	for _, value := range values {
+		s, err := ParseSecret(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := secrets[s.ID]; ok {
+			return nil, errors.Errorf("secret %s was given more than once", s.ID)
+		}
+		secrets[s.ID] = s
+	}
+	return secrets, nil
+}
+
+// Contents returns the value of the secret
+func (s Secret) Contents() ([]byte, error) {
+	if s.Src != "" {
+		contents, err := ioutil.ReadFile(s.Src)
+		return contents, errors.Wrapf(err, "reading secret %s", s.ID)
+	}
+	value, ok := os.LookupEnv(s.Env)
+	if !ok {
+		return nil, errors.Errorf("environment variable %s for secret %s isn't set", s.Env, s.ID)
+	}
+	return []byte(value), nil
+}
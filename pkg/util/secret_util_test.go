@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParseSecrets(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      []string
+		expected    map[string]Secret
+		shouldError bool
+	}{
+		{
+			name:   "file and env secrets",
+			values: []string{"id=token,src=/secrets/token", "id=key,env=KEY", "id=other,source=/other"},
+			expected: map[string]Secret{
+				"token": {ID: "token", Src: "/secrets/token"},
+				"key":   {ID: "key", Env: "KEY"},
+				"other": {ID: "other", Src: "/other"},
+			},
+		},
+		{
+			name:     "no secrets",
+			expected: map[string]Secret{},
+		},
+		{
+			name:        "missing id",
+			values:      []string{"src=/secrets/token"},
+			shouldError: true,
+		},
+		{
+			name:        "missing source",
+			values:      []string{"id=token"},
+			shouldError: true,
+		},
+		{
+			name:        "src and env",
+			values:      []string{"id=token,src=/secrets/token,env=TOKEN"},
+			shouldError: true,
+		},
+		{
+			name:        "unsupported option",
+			values:      []string{"id=token,src=/secrets/token,type=file"},
+			shouldError: true,
+		},
+		{
+			name:        "duplicate id",
+			values:      []string{"id=token,src=/secrets/token", "id=token,env=TOKEN"},
+			shouldError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ParseSecrets(test.values)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldError, err, test.expected, actual)
+		})
+	}
+}
+
+func TestSecret_Contents(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	src := filepath.Join(testDir, "token")
+	if err := ioutil.WriteFile(src, []byte("from file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KANIKO_TEST_SECRET", "from env")
+	defer os.Unsetenv("KANIKO_TEST_SECRET")
+
+	tests := []struct {
+		name        string
+		secret      Secret
+		expected    string
+		shouldError bool
+	}{
+		{
+			name:     "file",
+			secret:   Secret{ID: "token", Src: src},
+			expected: "from file",
+		},
+		{
+			name:     "env",
+			secret:   Secret{ID: "token", Env: "KANIKO_TEST_SECRET"},
+			expected: "from env",
+		},
+		{
+			name:        "missing file",
+			secret:      Secret{ID: "token", Src: filepath.Join(testDir, "missing")},
+			shouldError: true,
+		},
+		{
+			name:        "unset env",
+			secret:      Secret{ID: "token", Env: "KANIKO_TEST_SECRET_UNSET"},
+			shouldError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contents, err := test.secret.Contents()
+			if test.shouldError {
+				testutil.CheckError(t, true, err)
+				return
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, string(contents))
+		})
+	}
+}
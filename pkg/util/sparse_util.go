@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// lseek whence values for finding data and holes in a file on linux
+	seekData = 3
+	seekHole = 4
+
+	tarBlockSize = 512
+)
+
+// sparseEntry is a region of a sparse file which contains data
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// dataRegions returns the regions of f which contain data, using SEEK_DATA and SEEK_HOLE.
+// It returns false if f has no holes, or if the filesystem doesn't support seeking for them.
+func dataRegions(f *os.File, size int64) ([]sparseEntry, bool) {
+	if size == 0 {
+		return nil, false
+	}
+	var regions []sparseEntry
+	var offset int64
+	for offset < size {
+		data, err := f.Seek(offset, seekData)
+		if err != nil {
+			if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+				// The rest of the file is a hole
+				break
+			}
+			return nil, false
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, false
+		}
+		regions = append(regions, sparseEntry{offset: data, length: hole - data})
+		offset = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, false
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, false
+	}
+	// Mark the end of the file, in case it ends with a hole
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length != size {
+		regions = append(regions, sparseEntry{offset: size, length: 0})
+	}
+	return regions, true
+}
+
+// writeSparseFile writes f to the tar as a PAX format 1.0 sparse file, so that only the data regions
+// are stored. The tar writer can't encode the GNU.sparse records itself, so the entry is written
+// directly to raw, the writer underlying tw. It returns false if hdr can't be written as a sparse file,
+// in which case nothing has been written.
+func writeSparseFile(hdr *tar.Header, f *os.File, regions []sparseEntry, tw *tar.Writer, raw io.Writer) (bool, error) {
+	sparseMap := bytes.NewBufferString(fmt.Sprintf("%d\n", len(regions)))
+	var dataSize int64
+	for _, r := range regions {
+		fmt.Fprintf(sparseMap, "%d\n%d\n", r.offset, r.length)
+		dataSize += r.length
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+
+	records := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = hdr.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(hdr.Size, 10)
+	paxData := formatPAXRecords(records)
+
+	dir, base := filepath.Dir(hdr.Name), filepath.Base(hdr.Name)
+	paxHeader, err := headerBlock(&tar.Header{
+		Name:     truncateName(filepath.Join(dir, "PaxHeaders.0", base)),
+		Mode:     0644,
+		Size:     int64(len(paxData)),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	})
+	if err != nil {
+		return false, nil
+	}
+	setTypeflag(paxHeader, tar.TypeXHeader)
+
+	// The reader only applies the most recent PAX header, so this must fit in a single ustar block
+	sparseHdr := *hdr
+	sparseHdr.Name = truncateName(filepath.Join(dir, "GNUSparseFile.0", base))
+	sparseHdr.Size = int64(sparseMap.Len()) + dataSize
+	sparseHdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	sparseHdr.AccessTime = time.Time{}
+	sparseHdr.ChangeTime = time.Time{}
+	sparseHdr.PAXRecords = nil
+	sparseHdr.Xattrs = nil
+	sparseHdr.Format = tar.FormatUSTAR
+	sparseHeader, err := headerBlock(&sparseHdr)
+	if err != nil {
+		return false, nil
+	}
+
+	// Make sure the previous entry is padded out before writing to raw
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+	for _, b := range [][]byte{paxHeader, paxData, make([]byte, padding(int64(len(paxData)))), sparseHeader, sparseMap.Bytes()} {
+		if _, err := raw.Write(b); err != nil {
+			return false, err
+		}
+	}
+	for _, r := range regions {
+		if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(raw, f, r.length); err != nil {
+			return false, errors.Wrapf(err, "copying data region of sparse file %s", hdr.Name)
+		}
+	}
+	_, err = raw.Write(make([]byte, padding(dataSize)))
+	return true, err
+}
+
+// formatPAXRecords encodes records as the contents of a PAX extended header
+func formatPAXRecords(records map[string]string) []byte {
+	var keys []string
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := bytes.NewBuffer([]byte{})
+	for _, k := range keys {
+		// Each record is prefixed with its length in bytes, which includes the digits of the length itself
+		record := fmt.Sprintf(" %s=%s\n", k, records[k])
+		size := len(record) + len(strconv.Itoa(len(record)))
+		size = len(record) + len(strconv.Itoa(size))
+		fmt.Fprintf(buf, "%d%s", size, record)
+	}
+	return buf.Bytes()
+}
+
+// headerBlock returns the 512 byte header block the tar writer would write for hdr
+func headerBlock(hdr *tar.Header) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	if err := tar.NewWriter(buf).WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setTypeflag changes the type flag of a ustar header block and updates its checksum
+func setTypeflag(block []byte, typeflag byte) {
+	block[156] = typeflag
+	copy(block[148:156], "        ")
+	var chksum int64
+	for _, b := range block[:tarBlockSize] {
+		chksum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+}
+
+// truncateName shortens name to fit in a ustar header; the full name is kept in the PAX records
+func truncateName(name string) string {
+	if len(name) > 100 {
+		return name[len(name)-100:]
+	}
+	return name
+}
+
+// padding returns the number of bytes needed to pad size out to a full tar block
+func padding(size int64) int64 {
+	return (tarBlockSize - size%tarBlockSize) % tarBlockSize
+}
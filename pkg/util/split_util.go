@@ -0,0 +1,412 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/pkg/errors"
+)
+
+// ParseMaxLayerSize parses the value of --max-layer-size, a size like 2GB in decimal units, or returns 0
+// if it's empty, for no limit
+func ParseMaxLayerSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := units.FromHumanSize(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "--max-layer-size %s", value)
+	}
+	if size <= 0 {
+		return 0, errors.Errorf("--max-layer-size %s must be more than 0 bytes", value)
+	}
+	return size, nil
+}
+
+// SplitLayers returns img with each of its layers from the one at index from on which is bigger than
+// maxSize compressed split into layers applied one after the other which aren't, compressed with
+// compression at level unless it's 0. The files stay in the same order. The whiteouts of a split layer
+// go in the first of the layers it's split into, so they still only delete the files below it. A file
+// which is bigger than maxSize compressed on its own can't be split, and is an error.
+func SplitLayers(img v1.Image, from int, maxSize int64, compression string, level int) (v1.Image, error) {
+	// The image a registry which doesn't support zstd is pushed instead is split too
+	if z, ok := img.(*zstdFallbackImage); ok {
+		split, err := SplitLayers(z.Image, from, maxSize, compression, level)
+		if err != nil {
+			return nil, err
+		}
+		gzipped, err := SplitLayers(z.gzipped, from, maxSize, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdFallbackImage{Image: split, gzipped: gzipped}, nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+
+	var descs []v1.Descriptor
+	var diffIDs []v1.Hash
+	var parts []int
+	splitLayers := map[v1.Hash]v1.Layer{}
+	for i, l := range layers {
+		size, err := l.Size()
+		if err != nil {
+			return nil, err
+		}
+		if i < from || size <= maxSize {
+			descs = append(descs, m.Layers[i])
+			diffIDs = append(diffIDs, cfg.RootFS.DiffIDs[i])
+			parts = append(parts, 1)
+			continue
+		}
+		split, err := splitLayer(l, maxSize, compression, level)
+		if err != nil {
+			return nil, errors.Wrapf(err, "splitting layer %d", i)
+		}
+		for _, s := range split {
+			desc := v1.Descriptor{MediaType: m.Layers[i].MediaType}
+			if desc.Digest, err = s.Digest(); err != nil {
+				return nil, err
+			}
+			if desc.Size, err = s.Size(); err != nil {
+				return nil, err
+			}
+			diffID, err := s.DiffID()
+			if err != nil {
+				return nil, err
+			}
+			descs = append(descs, desc)
+			diffIDs = append(diffIDs, diffID)
+			splitLayers[desc.Digest] = s
+		}
+		parts = append(parts, len(split))
+	}
+	if len(splitLayers) == 0 {
+		return img, nil
+	}
+	m.Layers = descs
+	cfg.RootFS.DiffIDs = diffIDs
+	cfg.History = splitHistory(cfg.History, parts)
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.Config.Digest, m.Config.Size, err = v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return &splitImage{
+		compressedImage: &compressedImage{
+			Image:       img,
+			mediaType:   mediaType,
+			rawManifest: rawManifest,
+			layers:      splitLayers,
+		},
+		rawConfig: rawConfig,
+	}, nil
+}
+
+// splitImage is an image with some of the layers of the image it embeds split, which changes the diff IDs
+// and history in its config too. The split layers are compressed like the rest, which could be with zstd,
+// so unlike partial.CompressedToImage, it doesn't expect them to be gzipped.
+type splitImage struct {
+	*compressedImage
+	rawConfig []byte
+}
+
+// RawConfigFile implements v1.Image
+func (s *splitImage) RawConfigFile() ([]byte, error) {
+	return s.rawConfig, nil
+}
+
+// ConfigFile implements v1.Image
+func (s *splitImage) ConfigFile() (*v1.ConfigFile, error) {
+	return partial.ConfigFile(s)
+}
+
+// ConfigName implements v1.Image
+func (s *splitImage) ConfigName() (v1.Hash, error) {
+	return partial.ConfigName(s)
+}
+
+// LayerByDigest implements v1.Image. The config is a blob of the image too.
+func (s *splitImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	configName, err := s.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	if h == configName {
+		return partial.ConfigLayer(s)
+	}
+	return s.compressedImage.LayerByDigest(h)
+}
+
+// LayerByDiffID implements v1.Image
+func (s *splitImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	digest, err := partial.DiffIDToBlob(s, h)
+	if err != nil {
+		return nil, err
+	}
+	return s.LayerByDigest(digest)
+}
+
+// splitHistory repeats the history entry of each layer for each of the parts it's split into, the number
+// of which is in parts. If the history doesn't have an entry for each of the layers, it's left as it is.
+func splitHistory(history []v1.History, parts []int) []v1.History {
+	var withLayers int
+	for _, h := range history {
+		if !h.EmptyLayer {
+			withLayers++
+		}
+	}
+	if withLayers != len(parts) {
+		return history
+	}
+	var split []v1.History
+	layer := 0
+	for _, h := range history {
+		if h.EmptyLayer {
+			split = append(split, h)
+			continue
+		}
+		n := parts[layer]
+		layer++
+		if n == 1 {
+			split = append(split, h)
+			continue
+		}
+		for i := 0; i < n; i++ {
+			part := h
+			part.Comment = fmt.Sprintf("part %d of %d of a split layer", i+1, n)
+			split = append(split, part)
+		}
+	}
+	return split
+}
+
+// splitEntry is a file in a layer being split, as it's written to a tarball. Its raw tar entry is the
+// size bytes at offset in the spool file.
+type splitEntry struct {
+	name   string
+	spool  io.ReaderAt
+	offset int64
+	size   int64
+}
+
+// raw returns a reader of the raw tar entry of e
+func (e splitEntry) raw() io.Reader {
+	return io.NewSectionReader(e.spool, e.offset, e.size)
+}
+
+// splitLayer returns the layers l is split into, which are each at most maxSize compressed. The entries of
+// l are spooled to a file while it's split, and the layers are written to layer files, so neither the
+// layer nor its files are held in memory.
+func splitLayer(l v1.Layer, maxSize int64, compression string, level int) ([]v1.Layer, error) {
+	spool, err := NewLayerFile()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	entries, err := splitEntries(l, spool)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := splitChunks(entries, maxSize, compression, level)
+	if err != nil {
+		return nil, err
+	}
+	var split []v1.Layer
+	for i := 0; i < len(chunks); i++ {
+		chunk, err := compressChunk(chunks[i], compression, level)
+		if err != nil {
+			return nil, err
+		}
+		size, err := chunk.Size()
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSize {
+			// Compressed on its own, the chunk can come out a little bigger than it was measured as, so
+			// its last file is moved to the next chunk
+			if len(chunks[i]) == 1 {
+				return nil, tooBig(chunks[i][0], size, maxSize)
+			}
+			last := chunks[i][len(chunks[i])-1]
+			chunks[i] = chunks[i][:len(chunks[i])-1]
+			if i == len(chunks)-1 {
+				chunks = append(chunks, nil)
+			}
+			chunks[i+1] = append([]splitEntry{last}, chunks[i+1]...)
+			i--
+			continue
+		}
+		split = append(split, chunk)
+	}
+	return split, nil
+}
+
+// splitEntries writes the files in l to spool as they're written to a tarball, one after the other, and
+// returns them with the whiteouts first
+func splitEntries(l v1.Layer, spool *os.File) ([]splitEntry, error) {
+	r, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var whiteouts, files []splitEntry
+	var offset int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		counter := countingWriter{}
+		tw := tar.NewWriter(io.MultiWriter(spool, &counter))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+		// Flushing pads the contents, and doesn't write the end of the tarball like closing does
+		if err := tw.Flush(); err != nil {
+			return nil, err
+		}
+		entry := splitEntry{name: hdr.Name, spool: spool, offset: offset, size: counter.n}
+		offset += counter.n
+		if strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+			whiteouts = append(whiteouts, entry)
+		} else {
+			files = append(files, entry)
+		}
+	}
+	return append(whiteouts, files...), nil
+}
+
+// splitChunks divides entries into chunks which are each about maxSize compressed at most, by
+// compressing them one after the other, and starting a new chunk when the next entry doesn't fit
+func splitChunks(entries []splitEntry, maxSize int64, compression string, level int) ([][]splitEntry, error) {
+	var chunks [][]splitEntry
+	var chunk []splitEntry
+	var counter countingWriter
+	w, err := newCompressWriter(&counter, compression, level)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, err := io.Copy(w, e.raw()); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		if counter.n <= maxSize {
+			chunk = append(chunk, e)
+			continue
+		}
+		if len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+		}
+		// The entry starts the next chunk, so it's measured on its own
+		counter = countingWriter{}
+		if w, err = newCompressWriter(&counter, compression, level); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(w, e.raw()); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		if counter.n > maxSize {
+			return nil, tooBig(e, counter.n, maxSize)
+		}
+		chunk = []splitEntry{e}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// compressChunk returns the layer with the entries in chunk, compressed with compression at level
+func compressChunk(chunk []splitEntry, compression string, level int) (v1.Layer, error) {
+	layer, err := LayerFromTar(func(w io.Writer) error {
+		for _, e := range chunk {
+			if _, err := io.Copy(w, e.raw()); err != nil {
+				return err
+			}
+		}
+		// The end of a tarball is two empty blocks
+		_, err := w.Write(make([]byte, 2*512))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return CompressLayer(layer, compression, level)
+}
+
+func tooBig(e splitEntry, size, maxSize int64) error {
+	return errors.Errorf("%s is %d bytes compressed on its own, which is more than --max-layer-size of %d bytes, and a file can't be split across layers", e.name, size, maxSize)
+}
+
+// countingWriter counts the bytes written to it, and discards them
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+// incompressible returns size random bytes, which are about as big compressed
+func incompressible(r *rand.Rand, size int) string {
+	b := make([]byte, size)
+	r.Read(b)
+	return string(b)
+}
+
+func layerContents(t *testing.T, l v1.Layer) map[string]string {
+	r, err := l.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(b)
+	}
+	return contents
+}
+
+func TestSplitLayers(t *testing.T) {
+	for _, compression := range []string{constants.CompressionGzip, constants.CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			base := layerFromEntries(t, []layerEntry{
+				{hdr: fileHeader("etc/removed", "removed", 0644), contents: "removed"},
+				{hdr: dirHeader("var/dir/", 0755)},
+				{hdr: fileHeader("var/dir/old", "old", 0644), contents: "old"},
+			})
+			entries := []layerEntry{{hdr: dirHeader("app/", 0755)}}
+			expectedNames := []string{"etc/.wh.removed", "var/dir/.wh..wh..opq", "app/"}
+			for i := 0; i < 8; i++ {
+				contents := incompressible(r, 10*1024)
+				name := fmt.Sprintf("app/file%d", i)
+				entries = append(entries, layerEntry{hdr: fileHeader(name, contents, 0644), contents: contents})
+				expectedNames = append(expectedNames, name)
+			}
+			// The whiteouts come after the files, and are moved to the first of the split layers
+			entries = append(entries,
+				layerEntry{hdr: fileHeader("etc/.wh.removed", "", 0644)},
+				layerEntry{hdr: fileHeader("var/dir/.wh..wh..opq", "", 0644)},
+			)
+			built := layerFromEntries(t, entries)
+			img, err := mutate.Append(empty.Image,
+				mutate.Addendum{Layer: base, History: v1.History{CreatedBy: "FROM base"}},
+				mutate.Addendum{Layer: built, History: v1.History{CreatedBy: "COPY app /app"}},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compression == constants.CompressionZstd {
+				if img, err = CompressLayers(img, 1, compression, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			maxSize := int64(25 * 1024)
+			split, err := SplitLayers(img, 1, maxSize, compression, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := split.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) < 4 {
+				t.Fatalf("the layer was split into %d layers, expected at least 3", len(layers)-1)
+			}
+			baseDigest, err := base.DiffID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			actualBase, err := layers[0].DiffID()
+			testutil.CheckErrorAndDeepEqual(t, false, err, baseDigest, actualBase)
+
+			// Each layer is under the limit, and together they have the files of the layer in order
+			var names []string
+			contents := map[string]string{}
+			for i, l := range layers[1:] {
+				size, err := l.Size()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size > maxSize {
+					t.Errorf("layer %d is %d bytes, more than %d", i+1, size, maxSize)
+				}
+				layerNames := layerNames(t, l)
+				for _, name := range layerNames {
+					if strings.Contains(name, ".wh.") && i > 0 {
+						t.Errorf("whiteout %s is in split layer %d instead of the first", name, i)
+					}
+				}
+				names = append(names, layerNames...)
+				for name, c := range layerContents(t, l) {
+					contents[name] = c
+				}
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, expectedNames, names)
+			for _, e := range entries {
+				if contents[e.hdr.Name] != e.contents {
+					t.Errorf("the contents of %s changed", e.hdr.Name)
+				}
+			}
+
+			// The config has the diff IDs of the split layers, and a history entry for each of them
+			splitCfg, err := split.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, len(layers), len(splitCfg.RootFS.DiffIDs))
+			for i, l := range layers {
+				diffID, err := l.DiffID()
+				testutil.CheckErrorAndDeepEqual(t, false, err, diffID, splitCfg.RootFS.DiffIDs[i])
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, len(layers), len(splitCfg.History))
+			last := splitCfg.History[len(splitCfg.History)-1]
+			testutil.CheckErrorAndDeepEqual(t, false, nil, "COPY app /app", last.CreatedBy)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, fmt.Sprintf("part %d of %d of a split layer", len(layers)-1, len(layers)-1), last.Comment)
+
+			m, err := split.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			configName, err := split.ConfigName()
+			testutil.CheckErrorAndDeepEqual(t, false, err, m.Config.Digest, configName)
+			if _, err := split.LayerByDigest(configName); err != nil {
+				t.Errorf("the config can't be pushed as a blob: %v", err)
+			}
+			original, err := img.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, desc := range m.Layers[1:] {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, original.Layers[1].MediaType, desc.MediaType)
+			}
+			// The image pushed to registries which don't support zstd is split too
+			gzipped, zstdFallback := GzipFallback(split)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, compression == constants.CompressionZstd, zstdFallback)
+			if zstdFallback {
+				gzippedLayers, err := gzipped.Layers()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, l := range gzippedLayers[1:] {
+					size, err := l.Size()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if size > maxSize {
+						t.Errorf("gzip layer %d is %d bytes, more than %d", i+1, size, maxSize)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSplitLayers_Small(t *testing.T) {
+	img := squashTestImage(t)
+	split, err := SplitLayers(img, 0, 1024*1024, constants.CompressionGzip, 0)
+	testutil.CheckErrorAndDeepEqual(t, false, err, img, split)
+}
+
+func TestSplitLayers_FileTooBig(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	contents := incompressible(r, 50*1024)
+	built := layerFromEntries(t, []layerEntry{
+		{hdr: fileHeader("app/small", "small", 0644), contents: "small"},
+		{hdr: fileHeader("app/huge", contents, 0644), contents: contents},
+	})
+	img, err := mutate.AppendLayers(empty.Image, built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SplitLayers(img, 0, 20*1024, constants.CompressionGzip, 0)
+	testutil.CheckError(t, true, err)
+	if err != nil && !strings.Contains(err.Error(), "app/huge") {
+		t.Errorf("the error doesn't say which file is too big: %v", err)
+	}
+}
+
+func TestSplitLayers_Memory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetLayerDir(dir)
+	defer SetLayerDir("")
+
+	// The layer is written to a file a chunk at a time, so only splitting it could need memory for all of it
+	const files, fileSize = 4, 16 << 20
+	f, err := os.Create(filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	tw := tar.NewWriter(f)
+	chunk := make([]byte, 1<<20)
+	for i := 0; i < files; i++ {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("app/file%d", i), Mode: 0644, Size: fileSize, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < fileSize/len(chunk); j++ {
+			r.Read(chunk)
+			if _, err := tw.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The heap can't grow by more than what's allocated, so that bounds the peak memory of splitting
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	split, err := SplitLayers(img, 0, 3*fileSize/2, constants.CompressionGzip, 0)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Holding the layer in memory takes at least as much as the layer, while the compressors alone take a few MB
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > files*fileSize/2 {
+		t.Errorf("splitting a %d byte layer allocated %d bytes", files*fileSize, allocated)
+	}
+	layers, err := split.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, files, len(layers))
+}
+
+func TestParseMaxLayerSize(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  int64
+		shouldErr bool
+	}{
+		{value: "", expected: 0},
+		{value: "2GB", expected: 2000000000},
+		{value: "512mb", expected: 512000000},
+		{value: "1024", expected: 1024},
+		{value: "0", shouldErr: true},
+		{value: "big", shouldErr: true},
+	}
+	for _, test := range tests {
+		size, err := ParseMaxLayerSize(test.value)
+		testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, size)
+	}
+}
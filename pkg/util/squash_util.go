@@ -0,0 +1,299 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// SquashLayers returns img with its layers from the one at index from on merged into a single layer, and
+// the layers before it as they are. The history entry of the last merged layer is the one for the new layer.
+// If from is the number of layers, there's nothing to squash.
+func SquashLayers(img v1.Image, from int) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > len(layers) {
+		return nil, errors.Errorf("can't squash from layer %d of an image with %d layers", from, len(layers))
+	}
+	if from >= len(layers)-1 {
+		return img, nil
+	}
+	layer, err := squashTars(layers[from:])
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs[:from:from], diffID)
+	squashHistory(cfg.History, from, len(layers))
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	mediaType := types.DockerLayer
+	if m.MediaType == types.OCIManifestSchema1 {
+		mediaType = types.OCILayer
+	}
+	m.Layers = append(m.Layers[:from:from], v1.Descriptor{
+		MediaType: mediaType,
+		Size:      size,
+		Digest:    digest,
+	})
+	m.Config.Digest, m.Config.Size, err = v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&configImage{
+		base:        img,
+		rawConfig:   rawConfig,
+		rawManifest: rawManifest,
+		configName:  m.Config.Digest,
+		layers:      map[v1.Hash]v1.Layer{digest: layer},
+	})
+}
+
+// squashHistory marks the history entries of the layers from the one at index from on as empty layers,
+// except for the last one, which is the entry for the squashed layer. If the history doesn't have an
+// entry for each of the layers, it's left as it is.
+func squashHistory(history []v1.History, from, layers int) {
+	var withLayers []int
+	for i, h := range history {
+		if !h.EmptyLayer {
+			withLayers = append(withLayers, i)
+		}
+	}
+	if len(withLayers) != layers {
+		return
+	}
+	for _, i := range withLayers[from:] {
+		history[i].EmptyLayer = true
+	}
+	last := withLayers[len(withLayers)-1]
+	history[last].EmptyLayer = false
+	history[last].Comment = fmt.Sprintf("squashed %d layers", layers-from)
+}
+
+// squashEntry is a file in a squashed layer, whose contents are at offset in the spool file
+type squashEntry struct {
+	hdr    *tar.Header
+	offset int64
+	size   int64
+}
+
+// squashedTar is the files, whiteouts and opaque directories of layers applied on top of each other.
+// The contents of the files are written to spool, rather than held in memory.
+type squashedTar struct {
+	order      []string
+	entries    map[string]*squashEntry
+	whiteouts  map[string]struct{}
+	opaqueDirs map[string]struct{}
+	spool      *os.File
+	spooled    int64
+}
+
+// squashTars returns a layer with the changes of layers applied on top of each other. Files deleted
+// by the layers are whited out, unless a later layer adds them again, and directories which are
+// deleted and added again are opaque, so the files in them below the layers stay hidden.
+func squashTars(layers []v1.Layer) (v1.Layer, error) {
+	spool, err := NewLayerFile()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	s := &squashedTar{
+		entries:    map[string]*squashEntry{},
+		whiteouts:  map[string]struct{}{},
+		opaqueDirs: map[string]struct{}{},
+		spool:      spool,
+	}
+	for i, l := range layers {
+		if err := s.apply(l); err != nil {
+			return nil, errors.Wrapf(err, "squashing layer %d", i)
+		}
+	}
+	return LayerFromTar(s.tar)
+}
+
+// apply applies the changes in l. Whiteouts only delete the files of the layers below l, so they're
+// applied before the files l adds.
+func (s *squashedTar) apply(l v1.Layer) error {
+	r, err := l.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var added []*squashEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := filepath.Clean("/" + hdr.Name)
+		base := filepath.Base(p)
+		dir := filepath.Dir(p)
+		if base == opaqueWhiteout {
+			s.remove(dir, false)
+			s.opaqueDirs[dir] = struct{}{}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			deleted := filepath.Join(dir, strings.TrimPrefix(base, ".wh."))
+			s.remove(deleted, true)
+			s.whiteouts[deleted] = struct{}{}
+			continue
+		}
+		size, err := io.Copy(s.spool, tr)
+		if err != nil {
+			return err
+		}
+		added = append(added, &squashEntry{hdr: hdr, offset: s.spooled, size: size})
+		s.spooled += size
+	}
+	for _, e := range added {
+		s.add(e)
+	}
+	return nil
+}
+
+// remove removes the files, whiteouts and opaque directories under p, and p itself too if self is set
+func (s *squashedTar) remove(p string, self bool) {
+	under := func(q string) bool {
+		return (self && q == p) || p == "/" || strings.HasPrefix(q, p+"/")
+	}
+	for _, m := range []map[string]struct{}{s.whiteouts, s.opaqueDirs} {
+		for q := range m {
+			if under(q) {
+				delete(m, q)
+			}
+		}
+	}
+	for q := range s.entries {
+		if under(q) {
+			delete(s.entries, q)
+		}
+	}
+}
+
+// add adds the file in e, over any file with the same path
+func (s *squashedTar) add(e *squashEntry) {
+	p := filepath.Clean("/" + e.hdr.Name)
+	if old, ok := s.entries[p]; ok && old.hdr.Typeflag == tar.TypeDir && e.hdr.Typeflag != tar.TypeDir {
+		s.remove(p, false)
+	}
+	if _, ok := s.whiteouts[p]; ok {
+		delete(s.whiteouts, p)
+		// The directory is new, but what was in it before it was deleted mustn't come back
+		if e.hdr.Typeflag == tar.TypeDir {
+			s.opaqueDirs[p] = struct{}{}
+		}
+	}
+	for dir := filepath.Dir(p); dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := s.whiteouts[dir]; ok {
+			delete(s.whiteouts, dir)
+			s.opaqueDirs[dir] = struct{}{}
+		}
+	}
+	if _, ok := s.entries[p]; !ok {
+		s.order = append(s.order, p)
+	}
+	s.entries[p] = e
+}
+
+// tar writes the files to f, and then the whiteouts, so they don't hide the files in the same layer
+func (s *squashedTar) tar(f io.Writer) error {
+	w := tar.NewWriter(f)
+	written := map[string]bool{}
+	for _, p := range s.order {
+		e, ok := s.entries[p]
+		if !ok || written[p] {
+			continue
+		}
+		written[p] = true
+		if err := w.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(s.spool, e.offset, e.size)); err != nil {
+			return err
+		}
+	}
+	for _, p := range sortedKeys(s.opaqueDirs) {
+		if err := WhiteoutOpaqueDir(p, w); err != nil {
+			return err
+		}
+	}
+	for _, p := range sortedKeys(s.whiteouts) {
+		if err := Whiteout(p, w); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
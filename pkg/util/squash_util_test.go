@@ -0,0 +1,194 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func squashTestImage(t *testing.T) v1.Image {
+	base := layerFromEntries(t, []layerEntry{
+		{hdr: dirHeader("etc/", 0755)},
+		{hdr: fileHeader("etc/keep", "keep", 0644), contents: "keep"},
+		{hdr: fileHeader("etc/removed", "removed", 0644), contents: "removed"},
+		{hdr: dirHeader("var/dir/", 0755)},
+		{hdr: fileHeader("var/dir/old", "old", 0644), contents: "old"},
+	})
+	// Deletes a file of the base image, and adds a file the next layer deletes
+	first := layerFromEntries(t, []layerEntry{
+		{hdr: dirHeader("app/", 0755)},
+		{hdr: fileHeader("app/a", "v1", 0644), contents: "v1"},
+		{hdr: dirHeader("tmp/", 0755)},
+		{hdr: fileHeader("tmp/scratch", "scratch", 0644), contents: "scratch"},
+		{hdr: fileHeader("etc/.wh.removed", "", 0644)},
+	})
+	// Deletes a directory of the base image, which the next layer adds again
+	second := layerFromEntries(t, []layerEntry{
+		{hdr: fileHeader("tmp/.wh.scratch", "", 0644)},
+		{hdr: fileHeader("app/a", "v2", 0644), contents: "v2"},
+		{hdr: fileHeader("var/.wh.dir", "", 0644)},
+	})
+	third := layerFromEntries(t, []layerEntry{
+		{hdr: dirHeader("var/dir/", 0755)},
+		{hdr: fileHeader("var/dir/new", "new", 0644), contents: "new"},
+	})
+	img, err := mutate.AppendLayers(empty.Image, base, first, second, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func layerNames(t *testing.T, l v1.Layer) []string {
+	r, err := l.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestSquashLayers(t *testing.T) {
+	img := squashTestImage(t)
+	squashed, err := SquashLayers(img, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := squashed.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, len(layers))
+	original, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, digest := range []func(v1.Layer) (v1.Hash, error){v1.Layer.Digest, v1.Layer.DiffID} {
+		expected, err := digest(original[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := digest(layers[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected != actual {
+			t.Errorf("%d: the base layer changed from %s to %s", i, expected, actual)
+		}
+	}
+	expected := []string{
+		"app/",
+		"app/a",
+		"tmp/",
+		"var/dir/",
+		"var/dir/new",
+		"/var/dir/.wh..wh..opq",
+		"/etc/.wh.removed",
+		"/tmp/.wh.scratch",
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, expected, layerNames(t, layers[1]))
+
+	cfg, err := squashed.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, len(cfg.RootFS.DiffIDs))
+	var withLayers []v1.History
+	for _, h := range cfg.History {
+		if !h.EmptyLayer {
+			withLayers = append(withLayers, h)
+		}
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 2, len(withLayers))
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "squashed 3 layers", withLayers[1].Comment)
+
+	// The squashed image has the same files as the image it was squashed from
+	for _, image := range []v1.Image{img, squashed} {
+		root, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		if err := extractTestImage(root, image, nil); err != nil {
+			t.Fatal(err)
+		}
+		for path, contents := range map[string]string{"etc/keep": "keep", "app/a": "v2", "var/dir/new": "new"} {
+			actual, err := ioutil.ReadFile(filepath.Join(root, path))
+			testutil.CheckErrorAndDeepEqual(t, false, err, contents, string(actual))
+		}
+		for _, path := range []string{"etc/removed", "tmp/scratch", "var/dir/old"} {
+			if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+				t.Errorf("%s should have been deleted, but got %v", path, err)
+			}
+		}
+	}
+}
+
+func TestSquashLayers_Range(t *testing.T) {
+	img := squashTestImage(t)
+	tests := []struct {
+		name      string
+		from      int
+		layers    int
+		shouldErr bool
+	}{
+		{name: "all layers", from: 0, layers: 1},
+		{name: "last layers", from: 2, layers: 3},
+		{name: "last layer", from: 3, layers: 4},
+		{name: "no layers", from: 4, layers: 4},
+		{name: "past the layers", from: 5, shouldErr: true},
+		{name: "negative", from: -1, shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			squashed, err := SquashLayers(img, test.from)
+			if test.shouldErr {
+				testutil.CheckError(t, true, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := squashed.Layers()
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.layers, len(layers))
+		})
+	}
+}
@@ -18,62 +18,412 @@ package util
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
 )
 
+// Zstd is the zstd compression algorithm, which archive.DetectCompression doesn't know about
+const Zstd archive.Compression = archive.Xz + 1
+
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+// paxSchilyXattr is the PAX record prefix used to store extended attributes
+const paxSchilyXattr = "SCHILY.xattr."
+
+// opaqueWhiteout is the name of the marker which makes a directory opaque in an overlay filesystem
+const opaqueWhiteout = ".wh..wh..opq"
+
+// compressionMagicLength is the number of bytes read from a file to detect its compression,
+// which must be at least as long as the longest magic number we check for
+const compressionMagicLength = 16
+
+// SocketMode controls how unix sockets are added to a tar
+type SocketMode int
+
+const (
+	// SkipSockets leaves sockets out of the tar
+	SkipSockets SocketMode = iota
+	// PlaceholderSockets adds sockets to the tar as empty regular files
+	PlaceholderSockets
+	// ErrorOnSockets returns an error if a socket is added to the tar
+	ErrorOnSockets
+)
+
+// TarOptions configures how files are written to a tar by AddToTar
+type TarOptions struct {
+	// Reproducible strips timestamps and user and group names from headers,
+	// so that identical files produce identical tars across builds
+	Reproducible bool
+	// SourceDateEpoch, if set, clamps timestamps in headers so that none are later than it
+	SourceDateEpoch *time.Time
+	// SparseWriter is the writer underlying the tar writer. If set, files with holes are written
+	// as sparse files so the holes don't take up space in the layer.
+	SparseWriter io.Writer
+	// IDMappings translates the uid and gid of each file as seen by kaniko to the ids written to the tar,
+	// for builds running in a user namespace. If nil, ids are written unchanged.
+	IDMappings *idtools.IDMappings
+	// Sockets controls how unix sockets are handled, which can't be stored in a tar
+	Sockets SocketMode
+	// Root, if set, is a directory which the files are written to the tar relative to, as if it
+	// were the root of the filesystem
+	Root string
+}
+
 // AddToTar adds the file i to tar w at path p
-func AddToTar(p string, i os.FileInfo, hardlinks map[uint64]string, w *tar.Writer) error {
-	linkDst := ""
-	if i.Mode()&os.ModeSymlink != 0 {
-		var err error
-		linkDst, err = os.Readlink(p)
-		if err != nil {
-			return err
-		}
-	}
-	if i.Mode()&os.ModeSocket != 0 {
-		logrus.Infof("ignoring socket %s, not adding to tar", i.Name())
-		return nil
+func AddToTar(p string, i os.FileInfo, hardlinks map[FileID]string, w *tar.Writer, opts TarOptions) error {
+	if add, err := addSocket(p, i, opts); err != nil || !add {
+		return err
 	}
-	hdr, err := tar.FileInfoHeader(i, linkDst)
+	hdr, err := tarHeader(p, i, opts)
 	if err != nil {
 		return err
 	}
-	hdr.Name = p
 
 	hardlink, linkDst := checkHardlink(p, hardlinks, i)
 	if hardlink {
-		hdr.Linkname = linkDst
+		hdr.Linkname = tarPath(linkDst, opts)
 		hdr.Typeflag = tar.TypeLink
 		hdr.Size = 0
 	}
-	if err := w.WriteHeader(hdr); err != nil {
-		return err
-	}
 	if !(i.Mode().IsRegular()) || hardlink {
-		return nil
+		return w.WriteHeader(hdr)
 	}
 	r, err := os.Open(p)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
+	if opts.SparseWriter != nil {
+		if regions, sparse := dataRegions(r, hdr.Size); sparse {
+			written, err := writeSparseFile(hdr, r, regions, w, opts.SparseWriter)
+			if err != nil || written {
+				return err
+			}
+		}
+	}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
 	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
 	return nil
 }
 
+// tarHeader returns the tar header for the file i at path p
+func tarHeader(p string, i os.FileInfo, opts TarOptions) (*tar.Header, error) {
+	var err error
+	linkDst := ""
+	if i.Mode()&os.ModeSymlink != 0 {
+		linkDst, err = os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var hdr *tar.Header
+	if i.Mode()&os.ModeSocket != 0 {
+		hdr = socketPlaceholderHeader(i)
+	} else if hdr, err = tar.FileInfoHeader(i, linkDst); err != nil {
+		return nil, err
+	}
+	hdr.Name = tarPath(p, opts)
+	setDeviceType(hdr, i)
+	if opts.IDMappings != nil {
+		hdr.Uid, hdr.Gid, err = opts.IDMappings.ToContainer(idtools.IDPair{UID: hdr.Uid, GID: hdr.Gid})
+		if err != nil {
+			return nil, errors.Wrapf(err, "mapping ownership of %s", p)
+		}
+	}
+	if i.Mode()&os.ModeSymlink == 0 {
+		if err := addXattrs(p, hdr); err != nil {
+			return nil, err
+		}
+		addFileFlags(p, hdr)
+	}
+
+	if opts.Reproducible {
+		hdr.ModTime = time.Time{}
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Uname = ""
+		hdr.Gname = ""
+	}
+	if epoch := opts.SourceDateEpoch; epoch != nil {
+		for _, t := range []*time.Time{&hdr.ModTime, &hdr.AccessTime, &hdr.ChangeTime} {
+			if t.After(*epoch) {
+				*t = *epoch
+			}
+		}
+	}
+	return hdr, nil
+}
+
+// tarPath returns the path of p in the tar, which is relative to opts.Root if it's set
+func tarPath(p string, opts TarOptions) string {
+	if opts.Root == "" {
+		return p
+	}
+	rel, err := filepath.Rel(opts.Root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.Join("/", rel)
+}
+
+// addSocket returns true if i should be added to the tar. Files other than sockets are always added.
+func addSocket(p string, i os.FileInfo, opts TarOptions) (bool, error) {
+	if i.Mode()&os.ModeSocket == 0 {
+		return true, nil
+	}
+	switch opts.Sockets {
+	case PlaceholderSockets:
+		logger.Debugf("adding socket %s to tar as an empty file", p)
+		return true, nil
+	case ErrorOnSockets:
+		return false, errors.Errorf("%s is a socket, which can't be added to a tar", p)
+	default:
+		logger.Debugf("ignoring socket %s, not adding to tar", p)
+		return false, nil
+	}
+}
+
+// socketPlaceholderHeader returns the header for an empty regular file standing in for the socket i
+func socketPlaceholderHeader(i os.FileInfo) *tar.Header {
+	hdr := &tar.Header{
+		Name:     i.Name(),
+		Mode:     int64(i.Mode().Perm()),
+		Typeflag: tar.TypeReg,
+		ModTime:  i.ModTime(),
+	}
+	if stat, ok := i.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid = int(stat.Uid)
+		hdr.Gid = int(stat.Gid)
+	}
+	return hdr
+}
+
+// tarEntry is a file which has been read ahead of being written to a tar
+type tarEntry struct {
+	info     os.FileInfo
+	hdr      *tar.Header
+	contents []byte
+	// stream is set for files too big to be read into memory, which are copied to the tar from the file
+	stream bool
+	err    error
+}
+
+// maxBufferedTarEntrySize is the biggest file BuildTarConcurrent reads into memory before it's written
+const maxBufferedTarEntrySize = 1 << 20
+
+// SortTarPaths cleans paths and sorts them in place by comparing their bytes, so the entries of a tar
+// are written in the same order on any machine, whatever order the filesystem was walked in or the
+// locale is. Since a directory is a prefix of everything in it, it's always before its children.
+func SortTarPaths(paths []string) {
+	for i, p := range paths {
+		paths[i] = filepath.Clean(p)
+	}
+	sort.Strings(paths)
+}
+
+// BuildTarConcurrent adds files to tar w in order. The files and their metadata are read by a pool of
+// workers goroutines, while the tar itself is written from a single goroutine so that the output is
+// the same as adding each file with AddToTar. At most 2*workers files are held in memory at once, and files
+// bigger than maxBufferedTarEntrySize are copied to the tar from the file when they're written, so the
+// memory used doesn't depend on the size of the files. Files with holes are written out in full rather
+// than as sparse files.
+func BuildTarConcurrent(files []string, w *tar.Writer, workers int, opts TarOptions) error {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]chan tarEntry, len(files))
+	for i := range results {
+		results[i] = make(chan tarEntry, 1)
+	}
+	jobs := make(chan int)
+	// Bound the number of files which have been read but not yet written
+	tokens := make(chan struct{}, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		for i := range files {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for n := 0; n < workers; n++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- readTarEntry(files[i], opts)
+			}
+		}()
+	}
+
+	hardlinks := map[FileID]string{}
+	for i, p := range files {
+		entry := <-results[i]
+		<-tokens
+		if entry.err != nil {
+			return entry.err
+		}
+		if entry.hdr == nil {
+			continue
+		}
+		hardlink, linkDst := checkHardlink(p, hardlinks, entry.info)
+		if hardlink {
+			entry.hdr.Linkname = tarPath(linkDst, opts)
+			entry.hdr.Typeflag = tar.TypeLink
+			entry.hdr.Size = 0
+		}
+		if err := w.WriteHeader(entry.hdr); err != nil {
+			return err
+		}
+		if hardlink {
+			continue
+		}
+		if entry.stream {
+			if err := copyToTar(p, entry.hdr.Size, w); err != nil {
+				return errors.Wrapf(err, "writing %s to tar", p)
+			}
+			continue
+		}
+		if entry.contents == nil {
+			continue
+		}
+		if _, err := w.Write(entry.contents); err != nil {
+			return errors.Wrapf(err, "writing %s to tar", p)
+		}
+	}
+	return nil
+}
+
+// readTarEntry reads the header and contents of the file at p. The header is nil if the file
+// shouldn't be added to the tar.
+func readTarEntry(p string, opts TarOptions) tarEntry {
+	i, err := os.Lstat(p)
+	if err != nil {
+		return tarEntry{err: err}
+	}
+	if add, err := addSocket(p, i, opts); err != nil || !add {
+		return tarEntry{err: err}
+	}
+	hdr, err := tarHeader(p, i, opts)
+	if err != nil {
+		return tarEntry{err: err}
+	}
+	entry := tarEntry{info: i, hdr: hdr}
+	if i.Mode().IsRegular() && i.Size() > maxBufferedTarEntrySize {
+		entry.stream = true
+	} else if i.Mode().IsRegular() {
+		entry.contents, err = ioutil.ReadFile(p)
+		if err != nil {
+			return tarEntry{err: err}
+		}
+		// The header must match what was read, in case the file changed after it was stat'd
+		hdr.Size = int64(len(entry.contents))
+	}
+	return entry
+}
+
+// copyToTar copies size bytes of the file at p to w, which is the size in its header
+func copyToTar(p string, size int64, w io.Writer) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, size)
+	return err
+}
+
+// setDeviceType sets the type flag of hdr for block devices, character devices and named pipes,
+// along with the device numbers for device nodes
+func setDeviceType(hdr *tar.Header, i os.FileInfo) {
+	mode := i.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+		return
+	case mode&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+	case mode&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+	default:
+		return
+	}
+	if stat, ok := i.Sys().(*syscall.Stat_t); ok {
+		hdr.Devmajor = int64(unix.Major(uint64(stat.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(stat.Rdev)))
+	}
+}
+
+// addXattrs reads the extended attributes of the file at p, such as security.capability,
+// and stores them in the PAX records of hdr so they aren't lost from the layer
+func addXattrs(p string, hdr *tar.Header) error {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP || err == syscall.EPERM {
+			return nil
+		}
+		return errors.Wrapf(err, "listing xattrs for %s", p)
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		return errors.Wrapf(err, "listing xattrs for %s", p)
+	}
+	for _, key := range strings.Split(string(buf[:size]), "\x00") {
+		if key == "" {
+			continue
+		}
+		valueSize, err := syscall.Getxattr(p, key, nil)
+		if err != nil {
+			return errors.Wrapf(err, "getting xattr %s for %s", key, p)
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(p, key, value)
+		if err != nil {
+			return errors.Wrapf(err, "getting xattr %s for %s", key, p)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxSchilyXattr+key] = string(value[:valueSize])
+	}
+	if len(hdr.PAXRecords) > 0 {
+		hdr.Format = tar.FormatPAX
+	}
+	return nil
+}
+
 func Whiteout(p string, w *tar.Writer) error {
 	dir := filepath.Dir(p)
 	name := ".wh." + filepath.Base(p)
@@ -89,21 +439,38 @@ func Whiteout(p string, w *tar.Writer) error {
 	return nil
 }
 
+// WhiteoutOpaqueDir adds an opaque whiteout marker to the tar for dir, which hides all of
+// the directory's contents from lower layers without removing the directory itself
+func WhiteoutOpaqueDir(dir string, w *tar.Writer) error {
+	th := &tar.Header{
+		Name: filepath.Join(dir, opaqueWhiteout),
+		Size: 0,
+	}
+	return w.WriteHeader(th)
+}
+
+// FileID identifies a file by its device and inode numbers, which are used to find hardlinks
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
 // Returns true if path is hardlink, and the link destination
-func checkHardlink(p string, hardlinks map[uint64]string, i os.FileInfo) (bool, string) {
+func checkHardlink(p string, hardlinks map[FileID]string, i os.FileInfo) (bool, string) {
 	hardlink := false
 	linkDst := ""
 	if sys := i.Sys(); sys != nil {
 		if stat, ok := sys.(*syscall.Stat_t); ok {
 			nlinks := stat.Nlink
 			if nlinks > 1 {
-				inode := stat.Ino
-				if original, exists := hardlinks[inode]; exists && original != p {
+				// Inode numbers are only unique within a device
+				id := FileID{Dev: uint64(stat.Dev), Ino: stat.Ino}
+				if original, exists := hardlinks[id]; exists && original != p {
 					hardlink = true
-					logrus.Debugf("%s inode exists in hardlinks map, linking to %s", p, original)
+					logger.Debugf("%s inode exists in hardlinks map, linking to %s", p, original)
 					linkDst = original
 				} else {
-					hardlinks[inode] = p
+					hardlinks[id] = p
 				}
 			}
 		}
@@ -114,33 +481,111 @@ func checkHardlink(p string, hardlinks map[uint64]string, i os.FileInfo) (bool,
 // UnpackLocalTarArchive unpacks the tar archive at path to the directory dest
 // Returns true if the path was actually unpacked
 func UnpackLocalTarArchive(path, dest string) error {
+	_, err := UnpackLocalTarArchiveDetect(path, dest)
+	return err
+}
+
+// UnpackLocalTarArchiveDetect unpacks the tar archive at path to the directory dest,
+// and returns the compression the archive used
+func UnpackLocalTarArchiveDetect(path, dest string) (archive.Compression, error) {
+	return unpackLocalTarArchive(path, dest, CopyOptions{})
+}
+
+// UnpackLocalTarArchiveWithOptions unpacks the tar archive at path to the directory dest, like
+// UnpackLocalTarArchive, with the mode and ownership in opts instead of the ones in the archive
+func UnpackLocalTarArchiveWithOptions(path, dest string, opts CopyOptions) error {
+	_, err := unpackLocalTarArchive(path, dest, opts)
+	return err
+}
+
+func unpackLocalTarArchive(path, dest string, opts CopyOptions) (archive.Compression, error) {
 	// First, we need to check if the path is a local tar archive
 	if compressed, compressionLevel := fileIsCompressedTar(path); compressed {
 		file, err := os.Open(path)
 		if err != nil {
-			return err
+			return compressionLevel, err
 		}
 		defer file.Close()
 		if compressionLevel == archive.Gzip {
-			return UnpackCompressedTar(path, dest)
+			gzr, err := gzip.NewReader(file)
+			if err != nil {
+				return compressionLevel, err
+			}
+			defer gzr.Close()
+			return compressionLevel, unTar(gzr, dest, opts)
 		} else if compressionLevel == archive.Bzip2 {
 			bzr := bzip2.NewReader(file)
-			return unTar(bzr, dest)
+			return compressionLevel, unTar(bzr, dest, opts)
+		} else if compressionLevel == Zstd {
+			zr, err := zstd.NewReader(file)
+			if err != nil {
+				return compressionLevel, err
+			}
+			defer zr.Close()
+			return compressionLevel, unTar(zr, dest, opts)
+		} else if compressionLevel == archive.Xz {
+			xzr, err := xz.NewReader(file)
+			if err != nil {
+				return compressionLevel, err
+			}
+			return compressionLevel, unTar(xzr, dest, opts)
 		}
 	}
 	if fileIsUncompressedTar(path) {
 		file, err := os.Open(path)
 		if err != nil {
-			return err
+			return archive.Uncompressed, err
 		}
 		defer file.Close()
-		return unTar(file, dest)
+		return archive.Uncompressed, unTar(file, dest, opts)
+	}
+	return -1, errors.New("path does not lead to local tar archive")
+}
+
+// UnpackNestedTarArchives unpacks the tar archives at paths, relative to dir, into the directories they're in,
+// with the mode and ownership in opts like UnpackLocalTarArchiveWithOptions. They're unpacked in order, so an
+// archive can be in one unpacked before it. Each archive is removed once it's been unpacked.
+func UnpackNestedTarArchives(dir string, paths []string, opts CopyOptions) error {
+	for _, p := range paths {
+		archivePath := filepath.Join(dir, p)
+		fi, err := os.Lstat(archivePath)
+		if err != nil {
+			return errors.Wrapf(err, "nested archive %s", p)
+		}
+		if !fi.Mode().IsRegular() || !IsFileLocalTarArchive(archivePath) {
+			return errors.Errorf("nested archive %s isn't a tar archive", p)
+		}
+		if err := unpackNestedTarArchive(archivePath, opts); err != nil {
+			return errors.Wrapf(err, "unpacking nested archive %s", p)
+		}
+	}
+	return nil
+}
+
+// unpackNestedTarArchive moves the archive at path out of the way before unpacking it next to where it
+// was, so a file in it with the same name doesn't overwrite the archive while it's being read
+func unpackNestedTarArchive(path string, opts CopyOptions) error {
+	dest := filepath.Dir(path)
+	tmpDir, err := ioutil.TempDir(dest, ".nested")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, filepath.Base(path))
+	if err := os.Rename(path, archivePath); err != nil {
+		return err
 	}
-	return errors.New("path does not lead to local tar archive")
+	logger.Infof("Unpacking nested tar archive %s to %s", path, dest)
+	_, err = unpackLocalTarArchive(archivePath, dest, opts)
+	return err
 }
 
-//IsFileLocalTarArchive returns true if the file is a local tar archive
+//IsFileLocalTarArchive returns true if the file is a local tar archive. A symlink isn't followed, since
+// what it points to can be outside of the build context, so it's never an archive.
 func IsFileLocalTarArchive(src string) bool {
+	if fi, err := os.Lstat(src); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
 	compressed, _ := fileIsCompressedTar(src)
 	uncompressed := fileIsUncompressedTar(src)
 	return compressed || uncompressed
@@ -152,11 +597,18 @@ func fileIsCompressedTar(src string) (bool, archive.Compression) {
 		return false, -1
 	}
 	defer r.Close()
-	buf, err := ioutil.ReadAll(r)
-	if err != nil {
+	// Compression is detected from the magic number at the start of the file,
+	// so there's no need to read the whole archive into memory
+	buf := make([]byte, compressionMagicLength)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
 		return false, -1
 	}
+	buf = buf[:n]
 	compressionLevel := archive.DetectCompression(buf)
+	if compressionLevel == archive.Uncompressed && bytes.HasPrefix(buf, zstdMagic) {
+		compressionLevel = Zstd
+	}
 	return (compressionLevel > 0), compressionLevel
 }
 
@@ -198,5 +650,5 @@ func UnpackCompressedTar(path, dir string) error {
 		return err
 	}
 	defer gzr.Close()
-	return unTar(gzr, dir)
+	return unTar(gzr, dir, CopyOptions{})
 }
@@ -18,19 +18,34 @@ package util
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/GoogleContainerTools/kaniko/testutil"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
 )
 
 var regularFiles = []string{"file", "file.tar", "file.tar.gz"}
 var uncompressedTars = []string{"uncompressed", "uncompressed.tar"}
 var compressedTars = []string{"compressed", "compressed.tar.gz"}
+var zstdTars = []string{"zstd", "compressed.tar.zst"}
+var xzTars = []string{"xz", "compressed.tar.xz"}
 
 func Test_IsLocalTarArchive(t *testing.T) {
 	testDir, err := ioutil.TempDir("", "")
@@ -56,6 +71,235 @@ func Test_IsLocalTarArchive(t *testing.T) {
 		isTarArchive := IsFileLocalTarArchive(filepath.Join(testDir, compressedTar))
 		testutil.CheckErrorAndDeepEqual(t, false, nil, true, isTarArchive)
 	}
+	// Test we get the correct result for zstd compressed tars
+	for _, zstdTar := range zstdTars {
+		isTarArchive := IsFileLocalTarArchive(filepath.Join(testDir, zstdTar))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, true, isTarArchive)
+	}
+	// Test we get the correct result for xz compressed tars
+	for _, xzTar := range xzTars {
+		isTarArchive := IsFileLocalTarArchive(filepath.Join(testDir, xzTar))
+		testutil.CheckErrorAndDeepEqual(t, false, nil, true, isTarArchive)
+	}
+	// Symlinks to tars aren't followed
+	link := filepath.Join(testDir, "link.tar")
+	if err := os.Symlink(filepath.Join(testDir, uncompressedTars[0]), link); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, false, IsFileLocalTarArchive(link))
+}
+
+func Test_UnpackLocalTarArchive_Zstd(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := setUpFilesAndTars(testDir); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(testDir, "dest")
+	err = UnpackLocalTarArchive(filepath.Join(testDir, zstdTars[1]), dest)
+	testutil.CheckError(t, false, err)
+	contents, err := ioutil.ReadFile(filepath.Join(dest, testDir, regularFiles[1]))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "something", string(contents))
+}
+
+func Test_UnpackLocalTarArchive_Xz(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := setUpFilesAndTars(testDir); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(testDir, "dest")
+	err = UnpackLocalTarArchive(filepath.Join(testDir, xzTars[1]), dest)
+	testutil.CheckError(t, false, err)
+	contents, err := ioutil.ReadFile(filepath.Join(dest, testDir, regularFiles[1]))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "something", string(contents))
+}
+
+func Test_UnpackLocalTarArchive_LongNames(t *testing.T) {
+	// 200 bytes, twice as long as the name field of a tar header
+	longPath := strings.Repeat(strings.Repeat("d", 49)+"/", 3) + strings.Repeat("f", 50)
+	tests := []struct {
+		name     string
+		format   tar.Format
+		encoding string
+	}{
+		{
+			name:     "gnu",
+			format:   tar.FormatGNU,
+			encoding: "././@LongLink",
+		},
+		{
+			name:     "pax",
+			format:   tar.FormatPAX,
+			encoding: "path=" + longPath,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(testDir)
+			var buf bytes.Buffer
+			w := tar.NewWriter(&buf)
+			headers := []*tar.Header{
+				{Name: longPath, Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+				{Name: longPath + ".link", Typeflag: tar.TypeSymlink, Linkname: "../../../" + longPath, Mode: 0777},
+				// Old archives have files of types which are extracted like regular files too
+				{Name: longPath + ".cont", Typeflag: tar.TypeCont, Mode: 0644, Size: 4},
+			}
+			for _, hdr := range headers {
+				hdr.Format = test.format
+				if err := w.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(make([]byte, hdr.Size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(buf.Bytes(), []byte(test.encoding)) {
+				t.Fatalf("expected the tar to have the long name as %s", test.encoding)
+			}
+			tarPath := filepath.Join(testDir, "long.tar")
+			if err := ioutil.WriteFile(tarPath, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(testDir, "dest")
+			testutil.CheckError(t, false, UnpackLocalTarArchive(tarPath, dest))
+			for _, hdr := range headers {
+				if hdr.Typeflag == tar.TypeSymlink {
+					target, err := os.Readlink(filepath.Join(dest, hdr.Name))
+					testutil.CheckErrorAndDeepEqual(t, false, err, hdr.Linkname, target)
+					continue
+				}
+				contents, err := ioutil.ReadFile(filepath.Join(dest, hdr.Name))
+				testutil.CheckErrorAndDeepEqual(t, false, err, make([]byte, 4), contents)
+			}
+		})
+	}
+}
+
+// tarOf returns a tar of files, compressed with gzip if gzipped is set
+func tarOf(t *testing.T, files map[string][]byte, gzipped bool) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	var gw *gzip.Writer
+	var out io.Writer = &buf
+	if gzipped {
+		gw = gzip.NewWriter(&buf)
+		out = gw
+	}
+	w := tar.NewWriter(out)
+	for _, name := range names {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func Test_UnpackNestedTarArchives(t *testing.T) {
+	inner := tarOf(t, map[string][]byte{
+		"b/file":  []byte("b"),
+		"b/c.tar": tarOf(t, map[string][]byte{"c": []byte("c")}, false),
+	}, true)
+	bundle := tarOf(t, map[string][]byte{"inner/b.tar.gz": inner, "readme": []byte("readme")}, false)
+
+	tests := []struct {
+		name      string
+		paths     []string
+		expected  map[string]string
+		shouldErr bool
+	}{
+		{
+			name:     "nothing nested",
+			expected: map[string]string{"inner/b.tar.gz": string(inner), "readme": "readme"},
+		},
+		{
+			name:     "archive in an archive",
+			paths:    []string{"inner/b.tar.gz"},
+			expected: map[string]string{"inner/b/file": "b", "inner/b/c.tar": string(tarOf(t, map[string][]byte{"c": []byte("c")}, false)), "readme": "readme"},
+		},
+		{
+			name:     "archive in a nested archive",
+			paths:    []string{"inner/b.tar.gz", "inner/b/c.tar"},
+			expected: map[string]string{"inner/b/file": "b", "inner/b/c": "c", "readme": "readme"},
+		},
+		{
+			name:      "not an archive",
+			paths:     []string{"readme"},
+			shouldErr: true,
+		},
+		{
+			name:      "missing",
+			paths:     []string{"inner/missing.tar"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(testDir)
+			bundlePath := filepath.Join(testDir, "bundle.tar")
+			if err := ioutil.WriteFile(bundlePath, bundle, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(testDir, "dest")
+			if err := UnpackLocalTarArchive(bundlePath, dest); err != nil {
+				t.Fatal(err)
+			}
+			err = UnpackNestedTarArchives(dest, test.paths, CopyOptions{})
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			actual := map[string]string{}
+			if err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				contents, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				actual[rel] = string(contents)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected, actual)
+		})
+	}
 }
 
 func setUpFilesAndTars(testDir string) error {
@@ -87,6 +331,43 @@ func setUpFilesAndTars(testDir string) error {
 		if err := createTar(testDir, gzr); err != nil {
 			return err
 		}
+		if err := gzr.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, zstdTar := range zstdTars {
+		tarFile, err := os.Create(filepath.Join(testDir, zstdTar))
+		if err != nil {
+			return err
+		}
+		zw, err := zstd.NewWriter(tarFile)
+		if err != nil {
+			return err
+		}
+		if err := createTar(testDir, zw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, xzTar := range xzTars {
+		tarFile, err := os.Create(filepath.Join(testDir, xzTar))
+		if err != nil {
+			return err
+		}
+		xzw, err := xz.NewWriter(tarFile)
+		if err != nil {
+			return err
+		}
+		if err := createTar(testDir, xzw); err != nil {
+			return err
+		}
+		if err := xzw.Close(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -101,9 +382,710 @@ func createTar(testdir string, writer io.Writer) error {
 		if err != nil {
 			return err
 		}
-		if err := AddToTar(filePath, fi, map[uint64]string{}, w); err != nil {
+		if err := AddToTar(filePath, fi, map[FileID]string{}, w, TarOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_AddToTar_Xattrs(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "binary")
+	if err := ioutil.WriteFile(path, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// vfs_cap_data revision 2 with cap_net_bind_service permitted and effective
+	capability := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if err := syscall.Setxattr(path, "security.capability", capability, 0); err != nil {
+		t.Skipf("unable to set security.capability xattr: %v", err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	if err := AddToTar(path, fi, map[FileID]string{}, w, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	hdr, err := tar.NewReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, string(capability), hdr.PAXRecords["SCHILY.xattr.security.capability"])
+}
+
+func Test_AddToTar_DevicesAndFifos(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating device nodes requires root")
+	}
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	tests := []struct {
+		name     string
+		mode     uint32
+		dev      int
+		typeflag byte
+		major    int64
+		minor    int64
+	}{
+		{
+			name:     "null",
+			mode:     syscall.S_IFCHR | 0666,
+			dev:      int(unix.Mkdev(1, 3)),
+			typeflag: tar.TypeChar,
+			major:    1,
+			minor:    3,
+		},
+		{
+			name:     "loop0",
+			mode:     syscall.S_IFBLK | 0660,
+			dev:      int(unix.Mkdev(7, 0)),
+			typeflag: tar.TypeBlock,
+			major:    7,
+			minor:    0,
+		},
+		{
+			name:     "fifo",
+			mode:     syscall.S_IFIFO | 0644,
+			typeflag: tar.TypeFifo,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(testDir, test.name)
+			if err := syscall.Mknod(path, test.mode, test.dev); err != nil {
+				t.Skipf("unable to create node %s: %v", path, err)
+			}
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(buf)
+			if err := AddToTar(path, fi, map[FileID]string{}, w, TarOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+			hdr, err := tar.NewReader(buf).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.typeflag, hdr.Typeflag)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.major, hdr.Devmajor)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.minor, hdr.Devminor)
+		})
+	}
+}
+
+func Test_AddToTar_Sparse(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(64 << 20)
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	r, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sparse := dataRegions(r, size)
+	r.Close()
+	if !sparse {
+		t.Skip("filesystem does not support seeking for holes")
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	if err := AddToTar(path, fi, map[FileID]string{}, w, TarOptions{SparseWriter: buf}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if int64(buf.Len()) > size/1024 {
+		t.Fatalf("tar of sparse file is %d bytes, expected it to be much smaller than %d", buf.Len(), size)
+	}
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, path, hdr.Name)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, size, hdr.Size)
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []byte("data"), contents[1<<20:1<<20+4])
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected a single entry in the tar, got %v", err)
+	}
+}
+
+func Test_WhiteoutOpaqueDir(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(buf)
+	if err := WhiteoutOpaqueDir("/some/dir", w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	hdr, err := tar.NewReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, "/some/dir/.wh..wh..opq", hdr.Name)
+	testutil.CheckErrorAndDeepEqual(t, false, nil, int64(0), hdr.Size)
+}
+
+func setUpFilesForTar(b testing.TB, numFiles, size int) (string, []string) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		b.Fatalf("err setting up temp dir: %v", err)
+	}
+	contents := bytes.Repeat([]byte("a"), size)
+	files := []string{testDir}
+	for n := 0; n < numFiles; n++ {
+		path := filepath.Join(testDir, fmt.Sprintf("file%d", n))
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return testDir, files
+}
+
+func addToTarSerial(files []string, w *tar.Writer, opts TarOptions) error {
+	hardlinks := map[FileID]string{}
+	for _, file := range files {
+		fi, err := os.Lstat(file)
+		if err != nil {
+			return err
+		}
+		if err := AddToTar(file, fi, hardlinks, w, opts); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func Test_BuildTarConcurrent(t *testing.T) {
+	testDir, files := setUpFilesForTar(t, 20, 1024)
+	defer os.RemoveAll(testDir)
+	hardlink := filepath.Join(testDir, "hardlink")
+	if err := os.Link(files[1], hardlink); err != nil {
+		t.Fatal(err)
+	}
+	symlink := filepath.Join(testDir, "symlink")
+	if err := os.Symlink("file0", symlink); err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, hardlink, symlink)
+
+	// With a root, the names of files and the targets of hardlinks are both written relative to it
+	for _, test := range []struct {
+		opts   TarOptions
+		target string
+	}{
+		{opts: TarOptions{}, target: files[1]},
+		{opts: TarOptions{Root: testDir}, target: "/file0"},
+	} {
+		serial := bytes.NewBuffer([]byte{})
+		w := tar.NewWriter(serial)
+		if err := addToTarSerial(files, w, test.opts); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		for _, workers := range []int{0, 1, 4} {
+			concurrent := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(concurrent)
+			err := BuildTarConcurrent(files, w, workers, test.opts)
+			w.Close()
+			testutil.CheckErrorAndDeepEqual(t, false, err, serial.Bytes(), concurrent.Bytes())
+		}
+
+		tr := tar.NewReader(serial)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				testutil.CheckErrorAndDeepEqual(t, false, nil, test.target, hdr.Linkname)
+			}
+		}
+	}
+}
+
+func Test_SortTarPaths(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := testutil.SetupFiles(testDir, map[string]string{
+		"a/b/c": "c",
+		"a-c":   "a-c",
+		"a.d/e": "e",
+		"B":     "B",
+		"a/z":   "z",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	if err := filepath.Walk(testDir, func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for seed := int64(0); seed < 5; seed++ {
+		shuffled := append([]string{}, paths...)
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		// Paths which aren't clean are sorted as if they were
+		shuffled[0] += "/"
+		SortTarPaths(shuffled)
+
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, p := range shuffled {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := AddToTar(p, fi, map[FileID]string{}, w, TarOptions{Root: testDir}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		seen := map[string]bool{}
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Directories are before what's in them, so they exist when their children are extracted
+			if dir := filepath.Dir(hdr.Name); dir != hdr.Name && !seen[dir] {
+				t.Errorf("%s is before its directory %s", hdr.Name, dir)
+			}
+			seen[hdr.Name] = true
+			names = append(names, hdr.Name)
+		}
+		if expected == nil {
+			expected = names
+		}
+		testutil.CheckErrorAndDeepEqual(t, false, nil, expected, names)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, []string{"/", "/B", "/a", "/a-c", "/a.d", "/a.d/e", "/a/b", "/a/b/c", "/a/z"}, expected)
+}
+
+func Test_BuildTarConcurrent_LargeFiles(t *testing.T) {
+	testDir, files := setUpFilesForTar(t, 4, maxBufferedTarEntrySize+1)
+	defer os.RemoveAll(testDir)
+	files = append(files, createLargeFile(t, testDir))
+
+	serial := bytes.NewBuffer([]byte{})
+	w := tar.NewWriter(serial)
+	if err := addToTarSerial(files, w, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	concurrent := bytes.NewBuffer([]byte{})
+	w = tar.NewWriter(concurrent)
+	err := BuildTarConcurrent(files, w, 4, TarOptions{})
+	w.Close()
+	testutil.CheckErrorAndDeepEqual(t, false, err, serial.Bytes(), concurrent.Bytes())
+
+	// Many workers still don't read the files into memory
+	n := allocated(func() {
+		w := tar.NewWriter(ioutil.Discard)
+		err = BuildTarConcurrent(files, w, 16, TarOptions{})
+		w.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > maxAllocated {
+		t.Errorf("writing %d bytes of files to a tar allocated %d bytes", largeFileSize+4*(maxBufferedTarEntrySize+1), n)
+	}
+}
+
+func Test_BuildTarConcurrent_MissingFile(t *testing.T) {
+	testDir, files := setUpFilesForTar(t, 20, 1024)
+	defer os.RemoveAll(testDir)
+	files = append(files, filepath.Join(testDir, "missing"))
+	w := tar.NewWriter(ioutil.Discard)
+	defer w.Close()
+	err := BuildTarConcurrent(files, w, 4, TarOptions{})
+	testutil.CheckError(t, true, err)
+}
+
+func BenchmarkAddToTar(b *testing.B) {
+	testDir, files := setUpFilesForTar(b, 1000, 64*1024)
+	defer os.RemoveAll(testDir)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		w := tar.NewWriter(ioutil.Discard)
+		if err := addToTarSerial(files, w, TarOptions{}); err != nil {
+			b.Fatal(err)
+		}
+		w.Close()
+	}
+}
+
+func BenchmarkBuildTarConcurrent(b *testing.B) {
+	testDir, files := setUpFilesForTar(b, 1000, 64*1024)
+	defer os.RemoveAll(testDir)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				w := tar.NewWriter(ioutil.Discard)
+				if err := BuildTarConcurrent(files, w, workers, TarOptions{}); err != nil {
+					b.Fatal(err)
+				}
+				w.Close()
+			}
+		})
+	}
+}
+
+func Test_AddToTar_IDMappings(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(path, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	uid, gid := int(stat.Uid), int(stat.Gid)
+
+	tests := []struct {
+		name        string
+		uids        []idtools.IDMap
+		gids        []idtools.IDMap
+		expectedUID int
+		expectedGID int
+		shouldErr   bool
+	}{
+		{
+			name:        "offset mapping",
+			uids:        []idtools.IDMap{{ContainerID: 1000, HostID: uid, Size: 65536}},
+			gids:        []idtools.IDMap{{ContainerID: 2000, HostID: gid, Size: 65536}},
+			expectedUID: 1000,
+			expectedGID: 2000,
+		},
+		{
+			name:        "id inside mapped range",
+			uids:        []idtools.IDMap{{ContainerID: 0, HostID: uid - 10, Size: 65536}},
+			gids:        []idtools.IDMap{{ContainerID: 0, HostID: gid - 5, Size: 65536}},
+			expectedUID: 10,
+			expectedGID: 5,
+		},
+		{
+			name:      "unmapped id",
+			uids:      []idtools.IDMap{{ContainerID: 0, HostID: uid + 1, Size: 1}},
+			gids:      []idtools.IDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(buf)
+			opts := TarOptions{IDMappings: idtools.NewIDMappingsFromMaps(test.uids, test.gids)}
+			err := AddToTar(path, fi, map[FileID]string{}, w, opts)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			w.Close()
+			hdr, err := tar.NewReader(buf).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedUID, hdr.Uid)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedGID, hdr.Gid)
+		})
+	}
+}
+
+func Test_AddToTar_SourceDateEpoch(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	epoch := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		name     string
+		mtime    time.Time
+		expected time.Time
+	}{
+		{
+			name:     "later than epoch",
+			mtime:    epoch.Add(time.Hour),
+			expected: epoch,
+		},
+		{
+			name:     "earlier than epoch",
+			mtime:    epoch.Add(-time.Hour),
+			expected: epoch.Add(-time.Hour),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(testDir, test.name)
+			if err := ioutil.WriteFile(path, []byte("file"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, test.mtime, test.mtime); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(buf)
+			if err := AddToTar(path, fi, map[FileID]string{}, w, TarOptions{SourceDateEpoch: &epoch}); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+			hdr, err := tar.NewReader(buf).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expected.Unix(), hdr.ModTime.Unix())
+		})
+	}
+}
+
+func Test_UnpackLocalTarArchiveDetect(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	if err := setUpFilesAndTars(testDir); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		archive             string
+		expectedCompression archive.Compression
+		shouldErr           bool
+	}{
+		{
+			archive:             uncompressedTars[1],
+			expectedCompression: archive.Uncompressed,
+		},
+		{
+			archive:             compressedTars[1],
+			expectedCompression: archive.Gzip,
+		},
+		{
+			archive:             zstdTars[1],
+			expectedCompression: Zstd,
+		},
+		{
+			archive:             xzTars[1],
+			expectedCompression: archive.Xz,
+		},
+		{
+			archive:             regularFiles[1],
+			expectedCompression: -1,
+			shouldErr:           true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.archive, func(t *testing.T) {
+			dest := filepath.Join(testDir, "dest", test.archive)
+			compression, err := UnpackLocalTarArchiveDetect(filepath.Join(testDir, test.archive), dest)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expectedCompression, compression)
+		})
+	}
+}
+
+func Test_AddToTar_Sockets(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "socket")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		sockets         SocketMode
+		expectedEntries int
+		shouldErr       bool
+	}{
+		{
+			name:            "skip",
+			sockets:         SkipSockets,
+			expectedEntries: 0,
+		},
+		{
+			name:            "placeholder",
+			sockets:         PlaceholderSockets,
+			expectedEntries: 1,
+		},
+		{
+			name:      "error",
+			sockets:   ErrorOnSockets,
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewBuffer([]byte{})
+			w := tar.NewWriter(buf)
+			err := AddToTar(path, fi, map[FileID]string{}, w, TarOptions{Sockets: test.sockets})
+			testutil.CheckError(t, test.shouldErr, err)
+			w.Close()
+			tr := tar.NewReader(buf)
+			entries := 0
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries++
+				if hdr.Name != path || hdr.Typeflag != tar.TypeReg || hdr.Size != 0 {
+					t.Errorf("Expected empty regular file placeholder for %s, got %+v", path, hdr)
+				}
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedEntries, entries)
+		})
+	}
+}
+
+// statFileInfo overrides the stat information of a file
+type statFileInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (s statFileInfo) Sys() interface{} {
+	return s.stat
+}
+
+func Test_checkHardlink(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err setting up temp dir: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	path := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(path, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo := func(dev, ino uint64) os.FileInfo {
+		return statFileInfo{FileInfo: fi, stat: &syscall.Stat_t{Dev: dev, Ino: ino, Nlink: 2}}
+	}
+
+	tests := []struct {
+		name             string
+		path             string
+		info             os.FileInfo
+		expectedHardlink bool
+		expectedLinkDst  string
+	}{
+		{
+			name: "first file",
+			path: "/dev1/original",
+			info: fileInfo(1, 100),
+		},
+		{
+			name:             "same device and inode",
+			path:             "/dev1/link",
+			info:             fileInfo(1, 100),
+			expectedHardlink: true,
+			expectedLinkDst:  "/dev1/original",
+		},
+		{
+			name: "same inode on another device",
+			path: "/dev2/other",
+			info: fileInfo(2, 100),
+		},
+		{
+			name:             "link on another device",
+			path:             "/dev2/link",
+			info:             fileInfo(2, 100),
+			expectedHardlink: true,
+			expectedLinkDst:  "/dev2/other",
+		},
+	}
+	hardlinks := map[FileID]string{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hardlink, linkDst := checkHardlink(test.path, hardlinks, test.info)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedHardlink, hardlink)
+			testutil.CheckErrorAndDeepEqual(t, false, nil, test.expectedLinkDst, linkDst)
+		})
+	}
+}
@@ -20,20 +20,23 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"hash"
 	"io"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-// SetLogLevel sets the logrus logging level
+// SetLogLevel sets the logrus logging level, or the level of each module, from the value of --verbosity
 func SetLogLevel(logLevel string) error {
-	lvl, err := logrus.ParseLevel(logLevel)
+	levels, err := ParseLogLevels(logLevel)
 	if err != nil {
 		return errors.Wrap(err, "parsing log level")
 	}
-	logrus.SetLevel(lvl)
+	setLogLevels(levels)
 	return nil
 }
 
@@ -53,12 +56,7 @@ func Hasher() func(string) (string, error) {
 		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Gid), 36)))
 
 		if fi.Mode().IsRegular() {
-			f, err := os.Open(p)
-			if err != nil {
-				return "", err
-			}
-			defer f.Close()
-			if _, err := io.Copy(h, f); err != nil {
+			if err := HashFile(h, p); err != nil {
 				return "", err
 			}
 		}
@@ -68,6 +66,22 @@ func Hasher() func(string) (string, error) {
 	return hasher
 }
 
+// hashBufferSize is the size of the chunks files are hashed in
+const hashBufferSize = 32 * 1024
+
+// HashFile writes the contents of the file at p to h a chunk at a time, so hashing a file takes the same
+// memory whatever its size
+func HashFile(h hash.Hash, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Hiding the file's WriteTo makes the copy go through the buffer
+	_, err = io.CopyBuffer(h, struct{ io.Reader }{f}, make([]byte, hashBufferSize))
+	return err
+}
+
 // MtimeHasher returns a hash function, which only looks at mtime to determine if a file has changed
 func MtimeHasher() func(string) (string, error) {
 	hasher := func(p string) (string, error) {
@@ -81,3 +95,132 @@ func MtimeHasher() func(string) (string, error) {
 	}
 	return hasher
 }
+
+// hashContents hashes the contents of files for TimeSizeHasher
+var hashContents = HashFile
+
+// TimeSizeHasher returns a hash function which looks at a file's mtime and size, and also hashes its contents
+// if its size is the same as the last time it was hashed but something else about it changed. The ctime of
+// the file shows that, so this finds changes which keep the mtime, like modifying a file in place and resetting
+// its mtime, without reading files the first time they're seen, which haven't changed, or whose size shows
+// they changed.
+// Since it remembers each file, a new one should be used for each filesystem. It's safe to use concurrently.
+func TimeSizeHasher() func(string) (string, error) {
+	type hashed struct {
+		size int64
+		// key is the stat and ctime of the file, which change whenever it does
+		key   string
+		value string
+	}
+	var lock sync.Mutex
+	last := map[string]hashed{}
+	hasher := func(p string) (string, error) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		h := md5.New()
+		h.Write([]byte(fi.Mode().String()))
+		h.Write([]byte(fi.ModTime().String()))
+		h.Write([]byte(strconv.FormatInt(fi.Size(), 36)))
+		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Uid), 36)))
+		h.Write([]byte(","))
+		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Gid), 36)))
+		stat := hex.EncodeToString(h.Sum(nil))
+		if !fi.Mode().IsRegular() {
+			return stat, nil
+		}
+		ctime := fi.Sys().(*syscall.Stat_t).Ctim
+		key := stat + "," + strconv.FormatInt(ctime.Sec, 36) + "." + strconv.FormatInt(ctime.Nsec, 36)
+
+		lock.Lock()
+		prev, seen := last[p]
+		lock.Unlock()
+		if seen && prev.key == key {
+			// Nothing about the file changed, so its contents didn't either
+			return prev.value, nil
+		}
+		value := stat
+		if seen && prev.size == fi.Size() {
+			// Only the contents can tell whether a file of the same size changed
+			if err := hashContents(h, p); err != nil {
+				return "", err
+			}
+			value = hex.EncodeToString(h.Sum(nil))
+		}
+		lock.Lock()
+		last[p] = hashed{size: fi.Size(), key: key, value: value}
+		lock.Unlock()
+		return value, nil
+	}
+	return hasher
+}
+
+// CacheHasher returns a hash function, which looks at everything about a file except its timestamps.
+// It's used to tell whether a file is the same as in a previous build.
+func CacheHasher() func(string) (string, error) {
+	hasher := func(p string) (string, error) {
+		h := md5.New()
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(fi.Mode().String()))
+
+		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Uid), 36)))
+		h.Write([]byte(","))
+		h.Write([]byte(strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Gid), 36)))
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			h.Write([]byte(target))
+		} else if fi.Mode().IsRegular() {
+			if err := HashFile(h, p); err != nil {
+				return "", err
+			}
+		}
+
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return hasher
+}
+
+// ParseSourceDateEpoch parses a SOURCE_DATE_EPOCH, the number of seconds since the unix epoch.
+// It returns nil if value is empty.
+func ParseSourceDateEpoch(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, errors.Errorf("invalid SOURCE_DATE_EPOCH %q: must be a non-negative number of seconds", value)
+	}
+	t := time.Unix(seconds, 0).UTC()
+	return &t, nil
+}
+
+// ParseLabels parses the values of --label flags, which are key=value. Only the first = separates the key and value,
+// so values can have = in them.
+func ParseLabels(values []string) (map[string]string, error) {
+	return parseKeyValues("--label", values)
+}
+
+// ParseAnnotations parses the values of --annotation flags, which are key=value like --label
+func ParseAnnotations(values []string) (map[string]string, error) {
+	return parseKeyValues("--annotation", values)
+}
+
+func parseKeyValues(flag string, values []string) (map[string]string, error) {
+	keyValues := map[string]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid %s %q: must be <key>=<value>", flag, value)
+		}
+		keyValues[parts[0]] = parts[1]
+	}
+	return keyValues, nil
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	epoch := time.Unix(1500000000, 0).UTC()
+	tests := []struct {
+		value     string
+		expected  *time.Time
+		shouldErr bool
+	}{
+		{value: "", expected: nil},
+		{value: "1500000000", expected: &epoch},
+		{value: "-1", shouldErr: true},
+		{value: "yesterday", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			actual, err := ParseSourceDateEpoch(test.value)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []string
+		expected  map[string]string
+		shouldErr bool
+	}{
+		{
+			name:     "no labels",
+			expected: map[string]string{},
+		},
+		{
+			name:   "labels",
+			values: []string{"maintainer=kaniko", "empty=", "url=https://example.com/?a=b"},
+			expected: map[string]string{
+				"maintainer": "kaniko",
+				"empty":      "",
+				"url":        "https://example.com/?a=b",
+			},
+		},
+		{
+			name:     "last value wins",
+			values:   []string{"version=1", "version=2"},
+			expected: map[string]string{"version": "2"},
+		},
+		{
+			name:      "missing value",
+			values:    []string{"maintainer"},
+			shouldErr: true,
+		},
+		{
+			name:      "missing key",
+			values:    []string{"=kaniko"},
+			shouldErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := ParseLabels(test.values)
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+	actual, err := ParseAnnotations([]string{"org.opencontainers.image.source=https://github.com/GoogleContainerTools/kaniko", "org.opencontainers.image.revision=abc"})
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/GoogleContainerTools/kaniko",
+		"org.opencontainers.image.revision": "abc",
+	}, actual)
+
+	_, err = ParseAnnotations([]string{"org.opencontainers.image.source"})
+	testutil.CheckError(t, true, err)
+}
+
+// largeFileSize is the size of the files which shouldn't be read into memory. They're sparse, so
+// creating them takes no time or space.
+const largeFileSize = 64 << 20
+
+// maxAllocated is the most memory the functions handling a large file can allocate
+const maxAllocated = 8 << 20
+
+func createLargeFile(t *testing.T, dir string) string {
+	p := filepath.Join(dir, "large")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("start"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("end"), largeFileSize-3); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// allocated returns how much memory f allocates
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestHashFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	p := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(p, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := md5.New()
+	err = HashFile(h, p)
+	expected := md5.Sum([]byte("contents"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, hex.EncodeToString(expected[:]), hex.EncodeToString(h.Sum(nil)))
+
+	testutil.CheckError(t, true, HashFile(md5.New(), filepath.Join(testDir, "missing")))
+}
+
+func TestHashers_LargeFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	p := createLargeFile(t, testDir)
+	hashers := map[string]func(string) (string, error){
+		"Hasher":         Hasher(),
+		"TimeSizeHasher": TimeSizeHasher(),
+		"CacheHasher":    CacheHasher(),
+	}
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			var err error
+			n := allocated(func() {
+				_, err = hasher(p)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > maxAllocated {
+				t.Errorf("hashing a file of %d bytes allocated %d bytes", largeFileSize, n)
+			}
+		})
+	}
+}
+
+func TestTimeSizeHasher(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	p := filepath.Join(testDir, "file")
+	if err := ioutil.WriteFile(p, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1000, 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	reads := 0
+	original := hashContents
+	defer func() { hashContents = original }()
+	hashContents = func(h hash.Hash, p string) error {
+		reads++
+		return original(h, p)
+	}
+
+	hasher := TimeSizeHasher()
+	hash := func() string {
+		h, err := hasher(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	// There's nothing to compare the file to the first time it's seen, so it isn't read
+	first := hash()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, reads)
+
+	// Nothing changed, so the file isn't read either
+	testutil.CheckErrorAndDeepEqual(t, false, nil, first, hash())
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 0, reads)
+
+	// The file is modified in place and its mtime reset
+	// Make sure its ctime changes
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(p, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	modified := hash()
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, reads)
+	if modified == first {
+		t.Errorf("expected a new hash after modifying %s in place", p)
+	}
+
+	// The size changed, so the contents don't need to be read
+	if err := ioutil.WriteFile(p, []byte("longer contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if hash() == modified {
+		t.Errorf("expected a new hash after changing the size of %s", p)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, 1, reads)
+}
+
+func TestCopyFile_LargeFile(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	src := createLargeFile(t, testDir)
+	dest := filepath.Join(testDir, "dest", "large")
+	var srcKey, destKey string
+	n := allocated(func() {
+		if err = CopyFile(src, dest, CopyOptions{}); err != nil {
+			return
+		}
+		// Copying a file also hashes it for the cache key
+		if srcKey, err = CacheHasher()(src); err != nil {
+			return
+		}
+		destKey, err = CacheHasher()(dest)
+	})
+	testutil.CheckErrorAndDeepEqual(t, false, err, srcKey, destKey)
+	if n > maxAllocated {
+		t.Errorf("copying a file of %d bytes allocated %d bytes", largeFileSize, n)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeAzureBlobStorage is the blob service of an Azure storage account, which keeps blobs in memory.
+// Requests have to be signed with the account's shared key.
+type FakeAzureBlobStorage struct {
+	*httptest.Server
+	mu sync.Mutex
+	// Blobs are the contents of the blobs, by <container>/<blob>
+	Blobs map[string][]byte
+}
+
+const fakeAzureStorageAccount = "kanikotest"
+
+var fakeAzureStorageKey = []byte("key")
+
+// NewFakeAzureBlobStorage starts a fake blob service, and sets the environment for the storage account to
+// use it. The returned function stops it and restores the environment.
+func NewFakeAzureBlobStorage() (*FakeAzureBlobStorage, func()) {
+	f := &FakeAzureBlobStorage{Blobs: map[string][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	env := map[string]string{
+		"AZURE_STORAGE_ACCOUNT":  fakeAzureStorageAccount,
+		"AZURE_STORAGE_KEY":      base64.StdEncoding.EncodeToString(fakeAzureStorageKey),
+		"AZURE_STORAGE_ENDPOINT": f.URL,
+	}
+	original := map[string]string{}
+	for k, v := range env {
+		original[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return f, func() {
+		f.Close()
+		for k, v := range original {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// SetBlob sets the contents of the blob in container
+func (f *FakeAzureBlobStorage) SetBlob(container, blob string, contents []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Blobs[container+"/"+blob] = contents
+}
+
+// sharedKeySignature returns the signature of r for account with key, worked out apart from the client, following
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func sharedKeySignature(r *http.Request, account string, key []byte) string {
+	var headers []string
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(headers)
+	resource := "/" + account + r.URL.EscapedPath()
+	var params []string
+	for name, values := range r.URL.Query() {
+		sort.Strings(values)
+		params = append(params, strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		resource += "\n" + param
+	}
+	contentLength := ""
+	if r.ContentLength != 0 {
+		contentLength = fmt.Sprint(r.ContentLength)
+	}
+	var lines []string
+	lines = append(lines, r.Method)
+	for _, header := range []string{"Content-Encoding", "Content-Language"} {
+		lines = append(lines, r.Header.Get(header))
+	}
+	lines = append(lines, contentLength)
+	for _, header := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		lines = append(lines, r.Header.Get(header))
+	}
+	lines = append(lines, headers...)
+	lines = append(lines, resource)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (f *FakeAzureBlobStorage) serve(w http.ResponseWriter, r *http.Request) {
+	signature := sharedKeySignature(r, fakeAzureStorageAccount, fakeAzureStorageKey)
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" ||
+		r.Header.Get("Authorization") != "SharedKey "+fakeAzureStorageAccount+":"+signature {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		contents, ok := f.Blobs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(contents)
+		}
+	case http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(contents)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.Blobs[name] = contents
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -39,6 +39,16 @@ func SetupFiles(path string, files map[string]string) error {
 	return nil
 }
 
+// ReadLayerFile returns the contents of the tarball at path which a snapshot was written to, and removes it.
+// It returns nil if path is empty, since nothing changed, or if err is set.
+func ReadLayerFile(path string, err error) ([]byte, error) {
+	if err != nil || path == "" {
+		return nil, err
+	}
+	defer os.Remove(path)
+	return ioutil.ReadFile(path)
+}
+
 func CheckErrorAndDeepEqual(t *testing.T, shouldErr bool, err error, expected, actual interface{}) {
 	if err := checkErr(shouldErr, err); err != nil {
 		t.Error(err)